@@ -46,53 +46,19 @@ func (instance *EmailHelper) NewHTMLMessage(subject string, body string) *Messag
 	return newMessage(subject, body, "text/html")
 }
 
+// HtmlToText converts HTML to plain text, as the text alternative generated for HTML messages
+func (instance *EmailHelper) HtmlToText(html string) string {
+	return htmlToText(html)
+}
+
 // Send sends the message.
 func (instance *EmailHelper) Send(addr string, auth smtp.Auth, m *Message) error {
-	return smtp.SendMail(addr, auth, m.From.Address, m.GetToList(), m.GetBytes())
+	return instance.send(addr, auth, m, nil)
 }
 
 // SendSecure sends the message over TLS.
 func (instance *EmailHelper) SendSecure(addr string, auth smtp.Auth, tlsConfig *tls.Config, m *Message) error {
-	host, _, _ := net.SplitHostPort(addr)
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
-	if err != nil {
-		return err
-	}
-	c, err := smtp.NewClient(conn, host)
-	if err != nil {
-		return err
-	}
-	defer c.Quit()
-
-	// Auth
-	if err = c.Auth(auth); err != nil {
-		return err
-	}
-	// To && From
-	if err = c.Mail(m.From.Address); err != nil {
-		return err
-	}
-	toList := m.GetToList()
-	for _, addr := range toList {
-		if len(addr) > 0 {
-			if err = c.Rcpt(addr); err != nil {
-				return err
-			}
-		}
-	}
-
-	// Data
-	w, err := c.Data()
-	if err != nil {
-		return err
-	}
-
-	_, err = w.Write(m.GetBytes())
-	if err != nil {
-		return err
-	}
-
-	return w.Close()
+	return instance.sendSecure(addr, auth, tlsConfig, m, nil)
 }
 
 func (instance *EmailHelper) SendMessage(host string, port int, secure bool, user string, pass string,
@@ -161,6 +127,61 @@ func (instance *EmailHelper) SendMessage(host string, port int, secure bool, use
 //	p r i v a t e
 // ---------------------------------------------------------------------------------------------------------------------
 
+func (instance *EmailHelper) send(addr string, auth smtp.Auth, m *Message, dkim *DkimSettings) error {
+	data, err := instance.DkimSign(m.GetBytes(), dkim)
+	if nil != err {
+		return err
+	}
+	return smtp.SendMail(addr, auth, m.From.Address, m.GetToList(), data)
+}
+
+func (instance *EmailHelper) sendSecure(addr string, auth smtp.Auth, tlsConfig *tls.Config, m *Message, dkim *DkimSettings) error {
+	data, err := instance.DkimSign(m.GetBytes(), dkim)
+	if nil != err {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Quit()
+
+	// Auth
+	if err = c.Auth(auth); err != nil {
+		return err
+	}
+	// To && From
+	if err = c.Mail(m.From.Address); err != nil {
+		return err
+	}
+	toList := m.GetToList()
+	for _, addr := range toList {
+		if len(addr) > 0 {
+			if err = c.Rcpt(addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Data
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
 func newMessage(subject string, body string, bodyContentType string) *Message {
 	m := &Message{Subject: subject, Body: body, BodyContentType: bodyContentType}
 	m.Attachments = make(map[string]*Attachment)
@@ -1,5 +1,10 @@
 package qb_email
 
+import (
+	"crypto/tls"
+	"time"
+)
+
 type SmtpSettingsAuth struct {
 	User string `json:"user"`
 	Pass string `json:"pass"`
@@ -12,4 +17,35 @@ type SmtpSettings struct {
 	Auth    *SmtpSettingsAuth `json:"auth"`
 	From    string            `json:"from"`
 	ReplyTo string            `json:"reply_to"`
+	Dkim    *DkimSettings     `json:"dkim"` // (optional) sign messages
+}
+
+// MailboxSettings configures IMAP and POP3 clients
+type MailboxSettings struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`     // default depends on protocol and security
+	Security string `json:"security"` // none (default), tls, starttls
+	User     string `json:"user"`
+	Pass     string `json:"pass"`
+	Insecure bool   `json:"insecure"` // skip verification of server certificate
+	Timeout  int    `json:"timeout"`  // seconds, default 30
+
+	TLSConfig *tls.Config `json:"-"` // (optional) custom TLS configuration
+}
+
+func (instance *MailboxSettings) timeout() time.Duration {
+	if instance.Timeout > 0 {
+		return time.Duration(instance.Timeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func (instance *MailboxSettings) tlsConfig() *tls.Config {
+	if nil != instance.TLSConfig {
+		return instance.TLSConfig
+	}
+	return &tls.Config{
+		ServerName:         instance.Host,
+		InsecureSkipVerify: instance.Insecure,
+	}
 }
@@ -0,0 +1,465 @@
+package qb_email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	DkimRsaSha256     = "rsa-sha256"
+	DkimEd25519Sha256 = "ed25519-sha256"
+
+	DkimSimple  = "simple"
+	DkimRelaxed = "relaxed"
+
+	dkimHeader = "DKIM-Signature"
+)
+
+var (
+	ErrorDkimNoSignature  = errors.New("dkim_signature_not_found")
+	ErrorDkimBodyHash     = errors.New("dkim_body_hash_mismatch")
+	ErrorDkimBadSignature = errors.New("dkim_bad_signature")
+	ErrorDkimInvalidKey   = errors.New("dkim_invalid_key")
+	ErrorDkimUnsupported  = errors.New("dkim_unsupported")
+	ErrorDkimMalformed    = errors.New("dkim_malformed_signature")
+	ErrorDkimExpired      = errors.New("dkim_signature_expired")
+)
+
+// DkimDefaultHeaders are signed when DkimSettings.Headers is empty
+var DkimDefaultHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id", "Mime-Version", "Content-Type"}
+
+var (
+	dkimSignatureValue = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+	dkimWhitespaces    = regexp.MustCompile(`[ \t]+`)
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+// ---------------------------------------------------------------------------------------------------------------------
+
+// DkimSettings configures DKIM signing (RFC 6376). Algorithm depends on private key (RSA or Ed25519).
+type DkimSettings struct {
+	Domain           string   `json:"domain"`
+	Selector         string   `json:"selector"`
+	PrivateKey       string   `json:"private_key"`      // PEM text (PKCS#1 or PKCS#8) or path of a PEM file
+	Canonicalization string   `json:"canonicalization"` // header/body, i.e. "relaxed/simple" (default "relaxed/relaxed")
+	Headers          []string `json:"headers"`          // signed headers (default DkimDefaultHeaders)
+}
+
+// DkimLookup returns TXT records of a name, i.e. "selector._domainkey.example.com"
+type DkimLookup func(name string) ([]string, error)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+// ---------------------------------------------------------------------------------------------------------------------
+
+// DkimSign returns the message with a DKIM-Signature header
+func (instance *EmailHelper) DkimSign(data []byte, settings *DkimSettings) ([]byte, error) {
+	if nil == settings {
+		return data, nil
+	}
+	signer, algorithm, err := parseDkimPrivateKey(settings.PrivateKey)
+	if nil != err {
+		return nil, err
+	}
+	headerCanon, bodyCanon, err := parseCanonicalization(settings.Canonicalization)
+	if nil != err {
+		return nil, err
+	}
+
+	data = normalizeCRLF(data)
+	headers, body := splitMessage(data)
+	bodyHash := sha256.Sum256(canonicalBody(body, bodyCanon))
+
+	names := settings.Headers
+	if len(names) == 0 {
+		names = DkimDefaultHeaders
+	}
+	selected, signedNames := selectHeaders(headers, names)
+
+	signature := fmt.Sprintf("%s: v=1; a=%s; c=%s/%s; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		dkimHeader, algorithm, headerCanon, bodyCanon, settings.Domain, settings.Selector, time.Now().Unix(),
+		strings.Join(signedNames, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	hash := dkimHeadersHash(selected, signature, headerCanon)
+	var b []byte
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		b, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash)
+	case ed25519.PrivateKey:
+		b = ed25519.Sign(key, hash) // RFC 8463: the hash is signed
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(signature)
+	buf.WriteString(base64.StdEncoding.EncodeToString(b))
+	buf.WriteString("\r\n")
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// DkimVerify checks DKIM signatures of a message. Public keys are read with lookup (default is DNS).
+// Returns nil if at least one signature is valid.
+func (instance *EmailHelper) DkimVerify(data []byte, lookup DkimLookup) error {
+	if nil == lookup {
+		lookup = net.LookupTXT
+	}
+	data = normalizeCRLF(data)
+	headers, body := splitMessage(data)
+
+	var err error = ErrorDkimNoSignature
+	for i, h := range headers {
+		if strings.EqualFold(headerName(h), dkimHeader) {
+			if err = verifySignature(headers[i], headers, body, lookup); nil == err {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// DkimRecord returns the value of the TXT record publishing the public key of a PEM private key
+func (instance *EmailHelper) DkimRecord(privateKey string) (string, error) {
+	signer, _, err := parseDkimPrivateKey(privateKey)
+	if nil != err {
+		return "", err
+	}
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if nil != err {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PrivateKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+	}
+	return "", ErrorDkimInvalidKey
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+func verifySignature(signatureHeader string, headers []string, body []byte, lookup DkimLookup) error {
+	tags := parseDkimTags(signatureHeader[strings.Index(signatureHeader, ":")+1:])
+	if tags["v"] != "1" || len(tags["d"]) == 0 || len(tags["s"]) == 0 || len(tags["h"]) == 0 || len(tags["b"]) == 0 {
+		return ErrorDkimMalformed
+	}
+	names := strings.Split(tags["h"], ":")
+	signsFrom := false
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+		signsFrom = signsFrom || strings.EqualFold(names[i], "From")
+	}
+	if !signsFrom {
+		return ErrorDkimMalformed // RFC 6376 5.4: From must be signed
+	}
+	if x, ok := tags["x"]; ok {
+		expiration, valid := parseDkimNumber(x)
+		if !valid {
+			return ErrorDkimMalformed
+		}
+		if t, ok := tags["t"]; ok {
+			if timestamp, valid := parseDkimNumber(t); !valid || expiration < timestamp {
+				return ErrorDkimMalformed
+			}
+		}
+		if time.Now().Unix() > expiration {
+			return ErrorDkimExpired
+		}
+	}
+	algorithm := tags["a"]
+	if algorithm != DkimRsaSha256 && algorithm != DkimEd25519Sha256 {
+		return qb_utils.Errors.Prefix(ErrorDkimUnsupported, algorithm+": ")
+	}
+	canonicalization := tags["c"]
+	if len(canonicalization) == 0 {
+		canonicalization = DkimSimple
+	}
+	headerCanon, bodyCanon, err := parseCanonicalization(canonicalization)
+	if nil != err {
+		return err
+	}
+
+	// body
+	canonical := canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		length, valid := parseDkimNumber(l)
+		if !valid {
+			return ErrorDkimMalformed
+		}
+		if length > int64(len(canonical)) {
+			return ErrorDkimBodyHash // body is shorter than signed length
+		}
+		canonical = canonical[:length]
+	}
+	bodyHash := sha256.Sum256(canonical)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return ErrorDkimBodyHash
+	}
+
+	// headers
+	others := make([]string, 0, len(headers))
+	for _, h := range headers {
+		if h != signatureHeader {
+			others = append(others, h)
+		}
+	}
+	selected, _ := selectHeaders(others, names)
+	unsigned := strings.TrimRight(dkimSignatureValue.ReplaceAllString(signatureHeader, "$1$2"), "\r\n")
+	hash := dkimHeadersHash(selected, unsigned, headerCanon)
+
+	// key
+	key, err := lookupDkimKey(tags["s"]+"._domainkey."+tags["d"], lookup)
+	if nil != err {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if nil != err {
+		return ErrorDkimMalformed
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != DkimRsaSha256 {
+			return ErrorDkimInvalidKey
+		}
+		if err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, signature); nil != err {
+			return ErrorDkimBadSignature
+		}
+	case ed25519.PublicKey:
+		if algorithm != DkimEd25519Sha256 {
+			return ErrorDkimInvalidKey
+		}
+		if !ed25519.Verify(k, hash, signature) {
+			return ErrorDkimBadSignature
+		}
+	}
+	return nil
+}
+
+// parseDkimNumber parses unsigned decimal values of l=, t= and x= tags
+func parseDkimNumber(value string) (int64, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 || len(value) > 18 {
+		return 0, false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, nil == err
+}
+
+func lookupDkimKey(name string, lookup DkimLookup) (interface{}, error) {
+	records, err := lookup(name)
+	if nil != err {
+		return nil, err
+	}
+	tags := parseDkimTags(strings.Join(records, ""))
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if nil != err || len(data) == 0 {
+		return nil, ErrorDkimInvalidKey // empty p= is a revoked key
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(data); nil == err {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return rsaKey, nil
+			}
+			return nil, ErrorDkimInvalidKey
+		}
+		if key, err := x509.ParsePKCS1PublicKey(data); nil == err {
+			return key, nil
+		}
+		return nil, ErrorDkimInvalidKey
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, ErrorDkimInvalidKey
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, qb_utils.Errors.Prefix(ErrorDkimUnsupported, tags["k"]+": ")
+}
+
+// parseDkimPrivateKey returns the key and the signing algorithm
+func parseDkimPrivateKey(text string) (crypto.Signer, string, error) {
+	if !strings.Contains(text, "-----BEGIN") {
+		content, err := qb_utils.IO.ReadTextFromFile(text)
+		if nil != err {
+			return nil, "", err
+		}
+		text = content
+	}
+	block, _ := pem.Decode([]byte(text))
+	if nil == block {
+		return nil, "", ErrorDkimInvalidKey
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); nil == err {
+		return key, DkimRsaSha256, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if nil != err {
+		return nil, "", ErrorDkimInvalidKey
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, DkimRsaSha256, nil
+	case ed25519.PrivateKey:
+		return k, DkimEd25519Sha256, nil
+	}
+	return nil, "", ErrorDkimInvalidKey
+}
+
+// parseCanonicalization returns header and body canonicalization. Body is simple if omitted.
+func parseCanonicalization(value string) (string, string, error) {
+	if len(value) == 0 {
+		return DkimRelaxed, DkimRelaxed, nil
+	}
+	tokens := strings.SplitN(strings.ToLower(value), "/", 2)
+	if len(tokens) == 1 {
+		tokens = append(tokens, DkimSimple)
+	}
+	for _, t := range tokens {
+		if t != DkimSimple && t != DkimRelaxed {
+			return "", "", qb_utils.Errors.Prefix(ErrorDkimUnsupported, value+": ")
+		}
+	}
+	return tokens[0], tokens[1], nil
+}
+
+func parseDkimTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, item := range strings.Split(value, ";") {
+		tokens := strings.SplitN(item, "=", 2)
+		if len(tokens) == 2 {
+			tags[strings.TrimSpace(tokens[0])] = strings.Join(strings.Fields(tokens[1]), "")
+		}
+	}
+	return tags
+}
+
+// dkimHeadersHash is the hash of selected headers followed by the DKIM-Signature header without trailing CRLF
+func dkimHeadersHash(selected []string, signature string, canon string) []byte {
+	h := sha256.New()
+	for _, header := range selected {
+		h.Write([]byte(canonicalHeader(header, canon)))
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(signature, canon), "\r\n")))
+	return h.Sum(nil)
+}
+
+// selectHeaders picks headers by name from bottom, a name repeated in the list picks the previous instance
+func selectHeaders(headers []string, names []string) ([]string, []string) {
+	used := make(map[int]bool)
+	selected := make([]string, 0, len(names))
+	signed := make([]string, 0, len(names))
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headerName(headers[i]), name) {
+				used[i] = true
+				selected = append(selected, headers[i])
+				signed = append(signed, name)
+				break
+			}
+		}
+	}
+	return selected, signed
+}
+
+func canonicalHeader(header string, canon string) string {
+	if canon == DkimSimple {
+		if !strings.HasSuffix(header, "\r\n") {
+			header += "\r\n"
+		}
+		return header
+	}
+	i := strings.Index(header, ":")
+	if i < 0 {
+		return header
+	}
+	name := strings.ToLower(strings.TrimSpace(header[:i]))
+	value := strings.Join(strings.Fields(header[i+1:]), " ")
+	return name + ":" + value + "\r\n"
+}
+
+func canonicalBody(body []byte, canon string) []byte {
+	if canon == DkimRelaxed {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, line := range lines {
+			line = bytes.TrimRight(line, " \t")
+			lines[i] = dkimWhitespaces.ReplaceAll(line, []byte(" "))
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) > 0 || canon == DkimSimple {
+		body = append(body, '\r', '\n')
+	}
+	return body
+}
+
+// splitMessage returns header fields (with folded lines and CRLF) and body
+func splitMessage(data []byte) ([]string, []byte) {
+	var head, body []byte
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head, body = data[:i+2], data[i+4:]
+	} else {
+		head = data
+	}
+	headers := make([]string, 0)
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+		} else {
+			headers = append(headers, line)
+		}
+	}
+	return headers, body
+}
+
+func headerName(header string) string {
+	if i := strings.Index(header, ":"); i > 0 {
+		return strings.TrimSpace(header[:i])
+	}
+	return ""
+}
+
+// normalizeCRLF converts bare LF to CRLF
+func normalizeCRLF(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) || bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) {
+		return data
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,134 @@
+package qb_email
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDkim(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDer, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	keys := map[string]string{
+		DkimRsaSha256:     string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})),
+		DkimEd25519Sha256: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDer})),
+	}
+
+	m := Email.NewMessage("DKIM test", "Hello  world \r\n\r\n\r\n")
+	m.From = &mail.Address{Name: "Me", Address: "me@example.com"}
+	m.AddTo(mail.Address{Address: "you@example.com"})
+	data := m.GetBytes()
+
+	for algorithm, key := range keys {
+		record, err := Email.DkimRecord(key)
+		if nil != err {
+			t.Fatal(err)
+		}
+		lookup := func(name string) ([]string, error) {
+			if name != "mail._domainkey.example.com" {
+				t.Fatal("unexpected lookup", name)
+			}
+			return []string{record}, nil
+		}
+		for _, c := range []string{"relaxed/relaxed", "simple/simple", "relaxed/simple", "simple/relaxed"} {
+			settings := &DkimSettings{Domain: "example.com", Selector: "mail", PrivateKey: key, Canonicalization: c}
+			signed, err := Email.DkimSign(data, settings)
+			if nil != err {
+				t.Fatal(algorithm, c, err)
+			}
+			if !bytes.HasPrefix(signed, []byte("DKIM-Signature: v=1; a="+algorithm+"; c="+c)) {
+				t.Fatal(algorithm, c, "missing signature", string(signed[:80]))
+			}
+			if err = Email.DkimVerify(signed, lookup); nil != err {
+				t.Fatal(algorithm, c, err)
+			}
+
+			tampered := bytes.Replace(signed, []byte("Subject: "), []byte("Subject: =?UTF-8?B?SGk=?= "), 1)
+			if err = Email.DkimVerify(tampered, lookup); err != ErrorDkimBadSignature {
+				t.Fatal(algorithm, c, "expected bad signature", err)
+			}
+			tampered = bytes.Replace(signed, []byte("Hello"), []byte("Hallo"), 1)
+			if err = Email.DkimVerify(tampered, lookup); err != ErrorDkimBodyHash {
+				t.Fatal(algorithm, c, "expected body hash mismatch", err)
+			}
+
+			// relaxed tolerates whitespace changes of relays
+			reformatted := bytes.Replace(signed, []byte("Hello  world \r\n"), []byte("Hello world\r\n"), 1)
+			reformatted = bytes.Replace(reformatted, []byte("MIME-Version: 1.0"), []byte("MIME-Version:   1.0"), 1)
+			err = Email.DkimVerify(reformatted, lookup)
+			if (c == "relaxed/relaxed") != (nil == err) {
+				t.Fatal(algorithm, c, "relaxed canonicalization", err)
+			}
+		}
+	}
+	// invalid tags are rejected before the key lookup
+	signed, _ := Email.DkimSign(data, &DkimSettings{Domain: "example.com", Selector: "mail", PrivateKey: keys[DkimRsaSha256]})
+	invalid := map[string]error{
+		"v=1; l=-5;":         ErrorDkimMalformed,
+		"v=1; l=abc;":        ErrorDkimMalformed,
+		"v=1; x=1e3;":        ErrorDkimMalformed,
+		"v=1; x=1;":          ErrorDkimMalformed, // before t=
+		"v=1; l=1000000000;": ErrorDkimBodyHash,
+	}
+	for tag, expected := range invalid {
+		tampered := bytes.Replace(signed, []byte("v=1;"), []byte(tag), 1)
+		if err := Email.DkimVerify(tampered, nil); err != expected {
+			t.Fatal(tag, "expected", expected, "got", err)
+		}
+	}
+	expired := regexp.MustCompile(`t=(\d+);`).ReplaceAll(signed, []byte("t=1; x=2;"))
+	if err := Email.DkimVerify(expired, nil); err != ErrorDkimExpired {
+		t.Fatal("expected expired signature", err)
+	}
+	if err := Email.DkimVerify(bytes.Replace(signed, []byte("h=From:"), []byte("h="), 1), nil); err != ErrorDkimMalformed {
+		t.Fatal("expected From required", err)
+	}
+
+	if err := Email.DkimVerify(data, nil); err != ErrorDkimNoSignature {
+		t.Fatal("expected missing signature", err)
+	}
+}
+
+func TestDkim_sender(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	key := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	record, _ := Email.DkimRecord(key)
+
+	received := make(chan string, 1)
+	addr := fakeSmtp(t, func() bool { return true }, func(data string) { received <- data })
+	host, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+	sender, _ := Email.NewSender(&SmtpSettings{
+		Host: host,
+		Port: portNumber,
+		From: "me@example.com",
+		Dkim: &DkimSettings{Domain: "example.com", Selector: "s1", PrivateKey: key},
+	})
+	if err := sender.Send("signed", "body", []string{"you@example.com"}, nil, nil, "", "", nil); nil != err {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if !strings.HasPrefix(data, "DKIM-Signature:") {
+			t.Fatal("message not signed")
+		}
+		err := Email.DkimVerify([]byte(data), func(name string) ([]string, error) { return []string{record}, nil })
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
@@ -0,0 +1,693 @@
+package qb_email
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	ImapPort    = 143
+	ImapTLSPort = 993
+
+	FlagSeen     = `\Seen`
+	FlagAnswered = `\Answered`
+	FlagFlagged  = `\Flagged`
+	FlagDeleted  = `\Deleted`
+	FlagDraft    = `\Draft`
+
+	imapDateLayout = "_2-Jan-2006 15:04:05 -0700"
+)
+
+var (
+	ErrorImapProtocol   = errors.New("imap_protocol_error")
+	ErrorExpungeNotSafe = errors.New("expunge_not_safe")
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ImapClient reads and manages messages of an IMAP4rev1 server.
+// Messages are identified by UID. Mailbox names are ASCII.
+type ImapClient struct {
+	config *MailboxSettings
+
+	//-- private --//
+	conn         net.Conn
+	reader       *bufio.Reader
+	writer       *bufio.Writer
+	tag          int
+	capabilities map[string]bool
+	mux          sync.Mutex
+}
+
+// ImapMailbox is a mailbox returned by List
+type ImapMailbox struct {
+	Name       string
+	Delimiter  string
+	Attributes []string
+}
+
+// ImapStatus is the status of the selected mailbox
+type ImapStatus struct {
+	Name        string
+	Messages    int // EXISTS
+	Recent      int
+	UidValidity uint32
+	UidNext     uint32
+}
+
+// imapResponse is a response line. Status responses (OK, NO, BAD, BYE, PREAUTH) have the text, others are parsed.
+type imapResponse struct {
+	tag    string
+	fields []interface{} // string, []byte (literal), []interface{} (list), nil (NIL)
+	status string
+	text   string
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewImapClient returns a client. Settings are *MailboxSettings, MailboxSettings, JSON text or a JSON file.
+func (instance *EmailHelper) NewImapClient(settings interface{}) (*ImapClient, error) {
+	config, err := configureMailbox(settings)
+	if nil != err {
+		return nil, err
+	}
+	return &ImapClient{config: config}, nil
+}
+
+// Open connects and logs in
+func (instance *ImapClient) Open() error {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		conn, err := dialMailbox(instance.config, ImapPort, ImapTLSPort)
+		if nil != err {
+			return err
+		}
+		instance.setConn(conn)
+		greeting, err := instance.read()
+		if nil != err {
+			_ = conn.Close()
+			return err
+		}
+		if greeting.status != "OK" && greeting.status != "PREAUTH" {
+			_ = conn.Close()
+			return qb_utils.Errors.Prefix(ErrorImapProtocol, "bad greeting: ")
+		}
+		if err = instance.capability(); nil != err {
+			_ = conn.Close()
+			return err
+		}
+		if instance.config.Security == SecuritySTARTTLS {
+			if err = instance.startTLS(); nil != err {
+				_ = conn.Close()
+				return err
+			}
+		}
+		if greeting.status != "PREAUTH" && len(instance.config.User) > 0 {
+			if _, err = instance.cmd("LOGIN %s %s", quote(instance.config.User), quote(instance.config.Pass)); nil != err {
+				_ = conn.Close()
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// Close logs out and closes the connection
+func (instance *ImapClient) Close() error {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		if nil != instance.conn {
+			_, _ = instance.cmd("LOGOUT")
+			err := instance.conn.Close()
+			instance.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// HasCapability checks a capability of server, i.e. MOVE
+func (instance *ImapClient) HasCapability(name string) bool {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		return instance.capabilities[strings.ToUpper(name)]
+	}
+	return false
+}
+
+// List returns mailboxes matching pattern ("*" all mailboxes, "%" top level mailboxes)
+func (instance *ImapClient) List(pattern string) ([]*ImapMailbox, error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		if len(pattern) == 0 {
+			pattern = "*"
+		}
+		responses, err := instance.cmd("LIST \"\" %s", quote(pattern))
+		if nil != err {
+			return nil, err
+		}
+		mailboxes := make([]*ImapMailbox, 0)
+		for _, r := range responses {
+			if r.is("LIST") && len(r.fields) >= 4 {
+				mailbox := &ImapMailbox{Delimiter: toString(r.fields[2]), Name: toString(r.fields[3])}
+				if list, b := r.fields[1].([]interface{}); b {
+					for _, a := range list {
+						mailbox.Attributes = append(mailbox.Attributes, toString(a))
+					}
+				}
+				mailboxes = append(mailboxes, mailbox)
+			}
+		}
+		return mailboxes, nil
+	}
+	return nil, nil
+}
+
+// Select opens a mailbox, next commands work on this mailbox
+func (instance *ImapClient) Select(mailbox string) (*ImapStatus, error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		responses, err := instance.cmd("SELECT %s", quote(mailbox))
+		if nil != err {
+			return nil, err
+		}
+		status := &ImapStatus{Name: mailbox}
+		for _, r := range responses {
+			if len(r.fields) >= 2 {
+				n, _ := strconv.Atoi(toString(r.fields[0]))
+				switch strings.ToUpper(toString(r.fields[1])) {
+				case "EXISTS":
+					status.Messages = n
+				case "RECENT":
+					status.Recent = n
+				}
+			}
+			if code, value := r.code(); code == "UIDVALIDITY" {
+				status.UidValidity = toUint32(value)
+			} else if code == "UIDNEXT" {
+				status.UidNext = toUint32(value)
+			}
+		}
+		return status, nil
+	}
+	return nil, nil
+}
+
+// Search returns UIDs of messages matching criteria (RFC 3501), i.e. `UNSEEN FROM "billing"`. Empty criteria is ALL.
+func (instance *ImapClient) Search(criteria string) ([]uint32, error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		if len(criteria) == 0 {
+			criteria = "ALL"
+		}
+		responses, err := instance.cmd("UID SEARCH %s", criteria)
+		if nil != err {
+			return nil, err
+		}
+		uids := make([]uint32, 0)
+		for _, r := range responses {
+			if r.is("SEARCH") {
+				for _, f := range r.fields[1:] {
+					uids = append(uids, toUint32(f))
+				}
+			}
+		}
+		return uids, nil
+	}
+	return nil, nil
+}
+
+// Fetch returns messages with flags, size, internal date and content. Messages are not marked as seen.
+func (instance *ImapClient) Fetch(uids ...uint32) ([]*MailboxMessage, error) {
+	return instance.fetch(uids, "BODY.PEEK[]")
+}
+
+// FetchHeaders is like Fetch, but reads only the header of messages
+func (instance *ImapClient) FetchHeaders(uids ...uint32) ([]*MailboxMessage, error) {
+	return instance.fetch(uids, "BODY.PEEK[HEADER]")
+}
+
+// AddFlags adds flags to messages, i.e. FlagSeen
+func (instance *ImapClient) AddFlags(uids []uint32, flags ...string) error {
+	return instance.store(uids, "+FLAGS.SILENT", flags)
+}
+
+// RemoveFlags removes flags from messages
+func (instance *ImapClient) RemoveFlags(uids []uint32, flags ...string) error {
+	return instance.store(uids, "-FLAGS.SILENT", flags)
+}
+
+// Move moves messages to another mailbox. If server does not support MOVE, messages are copied and deleted.
+func (instance *ImapClient) Move(uids []uint32, mailbox string) error {
+	if nil != instance && len(uids) > 0 {
+		if instance.HasCapability("MOVE") {
+			instance.mux.Lock()
+			defer instance.mux.Unlock()
+			_, err := instance.cmd("UID MOVE %s %s", uidSet(uids), quote(mailbox))
+			return err
+		}
+		if err := instance.Copy(uids, mailbox); nil != err {
+			return err
+		}
+		return instance.Delete(uids...)
+	}
+	return nil
+}
+
+// Copy copies messages to another mailbox
+func (instance *ImapClient) Copy(uids []uint32, mailbox string) error {
+	if nil != instance && len(uids) > 0 {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		_, err := instance.cmd("UID COPY %s %s", uidSet(uids), quote(mailbox))
+		return err
+	}
+	return nil
+}
+
+// Delete marks messages as deleted and expunges them.
+// Without UIDPLUS, EXPUNGE removes all messages marked as deleted in the mailbox: if other messages are marked,
+// Delete returns ErrorExpungeNotSafe and messages are not changed.
+func (instance *ImapClient) Delete(uids ...uint32) error {
+	if nil != instance && len(uids) > 0 {
+		if !instance.HasCapability("UIDPLUS") {
+			deleted, err := instance.Search("DELETED")
+			if nil != err {
+				return err
+			}
+			requested := make(map[uint32]bool)
+			for _, uid := range uids {
+				requested[uid] = true
+			}
+			for _, uid := range deleted {
+				if !requested[uid] {
+					return ErrorExpungeNotSafe
+				}
+			}
+		}
+		if err := instance.AddFlags(uids, FlagDeleted); nil != err {
+			return err
+		}
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		var err error
+		if instance.capabilities["UIDPLUS"] {
+			_, err = instance.cmd("UID EXPUNGE %s", uidSet(uids))
+		} else {
+			_, err = instance.cmd("EXPUNGE")
+		}
+		return err
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (instance *ImapClient) setConn(conn net.Conn) {
+	instance.conn = conn
+	instance.reader = bufio.NewReader(conn)
+	instance.writer = bufio.NewWriter(conn)
+}
+
+func (instance *ImapClient) capability() error {
+	responses, err := instance.cmd("CAPABILITY")
+	if nil != err {
+		return err
+	}
+	instance.capabilities = make(map[string]bool)
+	for _, r := range responses {
+		if r.is("CAPABILITY") {
+			for _, c := range r.fields[1:] {
+				instance.capabilities[strings.ToUpper(toString(c))] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (instance *ImapClient) startTLS() error {
+	if !instance.capabilities["STARTTLS"] {
+		return ErrorStartTLSNotAllowed
+	}
+	if _, err := instance.cmd("STARTTLS"); nil != err {
+		return err
+	}
+	conn := tls.Client(instance.conn, instance.config.tlsConfig())
+	if err := conn.Handshake(); nil != err {
+		return err
+	}
+	instance.setConn(conn)
+	return instance.capability() // capabilities may change after STARTTLS
+}
+
+func (instance *ImapClient) fetch(uids []uint32, section string) ([]*MailboxMessage, error) {
+	if nil != instance {
+		if len(uids) == 0 {
+			return []*MailboxMessage{}, nil
+		}
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		responses, err := instance.cmd("UID FETCH %s (UID FLAGS RFC822.SIZE INTERNALDATE %s)", uidSet(uids), section)
+		if nil != err {
+			return nil, err
+		}
+		messages := make([]*MailboxMessage, 0, len(uids))
+		for _, r := range responses {
+			if len(r.fields) < 3 || !strings.EqualFold(toString(r.fields[1]), "FETCH") {
+				continue
+			}
+			items, _ := r.fields[2].([]interface{})
+			message := &MailboxMessage{}
+			var size int64
+			for i := 0; i+1 < len(items); i += 2 {
+				key := strings.ToUpper(toString(items[i]))
+				switch {
+				case key == "UID":
+					message.Uid = toUint32(items[i+1])
+				case key == "FLAGS":
+					list, _ := items[i+1].([]interface{})
+					for _, f := range list {
+						message.Flags = append(message.Flags, toString(f))
+					}
+				case key == "RFC822.SIZE":
+					size, _ = strconv.ParseInt(toString(items[i+1]), 10, 64)
+				case key == "INTERNALDATE":
+					message.Date, _ = time.Parse(imapDateLayout, toString(items[i+1]))
+				case strings.HasPrefix(key, "BODY["):
+					raw := items[i+1]
+					if v, b := raw.([]byte); b {
+						parsed := newMailboxMessage(v)
+						message.Raw, message.Header, message.Body = parsed.Raw, parsed.Header, parsed.Body
+					} else if nil != raw {
+						parsed := newMailboxMessage([]byte(toString(raw)))
+						message.Raw, message.Header, message.Body = parsed.Raw, parsed.Header, parsed.Body
+					}
+				}
+			}
+			message.Number, _ = strconv.Atoi(toString(r.fields[0]))
+			message.Size = size
+			if message.Uid > 0 {
+				messages = append(messages, message)
+			}
+		}
+		return messages, nil
+	}
+	return nil, nil
+}
+
+func (instance *ImapClient) store(uids []uint32, item string, flags []string) error {
+	if nil != instance && len(uids) > 0 {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		_, err := instance.cmd("UID STORE %s %s (%s)", uidSet(uids), item, strings.Join(flags, " "))
+		return err
+	}
+	return nil
+}
+
+// cmd sends a command and returns untagged responses. Returns an error if the command does not complete with OK.
+func (instance *ImapClient) cmd(format string, args ...interface{}) ([]*imapResponse, error) {
+	if nil == instance.conn {
+		return nil, ErrorNotConnected
+	}
+	command := fmt.Sprintf(format, args...)
+	if strings.ContainsAny(command, "\r\n") {
+		return nil, ErrorInvalidArgument // would inject a command
+	}
+	instance.tag++
+	tag := fmt.Sprintf("A%03d", instance.tag)
+	_ = instance.conn.SetDeadline(time.Now().Add(instance.config.timeout()))
+	defer instance.conn.SetDeadline(time.Time{})
+
+	if _, err := instance.writer.WriteString(tag + " " + command + "\r\n"); nil != err {
+		return nil, err
+	}
+	if err := instance.writer.Flush(); nil != err {
+		return nil, err
+	}
+	responses := make([]*imapResponse, 0)
+	for {
+		r, err := instance.read()
+		if nil != err {
+			return nil, err
+		}
+		if r.tag == tag {
+			if r.status != "OK" {
+				return responses, errors.New(strings.TrimSpace(r.status + " " + r.text))
+			}
+			return responses, nil
+		}
+		if r.tag == "*" && r.status == "BYE" && !strings.HasPrefix(format, "LOGOUT") {
+			return nil, errors.New(strings.TrimSpace("BYE " + r.text))
+		}
+		responses = append(responses, r)
+	}
+}
+
+// read reads a response line
+func (instance *ImapClient) read() (*imapResponse, error) {
+	r := new(imapResponse)
+	tag, err := readAtom(instance.reader)
+	if nil != err {
+		return nil, err
+	}
+	r.tag = tag
+	if tag == "+" {
+		// continuation request
+		r.text, err = readLine(instance.reader)
+		return r, err
+	}
+	if err = skipSpace(instance.reader); nil != err {
+		return nil, err
+	}
+	first, err := readToken(instance.reader)
+	if nil != err {
+		return nil, err
+	}
+	if s, b := first.(string); b {
+		switch strings.ToUpper(s) {
+		case "OK", "NO", "BAD", "BYE", "PREAUTH":
+			r.status = strings.ToUpper(s)
+			r.text, err = readLine(instance.reader)
+			r.text = strings.TrimSpace(r.text)
+			return r, err
+		}
+	}
+	fields, err := readTokens(instance.reader, false)
+	if nil != err {
+		return nil, err
+	}
+	r.fields = append([]interface{}{first}, fields...)
+	return r, nil
+}
+
+func (instance *imapResponse) is(name string) bool {
+	return len(instance.fields) > 0 && strings.EqualFold(toString(instance.fields[0]), name)
+}
+
+// code returns the response code of a status response, i.e. "[UIDVALIDITY 3857529045] UIDs valid"
+func (instance *imapResponse) code() (string, string) {
+	if strings.HasPrefix(instance.text, "[") {
+		if end := strings.Index(instance.text, "]"); end > 0 {
+			tokens := strings.SplitN(instance.text[1:end], " ", 2)
+			if len(tokens) == 2 {
+				return strings.ToUpper(tokens[0]), tokens[1]
+			}
+			return strings.ToUpper(tokens[0]), ""
+		}
+	}
+	return "", ""
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p a r s e r
+// ---------------------------------------------------------------------------------------------------------------------
+
+// readTokens reads tokens up to the end of line (or of a list)
+func readTokens(r *bufio.Reader, inList bool) ([]interface{}, error) {
+	tokens := make([]interface{}, 0)
+	for {
+		c, err := r.ReadByte()
+		if nil != err {
+			return nil, err
+		}
+		switch c {
+		case ' ':
+			continue
+		case '\r':
+			if _, err = r.ReadByte(); nil != err { // \n
+				return nil, err
+			}
+			if inList {
+				return nil, ErrorImapProtocol
+			}
+			return tokens, nil
+		case '\n':
+			if inList {
+				return nil, ErrorImapProtocol
+			}
+			return tokens, nil
+		case ')':
+			if !inList {
+				return nil, ErrorImapProtocol
+			}
+			return tokens, nil
+		default:
+			_ = r.UnreadByte()
+			token, err := readToken(r)
+			if nil != err {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+		}
+	}
+}
+
+// readToken reads an atom, a quoted string, a literal or a list
+func readToken(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if nil != err {
+		return nil, err
+	}
+	switch c {
+	case '(':
+		return readTokens(r, true)
+	case '"':
+		var sb strings.Builder
+		for {
+			c, err = r.ReadByte()
+			if nil != err {
+				return nil, err
+			}
+			if c == '\\' {
+				if c, err = r.ReadByte(); nil != err {
+					return nil, err
+				}
+			} else if c == '"' {
+				return sb.String(), nil
+			}
+			sb.WriteByte(c)
+		}
+	case '{':
+		text, err := r.ReadString('}')
+		if nil != err {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(text, "}"), "+"))
+		if nil != err || size < 0 {
+			return nil, ErrorImapProtocol
+		}
+		if _, err = readLine(r); nil != err {
+			return nil, err
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); nil != err {
+			return nil, err
+		}
+		return data, nil
+	}
+	_ = r.UnreadByte()
+	atom, err := readAtom(r)
+	if nil != err {
+		return nil, err
+	}
+	if atom == "NIL" {
+		return nil, nil
+	}
+	return atom, nil
+}
+
+// readAtom reads up to a space, a parenthesis or the end of line. Brackets are part of the atom (BODY[HEADER]).
+func readAtom(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	depth := 0
+	for {
+		c, err := r.ReadByte()
+		if nil != err {
+			return "", err
+		}
+		if depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '\r' || c == '\n') {
+			_ = r.UnreadByte()
+			return sb.String(), nil
+		}
+		if c == '[' {
+			depth++
+		} else if c == ']' && depth > 0 {
+			depth--
+		}
+		sb.WriteByte(c)
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func skipSpace(r *bufio.Reader) error {
+	c, err := r.ReadByte()
+	if nil == err && c != ' ' {
+		err = r.UnreadByte()
+	}
+	return err
+}
+
+func toString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	if nil == v {
+		return ""
+	}
+	return qb_utils.Convert.ToString(v)
+}
+
+func toUint32(v interface{}) uint32 {
+	n, _ := strconv.ParseUint(strings.TrimSpace(toString(v)), 10, 32)
+	return uint32(n)
+}
+
+// quote returns a quoted string. CR and LF cannot be quoted: commands containing them are refused by cmd
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func uidSet(uids []uint32) string {
+	items := make([]string, len(uids))
+	for i, uid := range uids {
+		items[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	return strings.Join(items, ",")
+}
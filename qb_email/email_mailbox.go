@@ -0,0 +1,129 @@
+package qb_email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	SecurityNone     = "none"     // plain text connection
+	SecurityTLS      = "tls"      // TLS from the beginning (IMAPS 993, POP3S 995)
+	SecuritySTARTTLS = "starttls" // plain text connection upgraded to TLS (IMAP 143, POP3 110)
+)
+
+var (
+	ErrorNotConnected       = errors.New("not_connected")
+	ErrorStartTLSNotAllowed = errors.New("starttls_not_supported_by_server")
+	ErrorInvalidArgument    = errors.New("invalid_argument") // i.e. CR or LF in a name, a password or a criteria
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//		MailboxMessage
+// ---------------------------------------------------------------------------------------------------------------------
+
+// MailboxMessage is a message read from a mailbox (IMAP or POP3)
+type MailboxMessage struct {
+	Number int       // sequence number (IMAP) or message number (POP3)
+	Uid    uint32    // IMAP unique id
+	Id     string    // POP3 unique id (UIDL)
+	Flags  []string  // IMAP flags, i.e. \Seen
+	Size   int64     // size in bytes
+	Date   time.Time // IMAP internal date (arrival time)
+	Raw    []byte    // RFC 5322 message
+	Header mail.Header
+	Body   []byte // raw body (not decoded)
+}
+
+// Subject returns the decoded subject
+func (m *MailboxMessage) Subject() string {
+	return decodeHeader(m.Header.Get("Subject"))
+}
+
+// From returns the sender
+func (m *MailboxMessage) From() *mail.Address {
+	if list, err := m.Header.AddressList("From"); nil == err && len(list) > 0 {
+		return list[0]
+	}
+	return nil
+}
+
+// HasFlag checks an IMAP flag
+func (m *MailboxMessage) HasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+func newMailboxMessage(raw []byte) *MailboxMessage {
+	m := &MailboxMessage{Raw: raw, Size: int64(len(raw)), Header: mail.Header{}}
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); nil == err {
+		m.Header = msg.Header
+		var body bytes.Buffer
+		_, _ = body.ReadFrom(msg.Body)
+		m.Body = body.Bytes()
+	}
+	return m
+}
+
+func decodeHeader(value string) string {
+	if decoded, err := headerDecoder.DecodeHeader(value); nil == err {
+		return decoded
+	}
+	return value
+}
+
+// configureMailbox reads settings as the SMTP sender does: struct, pointer, JSON text or JSON file
+func configureMailbox(settings interface{}) (*MailboxSettings, error) {
+	if c, b := settings.(*MailboxSettings); b {
+		return c, nil
+	} else if cc, bb := settings.(MailboxSettings); bb {
+		return &cc, nil
+	} else if s, bs := settings.(string); bs && !strings.HasPrefix(s, "{") {
+		text, err := qb_utils.IO.ReadTextFromFile(s)
+		if nil != err {
+			return nil, err
+		}
+		return configureMailbox(text)
+	}
+	var config MailboxSettings
+	err := qb_utils.JSON.Read(qb_utils.Convert.ToString(settings), &config)
+	if nil != err {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// dialMailbox connects to server. With SecurityTLS the connection is encrypted from the beginning.
+func dialMailbox(settings *MailboxSettings, defaultPort, defaultTLSPort int) (net.Conn, error) {
+	port := settings.Port
+	if port == 0 {
+		port = defaultPort
+		if settings.Security == SecurityTLS {
+			port = defaultTLSPort
+		}
+	}
+	timeout := settings.timeout()
+	addr := net.JoinHostPort(settings.Host, qb_utils.Convert.ToString(port))
+	if settings.Security == SecurityTLS {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, settings.tlsConfig())
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
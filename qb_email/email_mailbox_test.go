@@ -0,0 +1,327 @@
+package qb_email
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRawMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+	"\r\n" +
+	"Hello Bob\r\n" +
+	".dot line\r\n"
+
+func TestImapClient(t *testing.T) {
+	for _, security := range []string{SecurityNone, SecurityTLS, SecuritySTARTTLS} {
+		cert := testCertificate(t)
+		addr := fakeServer(t, cert, security == SecurityTLS, serveImap)
+		client, err := Email.NewImapClient(testMailboxSettings(addr, security, cert))
+		if nil != err {
+			t.Fatal(err)
+		}
+		if err = client.Open(); nil != err {
+			t.Fatal(security, err)
+		}
+
+		mailboxes, err := client.List("*")
+		if nil != err || len(mailboxes) != 2 || mailboxes[1].Name != "Archive" || mailboxes[1].Delimiter != "/" {
+			t.Fatal(security, "List", err, mailboxes)
+		}
+		status, err := client.Select("INBOX")
+		if nil != err || status.Messages != 1 || status.UidValidity != 3857529045 || status.UidNext != 43 {
+			t.Fatal(security, "Select", err, status)
+		}
+		uids, err := client.Search("UNSEEN")
+		if nil != err || len(uids) != 1 || uids[0] != 42 {
+			t.Fatal(security, "Search", err, uids)
+		}
+		messages, err := client.Fetch(uids...)
+		if nil != err || len(messages) != 1 {
+			t.Fatal(security, "Fetch", err)
+		}
+		m := messages[0]
+		if m.Uid != 42 || !m.HasFlag(FlagFlagged) || m.Subject() != "Café" || m.From().Address != "alice@example.com" {
+			t.Fatal(security, "Fetch", m.Uid, m.Flags, m.Subject())
+		}
+		if m.Date.Year() != 2023 || string(m.Raw) != testRawMessage {
+			t.Fatal(security, "Fetch", m.Date, string(m.Raw))
+		}
+		if err = client.AddFlags(uids, FlagSeen); nil != err {
+			t.Fatal(security, "AddFlags", err)
+		}
+		if err = client.Move(uids, "Archive"); nil != err {
+			t.Fatal(security, "Move", err)
+		}
+		if err = client.Delete(uids...); nil != err {
+			t.Fatal(security, "Delete", err)
+		}
+		if _, err = client.Select("Missing"); nil == err {
+			t.Fatal(security, "expected error selecting a missing mailbox")
+		}
+		if _, err = client.Select("INBOX\r\nA999 DELETE INBOX"); err != ErrorInvalidArgument {
+			t.Fatal(security, "expected invalid argument", err)
+		}
+		// without UIDPLUS, EXPUNGE would remove message 7 too
+		client.capabilities["UIDPLUS"] = false
+		if err = client.Delete(uids...); err != ErrorExpungeNotSafe {
+			t.Fatal(security, "expected unsafe expunge", err)
+		}
+		if err = client.Close(); nil != err {
+			t.Fatal(security, err)
+		}
+	}
+}
+
+func TestPop3Client(t *testing.T) {
+	for _, security := range []string{SecurityNone, SecurityTLS, SecuritySTARTTLS} {
+		cert := testCertificate(t)
+		addr := fakeServer(t, cert, security == SecurityTLS, servePop3)
+		client, err := Email.NewPop3Client(testMailboxSettings(addr, security, cert))
+		if nil != err {
+			t.Fatal(err)
+		}
+		if err = client.Open(); nil != err {
+			t.Fatal(security, err)
+		}
+		count, size, err := client.Stat()
+		if nil != err || count != 1 || size != int64(len(testRawMessage)) {
+			t.Fatal(security, "Stat", err, count, size)
+		}
+		list, err := client.Uidl()
+		if nil != err || len(list) != 1 || list[0].Id != "uid-1" {
+			t.Fatal(security, "Uidl", err, list)
+		}
+		m, err := client.Retr(1)
+		if nil != err || string(m.Raw) != testRawMessage || m.Subject() != "Café" {
+			t.Fatal(security, "Retr", err)
+		}
+		if err = client.Dele(1); nil != err {
+			t.Fatal(security, "Dele", err)
+		}
+		if _, err = client.Retr(2); nil == err {
+			t.Fatal(security, "expected error retrieving a missing message")
+		}
+		if _, err = client.cmd("NOOP\r\nDELE %d", 1); err != ErrorInvalidArgument {
+			t.Fatal(security, "expected invalid argument", err)
+		}
+		if err = client.Close(); nil != err {
+			t.Fatal(security, err)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	fake servers
+//----------------------------------------------------------------------------------------------------------------------
+
+type fakeConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	cert   tls.Certificate
+}
+
+func (c *fakeConn) send(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(c.conn, format+"\r\n", args...)
+}
+
+func (c *fakeConn) startTLS() {
+	tlsConn := tls.Server(c.conn, &tls.Config{Certificates: []tls.Certificate{c.cert}})
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+}
+
+func serveImap(c *fakeConn) {
+	c.send("* OK fake IMAP ready")
+	for {
+		line, err := c.reader.ReadString('\n')
+		if nil != err {
+			return
+		}
+		tokens := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		tag, command, args := tokens[0], strings.ToUpper(tokens[1]), ""
+		if len(tokens) > 2 {
+			args = tokens[2]
+		}
+		if command == "UID" {
+			sub := strings.SplitN(args, " ", 2)
+			command, args = "UID "+strings.ToUpper(sub[0]), sub[1]
+		}
+		switch command {
+		case "CAPABILITY":
+			if _, ok := c.conn.(*tls.Conn); ok {
+				c.send("* CAPABILITY IMAP4rev1 MOVE UIDPLUS")
+			} else {
+				c.send("* CAPABILITY IMAP4rev1 STARTTLS MOVE UIDPLUS")
+			}
+		case "STARTTLS":
+			c.send("%s OK begin TLS", tag)
+			c.startTLS()
+			continue
+		case "LOGIN":
+			if args != `"user" "p\"ss"` {
+				c.send("%s NO invalid credentials", tag)
+				continue
+			}
+		case "LIST":
+			c.send(`* LIST (\HasNoChildren) "/" "INBOX"`)
+			c.send(`* LIST (\HasNoChildren \Archive) "/" Archive`)
+		case "SELECT":
+			if args != `"INBOX"` {
+				c.send("%s NO mailbox not found", tag)
+				continue
+			}
+			c.send(`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+			c.send("* 1 EXISTS")
+			c.send("* 0 RECENT")
+			c.send("* OK [UIDVALIDITY 3857529045] UIDs valid")
+			c.send("* OK [UIDNEXT 43] Predicted next UID")
+			c.send("%s OK [READ-WRITE] SELECT completed", tag)
+			continue
+		case "UID SEARCH":
+			if args == "DELETED" {
+				c.send("* SEARCH 7") // deleted by another client
+			} else {
+				c.send("* SEARCH 42")
+			}
+		case "UID FETCH":
+			c.send(`* 1 FETCH (UID 42 FLAGS (\Flagged) RFC822.SIZE %d INTERNALDATE " 7-Feb-2023 10:20:30 +0100" BODY[] {%d}`,
+				len(testRawMessage), len(testRawMessage))
+			_, _ = c.conn.Write([]byte(testRawMessage + ")\r\n"))
+		case "UID STORE", "UID MOVE", "UID EXPUNGE":
+			if !strings.HasPrefix(args, "42") {
+				c.send("%s BAD invalid set", tag)
+				continue
+			}
+		case "LOGOUT":
+			c.send("* BYE logging out")
+			c.send("%s OK LOGOUT completed", tag)
+			return
+		default:
+			c.send("%s BAD unknown command", tag)
+			continue
+		}
+		c.send("%s OK %s completed", tag, command)
+	}
+}
+
+func servePop3(c *fakeConn) {
+	c.send("+OK fake POP3 ready")
+	for {
+		line, err := c.reader.ReadString('\n')
+		if nil != err {
+			return
+		}
+		fields := strings.Fields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "STLS":
+			c.send("+OK begin TLS")
+			c.startTLS()
+		case "USER":
+			c.send("+OK")
+		case "PASS":
+			if fields[1] != `p"ss` {
+				c.send("-ERR invalid credentials")
+			} else {
+				c.send("+OK logged in")
+			}
+		case "STAT":
+			c.send("+OK 1 %d", len(testRawMessage))
+		case "UIDL":
+			c.send("+OK")
+			c.send("1 uid-1")
+			c.send(".")
+		case "RETR":
+			if fields[1] != "1" {
+				c.send("-ERR no such message")
+				continue
+			}
+			c.send("+OK %d octets", len(testRawMessage))
+			_, _ = c.conn.Write([]byte(strings.ReplaceAll(testRawMessage, "\r\n.", "\r\n..") + ".\r\n"))
+		case "DELE":
+			c.send("+OK message deleted")
+		case "QUIT":
+			c.send("+OK bye")
+			return
+		default:
+			c.send("-ERR unknown command")
+		}
+	}
+}
+
+func fakeServer(t *testing.T, cert tls.Certificate, implicitTLS bool, serve func(c *fakeConn)) string {
+	var listener net.Listener
+	var err error
+	if implicitTLS {
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				c := &fakeConn{conn: conn, reader: bufio.NewReader(conn), cert: cert}
+				serve(c)
+				_ = c.conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testMailboxSettings(addr, security string, cert tls.Certificate) *MailboxSettings {
+	host, port, _ := net.SplitHostPort(addr)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	settings := &MailboxSettings{
+		Host:      host,
+		Security:  security,
+		User:      "user",
+		Pass:      `p"ss`,
+		Timeout:   5,
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"},
+	}
+	_, _ = fmt.Sscan(port, &settings.Port)
+	return settings
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
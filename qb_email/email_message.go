@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"mime"
 	"net/mail"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/rskvp/qb-core/qb_vcal"
 )
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -18,9 +23,11 @@ import (
 
 // Attachment represents an email attachment.
 type Attachment struct {
-	Filename string
-	Data     []byte
-	Inline   bool
+	Filename    string
+	Data        []byte
+	Inline      bool
+	ContentType string // (optional) MIME type, i.e. "image/png"
+	ContentId   string // (optional) id of inline parts referenced as "cid:<id>"
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -47,6 +54,9 @@ type Message struct {
 	Subject         string
 	Body            string
 	BodyContentType string
+	TextBody        string // (optional) text alternative of an HTML Body, generated from HTML when empty
+	Calendar        string // (optional) text/calendar alternative, see AddCalendarInvite
+	CalendarMethod  string
 	Headers         []Header
 	Attachments     map[string]*Attachment
 }
@@ -93,6 +103,27 @@ func (m *Message) AddHeader(key string, value string) Header {
 	return newHeader
 }
 
+// AddCalendarInvite adds a meeting invitation. The calendar is sent as a text/calendar alternative of the body
+// (shown as an invitation by Outlook and Gmail) and as an "invite.ics" attachment.
+// Calendar method is REQUEST if not set.
+func (m *Message) AddCalendarInvite(calendar *qb_vcal.Calendar) {
+	if nil == calendar {
+		return
+	}
+	if len(calendar.Method()) == 0 {
+		calendar.SetMethod(qb_vcal.MethodRequest)
+	}
+	if calendar.Version() != "2.0" {
+		calendar.SetVersion("2.0") // iCalendar (RFC 5545), required by mail clients
+	}
+	m.Calendar = calendar.String()
+	m.CalendarMethod = calendar.Method()
+	m.Attachments["invite.ics"] = &Attachment{
+		Filename:    "invite.ics",
+		Data:        []byte(m.Calendar),
+		ContentType: "application/ics",
+	}
+}
 
 // GetToList returns all the recipients of the email
 func (m *Message) GetToList() []string {
@@ -150,17 +181,28 @@ func (m *Message) GetBytes() []byte {
 
 	boundary := "f46d043c813270fc6b04c2d223da"
 
-	if len(m.Attachments) > 0 {
+	// inline parts with a Content-ID are related to the body, other attachments are mixed with it
+	related := make([]*Attachment, 0)
+	attachments := make([]*Attachment, 0)
+	for _, attachment := range m.Attachments {
+		if len(attachment.ContentId) > 0 {
+			related = append(related, attachment)
+		} else {
+			attachments = append(attachments, attachment)
+		}
+	}
+	sort.Slice(related, func(i, j int) bool { return related[i].ContentId < related[j].ContentId })
+
+	if len(attachments) > 0 {
 		buf.WriteString("Content-Type: multipart/mixed; boundary=" + boundary + "\r\n")
 		buf.WriteString("\r\n--" + boundary + "\r\n")
 	}
 
-	buf.WriteString(fmt.Sprintf("Content-Type: %s; charset=utf-8\r\n\r\n", m.BodyContentType))
-	buf.WriteString(m.Body)
+	m.writeBody(buf, "alt-"+boundary, related)
 	buf.WriteString("\r\n")
 
-	if len(m.Attachments) > 0 {
-		for _, attachment := range m.Attachments {
+	if len(attachments) > 0 {
+		for _, attachment := range attachments {
 			buf.WriteString("\r\n\r\n--" + boundary + "\r\n")
 
 			if attachment.Inline {
@@ -169,30 +211,7 @@ func (m *Message) GetBytes() []byte {
 
 				buf.Write(attachment.Data)
 			} else {
-				ext := filepath.Ext(attachment.Filename)
-				mimetype := mime.TypeByExtension(ext)
-				if mimetype != "" {
-					vmime := fmt.Sprintf("Content-Type: %s\r\n", mimetype)
-					buf.WriteString(vmime)
-				} else {
-					buf.WriteString("Content-Type: application/octet-stream\r\n")
-				}
-				buf.WriteString("Content-Transfer-Encoding: base64\r\n")
-
-				buf.WriteString("Content-Disposition: attachment; filename=\"=?UTF-8?B?")
-				buf.WriteString(coder.EncodeToString([]byte(attachment.Filename)))
-				buf.WriteString("?=\"\r\n\r\n")
-
-				b := make([]byte, base64.StdEncoding.EncodedLen(len(attachment.Data)))
-				base64.StdEncoding.Encode(b, attachment.Data)
-
-				// write base64 content in lines of up to 76 chars
-				for i, l := 0, len(b); i < l; i++ {
-					buf.WriteByte(b[i])
-					if (i+1)%76 == 0 {
-						buf.WriteString("\r\n")
-					}
-				}
+				writeAttachment(buf, attachment)
 			}
 
 			buf.WriteString("\r\n--" + boundary)
@@ -225,4 +244,138 @@ func (m *Message) attach(file string, inline bool) error {
 	return nil
 }
 
+// writeBody writes the body. Alternatives (text, HTML, calendar) are written as multipart/alternative.
+// Related parts (images referenced as "cid:<id>") are written with the body in a multipart/related.
+func (m *Message) writeBody(buf *bytes.Buffer, boundary string, related []*Attachment) {
+	parts := make([][2]string, 0, 3) // content type, content
+	if m.BodyContentType == "text/html" {
+		text := m.TextBody
+		if len(text) == 0 {
+			text = htmlToText(m.Body)
+		}
+		parts = append(parts, [2]string{"text/plain; charset=utf-8", text})
+	}
+	body := len(parts)
+	parts = append(parts, [2]string{fmt.Sprintf("%s; charset=utf-8", m.BodyContentType), m.Body})
+	if len(m.Calendar) > 0 {
+		method := m.CalendarMethod
+		if len(method) == 0 {
+			method = string(qb_vcal.MethodRequest)
+		}
+		parts = append(parts, [2]string{"text/calendar; charset=utf-8; method=" + method, m.Calendar})
+	}
+
+	if len(parts) == 1 {
+		writeRelated(buf, "rel-"+boundary, parts[0], related)
+		return
+	}
+	buf.WriteString("Content-Type: multipart/alternative; boundary=" + boundary + "\r\n")
+	for i, part := range parts {
+		buf.WriteString("\r\n--" + boundary + "\r\n")
+		if i == body {
+			writeRelated(buf, "rel-"+boundary, part, related)
+		} else {
+			buf.WriteString("Content-Type: " + part[0] + "\r\n\r\n")
+			buf.WriteString(part[1])
+		}
+	}
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+}
+
+// writeRelated writes a part (content type, content) followed by its related parts as multipart/related
+func writeRelated(buf *bytes.Buffer, boundary string, part [2]string, related []*Attachment) {
+	if len(related) == 0 {
+		buf.WriteString("Content-Type: " + part[0] + "\r\n\r\n")
+		buf.WriteString(part[1])
+		return
+	}
+	mimetype := strings.TrimSpace(strings.Split(part[0], ";")[0])
+	buf.WriteString("Content-Type: multipart/related; boundary=" + boundary + "; type=\"" + mimetype + "\"\r\n")
+	buf.WriteString("\r\n--" + boundary + "\r\n")
+	buf.WriteString("Content-Type: " + part[0] + "\r\n\r\n")
+	buf.WriteString(part[1])
+	for _, attachment := range related {
+		buf.WriteString("\r\n--" + boundary + "\r\n")
+		writeAttachment(buf, attachment)
+	}
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+}
+
+// writeAttachment writes headers and base64 content of an attachment
+func writeAttachment(buf *bytes.Buffer, attachment *Attachment) {
+	mimetype := attachment.ContentType
+	if mimetype == "" {
+		mimetype = mime.TypeByExtension(filepath.Ext(attachment.Filename))
+	}
+	if mimetype != "" {
+		vmime := fmt.Sprintf("Content-Type: %s\r\n", mimetype)
+		buf.WriteString(vmime)
+	} else {
+		buf.WriteString("Content-Type: application/octet-stream\r\n")
+	}
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+
+	// inline parts with a Content-ID are referenced by the body as "cid:<id>"
+	disposition := "attachment"
+	if len(attachment.ContentId) > 0 {
+		buf.WriteString("Content-ID: <" + attachment.ContentId + ">\r\n")
+		disposition = "inline"
+	}
+	buf.WriteString("Content-Disposition: " + disposition + "; filename=\"=?UTF-8?B?")
+	buf.WriteString(base64.StdEncoding.EncodeToString([]byte(attachment.Filename)))
+	buf.WriteString("?=\"\r\n\r\n")
+
+	b := make([]byte, base64.StdEncoding.EncodedLen(len(attachment.Data)))
+	base64.StdEncoding.Encode(b, attachment.Data)
+
+	// write base64 content in lines of up to 76 chars
+	for i, l := 0, len(b); i < l; i++ {
+		buf.WriteByte(b[i])
+		if (i+1)%76 == 0 {
+			buf.WriteString("\r\n")
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//		H T M L   t o   t e x t
+// ---------------------------------------------------------------------------------------------------------------------
 
+var (
+	htmlInvisible  = regexp.MustCompile(`(?is)<(head|style|script|title)[^>]*>.*?</(head|style|script|title)>|<!--.*?-->`)
+	htmlLink       = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a>`)
+	htmlLineBreak  = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlBlockEnd   = regexp.MustCompile(`(?i)</(p|div|h[1-6]|table|ul|ol|blockquote|pre)>|<(p|div|h[1-6]|table|ul|ol|hr)(\s[^>]*)?/?>`)
+	htmlRowEnd     = regexp.MustCompile(`(?i)</(tr|li|dt|dd)>`)
+	htmlListItem   = regexp.MustCompile(`(?i)<li(\s[^>]*)?>`)
+	htmlTag        = regexp.MustCompile(`(?s)<[^>]*>`)
+	textSpaces     = regexp.MustCompile(`[ \t\r\f\v]+`)
+	textEmptyLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText converts HTML to readable plain text (links are written as "text (url)")
+func htmlToText(content string) string {
+	text := htmlInvisible.ReplaceAllString(content, "")
+	text = htmlLink.ReplaceAllStringFunc(text, func(s string) string {
+		match := htmlLink.FindStringSubmatch(s)
+		label := strings.TrimSpace(htmlTag.ReplaceAllString(match[2], ""))
+		if len(label) == 0 || label == match[1] || strings.HasPrefix(match[1], "#") {
+			return label
+		}
+		return label + " (" + strings.TrimPrefix(match[1], "mailto:") + ")"
+	})
+	text = strings.ReplaceAll(text, "\n", " ")
+	text = htmlLineBreak.ReplaceAllString(text, "\n")
+	text = htmlBlockEnd.ReplaceAllString(text, "\n\n")
+	text = htmlRowEnd.ReplaceAllString(text, "\n")
+	text = htmlListItem.ReplaceAllString(text, "- ")
+	text = htmlTag.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(textSpaces.ReplaceAllString(line, " "))
+	}
+	text = textEmptyLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text)
+}
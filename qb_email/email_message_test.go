@@ -0,0 +1,75 @@
+package qb_email
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_vcal"
+)
+
+func TestMessage_alternative(t *testing.T) {
+	m := Email.NewHTMLMessage("News", `<html><head><style>p{}</style></head><body>`+
+		`<h1>Hello &amp; welcome</h1><p>Read <a href="https://example.com">the news</a>.<br>Bye</p>`+
+		`<ul><li>one</li><li>two</li></ul></body></html>`)
+	m.From = &mail.Address{Address: "me@example.com"}
+	m.AddTo(mail.Address{Address: "you@example.com"})
+
+	data := m.GetBytes()
+	if !bytes.Contains(data, []byte("Content-Type: multipart/alternative;")) {
+		t.Fatal("missing alternative", string(data))
+	}
+	parsed, err := ParseMessage(bytes.NewReader(data))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if parsed.BodyContentType != "text/html" || parsed.Body != m.Body {
+		t.Fatal("html body", parsed.Body)
+	}
+	if parsed.TextBody != "Hello & welcome\n\nRead the news (https://example.com).\nBye\n\n- one\n- two" {
+		t.Fatalf("text body %q", parsed.TextBody)
+	}
+
+	// explicit text, no alternative for plain messages
+	m.TextBody = "custom text"
+	if parsed, _ = ParseMessage(bytes.NewReader(m.GetBytes())); parsed.TextBody != "custom text" {
+		t.Fatal("text body", parsed.TextBody)
+	}
+	plain := Email.NewMessage("plain", "only text")
+	plain.From = m.From
+	if data = plain.GetBytes(); bytes.Contains(data, []byte("multipart")) {
+		t.Fatal("unexpected multipart", string(data))
+	}
+}
+
+func TestMessage_calendarInvite(t *testing.T) {
+	calendar := qb_vcal.NewCalendarFor("test")
+	event := calendar.AddEvent("meeting-1@example.com")
+	event.SetSummary("Planning")
+	event.SetStartAt(time.Date(2023, 5, 10, 9, 0, 0, 0, time.UTC))
+	event.SetEndAt(time.Date(2023, 5, 10, 10, 0, 0, 0, time.UTC))
+	event.SetOrganizer("mailto:me@example.com")
+
+	m := Email.NewHTMLMessage("Planning", "<p>Join us</p>")
+	m.From = &mail.Address{Address: "me@example.com"}
+	m.AddTo(mail.Address{Address: "you@example.com"})
+	m.AddCalendarInvite(calendar)
+
+	data := m.GetBytes()
+	if !bytes.Contains(data, []byte("Content-Type: text/calendar; charset=utf-8; method=REQUEST")) {
+		t.Fatal("missing calendar part", string(data))
+	}
+	parsed, err := ParseMessage(bytes.NewReader(data))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if parsed.CalendarMethod != "REQUEST" || !strings.Contains(parsed.Calendar, "METHOD:REQUEST") ||
+		!strings.Contains(parsed.Calendar, "VERSION:2.0") || !strings.Contains(parsed.Calendar, "SUMMARY:Planning") {
+		t.Fatal("calendar", parsed.CalendarMethod, parsed.Calendar)
+	}
+	if parsed.TextBody != "Join us" || nil == parsed.Attachments["invite.ics"] {
+		t.Fatal("text and attachment", parsed.TextBody, parsed.Attachments)
+	}
+}
@@ -0,0 +1,438 @@
+package qb_email
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+	"github.com/rskvp/qb-core/qb_rnd"
+	"github.com/rskvp/qb-core/qb_stoppable"
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	OutboxQueue      = "queue"
+	OutboxProcessing = "processing"
+	OutboxSent       = "sent"
+	OutboxFailed     = "failed"
+
+	EventOutboxSent   = "outbox_sent"
+	EventOutboxRetry  = "outbox_retry"
+	EventOutboxFailed = "outbox_failed"
+
+	outboxExt = ".json"
+)
+
+var (
+	ErrorOutboxItemNotFound = errors.New("outbox_item_not_found")
+	ErrorInvalidFolder      = errors.New("invalid_outbox_folder")
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Outbox is a durable queue of messages. Messages are written in the "queue" folder of a spool directory,
+// delivered by a background worker and moved to "sent" or "failed" folders.
+// Failed deliveries are retried with an exponential backoff, undelivered messages survive a restart.
+// Before sending, a message is claimed moving it to "processing" folder, so more processes can share a spool directory.
+// The claim is refreshed every ClaimTimeout/3 while sending, so a delivery slower than ClaimTimeout is not sent twice.
+type Outbox struct {
+	MaxAttempts  int           // attempts before moving a message to failed folder (default 8)
+	RetryDelay   time.Duration // delay after first failure, doubled at each attempt (default 30 seconds)
+	RetryMax     time.Duration // max delay between attempts (default 1 hour)
+	PollInterval time.Duration // interval to check queue folder for messages written by other processes (default 1 minute)
+	StopTimeout  time.Duration // max wait for a delivery in progress on Stop (default 2 seconds)
+	ClaimTimeout time.Duration // claims not refreshed for longer (i.e. a process crashed) are moved back to queue (default 10 minutes)
+
+	//-- private --//
+	dir       string
+	sender    *SmtpSender
+	events    *qb_events.Emitter
+	stoppable *qb_stoppable.Stoppable
+	wake      chan bool
+	stop      chan bool
+	done      chan bool
+	mux       sync.Mutex
+}
+
+// OutboxItem is a message in the spool directory. It is the argument of outbox events.
+type OutboxItem struct {
+	Id          string    `json:"id"`
+	Message     *Message  `json:"message"`
+	Attempts    int       `json:"attempts"`
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+	SentAt      time.Time `json:"sent_at"`
+	LastError   string    `json:"last_error"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewOutbox creates an outbox on a spool directory. Messages are delivered by sender.
+func (instance *EmailHelper) NewOutbox(dir string, sender *SmtpSender) (*Outbox, error) {
+	outbox := new(Outbox)
+	outbox.dir = dir
+	outbox.sender = sender
+	outbox.MaxAttempts = 8
+	outbox.RetryDelay = 30 * time.Second
+	outbox.RetryMax = time.Hour
+	outbox.PollInterval = time.Minute
+	outbox.StopTimeout = 2 * time.Second
+	outbox.ClaimTimeout = 10 * time.Minute
+	outbox.events = qb_events.Events.NewEmitter()
+	outbox.wake = make(chan bool, 1)
+
+	for _, folder := range []string{OutboxQueue, OutboxProcessing, OutboxSent, OutboxFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, folder), os.ModePerm); nil != err {
+			return nil, err
+		}
+	}
+
+	outbox.stoppable = qb_stoppable.NewStoppable().SetName("outbox")
+	outbox.stoppable.AddStopOperation("outbox", outbox.shutdown)
+	outbox.stoppable.OnStart(outbox.startWorker)
+
+	return outbox, nil
+}
+
+// Start starts the delivery worker. The worker is stopped by Stop or by a termination signal.
+func (instance *Outbox) Start() bool {
+	if nil != instance {
+		return instance.stoppable.Start()
+	}
+	return false
+}
+
+// Stop waits the delivery in progress (max StopTimeout) and stops the worker. Pending messages remain in queue.
+func (instance *Outbox) Stop() bool {
+	if nil != instance {
+		return instance.stoppable.Stop()
+	}
+	return false
+}
+
+// Join waits the worker to stop
+func (instance *Outbox) Join() {
+	if nil != instance {
+		instance.stoppable.Join()
+	}
+}
+
+// IsRunning returns true if the worker is started
+func (instance *Outbox) IsRunning() bool {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		return nil != instance.stop
+	}
+	return false
+}
+
+// Enqueue writes a message in the queue folder and returns the id of the item
+func (instance *Outbox) Enqueue(message *Message) (string, error) {
+	if nil != instance {
+		now := time.Now()
+		item := &OutboxItem{
+			Id:          fmt.Sprintf("%d-%s", now.UnixNano(), qb_rnd.Rnd.Uuid()),
+			Message:     message,
+			CreatedAt:   now,
+			NextAttempt: now,
+		}
+		if err := instance.write(OutboxQueue, item); nil != err {
+			return "", err
+		}
+		instance.notify()
+		return item.Id, nil
+	}
+	return "", nil
+}
+
+// Items returns items of a folder (OutboxQueue, OutboxProcessing, OutboxSent, OutboxFailed) sorted by creation
+func (instance *Outbox) Items(folder string) ([]*OutboxItem, error) {
+	if nil != instance {
+		if !isOutboxFolder(folder) {
+			return nil, ErrorInvalidFolder
+		}
+		files, err := ioutil.ReadDir(filepath.Join(instance.dir, folder))
+		if nil != err {
+			return nil, err
+		}
+		names := make([]string, 0, len(files))
+		for _, file := range files {
+			if !file.IsDir() && strings.HasSuffix(file.Name(), outboxExt) {
+				names = append(names, strings.TrimSuffix(file.Name(), outboxExt))
+			}
+		}
+		sort.Strings(names)
+		items := make([]*OutboxItem, 0, len(names))
+		for _, id := range names {
+			if item, err := instance.read(folder, id); nil == err {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	}
+	return nil, nil
+}
+
+// Retry moves a failed item back to queue resetting attempts
+func (instance *Outbox) Retry(id string) error {
+	if nil != instance {
+		item, err := instance.read(OutboxFailed, id)
+		if nil != err {
+			return ErrorOutboxItemNotFound
+		}
+		item.Attempts = 0
+		item.NextAttempt = time.Now()
+		if err = instance.move(OutboxFailed, OutboxQueue, item); nil != err {
+			return err
+		}
+		instance.notify()
+	}
+	return nil
+}
+
+// OnSent is notified when a message is delivered. Argument is *OutboxItem
+func (instance *Outbox) OnSent(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventOutboxSent, callback)
+	}
+}
+
+// OnRetry is notified when a delivery fails and is scheduled again. Argument is *OutboxItem
+func (instance *Outbox) OnRetry(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventOutboxRetry, callback)
+	}
+}
+
+// OnFailed is notified when a message is moved to failed folder after MaxAttempts. Argument is *OutboxItem
+func (instance *Outbox) OnFailed(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventOutboxFailed, callback)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (instance *Outbox) startWorker() {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	instance.stop = make(chan bool)
+	instance.done = make(chan bool)
+	go instance.work(instance.stop, instance.done)
+}
+
+// shutdown is the stop operation of stoppable
+func (instance *Outbox) shutdown() error {
+	instance.mux.Lock()
+	stop, done := instance.stop, instance.done
+	instance.stop, instance.done = nil, nil
+	instance.mux.Unlock()
+
+	if nil != stop {
+		close(stop)
+		select {
+		case <-done:
+		case <-time.After(instance.StopTimeout):
+			return errors.New("outbox_stop_timeout")
+		}
+	}
+	return nil
+}
+
+func (instance *Outbox) work(stop, done chan bool) {
+	defer close(done)
+	for {
+		wait := instance.process(stop)
+		select {
+		case <-stop:
+			return
+		case <-instance.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// process delivers due items and returns the time to wait for next item
+func (instance *Outbox) process(stop chan bool) time.Duration {
+	wait := instance.PollInterval
+	instance.recover()
+	items, err := instance.Items(OutboxQueue)
+	if nil != err {
+		return wait
+	}
+	for _, item := range items {
+		select {
+		case <-stop:
+			return wait
+		default:
+		}
+		if delay := time.Until(item.NextAttempt); delay > 0 {
+			if delay < wait {
+				wait = delay
+			}
+			continue
+		}
+		if !instance.claim(item) {
+			continue // claimed by another process
+		}
+		if next := instance.deliver(item); next > 0 && next < wait {
+			wait = next
+		}
+	}
+	return wait
+}
+
+// claim moves a queued item to processing folder. Rename is atomic: only one process claims an item
+func (instance *Outbox) claim(item *OutboxItem) bool {
+	// rename keeps the modification time: it is the claim time used by recover and is set before
+	// the rename, otherwise recover of another process could move back the item just claimed
+	queued := instance.filename(OutboxQueue, item.Id)
+	now := time.Now()
+	if err := os.Chtimes(queued, now, now); nil != err {
+		return false
+	}
+	return nil == os.Rename(queued, instance.filename(OutboxProcessing, item.Id))
+}
+
+// keepClaim refreshes the claim time of an item until the returned function is called
+func (instance *Outbox) keepClaim(item *OutboxItem) func() {
+	interval := instance.ClaimTimeout / 3
+	if interval <= 0 {
+		return func() {}
+	}
+	filename := instance.filename(OutboxProcessing, item.Id)
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				_ = os.Chtimes(filename, now, now)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// recover moves back to queue the items claimed more than ClaimTimeout ago
+func (instance *Outbox) recover() {
+	files, err := ioutil.ReadDir(filepath.Join(instance.dir, OutboxProcessing))
+	if nil != err {
+		return
+	}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), outboxExt) && time.Since(file.ModTime()) > instance.ClaimTimeout {
+			_ = os.Rename(filepath.Join(instance.dir, OutboxProcessing, file.Name()),
+				filepath.Join(instance.dir, OutboxQueue, file.Name()))
+		}
+	}
+}
+
+// deliver sends a claimed item and moves it to sent or failed folder, or back to queue.
+// Returns delay of next attempt (0 if no more attempts)
+func (instance *Outbox) deliver(item *OutboxItem) time.Duration {
+	release := instance.keepClaim(item)
+	err := instance.sender.SendMessage(item.Message)
+	release()
+	item.Attempts++
+	if nil == err {
+		item.SentAt = time.Now()
+		item.LastError = ""
+		if err = instance.move(OutboxProcessing, OutboxSent, item); nil == err {
+			instance.events.Emit(EventOutboxSent, item)
+		}
+		return 0
+	}
+
+	item.LastError = err.Error()
+	if item.Attempts >= instance.MaxAttempts {
+		if err = instance.move(OutboxProcessing, OutboxFailed, item); nil == err {
+			instance.events.Emit(EventOutboxFailed, item)
+		}
+		return 0
+	}
+	delay := instance.backoff(item.Attempts)
+	item.NextAttempt = time.Now().Add(delay)
+	if err = instance.move(OutboxProcessing, OutboxQueue, item); nil == err {
+		instance.events.Emit(EventOutboxRetry, item)
+	}
+	return delay
+}
+
+// backoff doubles RetryDelay at each attempt up to RetryMax
+func (instance *Outbox) backoff(attempts int) time.Duration {
+	delay := instance.RetryDelay
+	for i := 1; i < attempts && delay < instance.RetryMax; i++ {
+		delay *= 2
+	}
+	if delay > instance.RetryMax {
+		delay = instance.RetryMax
+	}
+	return delay
+}
+
+func (instance *Outbox) notify() {
+	select {
+	case instance.wake <- true:
+	default:
+	}
+}
+
+func (instance *Outbox) filename(folder, id string) string {
+	return filepath.Join(instance.dir, folder, id+outboxExt)
+}
+
+func (instance *Outbox) read(folder, id string) (*OutboxItem, error) {
+	data, err := ioutil.ReadFile(instance.filename(folder, id))
+	if nil != err {
+		return nil, err
+	}
+	var item OutboxItem
+	if err = qb_utils.JSON.Read(data, &item); nil != err {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// write saves an item into a temporary file and renames it, readers never see a partial item
+func (instance *Outbox) write(folder string, item *OutboxItem) error {
+	filename := instance.filename(folder, item.Id)
+	tmp := filepath.Join(instance.dir, folder, "."+item.Id+".tmp")
+	if err := ioutil.WriteFile(tmp, qb_utils.JSON.Bytes(item), 0600); nil != err {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (instance *Outbox) move(from, to string, item *OutboxItem) error {
+	if err := instance.write(to, item); nil != err {
+		return err
+	}
+	return os.Remove(instance.filename(from, item.Id))
+}
+
+func isOutboxFolder(folder string) bool {
+	return folder == OutboxQueue || folder == OutboxProcessing || folder == OutboxSent || folder == OutboxFailed
+}
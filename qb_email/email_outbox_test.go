@@ -0,0 +1,264 @@
+package qb_email
+
+import (
+	"bufio"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+)
+
+func TestOutbox(t *testing.T) {
+	var rejected int32 = 2 // first connections are refused with a temporary error
+	var delivered int32
+	addr := fakeSmtp(t, func() bool {
+		return atomic.AddInt32(&rejected, -1) < 0
+	}, func(data string) {
+		if strings.Contains(data, "Subject:") {
+			atomic.AddInt32(&delivered, 1)
+		}
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	sender, _ := Email.NewSender(`{"host":"` + host + `","port":` + port + `}`)
+
+	outbox, err := Email.NewOutbox(t.TempDir(), sender)
+	if nil != err {
+		t.Fatal(err)
+	}
+	outbox.RetryDelay = 20 * time.Millisecond
+	sent := make(chan *OutboxItem, 1)
+	var retries int32
+	outbox.OnSent(func(e *qb_events.Event) { sent <- e.Argument(0).(*OutboxItem) })
+	outbox.OnRetry(func(e *qb_events.Event) { atomic.AddInt32(&retries, 1) })
+
+	m := Email.NewMessage("outbox", "hello")
+	m.From = &mail.Address{Address: "me@example.com"}
+	m.AddTo(mail.Address{Address: "you@example.com"})
+	id, err := outbox.Enqueue(m)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if items, _ := outbox.Items(OutboxQueue); len(items) != 1 || items[0].Id != id {
+		t.Fatal("expected a queued item", items)
+	}
+
+	outbox.Start()
+	select {
+	case item := <-sent:
+		if item.Id != id || item.Attempts != 3 || item.SentAt.IsZero() {
+			t.Fatal("unexpected item", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	if atomic.LoadInt32(&delivered) != 1 || atomic.LoadInt32(&retries) != 2 {
+		t.Fatal("delivered", delivered, "retries", retries)
+	}
+	if items, _ := outbox.Items(OutboxQueue); len(items) != 0 {
+		t.Fatal("queue not empty", items)
+	}
+	if items, _ := outbox.Items(OutboxSent); len(items) != 1 || items[0].Message.Subject != "outbox" {
+		t.Fatal("message not in sent folder", items)
+	}
+	outbox.Stop()
+	if outbox.IsRunning() {
+		t.Fatal("worker still running")
+	}
+}
+
+func TestOutbox_failed(t *testing.T) {
+	// nobody listening
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+	sender, _ := Email.NewSender(`{"host":"` + host + `","port":` + port + `}`)
+
+	dir := t.TempDir()
+	outbox, _ := Email.NewOutbox(dir, sender)
+	outbox.RetryDelay = 10 * time.Millisecond
+	outbox.MaxAttempts = 2
+	failed := make(chan *OutboxItem, 1)
+	outbox.OnFailed(func(e *qb_events.Event) { failed <- e.Argument(0).(*OutboxItem) })
+
+	m := Email.NewMessage("lost", "hello")
+	m.From = &mail.Address{Address: "me@example.com"}
+	m.AddTo(mail.Address{Address: "you@example.com"})
+	id, _ := outbox.Enqueue(m)
+	outbox.Start()
+	select {
+	case item := <-failed:
+		if item.Id != id || item.Attempts != 2 || len(item.LastError) == 0 {
+			t.Fatal("unexpected item", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not failed")
+	}
+	outbox.Stop()
+
+	// a new outbox on the same spool can retry failed messages
+	outbox, _ = Email.NewOutbox(dir, sender)
+	if err := outbox.Retry(id); nil != err {
+		t.Fatal(err)
+	}
+	if items, _ := outbox.Items(OutboxQueue); len(items) != 1 || items[0].Attempts != 0 {
+		t.Fatal("expected item in queue", items)
+	}
+	if err := outbox.Retry(id); err != ErrorOutboxItemNotFound {
+		t.Fatal("expected not found", err)
+	}
+}
+
+func TestOutbox_sharedSpool(t *testing.T) {
+	var delivered int32
+	addr := fakeSmtp(t, func() bool { return true }, func(data string) {
+		if strings.Contains(data, "Subject:") {
+			atomic.AddInt32(&delivered, 1)
+		}
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	sender, _ := Email.NewSender(`{"host":"` + host + `","port":` + port + `}`)
+
+	// two processes on the same spool: each message is delivered once
+	dir := t.TempDir()
+	first, _ := Email.NewOutbox(dir, sender)
+	second, _ := Email.NewOutbox(dir, sender)
+	var sent int32
+	for _, outbox := range []*Outbox{first, second} {
+		outbox.OnSent(func(e *qb_events.Event) { atomic.AddInt32(&sent, 1) })
+	}
+	m := Email.NewMessage("shared", "hello")
+	m.From = &mail.Address{Address: "me@example.com"}
+	m.AddTo(mail.Address{Address: "you@example.com"})
+	for i := 0; i < 10; i++ {
+		_, _ = first.Enqueue(m)
+	}
+	// a message claimed by a crashed process
+	id, _ := second.Enqueue(m)
+	claimed := filepath.Join(dir, OutboxProcessing, id+outboxExt)
+	_ = os.Rename(filepath.Join(dir, OutboxQueue, id+outboxExt), claimed)
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(claimed, old, old)
+
+	first.Start()
+	second.Start()
+	defer first.Stop()
+	defer second.Stop()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&sent) < 11 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&delivered); n != 11 {
+		t.Fatal("expected 11 messages, delivered", n)
+	}
+	if items, _ := first.Items(OutboxSent); len(items) != 11 {
+		t.Fatal("expected 11 messages in sent folder", len(items))
+	}
+}
+
+func TestOutbox_slowDelivery(t *testing.T) {
+	var delivered int32
+	addr := fakeSmtp(t, func() bool {
+		time.Sleep(600 * time.Millisecond) // longer than ClaimTimeout
+		return true
+	}, func(data string) {
+		if strings.Contains(data, "Subject:") {
+			atomic.AddInt32(&delivered, 1)
+		}
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	sender, _ := Email.NewSender(`{"host":"` + host + `","port":` + port + `}`)
+
+	dir := t.TempDir()
+	first, _ := Email.NewOutbox(dir, sender)
+	second, _ := Email.NewOutbox(dir, sender)
+	sent := make(chan bool, 2)
+	for _, outbox := range []*Outbox{first, second} {
+		outbox.ClaimTimeout = 150 * time.Millisecond
+		outbox.PollInterval = 20 * time.Millisecond
+		outbox.OnSent(func(e *qb_events.Event) { sent <- true })
+	}
+	m := Email.NewMessage("slow", "hello")
+	m.From = &mail.Address{Address: "me@example.com"}
+	m.AddTo(mail.Address{Address: "you@example.com"})
+	_, _ = first.Enqueue(m)
+
+	first.Start()
+	second.Start()
+	defer first.Stop()
+	defer second.Stop()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(&delivered); n != 1 {
+		t.Fatal("expected 1 message, delivered", n)
+	}
+}
+
+// fakeSmtp accepts messages and any credentials. accept decides if a connection is served or refused (421).
+func fakeSmtp(t *testing.T, accept func() bool, onData func(data string)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				c := &fakeConn{conn: conn, reader: bufio.NewReader(conn)}
+				if !accept() {
+					c.send("421 service not available")
+					return
+				}
+				c.send("220 fake SMTP")
+				for {
+					line, err := c.reader.ReadString('\n')
+					if nil != err {
+						return
+					}
+					switch strings.ToUpper(strings.Fields(line + " x")[0]) {
+					case "EHLO", "HELO":
+						c.send("250-fake")
+						c.send("250 AUTH PLAIN")
+					case "AUTH":
+						c.send("235 authenticated")
+					case "DATA":
+						c.send("354 go ahead")
+						var data strings.Builder
+						for {
+							line, err = c.reader.ReadString('\n')
+							if nil != err {
+								return
+							}
+							if line == ".\r\n" {
+								break
+							}
+							data.WriteString(line)
+						}
+						onData(data.String())
+						c.send("250 queued")
+					case "QUIT":
+						c.send("221 bye")
+						return
+					default:
+						c.send("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
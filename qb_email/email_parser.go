@@ -0,0 +1,259 @@
+package qb_email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rskvp/qb-core/qb_coding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+var (
+	ErrorMissingBoundary = errors.New("missing_multipart_boundary")
+)
+
+// headers mapped to Message fields or rebuilt by GetBytes
+var parserSkipHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Subject": true,
+	"Date": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true, "Content-Disposition": true,
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ParseMessage reads an RFC 5322 message (i.e. an .eml file).
+// Text parts are converted to UTF-8. In multipart/alternative the HTML part is the Body, the plain text part is
+// TextBody and the text/calendar part is Calendar. Parts with a file name (or inline parts of multipart/related)
+// become attachments, keyed by file name or Content-ID ("name (2).ext" if the name is already used).
+func ParseMessage(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if nil != err {
+		return nil, err
+	}
+	m := newMessage(decodeHeader(msg.Header.Get("Subject")), "", "text/plain")
+
+	parser := &mail.AddressParser{WordDecoder: headerDecoder}
+	if from := msg.Header.Get("From"); len(from) > 0 {
+		if address, err := parser.Parse(from); nil == err {
+			m.From = address
+		} else {
+			m.From = &mail.Address{Address: strings.TrimSpace(from)}
+		}
+	}
+	m.To = parseAddressList(parser, msg.Header.Get("To"))
+	m.Cc = parseAddressList(parser, msg.Header.Get("Cc"))
+	m.Bcc = parseAddressList(parser, msg.Header.Get("Bcc"))
+	m.ReplyTo = msg.Header.Get("Reply-To")
+
+	keys := make([]string, 0, len(msg.Header))
+	for key := range msg.Header {
+		if !parserSkipHeaders[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range msg.Header[key] {
+			m.AddHeader(key, value)
+		}
+	}
+
+	err = parsePart(m, textproto.MIMEHeader(msg.Header), msg.Body, false)
+	if nil != err {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ParseMessage reads an RFC 5322 message (i.e. an .eml file)
+func (instance *EmailHelper) ParseMessage(r io.Reader) (*Message, error) {
+	return ParseMessage(r)
+}
+
+// ParseMessageFile reads an .eml file
+func (instance *EmailHelper) ParseMessageFile(filename string) (*Message, error) {
+	data, err := ioutil.ReadFile(filename)
+	if nil != err {
+		return nil, err
+	}
+	return ParseMessage(bytes.NewReader(data))
+}
+
+// Parse decodes the message read from a mailbox
+func (m *MailboxMessage) Parse() (*Message, error) {
+	return ParseMessage(bytes.NewReader(m.Raw))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+// parsePart walks the MIME tree. related is true for children of multipart/related.
+func parsePart(m *Message, header textproto.MIMEHeader, body io.Reader, related bool) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if nil != err {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary := params["boundary"]
+		if len(boundary) == 0 {
+			return ErrorMissingBoundary
+		}
+		reader := multipart.NewReader(body, boundary)
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if nil != err {
+				return err
+			}
+			err = parsePart(m, part.Header, part, mediaType == "multipart/related")
+			if nil != err {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if nil != err {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if len(filename) == 0 {
+		filename = params["name"]
+	}
+	filename = decodeHeader(filename)
+	contentId := strings.Trim(header.Get("Content-Id"), "<> ")
+
+	// body and alternatives
+	if disposition != "attachment" && len(filename) == 0 && len(contentId) == 0 {
+		text := strings.TrimRight(string(decodeCharset(params["charset"], data)), "\r\n")
+		switch {
+		case mediaType == "text/html" && m.BodyContentType != "text/html":
+			if len(m.Body) > 0 && len(m.TextBody) == 0 {
+				m.TextBody = m.Body
+			}
+			m.Body, m.BodyContentType = text, mediaType
+			return nil
+		case mediaType == "text/plain" && len(m.Body) == 0:
+			m.Body, m.BodyContentType = text, mediaType
+			return nil
+		case mediaType == "text/plain" && m.BodyContentType == "text/html" && len(m.TextBody) == 0:
+			m.TextBody = text
+			return nil
+		case mediaType == "text/calendar" && len(m.Calendar) == 0:
+			m.Calendar, m.CalendarMethod = string(data), strings.ToUpper(params["method"])
+			return nil
+		}
+	}
+
+	// attachment
+	if len(filename) == 0 {
+		filename = contentId
+	}
+	if len(filename) == 0 {
+		ext := ""
+		if list, _ := mime.ExtensionsByType(mediaType); len(list) > 0 {
+			ext = list[0]
+		}
+		filename = fmt.Sprintf("part%d%s", len(m.Attachments)+1, ext)
+	}
+	m.Attachments[attachmentKey(m.Attachments, filename)] = &Attachment{
+		Filename:    filename,
+		Data:        data,
+		Inline:      disposition == "inline" || (related && disposition != "attachment"),
+		ContentType: mediaType,
+		ContentId:   contentId,
+	}
+	return nil
+}
+
+// attachmentKey returns filename or, if already used, a unique name like "name (2).ext"
+func attachmentKey(attachments map[string]*Attachment, filename string) string {
+	if _, exists := attachments[filename]; !exists {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	for i := 2; ; i++ {
+		key := fmt.Sprintf("%s (%d)%s", name, i, ext)
+		if _, exists := attachments[key]; !exists {
+			return key
+		}
+	}
+}
+
+func parseAddressList(parser *mail.AddressParser, value string) []string {
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil
+	}
+	list, err := parser.ParseList(value)
+	if nil != err {
+		return []string{value}
+	}
+	response := make([]string, 0, len(list))
+	for _, address := range list {
+		response = append(response, address.String())
+	}
+	return response
+}
+
+// decodeTransfer decodes base64 and quoted-printable tolerating malformed content
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.RawStdEncoding, qb_coding.NewBase64Cleaner(r))
+	case "quoted-printable":
+		return quotedprintable.NewReader(qb_coding.NewQPCleaner(r))
+	}
+	return r
+}
+
+// decodeCharset converts text to UTF-8. Unknown charsets are returned as they are.
+func decodeCharset(charset string, data []byte) []byte {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if len(charset) == 0 || charset == "utf-8" || charset == "us-ascii" {
+		return data
+	}
+	encoding, err := htmlindex.Get(charset)
+	if nil != err {
+		return data
+	}
+	decoded, err := encoding.NewDecoder().Bytes(data)
+	if nil != err {
+		return data
+	}
+	return decoded
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if nil != err {
+		return nil, err
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
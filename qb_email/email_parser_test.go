@@ -0,0 +1,124 @@
+package qb_email
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const testMultipartMessage = "From: =?iso-8859-1?q?Andr=E9?= <andre@example.com>\r\n" +
+	"To: bob@example.com, \"Carl\" <carl@example.com>\r\n" +
+	"Subject: =?iso-8859-1?q?R=E9sum=E9?= and =?utf-8?b?8J+Ygg==?=\r\n" +
+	"Message-Id: <1@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/related; boundary=rel\r\n" +
+	"\r\n" +
+	"--rel\r\n" +
+	"Content-Type: multipart/alternative; boundary=alt\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=E9 plain\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html; charset=windows-1252\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+Q2Fm6SA8aW1nIHNyYz0iY2lkOmxvZ28iPjwvcD4=\r\n" +
+	"--alt--\r\n" +
+	"--rel\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Id: <logo>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0K\r\n" +
+	"--rel--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0=\r\n" +
+	"--outer--\r\n"
+
+func TestParseMessage(t *testing.T) {
+	m, err := ParseMessage(strings.NewReader(testMultipartMessage))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if m.Subject != "Résumé and 😂" {
+		t.Fatal("subject", m.Subject)
+	}
+	if m.From.Name != "André" || m.From.Address != "andre@example.com" || len(m.To) != 2 {
+		t.Fatal("addresses", m.From, m.To)
+	}
+	if m.BodyContentType != "text/html" || m.Body != `<p>Café <img src="cid:logo"></p>` {
+		t.Fatal("body", m.BodyContentType, m.Body)
+	}
+	if len(m.Headers) != 1 || m.Headers[0].Key != "Message-Id" {
+		t.Fatal("headers", m.Headers)
+	}
+	logo := m.Attachments["logo"]
+	if nil == logo || !logo.Inline || logo.ContentId != "logo" || logo.ContentType != "image/png" || !bytes.HasPrefix(logo.Data, []byte("\x89PNG")) {
+		t.Fatal("inline attachment", logo)
+	}
+	pdf := m.Attachments["résumé.pdf"]
+	if nil == pdf || pdf.Inline || string(pdf.Data) != "%PDF-" {
+		t.Fatal("attachment", pdf, len(m.Attachments))
+	}
+}
+
+func TestParseMessage_roundTrip(t *testing.T) {
+	m := Email.NewMessage("Città", "Ciao, àèìòù")
+	m.From = &mail.Address{Name: "Gian", Address: "gian@example.com"}
+	m.AddTo(mail.Address{Address: "bob@example.com"})
+	_ = m.AddAttachmentBinary("dati.bin", []byte{0, 1, 2, 250}, false)
+
+	parsed, err := ParseMessage(bytes.NewReader(m.GetBytes()))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if parsed.Subject != m.Subject || parsed.Body != m.Body || parsed.From.Address != m.From.Address {
+		t.Fatal("round trip", parsed.Subject, parsed.Body, parsed.From)
+	}
+	if a := parsed.Attachments["dati.bin"]; nil == a || !bytes.Equal(a.Data, []byte{0, 1, 2, 250}) {
+		t.Fatal("attachment", parsed.Attachments)
+	}
+}
+
+func TestParseMessage_duplicateFilenames(t *testing.T) {
+	part := func(filename, data string) string {
+		return "--mixed\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Content-Disposition: attachment; filename=\"" + filename + "\"\r\n" +
+			"\r\n" +
+			data + "\r\n"
+	}
+	message := "From: andre@example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=mixed\r\n" +
+		"\r\n" +
+		part("notes.txt", "first") +
+		part("notes.txt", "second") +
+		part("notes (2).txt", "third") +
+		part("notes.txt", "fourth") +
+		"--mixed--\r\n"
+	m, err := ParseMessage(strings.NewReader(message))
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"notes.txt": "first", "notes (2).txt": "second", "notes (2) (2).txt": "third", "notes (3).txt": "fourth"}
+	if len(m.Attachments) != len(expected) {
+		t.Fatal("attachments", len(m.Attachments))
+	}
+	for key, data := range expected {
+		if a := m.Attachments[key]; nil == a || string(a.Data) != data {
+			t.Errorf("%s: expected %q, got %v", key, data, a)
+		}
+	}
+}
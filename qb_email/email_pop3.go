@@ -0,0 +1,299 @@
+package qb_email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	Pop3Port    = 110
+	Pop3TLSPort = 995
+)
+
+var (
+	ErrorPop3Protocol = errors.New("pop3_protocol_error")
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Pop3Client reads and deletes messages of a POP3 server. Deleted messages are removed on Close.
+type Pop3Client struct {
+	config *MailboxSettings
+
+	//-- private --//
+	conn   net.Conn
+	reader *bufio.Reader
+	mux    sync.Mutex
+}
+
+// Pop3Info is an item of List and Uidl
+type Pop3Info struct {
+	Number int
+	Size   int64
+	Id     string
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewPop3Client returns a client. Settings are *MailboxSettings, MailboxSettings, JSON text or a JSON file.
+func (instance *EmailHelper) NewPop3Client(settings interface{}) (*Pop3Client, error) {
+	config, err := configureMailbox(settings)
+	if nil != err {
+		return nil, err
+	}
+	return &Pop3Client{config: config}, nil
+}
+
+// Open connects and logs in
+func (instance *Pop3Client) Open() error {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		conn, err := dialMailbox(instance.config, Pop3Port, Pop3TLSPort)
+		if nil != err {
+			return err
+		}
+		instance.setConn(conn)
+		if _, err = instance.response(); nil != err {
+			_ = conn.Close()
+			return err
+		}
+		if instance.config.Security == SecuritySTARTTLS {
+			if _, err = instance.cmd("STLS"); nil != err {
+				_ = conn.Close()
+				return ErrorStartTLSNotAllowed
+			}
+			tlsConn := tls.Client(conn, instance.config.tlsConfig())
+			if err = tlsConn.Handshake(); nil != err {
+				_ = conn.Close()
+				return err
+			}
+			instance.setConn(tlsConn)
+		}
+		if len(instance.config.User) > 0 {
+			if _, err = instance.cmd("USER %s", instance.config.User); nil == err {
+				_, err = instance.cmd("PASS %s", instance.config.Pass)
+			}
+			if nil != err {
+				_ = instance.conn.Close()
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// Close sends QUIT (messages marked with Dele are removed) and closes the connection
+func (instance *Pop3Client) Close() error {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		if nil != instance.conn {
+			_, err := instance.cmd("QUIT")
+			_ = instance.conn.Close()
+			instance.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat returns number of messages and total size
+func (instance *Pop3Client) Stat() (count int, size int64, err error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		var line string
+		line, err = instance.cmd("STAT")
+		if nil != err {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			err = ErrorPop3Protocol
+			return
+		}
+		count, _ = strconv.Atoi(fields[0])
+		size, _ = strconv.ParseInt(fields[1], 10, 64)
+	}
+	return
+}
+
+// List returns number and size of messages
+func (instance *Pop3Client) List() ([]*Pop3Info, error) {
+	return instance.list("LIST", func(info *Pop3Info, value string) {
+		info.Size, _ = strconv.ParseInt(value, 10, 64)
+	})
+}
+
+// Uidl returns number and unique id of messages
+func (instance *Pop3Client) Uidl() ([]*Pop3Info, error) {
+	return instance.list("UIDL", func(info *Pop3Info, value string) {
+		info.Id = value
+	})
+}
+
+// Retr returns a message
+func (instance *Pop3Client) Retr(number int) (*MailboxMessage, error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		if _, err := instance.cmd("RETR %d", number); nil != err {
+			return nil, err
+		}
+		data, err := instance.readMultiline()
+		if nil != err {
+			return nil, err
+		}
+		message := newMailboxMessage(data)
+		message.Number = number
+		return message, nil
+	}
+	return nil, nil
+}
+
+// Top returns the header and first lines of the body of a message
+func (instance *Pop3Client) Top(number int, lines int) (*MailboxMessage, error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		if _, err := instance.cmd("TOP %d %d", number, lines); nil != err {
+			return nil, err
+		}
+		data, err := instance.readMultiline()
+		if nil != err {
+			return nil, err
+		}
+		message := newMailboxMessage(data)
+		message.Number = number
+		return message, nil
+	}
+	return nil, nil
+}
+
+// Dele marks a message as deleted. Message is removed on Close.
+func (instance *Pop3Client) Dele(number int) error {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		_, err := instance.cmd("DELE %d", number)
+		return err
+	}
+	return nil
+}
+
+// Rset unmarks deleted messages
+func (instance *Pop3Client) Rset() error {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		_, err := instance.cmd("RSET")
+		return err
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (instance *Pop3Client) setConn(conn net.Conn) {
+	instance.conn = conn
+	instance.reader = bufio.NewReader(conn)
+}
+
+func (instance *Pop3Client) list(command string, set func(info *Pop3Info, value string)) ([]*Pop3Info, error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		if _, err := instance.cmd(command); nil != err {
+			return nil, err
+		}
+		data, err := instance.readMultiline()
+		if nil != err {
+			return nil, err
+		}
+		items := make([]*Pop3Info, 0)
+		for _, line := range strings.Split(string(data), "\r\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			info := new(Pop3Info)
+			info.Number, _ = strconv.Atoi(fields[0])
+			set(info, fields[1])
+			items = append(items, info)
+		}
+		return items, nil
+	}
+	return nil, nil
+}
+
+// cmd sends a command and returns the text of the +OK response
+func (instance *Pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	if nil == instance.conn {
+		return "", ErrorNotConnected
+	}
+	command := fmt.Sprintf(format, args...)
+	if strings.ContainsAny(command, "\r\n") {
+		return "", ErrorInvalidArgument // would inject a command
+	}
+	_ = instance.conn.SetDeadline(time.Now().Add(instance.config.timeout()))
+	if _, err := fmt.Fprint(instance.conn, command+"\r\n"); nil != err {
+		return "", err
+	}
+	return instance.response()
+}
+
+func (instance *Pop3Client) response() (string, error) {
+	line, err := readLine(instance.reader)
+	if nil != err {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	if strings.HasPrefix(line, "-ERR") {
+		return "", errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	return "", ErrorPop3Protocol
+}
+
+// readMultiline reads up to the terminating "." line and removes dot-stuffing
+func (instance *Pop3Client) readMultiline() ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := readLine(instance.reader)
+		if nil != err {
+			return nil, err
+		}
+		if line == "." {
+			return buf.Bytes(), nil
+		}
+		line = strings.TrimPrefix(line, ".")
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+}
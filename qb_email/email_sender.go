@@ -116,10 +116,10 @@ func (instance *SmtpSender) SendMessage(message *Message) (err error) {
 			ServerName:         host,
 		}
 		// try with custom TLS
-		err = Email.SendSecure(servername, auth, tlsconfig, message)
+		err = Email.sendSecure(servername, auth, tlsconfig, message, instance.config.Dkim)
 		if nil != err {
 			// try using SendMail
-			err2 := Email.Send(servername, auth, message)
+			err2 := Email.send(servername, auth, message, instance.config.Dkim)
 			if nil != err2 {
 				err = qb_utils.Errors.Prefix(err2, fmt.Sprintf("Concatenated errors. 1-> %s; 2-> ", err))
 			} else {
@@ -127,7 +127,7 @@ func (instance *SmtpSender) SendMessage(message *Message) (err error) {
 			}
 		}
 	} else {
-		err = Email.Send(servername, auth, message)
+		err = Email.send(servername, auth, message, instance.config.Dkim)
 	}
 	return err
 }
@@ -0,0 +1,664 @@
+package qb_email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	EventSmtpMessage = "smtp_message"
+)
+
+var (
+	ErrorServerNotStarted = errors.New("server_not_started")
+	ErrorAwaitTimeout     = errors.New("await_timeout")
+	ErrorMessageTooBig    = errors.New("message_too_big")
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SmtpServer is a small SMTP server to test senders or to use as a debugging sink in local development.
+// It supports EHLO, PIPELINING, AUTH PLAIN/LOGIN, STARTTLS and implicit TLS with a generated certificate.
+// Received messages are kept in memory and optionally written in a maildir.
+type SmtpServer struct {
+	Domain         string            // name in greeting and EHLO response (default "localhost")
+	Users          map[string]string // (optional) user/password accepted by AUTH. Any credential is accepted if empty
+	AuthRequired   bool              // refuse MAIL without AUTH
+	StartTLS       bool              // offer STARTTLS. Clients must trust Certificate() (net/smtp verifies it)
+	ImplicitTLS    bool              // TLS from the beginning, as SendSecure expects
+	TLSConfig      *tls.Config       // (optional) server certificate. A self-signed certificate is generated if nil
+	MaildirPath    string            // (optional) write messages in maildir format ("new" folder)
+	MaxMessageSize int               // (optional) max size of message in bytes. The session is closed when DATA exceeds it
+	Timeout        time.Duration     // idle timeout of a session (default 1 minute)
+
+	//-- private --//
+	address     string
+	listener    net.Listener
+	certificate *x509.Certificate
+	events      *qb_events.Emitter
+	messages    []*SmtpReceived
+	changed     chan bool // closed and replaced when a message arrives
+	sessions    map[net.Conn]bool
+	counter     uint64
+	wg          sync.WaitGroup
+	mux         sync.Mutex
+}
+
+// SmtpReceived is a message received by SmtpServer. It is the argument of smtp_message event.
+type SmtpReceived struct {
+	Id         string
+	From       string
+	To         []string
+	Data       []byte
+	User       string // authenticated user
+	TLS        bool
+	Helo       string
+	ReceivedAt time.Time
+	Filename   string // maildir file
+}
+
+type smtpSession struct {
+	server *SmtpServer
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	tls    bool
+	helo   string
+	user   string
+	from   string
+	to     []string
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewSmtpServer returns a server listening on address (i.e. "127.0.0.1:2525", port 0 is a random port)
+func (instance *EmailHelper) NewSmtpServer(address string) *SmtpServer {
+	server := new(SmtpServer)
+	server.address = address
+	server.Domain = "localhost"
+	server.Timeout = time.Minute
+	server.sessions = make(map[net.Conn]bool)
+	server.events = qb_events.Events.NewEmitter()
+	server.messages = make([]*SmtpReceived, 0)
+	server.changed = make(chan bool)
+	return server
+}
+
+// Start listens and serves connections in background
+func (instance *SmtpServer) Start() error {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		if nil == instance.TLSConfig {
+			config, certificate, err := generateTLSConfig(instance.Domain)
+			if nil != err {
+				return err
+			}
+			instance.TLSConfig, instance.certificate = config, certificate
+		} else if len(instance.TLSConfig.Certificates) > 0 {
+			instance.certificate, _ = x509.ParseCertificate(instance.TLSConfig.Certificates[0].Certificate[0])
+		}
+		if len(instance.MaildirPath) > 0 {
+			for _, dir := range []string{"tmp", "new", "cur"} {
+				if err := os.MkdirAll(filepath.Join(instance.MaildirPath, dir), 0700); nil != err {
+					return err
+				}
+			}
+		}
+
+		var err error
+		if instance.ImplicitTLS {
+			instance.listener, err = tls.Listen("tcp", instance.address, instance.TLSConfig)
+		} else {
+			instance.listener, err = net.Listen("tcp", instance.address)
+		}
+		if nil != err {
+			return err
+		}
+		instance.wg.Add(1)
+		go instance.serve(instance.listener)
+	}
+	return nil
+}
+
+// Stop closes the listener and open sessions
+func (instance *SmtpServer) Stop() error {
+	if nil != instance {
+		instance.mux.Lock()
+		listener := instance.listener
+		instance.listener = nil
+		for conn := range instance.sessions {
+			_ = conn.Close()
+		}
+		instance.mux.Unlock()
+		if nil == listener {
+			return ErrorServerNotStarted
+		}
+		err := listener.Close()
+		instance.wg.Wait()
+		return err
+	}
+	return nil
+}
+
+// Addr returns the listening address (i.e. "127.0.0.1:49152")
+func (instance *SmtpServer) Addr() string {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		if nil != instance.listener {
+			return instance.listener.Addr().String()
+		}
+	}
+	return ""
+}
+
+// Settings returns sender settings to deliver to this server
+func (instance *SmtpServer) Settings(user, pass string) *SmtpSettings {
+	host, port, _ := net.SplitHostPort(instance.Addr())
+	settings := &SmtpSettings{Host: host, Secure: instance.ImplicitTLS}
+	settings.Port, _ = strconv.Atoi(port)
+	settings.Auth = &SmtpSettingsAuth{User: user, Pass: pass}
+	return settings
+}
+
+// Certificate returns the server certificate (generated on Start if TLSConfig is nil)
+func (instance *SmtpServer) Certificate() *x509.Certificate {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		return instance.certificate
+	}
+	return nil
+}
+
+// ClientTLSConfig returns a client TLS configuration trusting the server certificate
+func (instance *SmtpServer) ClientTLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	if certificate := instance.Certificate(); nil != certificate {
+		pool.AddCert(certificate)
+	}
+	return &tls.Config{RootCAs: pool, ServerName: instance.Domain}
+}
+
+// Messages returns received messages
+func (instance *SmtpServer) Messages() []*SmtpReceived {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		return append([]*SmtpReceived{}, instance.messages...)
+	}
+	return nil
+}
+
+// Clear removes received messages from memory (maildir files are not removed)
+func (instance *SmtpServer) Clear() {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		instance.messages = make([]*SmtpReceived, 0)
+	}
+}
+
+// Await waits until count messages are received and returns them
+func (instance *SmtpServer) Await(count int, timeout time.Duration) ([]*SmtpReceived, error) {
+	messages, err := instance.await(timeout, func(messages []*SmtpReceived) bool {
+		return len(messages) >= count
+	})
+	return messages, err
+}
+
+// AwaitMessage waits a message matching filter (i.e. a recipient) and returns it
+func (instance *SmtpServer) AwaitMessage(filter func(m *SmtpReceived) bool, timeout time.Duration) (*SmtpReceived, error) {
+	var found *SmtpReceived
+	_, err := instance.await(timeout, func(messages []*SmtpReceived) bool {
+		for _, m := range messages {
+			if filter(m) {
+				found = m
+				return true
+			}
+		}
+		return false
+	})
+	return found, err
+}
+
+// OnMessage is notified when a message is received. Argument is *SmtpReceived
+func (instance *SmtpServer) OnMessage(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventSmtpMessage, callback)
+	}
+}
+
+// Parse decodes the received message
+func (m *SmtpReceived) Parse() (*Message, error) {
+	return ParseMessage(bytes.NewReader(m.Data))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (instance *SmtpServer) serve(listener net.Listener) {
+	defer instance.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if nil != err {
+			return
+		}
+		instance.mux.Lock()
+		instance.sessions[conn] = true
+		instance.mux.Unlock()
+		instance.wg.Add(1)
+		go func() {
+			defer instance.wg.Done()
+			session := &smtpSession{server: instance}
+			_, session.tls = conn.(*tls.Conn)
+			session.setConn(conn)
+			session.serve()
+			_ = conn.Close()
+			instance.mux.Lock()
+			delete(instance.sessions, conn)
+			instance.mux.Unlock()
+		}()
+	}
+}
+
+func (instance *SmtpServer) await(timeout time.Duration, done func(messages []*SmtpReceived) bool) ([]*SmtpReceived, error) {
+	deadline := time.After(timeout)
+	for {
+		instance.mux.Lock()
+		messages := append([]*SmtpReceived{}, instance.messages...)
+		changed := instance.changed
+		instance.mux.Unlock()
+		if done(messages) {
+			return messages, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return messages, ErrorAwaitTimeout
+		}
+	}
+}
+
+func (instance *SmtpServer) store(m *SmtpReceived) error {
+	m.Id = fmt.Sprintf("%d.%d", time.Now().UnixNano(), atomic.AddUint64(&instance.counter, 1))
+	if len(instance.MaildirPath) > 0 {
+		name := fmt.Sprintf("%s.%d.%s", m.Id, os.Getpid(), instance.Domain)
+		tmp := filepath.Join(instance.MaildirPath, "tmp", name)
+		if err := ioutil.WriteFile(tmp, m.Data, 0600); nil != err {
+			return err
+		}
+		m.Filename = filepath.Join(instance.MaildirPath, "new", name)
+		if err := os.Rename(tmp, m.Filename); nil != err {
+			return err
+		}
+	}
+
+	instance.mux.Lock()
+	instance.messages = append(instance.messages, m)
+	close(instance.changed)
+	instance.changed = make(chan bool)
+	instance.mux.Unlock()
+
+	instance.events.Emit(EventSmtpMessage, m)
+	return nil
+}
+
+func (instance *SmtpServer) authenticate(user, pass string) bool {
+	if len(instance.Users) == 0 {
+		return true
+	}
+	expected, ok := instance.Users[user]
+	return ok && expected == pass
+}
+
+func (instance *smtpSession) setConn(conn net.Conn) {
+	instance.conn = conn
+	instance.reader = bufio.NewReader(conn)
+	instance.writer = bufio.NewWriter(conn)
+}
+
+func (instance *smtpSession) serve() {
+	server := instance.server
+	instance.reply(220, server.Domain+" ESMTP ready")
+	for {
+		_ = instance.conn.SetDeadline(time.Now().Add(server.Timeout))
+		_ = instance.flush(false)
+		line, err := instance.readLine()
+		if nil != err {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i > 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			instance.helo = arg
+			instance.reset()
+			instance.reply(250, server.Domain)
+		case "EHLO":
+			instance.helo = arg
+			instance.reset()
+			extensions := []string{server.Domain, "PIPELINING", "8BITMIME"}
+			if server.MaxMessageSize > 0 {
+				extensions = append(extensions, fmt.Sprintf("SIZE %d", server.MaxMessageSize))
+			}
+			if server.StartTLS && !instance.tls {
+				extensions = append(extensions, "STARTTLS")
+			}
+			extensions = append(extensions, "AUTH PLAIN LOGIN")
+			instance.reply(250, extensions...)
+		case "STARTTLS":
+			if !server.StartTLS || instance.tls {
+				instance.reply(502, "5.5.1 STARTTLS not available")
+				continue
+			}
+			instance.reply(220, "2.0.0 Ready to start TLS")
+			if err = instance.flush(true); nil != err {
+				return
+			}
+			conn := tls.Server(instance.conn, server.TLSConfig)
+			if err = conn.Handshake(); nil != err {
+				return
+			}
+			instance.setConn(conn)
+			instance.tls = true
+			instance.helo = "" // client must send EHLO again
+			instance.user = ""
+			instance.reset()
+		case "AUTH":
+			instance.auth(arg)
+		case "MAIL":
+			if len(instance.helo) == 0 {
+				instance.reply(503, "5.5.1 EHLO first")
+			} else if server.AuthRequired && len(instance.user) == 0 {
+				instance.reply(530, "5.7.0 Authentication required")
+			} else if address, ok := parsePath(arg, "FROM:"); !ok {
+				instance.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+			} else if server.MaxMessageSize > 0 && declaredSize(arg) > server.MaxMessageSize {
+				instance.reply(552, "5.3.4 Message too big")
+			} else {
+				instance.reset()
+				instance.from = address
+				instance.reply(250, "2.1.0 Ok")
+			}
+		case "RCPT":
+			if len(instance.from) == 0 {
+				instance.reply(503, "5.5.1 MAIL first")
+			} else if address, ok := parsePath(arg, "TO:"); !ok || len(address) == 0 {
+				instance.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+			} else {
+				instance.to = append(instance.to, address)
+				instance.reply(250, "2.1.5 Ok")
+			}
+		case "DATA":
+			if len(instance.to) == 0 {
+				instance.reply(503, "5.5.1 RCPT first")
+				continue
+			}
+			instance.reply(354, "End data with <CR><LF>.<CR><LF>")
+			if err = instance.flush(true); nil != err {
+				return
+			}
+			if err = instance.data(); nil != err {
+				return
+			}
+		case "RSET":
+			instance.reset()
+			instance.reply(250, "2.0.0 Ok")
+		case "NOOP":
+			instance.reply(250, "2.0.0 Ok")
+		case "VRFY":
+			instance.reply(252, "2.5.0 Cannot VRFY user")
+		case "QUIT":
+			instance.reply(221, "2.0.0 Bye")
+			_ = instance.flush(true)
+			return
+		default:
+			instance.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+// data reads the message up to MaxMessageSize. A bigger message is refused and the session is closed
+// (the rest of the message is not read)
+func (instance *smtpSession) data() error {
+	server := instance.server
+	var buf bytes.Buffer
+	start := true // at the beginning of a line
+	for {
+		line, err := instance.reader.ReadSlice('\n')
+		if nil != err && err != bufio.ErrBufferFull {
+			return err
+		}
+		if start {
+			if s := string(line); s == ".\r\n" || s == ".\n" {
+				break
+			}
+			if len(line) > 0 && line[0] == '.' {
+				line = line[1:]
+			}
+		}
+		start = nil == err // a long line is read in more slices
+		if server.MaxMessageSize > 0 && buf.Len()+len(line) > server.MaxMessageSize {
+			instance.reply(552, "5.3.4 Message too big")
+			_ = instance.flush(true)
+			return ErrorMessageTooBig
+		}
+		buf.Write(line)
+	}
+	m := &SmtpReceived{
+		From:       instance.from,
+		To:         instance.to,
+		Data:       buf.Bytes(),
+		User:       instance.user,
+		TLS:        instance.tls,
+		Helo:       instance.helo,
+		ReceivedAt: time.Now(),
+	}
+	instance.reset()
+	if err := server.store(m); nil != err {
+		instance.reply(451, "4.3.0 "+err.Error())
+		return nil
+	}
+	instance.reply(250, "2.0.0 Ok: queued as "+m.Id)
+	return nil
+}
+
+func (instance *smtpSession) auth(arg string) {
+	if len(instance.user) > 0 {
+		instance.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+	tokens := strings.Fields(arg)
+	if len(tokens) == 0 {
+		instance.reply(501, "5.5.4 Syntax: AUTH mechanism")
+		return
+	}
+	var user, pass string
+	switch strings.ToUpper(tokens[0]) {
+	case "PLAIN":
+		response := ""
+		if len(tokens) > 1 {
+			response = tokens[1]
+		} else {
+			var ok bool
+			if response, ok = instance.challenge(""); !ok {
+				return
+			}
+		}
+		data, err := base64.StdEncoding.DecodeString(response)
+		fields := strings.Split(string(data), "\x00")
+		if nil != err || len(fields) != 3 {
+			instance.reply(501, "5.5.2 Cannot decode response")
+			return
+		}
+		user, pass = fields[1], fields[2]
+	case "LOGIN":
+		var ok bool
+		encoded := ""
+		if len(tokens) > 1 {
+			encoded = tokens[1]
+		} else if encoded, ok = instance.challenge("Username:"); !ok {
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if nil != err {
+			instance.reply(501, "5.5.2 Cannot decode response")
+			return
+		}
+		user = string(data)
+		if encoded, ok = instance.challenge("Password:"); !ok {
+			return
+		}
+		if data, err = base64.StdEncoding.DecodeString(encoded); nil != err {
+			instance.reply(501, "5.5.2 Cannot decode response")
+			return
+		}
+		pass = string(data)
+	default:
+		instance.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+	if !instance.server.authenticate(user, pass) {
+		instance.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	instance.user = user
+	instance.reply(235, "2.7.0 Authentication successful")
+}
+
+// challenge sends a 334 challenge and returns the response. Returns false if the client cancelled.
+func (instance *smtpSession) challenge(text string) (string, bool) {
+	instance.reply(334, base64.StdEncoding.EncodeToString([]byte(text)))
+	if nil != instance.flush(true) {
+		return "", false
+	}
+	line, err := instance.readLine()
+	if nil != err || line == "*" {
+		instance.reply(501, "5.7.0 Authentication cancelled")
+		return "", false
+	}
+	return line, true
+}
+
+func (instance *smtpSession) reset() {
+	instance.from = ""
+	instance.to = nil
+}
+
+func (instance *smtpSession) readLine() (string, error) {
+	line, err := instance.reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// reply writes a (multiline) response. Responses are buffered to support pipelining.
+func (instance *smtpSession) reply(code int, lines ...string) {
+	for i, line := range lines {
+		separator := " "
+		if i < len(lines)-1 {
+			separator = "-"
+		}
+		_, _ = fmt.Fprintf(instance.writer, "%d%s%s\r\n", code, separator, line)
+	}
+}
+
+// flush sends buffered responses. Without force, responses wait while pipelined commands are pending.
+func (instance *smtpSession) flush(force bool) error {
+	if force || instance.reader.Buffered() == 0 {
+		return instance.writer.Flush()
+	}
+	return nil
+}
+
+// declaredSize returns the SIZE parameter of "FROM:<address> SIZE=<n>" (0 if missing)
+func declaredSize(arg string) int {
+	for _, param := range strings.Fields(arg)[1:] {
+		if len(param) > 5 && strings.EqualFold(param[:5], "SIZE=") {
+			if size, err := strconv.Atoi(param[5:]); nil == err {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+// parsePath returns the address of "FROM:<address> [params]" or "TO:<address>"
+func parsePath(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	start, end := strings.Index(arg, "<"), strings.Index(arg, ">")
+	if start != 0 || end < start {
+		return "", false
+	}
+	return arg[start+1 : end], true
+}
+
+// generateTLSConfig creates a self-signed certificate for host, localhost and loopback addresses
+func generateTLSConfig(host string) (*tls.Config, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if nil != err {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host, "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if nil != err {
+		return nil, nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if nil != err {
+		return nil, nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: certificate}}}
+	return config, certificate, nil
+}
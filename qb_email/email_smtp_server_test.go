@@ -0,0 +1,209 @@
+package qb_email
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSmtpServer(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		server := Email.NewSmtpServer("127.0.0.1:0")
+		server.Users = map[string]string{"user": "secret"}
+		server.AuthRequired = true
+		server.ImplicitTLS = secure
+		server.Timeout = time.Second // sender falls back to plain SMTP when TLS fails
+		if err := server.Start(); nil != err {
+			t.Fatal(err)
+		}
+
+		sender, _ := Email.NewSender(server.Settings("user", "secret"))
+		m := Email.NewHTMLMessage("server test", "<p>hello</p>")
+		m.From = &mail.Address{Address: "me@example.com"}
+		m.AddTo(mail.Address{Address: "you@example.com"})
+		if err := sender.SendMessage(m); nil != err {
+			t.Fatal(secure, err)
+		}
+		messages, err := server.Await(1, 5*time.Second)
+		if nil != err {
+			t.Fatal(secure, err)
+		}
+		received := messages[0]
+		if received.From != "me@example.com" || received.To[0] != "you@example.com" ||
+			received.User != "user" || received.TLS != secure {
+			t.Fatal("unexpected envelope", received)
+		}
+		parsed, err := received.Parse()
+		if nil != err || parsed.Subject != "server test" || parsed.Body != "<p>hello</p>" {
+			t.Fatal("unexpected message", parsed, err)
+		}
+
+		bad, _ := Email.NewSender(server.Settings("user", "wrong"))
+		if err = bad.SendMessage(m); nil == err {
+			t.Fatal("expected authentication error")
+		}
+		_ = server.Stop()
+	}
+}
+
+func TestSmtpServer_startTLS(t *testing.T) {
+	server := Email.NewSmtpServer("127.0.0.1:0")
+	server.StartTLS = true
+	server.MaildirPath = t.TempDir()
+	if err := server.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := smtp.Dial(server.Addr())
+	if nil != err {
+		t.Fatal(err)
+	}
+	config := server.ClientTLSConfig()
+	if err = client.StartTLS(config); nil != err {
+		t.Fatal(err)
+	}
+	if err = client.Auth(&loginAuth{user: "any", pass: "any"}); nil != err {
+		t.Fatal(err)
+	}
+	_ = client.Mail("me@example.com")
+	_ = client.Rcpt("you@example.com")
+	w, err := client.Data()
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("Subject: tls\r\n\r\n.dotted line\r\n"))
+	_ = w.Close()
+	_ = client.Quit()
+
+	received, err := server.AwaitMessage(func(m *SmtpReceived) bool { return m.To[0] == "you@example.com" }, 5*time.Second)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !received.TLS || received.User != "any" || !strings.Contains(string(received.Data), "\r\n.dotted line") {
+		t.Fatal("unexpected message", received, string(received.Data))
+	}
+	data, err := ioutil.ReadFile(received.Filename)
+	if nil != err || string(data) != string(received.Data) || !strings.Contains(received.Filename, "new") {
+		t.Fatal("message not in maildir", received.Filename, err)
+	}
+}
+
+func TestSmtpServer_pipelining(t *testing.T) {
+	server := Email.NewSmtpServer("127.0.0.1:0")
+	if err := server.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, _ = reader.ReadString('\n') // greeting
+	_, _ = conn.Write([]byte("EHLO test\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nRCPT TO:<c@example.com>\r\nDATA\r\n"))
+	codes := make([]string, 0)
+	for len(codes) < 5 {
+		line, err := reader.ReadString('\n')
+		if nil != err {
+			t.Fatal(err)
+		}
+		if line[3] == ' ' {
+			codes = append(codes, line[:3])
+		}
+	}
+	if strings.Join(codes, ",") != "250,250,250,250,354" {
+		t.Fatal("unexpected responses", codes)
+	}
+	_, _ = conn.Write([]byte("Subject: pipelining\r\n\r\nbody\r\n.\r\nQUIT\r\n"))
+
+	messages, err := server.Await(1, 5*time.Second)
+	if nil != err || len(messages[0].To) != 2 {
+		t.Fatal("unexpected messages", messages, err)
+	}
+	if _, err = server.Await(2, 50*time.Millisecond); err != ErrorAwaitTimeout {
+		t.Fatal("expected timeout", err)
+	}
+}
+
+func TestSmtpServer_maxMessageSize(t *testing.T) {
+	server := Email.NewSmtpServer("127.0.0.1:0")
+	server.MaxMessageSize = 1024
+	if err := server.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, _ = reader.ReadString('\n') // greeting
+	_, _ = conn.Write([]byte("EHLO test\r\nMAIL FROM:<a@example.com> SIZE=2048\r\nMAIL FROM:<a@example.com> SIZE=512\r\nRCPT TO:<b@example.com>\r\nDATA\r\n"))
+	codes := make([]string, 0)
+	for len(codes) < 5 {
+		line, err := reader.ReadString('\n')
+		if nil != err {
+			t.Fatal(err)
+		}
+		if line[3] == ' ' {
+			codes = append(codes, line[:3])
+		}
+	}
+	if strings.Join(codes, ",") != "250,552,250,250,354" {
+		t.Fatal("unexpected responses", codes)
+	}
+
+	// the server stops reading at the limit: the rest of a big message is never read
+	go func() {
+		line := []byte(strings.Repeat("x", 998) + "\r\n")
+		for i := 0; i < 100*1024; i++ {
+			if _, err := conn.Write(line); nil != err {
+				return
+			}
+		}
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if nil != err || !strings.HasPrefix(line, "552 ") {
+		t.Fatal("expected message too big", line, err)
+	}
+	if _, err = reader.ReadString('\n'); nil == err {
+		t.Fatal("expected closed session")
+	}
+	if len(server.Messages()) != 0 {
+		t.Fatal("unexpected message")
+	}
+}
+
+// loginAuth implements AUTH LOGIN, not available in net/smtp
+type loginAuth struct {
+	user, pass string
+}
+
+func (a *loginAuth) Start(_ *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.user), nil
+	case "Password:":
+		return []byte(a.pass), nil
+	}
+	return nil, errors.New("unexpected challenge")
+}
@@ -0,0 +1,329 @@
+package qb_email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	templateHtml "html/template"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	templateText "text/template"
+
+	"github.com/rskvp/qb-core/qb_i18n_bundle"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	TemplateSubject = "subject"
+	TemplateHtml    = "html"
+	TemplateText    = "text"
+
+	templateContent = "content" // name of the message template inside a layout
+)
+
+var (
+	ErrorTemplateNotFound = errors.New("template_not_found")
+)
+
+var cidReference = regexp.MustCompile(`cid:([^"'\s)>]+)`)
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+// ---------------------------------------------------------------------------------------------------------------------
+
+// EmailTemplates renders localized messages reading templates from an i18n bundle.
+// A template "welcome" is made of the bundle keys "welcome.subject", "welcome.html" and "welcome.text" (html or text
+// may be missing). Layouts ("layout.html", "layout.text") wrap the message with {{template "content" .}}, partials
+// ("partials.footer.html", "partials.footer.text") are included with {{template "footer" .}}.
+// Keys missing in a language are read from the default language of the bundle.
+// Templates are Go templates, {{i18n "key"}} returns a localized string of the bundle.
+type EmailTemplates struct {
+	From        string // (optional) sender of rendered messages
+	LayoutKey   string // default "layout"
+	PartialsKey string // default "partials"
+
+	//-- private --//
+	bundle *qb_i18n_bundle.Bundle
+	images map[string]*Attachment
+	mux    sync.Mutex
+}
+
+// TemplateContent is a rendered template
+type TemplateContent struct {
+	Lang    string
+	Subject string
+	Html    string
+	Text    string
+	Images  []*Attachment // images referenced by Html as "cid:<id>"
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewTemplates returns a template renderer reading templates from bundle
+func (instance *EmailHelper) NewTemplates(bundle *qb_i18n_bundle.Bundle) *EmailTemplates {
+	templates := new(EmailTemplates)
+	templates.LayoutKey = "layout"
+	templates.PartialsKey = "partials"
+	templates.bundle = bundle
+	templates.images = make(map[string]*Attachment)
+	return templates
+}
+
+// AddImage registers an image embedded in messages that reference it as "cid:<id>"
+func (instance *EmailTemplates) AddImage(id string, data []byte) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		instance.images[id] = &Attachment{
+			Filename:    id,
+			Data:        data,
+			Inline:      true,
+			ContentType: mime.TypeByExtension(filepath.Ext(id)),
+			ContentId:   id,
+		}
+	}
+}
+
+// AddImageFile registers an image file. The id of the image is the file name, i.e. "cid:logo.png"
+func (instance *EmailTemplates) AddImageFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if nil != err {
+		return err
+	}
+	instance.AddImage(filepath.Base(filename), data)
+	return nil
+}
+
+// RenderContent renders subject, html and text of a template
+func (instance *EmailTemplates) RenderContent(name string, lang string, model interface{}) (*TemplateContent, error) {
+	if nil == instance {
+		return nil, nil
+	}
+	subject, hasSubject := instance.get(lang, name+"."+TemplateSubject)
+	html, hasHtml := instance.get(lang, name+"."+TemplateHtml)
+	text, hasText := instance.get(lang, name+"."+TemplateText)
+	if !hasSubject && !hasHtml && !hasText {
+		return nil, ErrorTemplateNotFound
+	}
+	if nil == model {
+		model = struct{}{}
+	}
+
+	var err error
+	content := &TemplateContent{Lang: lang}
+	if content.Subject, err = instance.renderText(lang, subject, false, model); nil != err {
+		return nil, err
+	}
+	content.Subject = strings.Join(strings.Fields(content.Subject), " ")
+	if hasHtml {
+		if content.Html, err = instance.renderHtml(lang, html, model); nil != err {
+			return nil, err
+		}
+		content.Images = instance.referencedImages(content.Html)
+	}
+	if hasText {
+		if content.Text, err = instance.renderText(lang, text, true, model); nil != err {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+// Render returns a message ready to send. Recipients are added by caller.
+func (instance *EmailTemplates) Render(name string, lang string, model interface{}) (*Message, error) {
+	content, err := instance.RenderContent(name, lang, model)
+	if nil != err || nil == content {
+		return nil, err
+	}
+	return instance.message(content), nil
+}
+
+// Preview renders a template and writes into dir the files "<name>.<lang>.eml", "<name>.<lang>.html" (images are
+// embedded as data URI to open the file in a browser) and "<name>.<lang>.txt" (generated from HTML if the template
+// has no text). Returns written files.
+func (instance *EmailTemplates) Preview(name string, lang string, model interface{}, dir string) ([]string, error) {
+	content, err := instance.RenderContent(name, lang, model)
+	if nil != err {
+		return nil, err
+	}
+	m := instance.message(content)
+	if nil == m.From {
+		m.From = &mail.Address{Address: "preview@localhost"}
+	}
+	if err = os.MkdirAll(dir, os.ModePerm); nil != err {
+		return nil, err
+	}
+
+	base := filepath.Join(dir, name)
+	if len(lang) > 0 {
+		base += "." + lang
+	}
+	files := []string{base + ".eml"}
+	if err = ioutil.WriteFile(base+".eml", m.GetBytes(), 0644); nil != err {
+		return nil, err
+	}
+	if len(content.Html) > 0 {
+		html := content.Html
+		for _, image := range content.Images {
+			uri := "data:" + image.ContentType + ";base64," + base64.StdEncoding.EncodeToString(image.Data)
+			html = strings.ReplaceAll(html, "cid:"+image.ContentId, uri)
+		}
+		files = append(files, base+".html")
+		if err = ioutil.WriteFile(base+".html", []byte(html), 0644); nil != err {
+			return nil, err
+		}
+	}
+	text := content.Text
+	if len(text) == 0 && len(content.Html) > 0 {
+		text = htmlToText(content.Html)
+	}
+	if len(text) > 0 {
+		files = append(files, base+".txt")
+		if err = ioutil.WriteFile(base+".txt", []byte(text), 0644); nil != err {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+// ---------------------------------------------------------------------------------------------------------------------
+
+// message creates a message from a rendered content
+func (instance *EmailTemplates) message(content *TemplateContent) *Message {
+	var m *Message
+	if len(content.Html) > 0 {
+		m = Email.NewHTMLMessage(content.Subject, content.Html)
+		m.TextBody = content.Text // generated from HTML if empty
+	} else {
+		m = Email.NewMessage(content.Subject, content.Text)
+	}
+	if len(instance.From) > 0 {
+		if address, err := mail.ParseAddress(instance.From); nil == err {
+			m.From = address
+		} else {
+			m.From = &mail.Address{Address: instance.From}
+		}
+	}
+	if len(content.Lang) > 0 {
+		m.AddHeader("Content-Language", content.Lang)
+	}
+	for _, image := range content.Images {
+		m.Attachments[image.Filename] = image
+	}
+	return m
+}
+
+// get returns a value of the bundle, falling back to default language
+func (instance *EmailTemplates) get(lang string, key string) (string, bool) {
+	for _, l := range []string{lang, ""} {
+		if dictionary, err := instance.bundle.GetDictionary(l); nil == err {
+			if elem, ok := dictionary[key]; ok {
+				return elem.Value(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// partials returns partials of a kind (html or text) by name
+func (instance *EmailTemplates) partials(lang string, kind string) map[string]string {
+	response := make(map[string]string)
+	prefix, suffix := instance.PartialsKey+".", "."+kind
+	for _, l := range []string{"", lang} { // language overrides default
+		if dictionary, err := instance.bundle.GetDictionary(l); nil == err {
+			for key, elem := range dictionary {
+				if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, suffix) {
+					response[strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)] = elem.Value()
+				}
+			}
+		}
+	}
+	return response
+}
+
+func (instance *EmailTemplates) funcs(lang string) map[string]interface{} {
+	return map[string]interface{}{
+		"i18n": func(key string) string {
+			value, _ := instance.get(lang, key)
+			return value
+		},
+	}
+}
+
+func (instance *EmailTemplates) renderHtml(lang string, text string, model interface{}) (string, error) {
+	t, err := templateHtml.New(templateContent).Funcs(instance.funcs(lang)).Parse(text)
+	if nil != err {
+		return "", err
+	}
+	for name, partial := range instance.partials(lang, TemplateHtml) {
+		if _, err = t.New(name).Parse(partial); nil != err {
+			return "", err
+		}
+	}
+	root := templateContent
+	if layout, ok := instance.get(lang, instance.LayoutKey+"."+TemplateHtml); ok {
+		if _, err = t.New(instance.LayoutKey).Parse(layout); nil != err {
+			return "", err
+		}
+		root = instance.LayoutKey
+	}
+	var buf bytes.Buffer
+	if err = t.ExecuteTemplate(&buf, root, model); nil != err {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderText renders subject (no layout) and text body
+func (instance *EmailTemplates) renderText(lang string, text string, useLayout bool, model interface{}) (string, error) {
+	t, err := templateText.New(templateContent).Funcs(instance.funcs(lang)).Parse(text)
+	if nil != err {
+		return "", err
+	}
+	root := templateContent
+	if useLayout {
+		for name, partial := range instance.partials(lang, TemplateText) {
+			if _, err = t.New(name).Parse(partial); nil != err {
+				return "", err
+			}
+		}
+		if layout, ok := instance.get(lang, instance.LayoutKey+"."+TemplateText); ok {
+			if _, err = t.New(instance.LayoutKey).Parse(layout); nil != err {
+				return "", err
+			}
+			root = instance.LayoutKey
+		}
+	}
+	var buf bytes.Buffer
+	if err = t.ExecuteTemplate(&buf, root, model); nil != err {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (instance *EmailTemplates) referencedImages(html string) []*Attachment {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	response := make([]*Attachment, 0)
+	added := make(map[string]bool)
+	for _, match := range cidReference.FindAllStringSubmatch(html, -1) {
+		if image, ok := instance.images[match[1]]; ok && !added[match[1]] {
+			added[match[1]] = true
+			response = append(response, image)
+		}
+	}
+	return response
+}
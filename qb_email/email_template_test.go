@@ -0,0 +1,137 @@
+package qb_email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rskvp/qb-core/qb_i18n_bundle"
+)
+
+const testBundleEn = `{
+  "layout": {
+    "html": "<html><body>{{template \"content\" .}}{{template \"footer\" .}}</body></html>",
+    "text": "{{template \"content\" .}}\n--\n{{template \"footer\" .}}"
+  },
+  "partials": {
+    "footer": {"html": "<p>{{i18n \"signature\"}}</p>", "text": "{{i18n \"signature\"}}"}
+  },
+  "signature": "The Team",
+  "welcome": {
+    "subject": "Welcome {{.name}}",
+    "html": "<h1>Hello {{.name}}</h1><img src=\"cid:logo.png\">",
+    "text": "Hello {{.name}}"
+  }
+}`
+
+const testBundleIt = `{
+  "signature": "Il Team",
+  "welcome": {
+    "subject": "Benvenuto {{.name}}",
+    "html": "<h1>Ciao {{.name}}</h1><img src=\"cid:logo.png\">"
+  }
+}`
+
+func TestEmailTemplates(t *testing.T) {
+	dir := t.TempDir()
+	_ = ioutil.WriteFile(filepath.Join(dir, "en.json"), []byte(testBundleEn), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "it.json"), []byte(testBundleIt), 0644)
+	bundle, err := qb_i18n_bundle.NewBundleFromDir("en", dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	templates := Email.NewTemplates(bundle)
+	templates.From = "Team <team@example.com>"
+	templates.AddImage("logo.png", []byte("\x89PNG"))
+	templates.AddImage("unused.png", []byte("\x89PNG"))
+
+	model := map[string]interface{}{"name": "<Mario>"}
+	content, err := templates.RenderContent("welcome", "it", model)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if content.Subject != "Benvenuto <Mario>" {
+		t.Fatal("subject", content.Subject)
+	}
+	if content.Html != `<html><body><h1>Ciao &lt;Mario&gt;</h1><img src="cid:logo.png"><p>Il Team</p></body></html>` {
+		t.Fatal("html", content.Html)
+	}
+	// text is missing in italian, english is used
+	if content.Text != "Hello <Mario>\n--\nIl Team" {
+		t.Fatal("text", content.Text)
+	}
+	if len(content.Images) != 1 || content.Images[0].ContentId != "logo.png" {
+		t.Fatal("images", content.Images)
+	}
+
+	m, err := templates.Render("welcome", "en", model)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if m.From.Address != "team@example.com" || m.BodyContentType != "text/html" || !strings.Contains(m.Body, "Hello &lt;Mario&gt;") {
+		t.Fatal("message", m.From, m.Body)
+	}
+	data := m.GetBytes()
+	if !bytes.Contains(data, []byte("Content-ID: <logo.png>")) || !bytes.Contains(data, []byte("Content-Language: en")) {
+		t.Fatal("missing inline image", string(data))
+	}
+	// html and images are related, text is an alternative: [text/plain, [text/html, image/png]]
+	if structure := mimeStructure(t, data); structure != "multipart/alternative[text/plain,multipart/related[text/html,image/png]]" {
+		t.Fatal("structure", structure)
+	}
+	parsed, err := ParseMessage(bytes.NewReader(data))
+	if nil != err || nil == parsed.Attachments["logo.png"] || !parsed.Attachments["logo.png"].Inline {
+		t.Fatal("parsed", err, parsed.Attachments)
+	}
+
+	_ = m.AddAttachmentBinary("doc.pdf", []byte("%PDF"), false)
+	if structure := mimeStructure(t, m.GetBytes()); structure != "multipart/mixed[multipart/alternative[text/plain,multipart/related[text/html,image/png]],application/pdf]" {
+		t.Fatal("structure", structure)
+	}
+
+	if _, err = templates.Render("missing", "en", model); err != ErrorTemplateNotFound {
+		t.Fatal("expected template not found", err)
+	}
+
+	files, err := templates.Preview("welcome", "it", model, filepath.Join(dir, "preview"))
+	if nil != err || len(files) != 3 {
+		t.Fatal("preview", err, files)
+	}
+	html, _ := ioutil.ReadFile(filepath.Join(dir, "preview", "welcome.it.html"))
+	if !bytes.Contains(html, []byte(`src="data:image/png;base64,`)) {
+		t.Fatal("preview html", string(html))
+	}
+}
+
+// mimeStructure returns content types of a message, i.e. "multipart/mixed[text/plain,image/png]"
+func mimeStructure(t *testing.T, data []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if nil != err {
+		t.Fatal(err)
+	}
+	var walk func(contentType string, body io.Reader) string
+	walk = func(contentType string, body io.Reader) string {
+		mediaType, params, _ := mime.ParseMediaType(contentType)
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return mediaType
+		}
+		parts := make([]string, 0)
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if nil != err {
+				break
+			}
+			parts = append(parts, walk(part.Header.Get("Content-Type"), part))
+		}
+		return mediaType + "[" + strings.Join(parts, ",") + "]"
+	}
+	return walk(m.Header.Get("Content-Type"), m.Body)
+}
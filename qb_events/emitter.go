@@ -3,6 +3,8 @@ package qb_events
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +18,22 @@ type stackItem struct {
 	callback EventCallback
 }
 
+// listener is a subscription. Exact subscriptions have no segments.
+type listener struct {
+	pattern  string
+	segments []string
+	callback EventCallback
+	priority int
+	once     bool
+	seq      uint64 // registration order
+}
+
+const (
+	WildcardSegment = "*"  // matches a single segment of a name, i.e. "file.*" matches "file.created"
+	WildcardDeep    = "**" // matches zero or more segments, i.e. "file.**" matches "file" and "file.dir.created"
+	separator       = "."
+)
+
 //----------------------------------------------------------------------------------------------------------------------
 //	Emitter
 //----------------------------------------------------------------------------------------------------------------------
@@ -23,7 +41,8 @@ type stackItem struct {
 type Emitter struct {
 	waitTime  time.Duration
 	debounces map[string]*Debouncer
-	listeners map[string][]EventCallback
+	listeners map[string][]*listener // by pattern
+	seq       uint64
 	mux       sync.Mutex
 	payload   interface{}
 }
@@ -31,7 +50,7 @@ type Emitter struct {
 func NewEmitterInstance(waitTime time.Duration, payload ...interface{}) (instance *Emitter) {
 	instance = new(Emitter)
 	instance.waitTime = waitTime
-	instance.listeners = make(map[string][]EventCallback)
+	instance.listeners = make(map[string][]*listener)
 	if waitTime > 0 {
 		instance.debounces = make(map[string]*Debouncer)
 	}
@@ -58,41 +77,58 @@ func (instance *Emitter) Debounce(waitTime time.Duration) *Emitter {
 	return instance
 }
 
+// Has returns true if an event with this name reaches at least a listener, either subscribed with the exact
+// name or with a matching pattern.
 func (instance *Emitter) Has(eventName string) bool {
 	if nil != instance {
 		instance.mux.Lock()
 		defer instance.mux.Unlock()
-		if _, b := instance.listeners[eventName]; b {
-			return len(instance.listeners[eventName]) > 0
+		for _, handlers := range instance.listeners {
+			if len(handlers) > 0 && handlers[0].match(eventName) {
+				return true
+			}
 		}
 	}
 	return false
 }
 
+// On subscribes an event name or a pattern. Names are made of segments separated by a dot ("file.created"), in a
+// pattern "*" matches a segment and "**" matches any number of segments ("file.*", "**").
+// Listeners are notified by priority (see OnPriority), then exact names before patterns with "*" before patterns
+// with "**", then in subscription order.
 func (instance *Emitter) On(eventName string, callback func(event *Event)) *Emitter {
-	if nil != instance {
-		instance.mux.Lock()
-		defer instance.mux.Unlock()
-		instance.listeners[eventName] = append(instance.listeners[eventName], callback)
-	}
-	return instance
+	return instance.subscribe(eventName, 0, false, callback)
+}
+
+// OnPriority subscribes a listener notified before listeners with a lower priority (default priority is 0)
+func (instance *Emitter) OnPriority(eventName string, priority int, callback func(event *Event)) *Emitter {
+	return instance.subscribe(eventName, priority, false, callback)
+}
+
+// Once subscribes a listener removed at the first emit of a matching event, even if a listener with higher
+// precedence stops the propagation
+func (instance *Emitter) Once(eventName string, callback func(event *Event)) *Emitter {
+	return instance.subscribe(eventName, 0, true, callback)
 }
 
+// Off removes listeners subscribed with this name or pattern (all listeners if callback is not passed).
+// Off("file.*") does not remove listeners of "file.created" and vice versa.
 func (instance *Emitter) Off(eventName string, callback ...func(event *Event)) *Emitter {
 	if nil != instance {
 		instance.mux.Lock()
 		defer instance.mux.Unlock()
 		if _, ok := instance.listeners[eventName]; ok {
 			if len(callback) == 0 {
-				instance.listeners[eventName] = make([]EventCallback, 0)
+				delete(instance.listeners, eventName)
 			} else {
 				handlers := instance.listeners[eventName]
 				// loop starting from end
 				for i := len(handlers) - 1; i > -1; i-- {
-					f := handlers[i]
+					f := handlers[i].callback
 					for _, h := range callback {
+						// same closure, not only same code (closures of the same literal share the code pointer)
 						v1 := reflect.ValueOf(f)
-						v2 := reflect.ValueOf(h)
+						v2 := reflect.ValueOf(EventCallback(h))
 						if v1 == v2 {
 							handlers = removeIndex(handlers, i)
 							break
@@ -113,7 +149,7 @@ func (instance *Emitter) Clear() {
 		defer instance.mux.Unlock()
 
 		// reset listeners
-		instance.listeners = make(map[string][]EventCallback, 0)
+		instance.listeners = make(map[string][]*listener, 0)
 		// remove debouncers
 		for _, d := range instance.debounces {
 			if nil != d.timer {
@@ -150,6 +186,60 @@ func (instance *Emitter) EmitAsync(eventName string, args ...interface{}) *Emitt
 //	p r i v a t e
 //----------------------------------------------------------------------------------------------------------------------
 
+func (instance *Emitter) subscribe(eventName string, priority int, once bool, callback EventCallback) *Emitter {
+	if nil != instance && nil != callback {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		instance.seq++
+		item := &listener{
+			pattern:  eventName,
+			callback: callback,
+			priority: priority,
+			once:     once,
+			seq:      instance.seq,
+		}
+		if isPattern(eventName) {
+			item.segments = strings.Split(eventName, separator)
+		}
+		instance.listeners[eventName] = append(instance.listeners[eventName], item)
+	}
+	return instance
+}
+
+// matching returns listeners of an event sorted by precedence and removes "once" listeners.
+// Must be called with lock.
+func (instance *Emitter) matching(eventName string) []*listener {
+	response := make([]*listener, 0)
+	for pattern, handlers := range instance.listeners {
+		if len(handlers) == 0 || !handlers[0].match(eventName) {
+			continue
+		}
+		remaining := handlers[:0]
+		for _, handler := range handlers {
+			response = append(response, handler)
+			if !handler.once {
+				remaining = append(remaining, handler)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(instance.listeners, pattern)
+		} else {
+			instance.listeners[pattern] = remaining
+		}
+	}
+	sort.Slice(response, func(i, j int) bool {
+		a, b := response[i], response[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if a.rank() != b.rank() {
+			return a.rank() < b.rank()
+		}
+		return a.seq < b.seq
+	})
+	return response
+}
+
 func (instance *Emitter) removeDebounce(item *Debouncer) {
 	if nil != instance && nil != instance.debounces && nil != item {
 		instance.mux.Lock()
@@ -186,28 +276,22 @@ func (instance *Emitter) emit(eventName string, async bool, args ...interface{})
 		instance.mux.Lock()
 		defer instance.mux.Unlock()
 
-		// creates internal execution stack
+		// creates internal execution stack. Listeners share the event to stop propagation.
+		event := NewEvent(async, eventName, instance.payload, args...)
 		stack := make([]*stackItem, 0)
-		for k, handlers := range instance.listeners {
-			if k == eventName {
-				for _, handler := range handlers {
-					if nil != handler {
-						event := NewEvent(async, eventName, instance.payload, args...)
-						item := &stackItem{
-							event:    event,
-							callback: handler,
-						}
-						stack = append(stack, item)
-					}
-				}
+		for _, handler := range instance.matching(eventName) {
+			item := &stackItem{
+				event:    event,
+				callback: handler.callback,
 			}
+			stack = append(stack, item)
 		}
 
 		go rawEmit(stack)
 	}
 }
 
-func removeIndex(a []EventCallback, index int) []EventCallback {
+func removeIndex(a []*listener, index int) []*listener {
 	return append(a[:index], a[index+1:]...)
 }
 
@@ -219,6 +303,9 @@ func rawEmit(stack []*stackItem) {
 	if nil != stack {
 		for _, item := range stack {
 			if nil != item && nil != item.event && nil != item.callback {
+				if item.event.IsPropagationStopped() {
+					return
+				}
 				if item.event.Async {
 					go item.callback(item.event)
 				} else {
@@ -228,3 +315,60 @@ func rawEmit(stack []*stackItem) {
 		}
 	}
 }
+
+func isPattern(eventName string) bool {
+	for _, segment := range strings.Split(eventName, separator) {
+		if segment == WildcardSegment || segment == WildcardDeep {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case WildcardDeep:
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case WildcardSegment:
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	listener
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *listener) match(eventName string) bool {
+	if nil == instance.segments {
+		return instance.pattern == eventName
+	}
+	return matchSegments(instance.segments, strings.Split(eventName, separator))
+}
+
+// rank is the precedence of listeners with same priority: exact names, patterns with "*", patterns with "**"
+func (instance *listener) rank() int {
+	if nil == instance.segments {
+		return 0
+	}
+	for _, segment := range instance.segments {
+		if segment == WildcardDeep {
+			return 2
+		}
+	}
+	return 1
+}
@@ -0,0 +1,133 @@
+package qb_events
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmitter_patterns(t *testing.T) {
+	emitter := Events.NewEmitter()
+	var mux sync.Mutex
+	calls := make([]string, 0)
+	done := make(chan bool, 1)
+	record := func(name string) func(e *Event) {
+		return func(e *Event) {
+			mux.Lock()
+			calls = append(calls, name+":"+e.Name)
+			mux.Unlock()
+		}
+	}
+	emitter.On("file.created", record("A"))
+	emitter.On("file.*", record("B"))
+	emitter.On("**", func(e *Event) {
+		record("C")(e)
+		done <- true
+	})
+	emitter.OnPriority("**", 10, record("D"))
+	emitter.On("file.created", record("E"))
+	emitter.On("file.*.x", record("F"))
+	emitter.On("dir.*", record("G"))
+
+	emitter.Emit("file.created")
+	wait(t, done)
+	if strings.Join(calls, ",") != "D:file.created,A:file.created,E:file.created,B:file.created,C:file.created" {
+		t.Fatal("unexpected order", calls)
+	}
+
+	calls = calls[:0]
+	emitter.Emit("file.dir.x")
+	wait(t, done)
+	if strings.Join(calls, ",") != "D:file.dir.x,F:file.dir.x,C:file.dir.x" {
+		t.Fatal("unexpected listeners", calls)
+	}
+}
+
+func TestEmitter_onceAndStop(t *testing.T) {
+	emitter := Events.NewEmitter()
+	count := make(chan string, 10)
+	emitter.Once("job.done", func(e *Event) { count <- "once" })
+	emitter.OnPriority("job.*", 1, func(e *Event) {
+		if e.Argument(0) == "stop" {
+			e.StopPropagation()
+		}
+		count <- "first"
+	})
+	emitter.On("job.**", func(e *Event) { count <- "last" })
+
+	emitter.Emit("job.done")
+	if calls := receive(t, count, 3); calls != "first,once,last" {
+		t.Fatal("unexpected calls", calls)
+	}
+	emitter.Emit("job.done", "stop")
+	if calls := receive(t, count, 1); calls != "first" {
+		t.Fatal("unexpected calls", calls)
+	}
+	select {
+	case c := <-count:
+		t.Fatal("unexpected call", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEmitter_hasOff(t *testing.T) {
+	emitter := Events.NewEmitter()
+	callback := func(e *Event) {}
+	emitter.On("file.*", callback)
+	if !emitter.Has("file.created") || !emitter.Has("file.*") || emitter.Has("file") || emitter.Has("dir.created") {
+		t.Fatal("unexpected Has")
+	}
+	emitter.Off("file.created")
+	if !emitter.Has("file.created") {
+		t.Fatal("Off of a name must not remove pattern listeners")
+	}
+	emitter.Off("file.*", callback)
+	if emitter.Has("file.created") {
+		t.Fatal("listener not removed")
+	}
+
+	// closures of the same literal are different listeners
+	count := make(chan string, 10)
+	newCallback := func(name string) func(e *Event) {
+		return func(e *Event) { count <- name }
+	}
+	a, b := newCallback("a"), newCallback("b")
+	emitter.On("closure", a)
+	emitter.On("closure", b)
+	emitter.Off("closure", a)
+	emitter.Emit("closure")
+	if calls := receive(t, count, 1); calls != "b" {
+		t.Fatal("unexpected calls", calls)
+	}
+
+	emitter.Once("once", callback)
+	if !emitter.Has("once") {
+		t.Fatal("expected listener")
+	}
+	emitter.Emit("once")
+	if emitter.Has("once") {
+		t.Fatal("once listener not removed")
+	}
+}
+
+func wait(t *testing.T, done chan bool) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func receive(t *testing.T, ch chan string, count int) string {
+	response := make([]string, 0, count)
+	for len(response) < count {
+		select {
+		case value := <-ch:
+			response = append(response, value)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout", response)
+		}
+	}
+	return strings.Join(response, ",")
+}
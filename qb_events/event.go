@@ -1,12 +1,18 @@
 package qb_events
 
-import "github.com/rskvp/qb-core/qb_utils"
+import (
+	"sync/atomic"
+
+	"github.com/rskvp/qb-core/qb_utils"
+)
 
 type Event struct {
 	Name      string
 	Arguments []interface{}
 	Payload   interface{}
 	Async     bool
+
+	stopped int32
 }
 
 func NewEvent(async bool, eventName string, payload interface{}, args ...interface{}) (event *Event) {
@@ -19,6 +25,15 @@ func NewEvent(async bool, eventName string, payload interface{}, args ...interfa
 	return
 }
 
+// StopPropagation prevents the notification of next listeners. Listeners of EmitAsync are already started.
+func (instance *Event) StopPropagation() {
+	atomic.StoreInt32(&instance.stopped, 1)
+}
+
+func (instance *Event) IsPropagationStopped() bool {
+	return atomic.LoadInt32(&instance.stopped) == 1
+}
+
 func (instance *Event) ArgumentsInterface() interface{} {
 	return interface{}(instance.Arguments)
 }
@@ -123,6 +123,9 @@ func (instance *Bundle) GetDictionary(rawLang string) (map[string]*Element, erro
 	} else {
 		cache = instance.cache[instance.defLang]
 	}
+	if nil == cache {
+		return nil, ResourceNotFoundError
+	}
 	return cache.getData()
 }
 
@@ -22,6 +22,7 @@ func init() {
 	NIO = new(NIOHelper)
 }
 
+// NewClient creates a client of a TCP server or of a unix socket (host is "unix:///path/to.sock", port is ignored)
 func (*NIOHelper) NewClient(host string, port int) *NioClient {
 	instance := new(NioClient)
 	instance.host = host
@@ -29,9 +30,13 @@ func (*NIOHelper) NewClient(host string, port int) *NioClient {
 	instance.Timeout = 10 * time.Second
 	instance.events = qb_events.Events.NewEmitter()
 	instance.connected = false
-	instance.closed = true
+	instance.closed = 1
 	instance.pingTimer = time.NewTicker(1 * time.Second)
 	instance.EnablePing = false // ping disabled (avoid continuous connect/disconnect)
+	instance.ReconnectDelay = 500 * time.Millisecond
+	instance.ReconnectMax = 30 * time.Second
+	instance.ChunkSize = qb_utils.ChunkSizeLarge
+	instance.MaxMessageSize = DefaultMaxMessageSize
 
 	sysid, err := qb_sys.Sys.ID()
 	if nil != err {
@@ -42,11 +47,24 @@ func (*NIOHelper) NewClient(host string, port int) *NioClient {
 	return instance
 }
 
-func (*NIOHelper) NewServer(port int) *NioServer {
+// NewServer creates a server listening on a TCP port or on a unix socket (port is "unix:///path/to.sock")
+func (*NIOHelper) NewServer(port interface{}) *NioServer {
 	instance := new(NioServer)
 	instance.clients = 0
-	instance.port = port
+	if s, b := port.(string); b && IsUnixAddress(s) {
+		instance.address = s
+		instance.SocketMode = DefaultSocketMode
+	} else {
+		instance.port = qb_utils.Convert.ToInt(port)
+	}
 	instance.clientsMap = make(map[string]*client)
+	instance.MaxConcurrency = 64
+	instance.HelloTimeout = 10 * time.Second
+	instance.MaxMessageSize = DefaultMaxMessageSize
+	instance.SubscriberQueueSize = DefaultSubscriberQueueSize
+	instance.topics = newTopicRegistry()
+	instance.rpc = newRpcRegistry()
+	instance.events = qb_events.Events.NewEmitter()
 	instance.active = false
 
 	sysid, err := qb_sys.Sys.ID()
@@ -75,6 +93,8 @@ type NioMessage struct {
 	PublicKey  *rsa.PublicKey // public key for response
 	SessionKey []byte         // session key
 	Body       interface{}    // message object
+	Id         uint64         // request id. Responses have the id of the request, pushes have id 0
+	Push       bool           // server initiated message (no response expected)
 }
 
 type NioSettings struct {
@@ -101,7 +121,18 @@ func (instance *NioSettings) Port() int {
 	}
 	return instance.port
 }
+
+// IsUnix returns true if Address is a unix socket (unix:///path/to.sock). Host returns the whole address.
+func (instance *NioSettings) IsUnix() bool {
+	return IsUnixAddress(instance.Address)
+}
+
 func (instance *NioSettings) parseAddress(address string) {
+	if IsUnixAddress(address) {
+		instance.host = address
+		instance.port = 0
+		return
+	}
 	tokens := strings.Split(address, ":")
 	switch len(tokens) {
 	case 1:
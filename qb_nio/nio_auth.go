@@ -0,0 +1,311 @@
+package qb_nio
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	authProtocol     = "qbnio-x25519-v1"
+	authClientHello  = "client_hello"
+	authServerHello  = "server_hello"
+	authClientFinish = "client_finish"
+)
+
+var (
+	ErrorAuthentication   = errors.New("authentication_error")
+	ErrorReplayedMessage  = errors.New("replayed_message")
+	ErrorMissingAuthProof = errors.New("missing_server_key_or_psk")
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// NioAuth enables the authenticated handshake: ephemeral X25519 key agreement (forward secrecy),
+// messages encrypted with ChaCha20-Poly1305 and a counter that rejects replayed or reordered messages.
+// The server is authenticated by a pinned Ed25519 public key, by a pre-shared secret or both.
+type NioAuth struct {
+	PrivateKey     ed25519.PrivateKey  // identity of this peer. Required on server when PSK is not set, optional on client (client authentication)
+	ServerKey      ed25519.PublicKey   // (client) pinned public key of the server
+	PSK            []byte              // (optional) pre-shared secret, must be the same on client and server
+	AuthorizedKeys []ed25519.PublicKey // (server) if not empty, only clients with one of these keys are accepted
+	AllowLegacy    bool                // (server) accept also clients using the RSA handshake
+}
+
+// authHandshake is the body of handshake messages
+type authHandshake struct {
+	Protocol  string `json:"protocol"`
+	Step      string `json:"step"`
+	Ephemeral []byte `json:"ephemeral,omitempty"` // X25519 public key
+	Nonce     []byte `json:"nonce,omitempty"`
+	Identity  []byte `json:"identity,omitempty"`  // Ed25519 public key
+	Signature []byte `json:"signature,omitempty"` // Ed25519 signature of transcript
+	Mac       []byte `json:"mac,omitempty"`       // HMAC-SHA256 of transcript
+}
+
+// authState is the handshake in progress
+type authState struct {
+	private    []byte
+	transcript []byte
+	session    *nioSession
+}
+
+// nioSession encrypts messages after an authenticated handshake.
+// Each direction has its own key and counter, the counter is the nonce of the AEAD.
+type nioSession struct {
+	send        cipher.AEAD
+	recv        cipher.AEAD
+	sendCounter uint64
+	recvCounter uint64
+	finishKey   []byte // client proves it derived the same keys
+	mux         sync.Mutex
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+// GenerateAuthKey creates an Ed25519 identity key for NioAuth
+func GenerateAuthKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	h a n d s h a k e
+//----------------------------------------------------------------------------------------------------------------------
+
+func parseAuthHandshake(message *NioMessage) *authHandshake {
+	if v, b := message.Body.([]byte); b && bytes.Contains(v, []byte(authProtocol)) {
+		var h authHandshake
+		if nil == json.Unmarshal(v, &h) && h.Protocol == authProtocol {
+			return &h
+		}
+	}
+	return nil
+}
+
+// newClientHello starts the handshake on client side
+func newClientHello() (*authHandshake, *authState, error) {
+	private, public, err := newEphemeral()
+	if nil != err {
+		return nil, nil, err
+	}
+	nonce := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, nonce); nil != err {
+		return nil, nil, err
+	}
+	hello := &authHandshake{Protocol: authProtocol, Step: authClientHello, Ephemeral: public, Nonce: nonce}
+	return hello, &authState{private: private, transcript: transcript(hello)}, nil
+}
+
+// serverHello answers a client hello and derives the session
+func (instance *NioAuth) serverHello(clientHello *authHandshake) (*authHandshake, *authState, error) {
+	if nil == instance || clientHello.Step != authClientHello || len(clientHello.Ephemeral) != curve25519.PointSize {
+		return nil, nil, ErrorAuthentication
+	}
+	if len(instance.PrivateKey) == 0 && len(instance.PSK) == 0 {
+		return nil, nil, ErrorMissingAuthProof
+	}
+	private, public, err := newEphemeral()
+	if nil != err {
+		return nil, nil, err
+	}
+	nonce := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, nonce); nil != err {
+		return nil, nil, err
+	}
+	hello := &authHandshake{Protocol: authProtocol, Step: authServerHello, Ephemeral: public, Nonce: nonce}
+	if len(instance.PrivateKey) > 0 {
+		hello.Identity = instance.PrivateKey.Public().(ed25519.PublicKey)
+	}
+	t := append(transcript(clientHello), transcript(hello)...)
+	if len(instance.PrivateKey) > 0 {
+		hello.Signature = ed25519.Sign(instance.PrivateKey, t)
+	}
+	if len(instance.PSK) > 0 {
+		hello.Mac = mac(instance.PSK, t)
+	}
+	session, err := newSession(private, clientHello.Ephemeral, instance.PSK, t, false)
+	if nil != err {
+		return nil, nil, err
+	}
+	return hello, &authState{transcript: t, session: session}, nil
+}
+
+// clientFinish verifies the server and derives the session
+func (instance *NioAuth) clientFinish(state *authState, serverHello *authHandshake) (*authHandshake, error) {
+	if serverHello.Step != authServerHello || len(serverHello.Ephemeral) != curve25519.PointSize {
+		return nil, ErrorAuthentication
+	}
+	if len(instance.ServerKey) == 0 && len(instance.PSK) == 0 {
+		return nil, ErrorMissingAuthProof
+	}
+	t := append(state.transcript, transcript(serverHello)...)
+	if len(instance.ServerKey) > 0 {
+		if !bytes.Equal(serverHello.Identity, instance.ServerKey) || !ed25519.Verify(instance.ServerKey, t, serverHello.Signature) {
+			return nil, ErrorAuthentication
+		}
+	}
+	if len(instance.PSK) > 0 && !hmac.Equal(serverHello.Mac, mac(instance.PSK, t)) {
+		return nil, ErrorAuthentication
+	}
+	session, err := newSession(state.private, serverHello.Ephemeral, instance.PSK, t, true)
+	if nil != err {
+		return nil, err
+	}
+	state.transcript = t
+	state.session = session
+
+	finish := &authHandshake{Protocol: authProtocol, Step: authClientFinish}
+	if len(instance.PrivateKey) > 0 {
+		finish.Identity = instance.PrivateKey.Public().(ed25519.PublicKey)
+		finish.Signature = ed25519.Sign(instance.PrivateKey, append(t, authClientFinish...))
+	}
+	finish.Mac = mac(session.finishKey, t)
+	return finish, nil
+}
+
+// verifyFinish authenticates the client (if required) and its session keys
+func (instance *NioAuth) verifyFinish(state *authState, finish *authHandshake) error {
+	if nil == state || nil == state.session || finish.Step != authClientFinish {
+		return ErrorAuthentication
+	}
+	if !hmac.Equal(finish.Mac, mac(state.session.finishKey, state.transcript)) {
+		return ErrorAuthentication
+	}
+	if len(instance.AuthorizedKeys) > 0 {
+		authorized := false
+		for _, key := range instance.AuthorizedKeys {
+			if bytes.Equal(key, finish.Identity) {
+				authorized = true
+				break
+			}
+		}
+		if !authorized || !ed25519.Verify(finish.Identity, append(state.transcript, authClientFinish...), finish.Signature) {
+			return ErrorAuthentication
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	s e s s i o n
+//----------------------------------------------------------------------------------------------------------------------
+
+// seal encrypts a body. Message id and push flag are authenticated too.
+func (instance *nioSession) seal(id uint64, push bool, data []byte) []byte {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	counter := instance.sendCounter
+	instance.sendCounter++
+	nonce := counterNonce(counter)
+	out := make([]byte, 8, 8+len(data)+instance.send.Overhead())
+	binary.BigEndian.PutUint64(out, counter)
+	return instance.send.Seal(out, nonce, data, additionalData(id, push))
+}
+
+// open decrypts a body. Messages must arrive in the same order they are sent.
+func (instance *nioSession) open(id uint64, push bool, data []byte) ([]byte, error) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	if len(data) < 8 {
+		return nil, ErrorAuthentication
+	}
+	counter := binary.BigEndian.Uint64(data)
+	if counter != instance.recvCounter {
+		return nil, ErrorReplayedMessage
+	}
+	plain, err := instance.recv.Open(nil, counterNonce(counter), data[8:], additionalData(id, push))
+	if nil != err {
+		return nil, ErrorAuthentication
+	}
+	instance.recvCounter++
+	return plain, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func newEphemeral() (private, public []byte, err error) {
+	private = make([]byte, curve25519.ScalarSize)
+	if _, err = io.ReadFull(rand.Reader, private); nil != err {
+		return
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	return
+}
+
+// newSession derives a key for each direction from the shared secret (and psk)
+func newSession(private, peer, psk, t []byte, isClient bool) (*nioSession, error) {
+	shared, err := curve25519.X25519(private, peer)
+	if nil != err {
+		return nil, err
+	}
+	hash := sha256.Sum256(t)
+	kdf := hkdf.New(sha256.New, shared, psk, append([]byte(authProtocol), hash[:]...))
+	keys := make([]byte, 3*chacha20poly1305.KeySize)
+	if _, err = io.ReadFull(kdf, keys); nil != err {
+		return nil, err
+	}
+	clientToServer, err := chacha20poly1305.New(keys[:32])
+	if nil != err {
+		return nil, err
+	}
+	serverToClient, err := chacha20poly1305.New(keys[32:64])
+	if nil != err {
+		return nil, err
+	}
+	session := &nioSession{finishKey: keys[64:]}
+	if isClient {
+		session.send, session.recv = clientToServer, serverToClient
+	} else {
+		session.send, session.recv = serverToClient, clientToServer
+	}
+	return session, nil
+}
+
+func transcript(h *authHandshake) []byte {
+	return append(append(append([]byte(h.Step), h.Ephemeral...), h.Nonce...), h.Identity...)
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func additionalData(id uint64, push bool) []byte {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint64(data, id)
+	if push {
+		data[8] = 1
+	}
+	return data
+}
@@ -0,0 +1,92 @@
+package qb_nio
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestNioAuth(t *testing.T) {
+	serverPub, serverKey, _ := GenerateAuthKey()
+	clientPub, clientKey, _ := GenerateAuthKey()
+	otherPub, _, _ := GenerateAuthKey()
+	psk := []byte("shared secret")
+
+	tests := []struct {
+		name   string
+		server *NioAuth
+		client *NioAuth
+		ok     bool
+	}{
+		{"pinned key", &NioAuth{PrivateKey: serverKey}, &NioAuth{ServerKey: serverPub}, true},
+		{"wrong pinned key", &NioAuth{PrivateKey: serverKey}, &NioAuth{ServerKey: otherPub}, false},
+		{"psk", &NioAuth{PSK: psk}, &NioAuth{PSK: psk}, true},
+		{"wrong psk", &NioAuth{PSK: psk}, &NioAuth{PSK: []byte("guess")}, false},
+		{"pinned key and psk", &NioAuth{PrivateKey: serverKey, PSK: psk}, &NioAuth{ServerKey: serverPub, PSK: psk}, true},
+		{"no server proof", &NioAuth{PrivateKey: serverKey}, &NioAuth{}, false},
+		{"client auth", &NioAuth{PrivateKey: serverKey, AuthorizedKeys: []ed25519.PublicKey{clientPub}},
+			&NioAuth{ServerKey: serverPub, PrivateKey: clientKey}, true},
+		{"client not authorized", &NioAuth{PrivateKey: serverKey, AuthorizedKeys: []ed25519.PublicKey{otherPub}},
+			&NioAuth{ServerKey: serverPub, PrivateKey: clientKey}, false},
+		{"legacy client refused", &NioAuth{PrivateKey: serverKey}, nil, false},
+		{"legacy client allowed", &NioAuth{PrivateKey: serverKey, AllowLegacy: true}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := openTestServer(t, test.server)
+			defer server.Close()
+
+			client := NIO.NewClient("127.0.0.1", server.Port())
+			client.Auth = test.client
+			client.Codec = CodecBinary
+			defer client.Close()
+			err := client.Open()
+			if nil == err {
+				var response *NioMessage
+				response, err = client.Send("hello")
+				if nil == err && string(response.Body.([]byte)) != "hello" {
+					t.Errorf("bad response: %v", response.Body)
+				}
+			}
+			if test.ok && nil != err {
+				t.Errorf("unexpected error: %v", err)
+			} else if !test.ok && nil == err {
+				t.Errorf("expected error")
+			}
+			if test.ok && nil != test.client {
+				pushes := make(chan string, 1)
+				client.OnPush(func(message *NioMessage) {
+					pushes <- string(message.Body.([]byte))
+				})
+				_ = server.Broadcast("push")
+				select {
+				case got := <-pushes:
+					if got != "push" {
+						t.Errorf("bad push: %q", got)
+					}
+				case <-time.After(2 * time.Second):
+					t.Errorf("push not received")
+				}
+			}
+		})
+	}
+}
+
+func TestNioSession_replay(t *testing.T) {
+	private, public, _ := newEphemeral()
+	peerPrivate, peerPublic, _ := newEphemeral()
+	client, _ := newSession(private, peerPublic, nil, []byte("transcript"), true)
+	server, _ := newSession(peerPrivate, public, nil, []byte("transcript"), false)
+
+	first := client.seal(1, false, []byte("first"))
+	second := client.seal(2, false, []byte("second"))
+	if data, err := server.open(1, false, first); nil != err || string(data) != "first" {
+		t.Fatalf("open: %q %v", data, err)
+	}
+	if _, err := server.open(1, false, first); err != ErrorReplayedMessage {
+		t.Errorf("expected replay error, got %v", err)
+	}
+	if _, err := server.open(3, false, second); err != ErrorAuthentication {
+		t.Errorf("expected authentication error for a changed id, got %v", err)
+	}
+}
@@ -2,15 +2,18 @@ package qb_nio
 
 import (
 	"bufio"
+	"context"
 	"crypto/rsa"
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rskvp/qb-core/qb_events"
+	"github.com/rskvp/qb-core/qb_utils"
 )
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -18,24 +21,73 @@ import (
 //----------------------------------------------------------------------------------------------------------------------
 
 type NioClient struct {
-	Timeout    time.Duration
+	Timeout    time.Duration // dial timeout and max wait of a response (SendContext with a deadline ignores it)
 	Secure     bool
 	EnablePing bool
+	Codec      string   // gob (default), json, binary or a custom codec added with RegisterCodec
+	Auth       *NioAuth // (optional) authenticated handshake. Secure is ignored
+	// reconnection
+	AutoReconnect  bool          // reconnect (and handshake) when connection is lost
+	ReconnectDelay time.Duration // first reconnection delay, doubled at each attempt
+	ReconnectMax   time.Duration // max reconnection delay
+	QueueSize      int           // (optional) requests waiting for reconnection. If zero, requests fail while disconnected
+	ChunkSize      int64         // size of chunks sent by SendFile
+	TrustedSocket  bool          // unix socket only: skip encryption (Secure and Auth are ignored)
+	MaxMessageSize int           // max size of a received message (default 4Mb), larger messages close the connection
 
 	//-- private --//
 	uuid      string
-	conn      net.Conn
+	conn      *clientConnection
 	host      string
 	port      int
 	mux       sync.Mutex
 	stopChan  chan bool
 	events    *qb_events.Emitter
 	connected bool
-	closed    bool
+	closed    int32 // atomic: 1 if closed
 	pingTimer *time.Ticker
+	connMux   sync.Mutex
+	onPush    NioPushHandler
+	pushMux   sync.RWMutex
+	lastId    uint64 // last request id
+	topics    map[string]NioTopicHandler
+	topicsMux sync.RWMutex
+	// reconnection
+	done         chan bool // closed on Close
+	reconnecting int32
+	queue        []chan bool // requests waiting for reconnection
+	queueMux     sync.Mutex
 	// RSA
 	publicKey  *rsa.PublicKey
 	privateKey *rsa.PrivateKey
+}
+
+type NioPushHandler func(message *NioMessage)
+
+var (
+	ErrorClientClosed    = errors.New("client_closed")
+	ErrorQueueFull       = errors.New("queue_full")
+	ErrorResponseTimeout = errors.New("response_timeout")
+)
+
+// clientConnection is a connection to server shared by concurrent requests.
+// Responses are matched to requests using the message id.
+// Legacy servers respond with id 0 in request order: responses are matched in arrival order.
+type clientConnection struct {
+	conn     net.Conn
+	codec    NioCodec
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	writeMux sync.Mutex
+	maxSize  int                         // max size of received messages
+	pending  map[uint64]chan *NioMessage // requests waiting for a response
+	order    []uint64                    // ids in request order, until the server responds with an id
+	tagged   bool                        // server responds with request id
+	mux      sync.Mutex
+	lost     bool
+	session  *nioSession // authenticated session
+	starting *nioSession // session starting after next message
+	// RSA (legacy handshake)
 	serverKey  *rsa.PublicKey // server signature (got on handshake)
 	sessionKey []byte
 }
@@ -51,9 +103,19 @@ func (instance *NioClient) GetUUID() string {
 	return ""
 }
 
+// IsConnected returns true if the client has a connection with completed handshake
+func (instance *NioClient) IsConnected() bool {
+	if nil != instance {
+		instance.connMux.Lock()
+		defer instance.connMux.Unlock()
+		return nil != instance.conn
+	}
+	return false
+}
+
 func (instance *NioClient) IsOpen() bool {
 	if nil != instance {
-		if !instance.closed {
+		if !instance.isClosed() {
 			err := instance.test() // test for real feedback
 			return nil == err
 		}
@@ -63,9 +125,10 @@ func (instance *NioClient) IsOpen() bool {
 
 func (instance *NioClient) Open() error {
 	if nil != instance {
-		if instance.closed {
-			instance.closed = false
+		if instance.isClosed() {
+			instance.setClosed(false)
 			instance.stopChan = make(chan bool, 1)
+			instance.done = make(chan bool)
 
 			// start pinging remote server every 1 second
 			go instance.startLoop()
@@ -74,7 +137,13 @@ func (instance *NioClient) Open() error {
 			if nil != err {
 				return err
 			}
-			return instance.handshake()
+			_, err = instance.connect()
+			if nil != err && instance.AutoReconnect {
+				// server is not available yet
+				go instance.reconnect()
+				return nil
+			}
+			return err
 		}
 	}
 	return nil
@@ -82,16 +151,24 @@ func (instance *NioClient) Open() error {
 
 func (instance *NioClient) Close() error {
 	if nil != instance {
-		if nil != instance.conn {
-			instance.closed = true
-			err := instance.conn.Close()
+		instance.stopReconnect()
+		instance.connMux.Lock()
+		c := instance.conn
+		instance.connMux.Unlock()
+		if nil != c {
+			instance.setClosed(true)
+			err := c.Close()
 
 			// emit event
 			instance.setConnected(false)
 
 			return err
 		}
-		instance.stopChan <- true
+		instance.setClosed(true)
+		select {
+		case instance.stopChan <- true:
+		default:
+		}
 	}
 	return nil
 }
@@ -102,18 +179,89 @@ func (instance *NioClient) Join() {
 	<-instance.stopChan
 }
 
+// Send sends a message and waits for the response.
+// Send can be called concurrently: all requests share the same connection.
 func (instance *NioClient) Send(data interface{}) (*NioMessage, error) {
+	return instance.SendContext(context.Background(), data)
+}
+
+// SendContext is like Send, but stops waiting for the response when ctx is done
+func (instance *NioClient) SendContext(ctx context.Context, data interface{}) (*NioMessage, error) {
 	if nil != instance {
 
 		// creates NIO message
 		message := new(NioMessage)
 		message.Body = data
 
-		return instance.send(message, false)
+		return instance.send(ctx, message)
 	}
 	return nil, nil
 }
 
+// OnPush sets the handler of messages sent by server with NioServer.SendTo or NioServer.Broadcast.
+// Pushes are notified in the same order they are sent.
+func (instance *NioClient) OnPush(callback NioPushHandler) {
+	if nil != instance {
+		instance.pushMux.Lock()
+		instance.onPush = callback
+		instance.pushMux.Unlock()
+	}
+}
+
+func (instance *NioClient) OffPush() {
+	if nil != instance {
+		instance.pushMux.Lock()
+		instance.onPush = nil
+		instance.pushMux.Unlock()
+	}
+}
+
+// Subscribe receives messages published on topics matching pattern (see MatchTopic).
+// Subscriptions are restored when the client reconnects.
+func (instance *NioClient) Subscribe(pattern string, handler NioTopicHandler) error {
+	if nil != instance {
+		if !validTopic(pattern, true) {
+			return ErrorInvalidTopic
+		}
+		instance.topicsMux.Lock()
+		if nil == instance.topics {
+			instance.topics = make(map[string]NioTopicHandler)
+		}
+		instance.topics[pattern] = handler
+		instance.topicsMux.Unlock()
+
+		err := instance.sendPubSub(newPubSub(pubsubSubscribe, pattern, nil))
+		if nil != err {
+			instance.topicsMux.Lock()
+			delete(instance.topics, pattern)
+			instance.topicsMux.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+func (instance *NioClient) Unsubscribe(pattern string) error {
+	if nil != instance {
+		instance.topicsMux.Lock()
+		delete(instance.topics, pattern)
+		instance.topicsMux.Unlock()
+		return instance.sendPubSub(newPubSub(pubsubUnsubscribe, pattern, nil))
+	}
+	return nil
+}
+
+// Publish sends a message to all clients subscribed to a matching topic. Topic cannot contain wildcards.
+func (instance *NioClient) Publish(topic string, body interface{}) error {
+	if nil != instance {
+		if !validTopic(topic, false) {
+			return ErrorInvalidTopic
+		}
+		return instance.sendPubSub(newPubSub(pubsubPublish, topic, serialize(body)))
+	}
+	return nil
+}
+
 func (instance *NioClient) OnConnect(callback func(e *qb_events.Event)) {
 	if nil != instance {
 		instance.events.On("connect", callback)
@@ -143,7 +291,7 @@ func (instance *NioClient) OffDisconnect() {
 //----------------------------------------------------------------------------------------------------------------------
 
 func (instance *NioClient) initRSA() error {
-	if nil != instance && instance.Secure && nil == instance.privateKey {
+	if nil != instance && instance.Secure && nil == instance.Auth && nil == instance.privateKey && !instance.isTrusted() {
 		// TODO: implement loading from file
 
 		// auto-generates
@@ -157,32 +305,57 @@ func (instance *NioClient) initRSA() error {
 	return nil
 }
 
+func (instance *NioClient) isClosed() bool {
+	return atomic.LoadInt32(&instance.closed) == 1
+}
+
+func (instance *NioClient) setClosed(value bool) {
+	if value {
+		atomic.StoreInt32(&instance.closed, 1)
+	} else {
+		atomic.StoreInt32(&instance.closed, 0)
+	}
+}
+
 func (instance *NioClient) setConnected(status bool) {
 	if nil != instance {
-		if status {
-			if !instance.connected {
+		instance.connMux.Lock()
+		changed := instance.connected != status
+		instance.connected = status
+		if !status && nil != instance.conn {
+			// reset connection for next call to regenerate
+			_ = instance.conn.Close()
+			instance.conn = nil
+		}
+		instance.connMux.Unlock()
+
+		if changed {
+			if status {
 				instance.events.EmitAsync("connect")
-			}
-		} else {
-			if instance.connected {
+			} else {
 				instance.events.EmitAsync("disconnect")
 			}
-			// reset connection for next call to regenerate
-			if nil != instance.conn {
-				_ = instance.conn.Close()
-				instance.conn = nil
-			}
 		}
-		instance.connected = status
 	}
 }
 
+// isTrusted returns true for a trusted unix socket, messages are not encrypted
+func (instance *NioClient) isTrusted() bool {
+	return instance.TrustedSocket && IsUnixAddress(instance.host)
+}
+
+// dial connects to a TCP server or to a unix socket
+func (instance *NioClient) dial() (net.Conn, error) {
+	network, address := networkAddress(instance.host, instance.port)
+	return net.DialTimeout(network, address, instance.Timeout)
+}
+
 func (instance *NioClient) test() error {
 	if nil != instance {
 		instance.mux.Lock()
 		defer instance.mux.Unlock()
 
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%v", instance.host, instance.port), instance.Timeout)
+		conn, err := instance.dial()
 		if nil != conn {
 			err = conn.Close()
 		}
@@ -191,33 +364,242 @@ func (instance *NioClient) test() error {
 	return nil
 }
 
-func (instance *NioClient) connect() (net.Conn, error) {
+// connect returns current connection or creates a new one. New connections are used after the handshake.
+func (instance *NioClient) connect() (*clientConnection, error) {
 	if nil != instance {
-		if nil == instance.conn {
-			conn, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%v", instance.host, instance.port), instance.Timeout)
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		instance.connMux.Lock()
+		c := instance.conn
+		instance.connMux.Unlock()
+		if nil == c {
+			conn, err := instance.dial()
+			if nil == err {
+				c, err = newClientConnection(conn, instance.Codec, instance.Timeout, instance.MaxMessageSize)
+			}
+			if nil == err {
+				pushes := make(chan *NioMessage, 100)
+				go instance.read(c, pushes)
+				go instance.dispatch(c, pushes)
+				err = instance.handshake(c)
+				if nil == err {
+					err = instance.resubscribe(c)
+				}
+				if nil != err {
+					_ = c.Close()
+				}
+			}
 			if nil == err {
-				instance.conn = conn
+				instance.connMux.Lock()
+				instance.conn = c
+				instance.connMux.Unlock()
 				// trigger connect
 				instance.setConnected(true)
 			} else {
 				// trigger disconnect
 				instance.setConnected(false)
 			}
-			return conn, err
+			return c, err
 		}
-		return instance.conn, nil
+		return c, nil
 	}
 	return nil, nil
 }
 
-func (instance *NioClient) handshake() error {
+// read reads all messages from a connection until it is closed
+func (instance *NioClient) read(c *clientConnection, pushes chan *NioMessage) {
+	defer close(pushes)
+	defer c.fail()
+
+	for {
+		var message NioMessage
+		err := decode(c.codec, c.reader, &message, c.maxSize)
+		if nil != err {
+			instance.connMux.Lock()
+			current := instance.conn == c
+			instance.connMux.Unlock()
+			if current && !instance.isClosed() {
+				// connection lost
+				instance.setConnected(false)
+				if instance.AutoReconnect {
+					go instance.reconnect()
+				}
+			}
+			return
+		}
+		if session := c.getSession(); nil != session {
+			// authenticated session: messages are decrypted in the same order they are sent
+			if v, b := message.Body.([]byte); b {
+				data, err := session.open(message.Id, message.Push, v)
+				if nil != err {
+					_ = c.Close() // tampered or replayed
+					continue
+				}
+				message.Body = data
+			}
+		}
+		if message.Push {
+			pushes <- &message
+		} else {
+			c.deliver(&message)
+		}
+	}
+}
+
+// dispatch notifies pushes to the handler
+func (instance *NioClient) dispatch(c *clientConnection, pushes chan *NioMessage) {
+	for message := range pushes {
+		instance.decryptBody(c, message)
+		if r := parsePubSub(message); nil != r && r.Action == pubsubMessage {
+			instance.dispatchTopic(r)
+		} else if handler := instance.getPushHandler(); nil != handler {
+			handler(message)
+		}
+	}
+}
+
+func (instance *NioClient) getPushHandler() NioPushHandler {
+	instance.pushMux.RLock()
+	defer instance.pushMux.RUnlock()
+	return instance.onPush
+}
+
+// dispatchTopic notifies a published message to handlers of matching subscriptions
+func (instance *NioClient) dispatchTopic(r *pubsubRequest) {
+	instance.topicsMux.RLock()
+	handlers := make([]NioTopicHandler, 0, 1)
+	for pattern, handler := range instance.topics {
+		if nil != handler && MatchTopic(pattern, r.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	instance.topicsMux.RUnlock()
+	for _, handler := range handlers {
+		handler(&NioTopicMessage{Topic: r.Topic, Body: r.Body})
+	}
+}
+
+// sendPubSub sends a pub/sub request and checks the response
+func (instance *NioClient) sendPubSub(r *pubsubRequest) error {
+	response, err := instance.Send(qb_utils.JSON.Bytes(r))
+	if nil != err {
+		return err
+	}
+	return pubsubError(response)
+}
+
+// resubscribe restores subscriptions on a new connection
+func (instance *NioClient) resubscribe(c *clientConnection) error {
+	instance.topicsMux.RLock()
+	patterns := make([]string, 0, len(instance.topics))
+	for pattern := range instance.topics {
+		patterns = append(patterns, pattern)
+	}
+	instance.topicsMux.RUnlock()
+	for _, pattern := range patterns {
+		message := &NioMessage{Body: qb_utils.JSON.Bytes(newPubSub(pubsubSubscribe, pattern, nil))}
+		if err := instance.encryptBody(c, message); nil != err {
+			return err
+		}
+		response, err := instance.roundTrip(context.Background(), c, message)
+		if nil != err {
+			return err
+		}
+		instance.decryptBody(c, response)
+		if err = pubsubError(response); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func pubsubError(response *NioMessage) error {
+	r := parsePubSub(response)
+	if nil == r {
+		return errors.New("Client failed to read pub/sub response")
+	}
+	if len(r.Error) > 0 {
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+func (instance *NioClient) encryptBody(c *clientConnection, message *NioMessage) error {
+	if key := c.getSessionKey(); nil != instance.publicKey && len(key) > 0 {
+		data, err := encrypt(serialize(message.Body), key)
+		if nil != err {
+			return errors.New("Client Encryption error")
+		}
+		message.Body = data
+	} else {
+		message.Body = serialize(message.Body)
+	}
+	return nil
+}
+
+func (instance *NioClient) decryptBody(c *clientConnection, message *NioMessage) {
+	if key := c.getSessionKey(); len(key) > 0 {
+		if v, b := message.Body.([]byte); b {
+			data, err := decrypt(v, key)
+			if nil == err {
+				message.Body = data
+			}
+		}
+	}
+}
+
+func (instance *NioClient) handshake(c *clientConnection) error {
+	if nil != instance && nil != instance.Auth && !instance.isTrusted() {
+		return instance.authHandshake(c)
+	}
 	if nil != instance {
-		HANDSHAKE.PublicKey = instance.publicKey
-		response, err := instance.send(HANDSHAKE, true)
+		message := *HANDSHAKE
+		if !instance.isTrusted() {
+			message.PublicKey = instance.publicKey
+		}
+		message.Body = serialize(message.Body)
+		response, err := instance.roundTrip(context.Background(), c, &message)
 		if nil != err {
 			return err
 		}
-		instance.serverKey = response.PublicKey
+		var sessionKey []byte
+		if len(response.SessionKey) > 0 {
+			data, err := decryptKey(response.SessionKey, instance.privateKey)
+			if nil == err {
+				sessionKey = data
+			}
+		}
+		c.setKeys(response.PublicKey, sessionKey)
+	}
+	return nil
+}
+
+// authHandshake authenticates the server and creates the session of the connection
+func (instance *NioClient) authHandshake(c *clientConnection) error {
+	hello, state, err := newClientHello()
+	if nil != err {
+		return err
+	}
+	response, err := instance.roundTrip(context.Background(), c, &NioMessage{Body: qb_utils.JSON.Bytes(hello)})
+	if nil != err {
+		return err
+	}
+	serverHello := parseAuthHandshake(response)
+	if nil == serverHello {
+		return ErrorAuthentication
+	}
+	finish, err := instance.Auth.clientFinish(state, serverHello)
+	if nil != err {
+		return err
+	}
+	c.startSession(state.session)
+	response, err = instance.roundTrip(context.Background(), c, &NioMessage{Body: qb_utils.JSON.Bytes(finish)})
+	if nil != err {
+		return err
+	}
+	if string(serialize(response.Body)) != string(HANDSHAKE.Body.([]byte)) {
+		return ErrorAuthentication
 	}
 	return nil
 }
@@ -227,6 +609,9 @@ func (instance *NioClient) ping() error {
 		err := instance.test()
 		instance.setConnected(nil == err)
 		if nil != err {
+			if instance.AutoReconnect && !instance.isClosed() {
+				go instance.reconnect()
+			}
 			return err
 		}
 	}
@@ -236,7 +621,7 @@ func (instance *NioClient) ping() error {
 func (instance *NioClient) startLoop() {
 
 	for {
-		if instance.closed {
+		if instance.isClosed() {
 			return
 		}
 		if nil != instance && nil != instance.pingTimer {
@@ -245,7 +630,7 @@ func (instance *NioClient) startLoop() {
 				return
 			case <-instance.pingTimer.C:
 				// event
-				if nil != instance && !instance.closed && instance.EnablePing {
+				if nil != instance && !instance.isClosed() && instance.EnablePing {
 					_ = instance.ping()
 				}
 			}
@@ -254,75 +639,316 @@ func (instance *NioClient) startLoop() {
 
 }
 
-func (instance *NioClient) send(message *NioMessage, handshake bool) (*NioMessage, error) {
+func (instance *NioClient) send(ctx context.Context, message *NioMessage) (*NioMessage, error) {
 	if nil != instance {
-		instance.mux.Lock()
-		defer instance.mux.Unlock()
-
-		conn, err := instance.connect()
+		c, err := instance.connect()
+		for nil != err && instance.AutoReconnect && !instance.isClosed() {
+			// wait for reconnection
+			go instance.reconnect()
+			if err = instance.waitReconnect(ctx); nil != err {
+				return nil, err
+			}
+			c, err = instance.connect()
+		}
 		if nil != err {
 			_ = instance.Close() // reset connection
 			return nil, err
 		}
 
-		if handshake {
-			message.PublicKey = instance.publicKey
+		// ENCRYPT BODY
+		if err = instance.encryptBody(c, message); nil != err {
+			return nil, err
 		}
 
-		// ENCRYPT BODY
-		if !handshake && nil != instance.publicKey && len(instance.sessionKey) > 0 {
-			v := serialize(message.Body)
-			data, err := encrypt(v, instance.sessionKey)
-			if nil == err {
-				message.Body = data
-			} else {
-				return nil, errors.New("Client Encryption error")
-			}
-		} else {
-			message.Body = serialize(message.Body)
+		response, err := instance.roundTrip(ctx, c, message)
+		if nil != err {
+			return nil, err
 		}
 
-		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-		enc := gob.NewEncoder(rw)
-		err = enc.Encode(message)
-		if err != nil {
-			return nil, errors.New(fmt.Sprintf("Encode failed for message: %#v", message))
+		// RESPONSE FROM SERVER
+		// DECRYPT BODY
+		instance.decryptBody(c, response)
+		return response, nil
+	}
+	return nil, nil
+}
+
+// reconnect tries to connect with exponential backoff and jitter until connected or closed.
+// Requests waiting for reconnection are released when connected.
+func (instance *NioClient) reconnect() {
+	if !atomic.CompareAndSwapInt32(&instance.reconnecting, 0, 1) {
+		return // already reconnecting
+	}
+	defer atomic.StoreInt32(&instance.reconnecting, 0)
+
+	instance.queueMux.Lock()
+	done := instance.done
+	instance.queueMux.Unlock()
+	for attempt := 0; !instance.isClosed(); attempt++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(instance.backoff(attempt)):
 		}
-		err = rw.Flush()
-		if err != nil {
-			return nil, errors.New("Flush failed.")
+		if instance.isClosed() {
+			return
+		}
+		if _, err := instance.connect(); nil == err {
+			instance.releaseQueue()
+			return
 		}
+	}
+}
+
+// backoff returns a random delay between half and full exponential delay
+func (instance *NioClient) backoff(attempt int) time.Duration {
+	delay, max := instance.ReconnectDelay, instance.ReconnectMax
+	if delay <= 0 {
+		delay = 500 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
-		// read NIO response
-		var response NioMessage
-		dec := gob.NewDecoder(rw)
-		err = dec.Decode(&response)
-		if err != nil {
+// waitReconnect waits in queue for reconnection. Fails if queue is disabled or full.
+func (instance *NioClient) waitReconnect(ctx context.Context) error {
+	instance.queueMux.Lock()
+	if len(instance.queue) >= instance.QueueSize {
+		instance.queueMux.Unlock()
+		if instance.QueueSize <= 0 {
+			return errors.New("Client is disconnected")
+		}
+		return ErrorQueueFull
+	}
+	ready := make(chan bool)
+	instance.queue = append(instance.queue, ready)
+	done := instance.done
+	instance.queueMux.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-done:
+		return ErrorClientClosed
+	case <-ctx.Done():
+		instance.queueMux.Lock()
+		for i, item := range instance.queue {
+			if item == ready {
+				instance.queue = append(instance.queue[:i], instance.queue[i+1:]...)
+				break
+			}
+		}
+		instance.queueMux.Unlock()
+		return ctx.Err()
+	}
+}
+
+// releaseQueue releases requests waiting for reconnection in arrival order
+func (instance *NioClient) releaseQueue() {
+	instance.queueMux.Lock()
+	defer instance.queueMux.Unlock()
+	for _, ready := range instance.queue {
+		close(ready)
+	}
+	instance.queue = nil
+}
+
+func (instance *NioClient) stopReconnect() {
+	instance.queueMux.Lock()
+	defer instance.queueMux.Unlock()
+	if nil != instance.done {
+		close(instance.done) // stop reconnection and fail queued requests
+		instance.done = nil
+	}
+	instance.queue = nil
+}
+
+// roundTrip writes a message and waits for the response with same id.
+// If ctx has no deadline, the wait is limited by Timeout.
+func (instance *NioClient) roundTrip(ctx context.Context, c *clientConnection, message *NioMessage) (*NioMessage, error) {
+	message.Id = atomic.AddUint64(&instance.lastId, 1)
+	responses := c.register(message.Id)
+	defer c.unregister(message.Id)
+
+	err := c.write(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if _, ok := ctx.Deadline(); !ok && instance.Timeout > 0 {
+		timer := time.NewTimer(instance.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// wait NIO response
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, ErrorResponseTimeout
+	case response, ok := <-responses:
+		if !ok {
 			// fmt.Println(errors.Wrap(err, "Client failed to read response"))
 			return nil, errors.New("Client failed to read response")
-		} else {
-			// RESPONSE FROM SERVER
-			if !handshake {
-				if len(instance.sessionKey) > 0 {
-					// DECRYPT BODY
-					if v, b := response.Body.([]byte); b {
-						data, err := decrypt(v, instance.sessionKey)
-						if nil == err {
-							response.Body = data
-						}
-					}
-				}
-			} else {
-				// handshake
-				if len(response.SessionKey) > 0 {
-					data, err := decryptKey(response.SessionKey, instance.privateKey)
-					if nil == err {
-						instance.sessionKey = data
-					}
-				}
+		}
+		return response, nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c l i e n t    c o n n e c t i o n
+//----------------------------------------------------------------------------------------------------------------------
+
+// newClientConnection negotiates the codec. Gob does not need negotiation (compatible with legacy servers).
+func newClientConnection(conn net.Conn, codecName string, timeout time.Duration, maxSize int) (*clientConnection, error) {
+	instance := new(clientConnection)
+	instance.conn = conn
+	instance.maxSize = maxSize
+	instance.reader = bufio.NewReader(conn)
+	instance.writer = bufio.NewWriter(conn)
+	instance.pending = make(map[uint64]chan *NioMessage)
+	instance.codec = GetCodec(codecName)
+	if nil == instance.codec {
+		_ = conn.Close()
+		return nil, ErrorUnsupportedCodec
+	}
+	if instance.codec.Name() != CodecGob {
+		if timeout > 0 {
+			_ = conn.SetDeadline(time.Now().Add(timeout))
+		}
+		err := writeHello(instance.writer, instance.codec.Name())
+		if nil == err {
+			var name string
+			name, err = readHello(instance.reader)
+			if nil == err && name != instance.codec.Name() {
+				err = ErrorUnsupportedCodec
 			}
-			return &response, nil
 		}
+		if nil != err {
+			_ = conn.Close()
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+	}
+	return instance, nil
+}
+
+func (instance *clientConnection) Close() error {
+	return instance.conn.Close()
+}
+
+func (instance *clientConnection) write(message *NioMessage) error {
+	instance.writeMux.Lock()
+	defer instance.writeMux.Unlock()
+
+	if nil != instance.session {
+		message.Body = instance.session.seal(message.Id, message.Push, serialize(message.Body))
+	}
+	err := instance.codec.Encode(instance.writer, message)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Encode failed for message: %#v", message))
+	}
+	if nil != instance.starting {
+		// session starts before the server can receive the message (and respond)
+		instance.mux.Lock()
+		instance.session, instance.starting = instance.starting, nil
+		instance.mux.Unlock()
+	}
+	err = instance.writer.Flush()
+	if err != nil {
+		return errors.New("Flush failed.")
+	}
+	return nil
+}
+
+// startSession sets the session used after next message (the response to next message is encrypted)
+func (instance *clientConnection) startSession(session *nioSession) {
+	instance.writeMux.Lock()
+	defer instance.writeMux.Unlock()
+	instance.starting = session
+}
+
+func (instance *clientConnection) getSession() *nioSession {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.session
+}
+
+// setKeys sets the keys got on legacy handshake
+func (instance *clientConnection) setKeys(serverKey *rsa.PublicKey, sessionKey []byte) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	instance.serverKey, instance.sessionKey = serverKey, sessionKey
+}
+
+func (instance *clientConnection) getSessionKey() []byte {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.sessionKey
+}
+
+// register returns the channel receiving the response of a request.
+// The channel is closed if the connection is lost.
+func (instance *clientConnection) register(id uint64) chan *NioMessage {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	ch := make(chan *NioMessage, 1)
+	if instance.lost {
+		close(ch)
+	} else {
+		instance.pending[id] = ch
+		if !instance.tagged {
+			instance.order = append(instance.order, id)
+		}
+	}
+	return ch
+}
+
+// unregister removes a request. The id stays in order: a late response of a legacy server must be discarded.
+func (instance *clientConnection) unregister(id uint64) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	delete(instance.pending, id)
+}
+
+// deliver passes a response to the request with same id. Responses of expired requests are discarded.
+// A response with id 0 (legacy server) is passed to the oldest request.
+func (instance *clientConnection) deliver(message *NioMessage) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	if message.Id == 0 {
+		if len(instance.order) == 0 {
+			return
+		}
+		message.Id, instance.order = instance.order[0], instance.order[1:]
+	} else if !instance.tagged {
+		instance.tagged = true
+		instance.order = nil
+	}
+	if ch, ok := instance.pending[message.Id]; ok {
+		delete(instance.pending, message.Id)
+		ch <- message
+	}
+}
+
+// fail closes all pending requests
+func (instance *clientConnection) fail() {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	instance.lost = true
+	for id, ch := range instance.pending {
+		close(ch)
+		delete(instance.pending, id)
 	}
-	return nil, nil
 }
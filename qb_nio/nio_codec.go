@@ -0,0 +1,400 @@
+package qb_nio
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	CodecGob    = "gob"    // default, Go only
+	CodecJson   = "json"   // one JSON document per line
+	CodecBinary = "binary" // length-prefixed binary frames
+
+	codecMagic   = "QBNIO"
+	codecVersion = 1
+
+	DefaultMaxMessageSize = 4 * 1024 * 1024 // 4Mb
+)
+
+var (
+	ErrorUnsupportedCodec = errors.New("unsupported_codec")
+	ErrorInvalidFrame     = errors.New("invalid_frame")
+	ErrorMessageTooLarge  = errors.New("message_too_large")
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// NioCodec writes and reads NioMessage on the wire.
+// Codecs different from gob are negotiated at the beginning of the connection (see readme.md).
+type NioCodec interface {
+	Name() string
+	Encode(w io.Writer, message *NioMessage) error
+	Decode(r *bufio.Reader, message *NioMessage) error
+}
+
+// NioSizedCodec is a codec refusing messages larger than maxSize before reading them.
+// Built-in codecs are sized, custom codecs implementing only NioCodec are not bounded by MaxMessageSize.
+type NioSizedCodec interface {
+	NioCodec
+	DecodeMax(r *bufio.Reader, message *NioMessage, maxSize int) error
+}
+
+// wireMessage is NioMessage as written by language neutral codecs
+type wireMessage struct {
+	Id         uint64 `json:"id,omitempty"`
+	Push       bool   `json:"push,omitempty"`
+	PublicKey  []byte `json:"public_key,omitempty"`  // PKIX, ASN.1 DER
+	SessionKey []byte `json:"session_key,omitempty"` // encrypted with the public key of the client
+	Body       []byte `json:"body,omitempty"`
+}
+
+type gobCodec struct{}
+type jsonCodec struct{}
+type binaryCodec struct{}
+
+var (
+	codecs    = map[string]NioCodec{}
+	codecsMux sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(new(gobCodec))
+	RegisterCodec(new(jsonCodec))
+	RegisterCodec(new(binaryCodec))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+// RegisterCodec adds a codec (or replaces a codec with same name). Both client and server must register custom codecs.
+func RegisterCodec(codec NioCodec) {
+	if nil != codec {
+		codecsMux.Lock()
+		defer codecsMux.Unlock()
+		codecs[codec.Name()] = codec
+	}
+}
+
+func GetCodec(name string) NioCodec {
+	if len(name) == 0 {
+		name = CodecGob
+	}
+	codecsMux.RLock()
+	defer codecsMux.RUnlock()
+	return codecs[name]
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	g o b
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *gobCodec) Name() string {
+	return CodecGob
+}
+
+func (instance *gobCodec) Encode(w io.Writer, message *NioMessage) error {
+	return gob.NewEncoder(w).Encode(message)
+}
+
+func (instance *gobCodec) Decode(r *bufio.Reader, message *NioMessage) error {
+	return instance.DecodeMax(r, message, DefaultMaxMessageSize)
+}
+
+func (instance *gobCodec) DecodeMax(r *bufio.Reader, message *NioMessage, maxSize int) error {
+	return gob.NewDecoder(&gobReader{r: r, max: maxSize}).Decode(message)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	j s o n
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *jsonCodec) Name() string {
+	return CodecJson
+}
+
+func (instance *jsonCodec) Encode(w io.Writer, message *NioMessage) error {
+	wire, err := toWire(message)
+	if nil != err {
+		return err
+	}
+	return json.NewEncoder(w).Encode(wire) // adds new line
+}
+
+func (instance *jsonCodec) Decode(r *bufio.Reader, message *NioMessage) error {
+	return instance.DecodeMax(r, message, DefaultMaxMessageSize)
+}
+
+func (instance *jsonCodec) DecodeMax(r *bufio.Reader, message *NioMessage, maxSize int) error {
+	line, err := readLine(r, maxSize)
+	if nil != err {
+		return err
+	}
+	var wire wireMessage
+	if err = json.Unmarshal(line, &wire); nil != err {
+		return err
+	}
+	return fromWire(&wire, message)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	b i n a r y
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *binaryCodec) Name() string {
+	return CodecBinary
+}
+
+// Encode writes a frame:
+// uint32 length of frame | uint8 flags | uint64 id | uint32 len + public key | uint32 len + session key | body
+func (instance *binaryCodec) Encode(w io.Writer, message *NioMessage) error {
+	wire, err := toWire(message)
+	if nil != err {
+		return err
+	}
+	size := 1 + 8 + 4 + len(wire.PublicKey) + 4 + len(wire.SessionKey) + len(wire.Body)
+	frame := make([]byte, 0, 4+size)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(size))
+	var flags byte
+	if wire.Push {
+		flags |= 1
+	}
+	frame = append(frame, flags)
+	frame = binary.BigEndian.AppendUint64(frame, wire.Id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(wire.PublicKey)))
+	frame = append(frame, wire.PublicKey...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(wire.SessionKey)))
+	frame = append(frame, wire.SessionKey...)
+	frame = append(frame, wire.Body...)
+	_, err = w.Write(frame)
+	return err
+}
+
+func (instance *binaryCodec) Decode(r *bufio.Reader, message *NioMessage) error {
+	return instance.DecodeMax(r, message, DefaultMaxMessageSize)
+}
+
+func (instance *binaryCodec) DecodeMax(r *bufio.Reader, message *NioMessage, maxSize int) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); nil != err {
+		return err
+	}
+	if size < 17 {
+		return ErrorInvalidFrame
+	}
+	if int64(size) > int64(maxSize) {
+		return ErrorMessageTooLarge
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); nil != err {
+		return err
+	}
+	wire := new(wireMessage)
+	wire.Push = frame[0]&1 == 1
+	wire.Id = binary.BigEndian.Uint64(frame[1:9])
+	frame = frame[9:]
+	var ok bool
+	if wire.PublicKey, frame, ok = readBlock(frame); !ok {
+		return ErrorInvalidFrame
+	}
+	if wire.SessionKey, frame, ok = readBlock(frame); !ok {
+		return ErrorInvalidFrame
+	}
+	wire.Body = frame
+	return fromWire(wire, message)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+// decode reads a message refusing messages larger than maxSize (default DefaultMaxMessageSize).
+// Codecs not implementing NioSizedCodec are not bounded.
+func decode(codec NioCodec, r *bufio.Reader, message *NioMessage, maxSize int) error {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	if sized, b := codec.(NioSizedCodec); b {
+		return sized.DecodeMax(r, message, maxSize)
+	}
+	return codec.Decode(r, message)
+}
+
+// gobReader reads the gob messages (a length followed by data) of a value up to max bytes.
+// The length of each gob message is checked before gob allocates and reads it.
+type gobReader struct {
+	r         *bufio.Reader
+	max       int
+	read      int // bytes of gob messages started
+	remaining int // bytes of current gob message
+}
+
+func (instance *gobReader) Read(p []byte) (int, error) {
+	if err := instance.next(); nil != err {
+		return 0, err
+	}
+	if len(p) > instance.remaining {
+		p = p[:instance.remaining]
+	}
+	n, err := instance.r.Read(p)
+	instance.remaining -= n
+	return n, err
+}
+
+// ReadByte avoids the buffering of gob decoder: next value is read by a new decoder
+func (instance *gobReader) ReadByte() (byte, error) {
+	if err := instance.next(); nil != err {
+		return 0, err
+	}
+	b, err := instance.r.ReadByte()
+	if nil == err {
+		instance.remaining--
+	}
+	return b, err
+}
+
+// next reads the length of next gob message (an unsigned integer) when current message is completed
+func (instance *gobReader) next() error {
+	if instance.remaining > 0 {
+		return nil
+	}
+	header, err := instance.r.Peek(1)
+	if nil != err {
+		return err
+	}
+	size, n := uint64(header[0]), 1
+	if header[0] >= 0x80 {
+		// byte count (negated) followed by big endian value
+		count := -int(int8(header[0]))
+		if count < 1 || count > 8 {
+			return ErrorInvalidFrame
+		}
+		n += count
+		if header, err = instance.r.Peek(n); nil != err {
+			return err
+		}
+		size = 0
+		for _, b := range header[1:] {
+			size = size<<8 | uint64(b)
+		}
+	}
+	if size > uint64(instance.max) || uint64(instance.read+n)+size > uint64(instance.max) {
+		return ErrorMessageTooLarge
+	}
+	instance.remaining = n + int(size)
+	instance.read += instance.remaining
+	return nil
+}
+
+// readLine reads up to a new line. Fails if the line is longer than limit.
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		data, err := r.ReadSlice('\n')
+		if len(line)+len(data) > limit {
+			return nil, ErrorMessageTooLarge
+		}
+		line = append(line, data...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func readBlock(data []byte) (block []byte, remaining []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	size := binary.BigEndian.Uint32(data)
+	if uint32(len(data)-4) < size {
+		return nil, nil, false
+	}
+	if size > 0 {
+		block = data[4 : 4+size]
+	}
+	return block, data[4+size:], true
+}
+
+func toWire(message *NioMessage) (*wireMessage, error) {
+	wire := &wireMessage{
+		Id:         message.Id,
+		Push:       message.Push,
+		SessionKey: message.SessionKey,
+		Body:       serialize(message.Body),
+	}
+	if nil != message.PublicKey {
+		key, err := x509.MarshalPKIXPublicKey(message.PublicKey)
+		if nil != err {
+			return nil, err
+		}
+		wire.PublicKey = key
+	}
+	return wire, nil
+}
+
+func fromWire(wire *wireMessage, message *NioMessage) error {
+	message.Id = wire.Id
+	message.Push = wire.Push
+	message.SessionKey = wire.SessionKey
+	message.Body = wire.Body
+	if nil == message.Body {
+		message.Body = []byte{}
+	}
+	if len(wire.PublicKey) > 0 {
+		key, err := x509.ParsePKIXPublicKey(wire.PublicKey)
+		if nil != err {
+			return err
+		}
+		if v, b := key.(*rsa.PublicKey); b {
+			message.PublicKey = v
+		} else {
+			return errors.New("unsupported_public_key")
+		}
+	}
+	return nil
+}
+
+// writeHello writes the codec negotiation request (or response): magic | version | uint8 len + name
+func writeHello(w *bufio.Writer, name string) error {
+	data := append([]byte(codecMagic), codecVersion, byte(len(name)))
+	data = append(data, name...)
+	if _, err := w.Write(data); nil != err {
+		return err
+	}
+	return w.Flush()
+}
+
+// readHello reads the codec name from a negotiation request (or response)
+func readHello(r *bufio.Reader) (string, error) {
+	header := make([]byte, len(codecMagic)+2)
+	if _, err := io.ReadFull(r, header); nil != err {
+		return "", err
+	}
+	if string(header[:len(codecMagic)]) != codecMagic || header[len(codecMagic)] != codecVersion {
+		return "", ErrorInvalidFrame
+	}
+	name := make([]byte, header[len(codecMagic)+1])
+	if _, err := io.ReadFull(r, name); nil != err {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// isHello checks if a connection starts with a codec negotiation. Gob connections (legacy) do not.
+func isHello(r *bufio.Reader) bool {
+	data, err := r.Peek(len(codecMagic))
+	return nil == err && string(data) == codecMagic
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package qb_nio
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials reads SO_PEERCRED of a unix socket
+func peerCredentials(conn net.Conn) (*NioPeerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, ErrorPeerCredentialsUnsupported
+	}
+	raw, err := unixConn.SyscallConn()
+	if nil != err {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if nil == err {
+		err = credErr
+	}
+	if nil != err {
+		return nil, err
+	}
+	return &NioPeerCredentials{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
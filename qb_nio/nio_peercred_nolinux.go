@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package qb_nio
+
+import (
+	"net"
+)
+
+// peerCredentials is supported only on linux (SO_PEERCRED)
+func peerCredentials(conn net.Conn) (*NioPeerCredentials, error) {
+	return nil, ErrorPeerCredentialsUnsupported
+}
@@ -0,0 +1,207 @@
+package qb_nio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	pubsubProtocol    = "qbnio-pubsub-v1"
+	pubsubSubscribe   = "subscribe"
+	pubsubUnsubscribe = "unsubscribe"
+	pubsubPublish     = "publish"
+	pubsubMessage     = "message" // published message pushed to a subscriber
+	pubsubAck         = "ack"
+
+	DefaultSubscriberQueueSize = 1000
+)
+
+var (
+	ErrorInvalidTopic = errors.New("invalid_topic")
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// NioTopicMessage is a message published on a topic
+type NioTopicMessage struct {
+	Topic string
+	Body  []byte
+}
+
+type NioTopicHandler func(message *NioTopicMessage)
+
+// pubsubRequest is the body of pub/sub messages
+type pubsubRequest struct {
+	Protocol string `json:"protocol"`
+	Action   string `json:"action"`
+	Topic    string `json:"topic,omitempty"` // topic or pattern
+	Body     []byte `json:"body,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// subscriber is a client with at least a subscription.
+// Published messages are queued and pushed by a goroutine, so a slow client does not block publishers.
+type subscriber struct {
+	client   *client
+	patterns map[string]bool
+	queue    chan *pubsubRequest
+}
+
+// topicRegistry routes published messages to subscribers
+type topicRegistry struct {
+	subscribers map[string]*subscriber // by client id
+	mux         sync.RWMutex
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+// MatchTopic checks if a topic matches a pattern. Topics are made of segments separated by dots:
+// "*" matches a single segment and "**" matches any number of segments (also none).
+//
+//	orders.*   matches orders.created, not orders.eu.created
+//	orders.**  matches orders, orders.created and orders.eu.created
+func MatchTopic(pattern, topic string) bool {
+	return matchSegments(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func parsePubSub(message *NioMessage) *pubsubRequest {
+	if v, b := message.Body.([]byte); b && bytes.Contains(v, []byte(pubsubProtocol)) {
+		var r pubsubRequest
+		if nil == json.Unmarshal(v, &r) && r.Protocol == pubsubProtocol {
+			return &r
+		}
+	}
+	return nil
+}
+
+func newPubSub(action, topic string, body []byte) *pubsubRequest {
+	return &pubsubRequest{Protocol: pubsubProtocol, Action: action, Topic: topic, Body: body}
+}
+
+func matchSegments(pattern, topic []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(topic); i++ {
+				if matchSegments(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(topic) == 0 || (pattern[0] != "*" && pattern[0] != topic[0]) {
+			return false
+		}
+		pattern, topic = pattern[1:], topic[1:]
+	}
+	return len(topic) == 0
+}
+
+// validTopic checks a topic (or a pattern if wildcards are allowed)
+func validTopic(topic string, wildcards bool) bool {
+	if len(topic) == 0 {
+		return false
+	}
+	for _, segment := range strings.Split(topic, ".") {
+		if len(segment) == 0 {
+			return false
+		}
+		if strings.Contains(segment, "*") && (!wildcards || (segment != "*" && segment != "**")) {
+			return false
+		}
+	}
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t o p i c    r e g i s t r y
+//----------------------------------------------------------------------------------------------------------------------
+
+func newTopicRegistry() *topicRegistry {
+	instance := new(topicRegistry)
+	instance.subscribers = make(map[string]*subscriber)
+	return instance
+}
+
+// subscribe adds a pattern to a client. The delivery goroutine starts with the first subscription.
+func (instance *topicRegistry) subscribe(c *client, pattern string, queueSize int, deliver func(*client, *pubsubRequest)) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	s, ok := instance.subscribers[c.Id]
+	if !ok {
+		if queueSize < 1 {
+			queueSize = DefaultSubscriberQueueSize
+		}
+		s = &subscriber{client: c, patterns: make(map[string]bool), queue: make(chan *pubsubRequest, queueSize)}
+		instance.subscribers[c.Id] = s
+		go func() {
+			for message := range s.queue {
+				deliver(s.client, message)
+			}
+		}()
+	}
+	s.patterns[pattern] = true
+}
+
+func (instance *topicRegistry) unsubscribe(clientId, pattern string) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	if s, ok := instance.subscribers[clientId]; ok {
+		delete(s.patterns, pattern)
+		if len(s.patterns) == 0 {
+			delete(instance.subscribers, clientId)
+			close(s.queue)
+		}
+	}
+}
+
+// remove removes all subscriptions of a client
+func (instance *topicRegistry) remove(clientId string) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	if s, ok := instance.subscribers[clientId]; ok {
+		delete(instance.subscribers, clientId)
+		close(s.queue)
+	}
+}
+
+// publish queues a message to all matching subscribers. Returns the number of subscribers.
+// Messages are dropped for subscribers with a full queue.
+func (instance *topicRegistry) publish(topic string, body []byte) int {
+	instance.mux.RLock()
+	defer instance.mux.RUnlock()
+
+	count := 0
+	message := newPubSub(pubsubMessage, topic, body)
+	for _, s := range instance.subscribers {
+		for pattern := range s.patterns {
+			if MatchTopic(pattern, topic) {
+				select {
+				case s.queue <- message:
+					count++
+				default:
+					// slow subscriber
+				}
+				break
+			}
+		}
+	}
+	return count
+}
@@ -0,0 +1,132 @@
+package qb_nio
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "users", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.**", "orders", true},
+		{"orders.**", "orders.eu.created", true},
+		{"**.created", "orders.eu.created", true},
+		{"**.created", "orders.eu.deleted", false},
+		{"**", "anything.at.all", true},
+	}
+	for _, test := range tests {
+		if got := MatchTopic(test.pattern, test.topic); got != test.match {
+			t.Errorf("%q %q: expected %v, got %v", test.pattern, test.topic, test.match, got)
+		}
+	}
+}
+
+func TestNioClient_pubsub(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		server, subscriber := openTestPair(t, secure, "")
+		publisher := NIO.NewClient("127.0.0.1", server.Port())
+		publisher.Secure = secure
+		if err := publisher.Open(); nil != err {
+			t.Fatalf("open publisher: %v", err)
+		}
+
+		received := make(chan string, 10)
+		err := subscriber.Subscribe("orders.*", func(message *NioTopicMessage) {
+			received <- message.Topic + ":" + string(message.Body)
+		})
+		if nil != err {
+			t.Fatalf("subscribe: %v", err)
+		}
+		if err = subscriber.Subscribe("orders.*.bad*", nil); err != ErrorInvalidTopic {
+			t.Errorf("expected invalid topic, got %v", err)
+		}
+		if err = publisher.Publish("orders.*", "x"); err != ErrorInvalidTopic {
+			t.Errorf("expected invalid topic, got %v", err)
+		}
+
+		_ = publisher.Publish("users.created", "ignored")
+		_ = publisher.Publish("orders.created", "1")
+		if n, _ := server.Publish("orders.deleted", "2"); n != 1 {
+			t.Errorf("expected 1 subscriber, got %d", n)
+		}
+		// requests are still handled by OnMessage
+		if response, err := subscriber.Send("echo"); nil != err || string(response.Body.([]byte)) != "echo" {
+			t.Errorf("bad response: %v %v", response, err)
+		}
+		for _, expected := range []string{"orders.created:1", "orders.deleted:2"} {
+			select {
+			case got := <-received:
+				if got != expected {
+					t.Errorf("secure=%v: expected %q, got %q", secure, expected, got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("secure=%v: %q not received", secure, expected)
+			}
+		}
+
+		if err = subscriber.Unsubscribe("orders.*"); nil != err {
+			t.Errorf("unsubscribe: %v", err)
+		}
+		if n, _ := server.Publish("orders.created", "3"); n != 0 {
+			t.Errorf("expected no subscribers, got %d", n)
+		}
+
+		// disconnected clients are unsubscribed
+		_ = publisher.Subscribe("**", nil)
+		_ = publisher.Close()
+		time.Sleep(100 * time.Millisecond)
+		if n, _ := server.Publish("orders.created", "4"); n != 0 {
+			t.Errorf("expected no subscribers after disconnect, got %d", n)
+		}
+		_ = subscriber.Close()
+		_ = server.Close()
+	}
+}
+
+func TestNioClient_pubsubReconnect(t *testing.T) {
+	server := openTestServer(t, nil)
+	port := server.Port()
+	client := NIO.NewClient("127.0.0.1", port)
+	client.AutoReconnect = true
+	client.ReconnectDelay = 50 * time.Millisecond
+	client.ReconnectMax = 100 * time.Millisecond
+	if err := client.Open(); nil != err {
+		t.Fatalf("open client: %v", err)
+	}
+	defer client.Close()
+
+	received := make(chan string, 1)
+	_ = client.Subscribe("jobs.*", func(message *NioTopicMessage) {
+		received <- string(message.Body)
+	})
+	_ = server.Close()
+
+	server = NIO.NewServer(port)
+	if err := server.Open(); nil != err {
+		t.Fatalf("reopen server: %v", err)
+	}
+	defer server.Close()
+	for i := 0; i < 50 && !client.IsConnected(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n, _ := server.Publish("jobs.done", "restored"); n != 1 {
+		t.Fatalf("subscription not restored")
+	}
+	select {
+	case got := <-received:
+		if got != "restored" {
+			t.Errorf("bad message %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("message not received")
+	}
+}
@@ -0,0 +1,298 @@
+package qb_nio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	rpcProtocol = "qbnio-rpc-v1"
+
+	RpcMethods = "rpc.methods" // built-in method listing registered methods
+
+	RpcCodeMethodNotFound = "method_not_found"
+	RpcCodeInvalidParams  = "invalid_params"
+	RpcCodeUnauthorized   = "unauthorized"
+	RpcCodeTimeout        = "timeout"
+	RpcCodeInternal       = "internal"
+)
+
+var (
+	ErrorRpcMethodNotFound = NewRpcError(RpcCodeMethodNotFound, "method not found")
+	ErrorRpcInvalidParams  = NewRpcError(RpcCodeInvalidParams, "invalid params")
+	ErrorRpcUnauthorized   = NewRpcError(RpcCodeUnauthorized, "unauthorized")
+	ErrorRpcTimeout        = NewRpcError(RpcCodeTimeout, "timeout")
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// NioRpcRequest is a call received by server
+type NioRpcRequest struct {
+	Method   string
+	ClientId string
+	Params   json.RawMessage
+}
+
+// NioRpcHandler runs a method. The response is sent to client as JSON.
+// Errors are sent as NioRpcError: return a NioRpcError to choose the code of the error.
+type NioRpcHandler func(ctx context.Context, req *NioRpcRequest) (interface{}, error)
+
+// NioRpcMiddleware wraps a handler, i.e. for authorization or logging
+type NioRpcMiddleware func(next NioRpcHandler) NioRpcHandler
+
+// NioRpcError is an error passed from server to client.
+// Errors with the same code are equal for errors.Is
+type NioRpcError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcMessage is the body of RPC requests and responses
+type rpcMessage struct {
+	Protocol string          `json:"protocol"`
+	Method   string          `json:"method,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Timeout  int64           `json:"timeout,omitempty"` // milliseconds
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *NioRpcError    `json:"error,omitempty"`
+}
+
+type rpcMethod struct {
+	name    string
+	handler NioRpcHandler // with middleware
+}
+
+// rpcRegistry contains methods registered on server
+type rpcRegistry struct {
+	methods    map[string]*rpcMethod
+	middleware []NioRpcMiddleware // applied to all methods
+	mux        sync.RWMutex
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+func NewRpcError(code, message string) *NioRpcError {
+	return &NioRpcError{Code: code, Message: message}
+}
+
+func (instance *NioRpcError) Error() string {
+	if nil != instance {
+		return fmt.Sprintf("%s: %s", instance.Code, instance.Message)
+	}
+	return ""
+}
+
+func (instance *NioRpcError) Is(target error) bool {
+	if t, b := target.(*NioRpcError); b && nil != instance && nil != t {
+		return instance.Code == t.Code
+	}
+	return false
+}
+
+// Bind decodes the params of the call
+func (instance *NioRpcRequest) Bind(v interface{}) error {
+	if nil != instance && len(instance.Params) > 0 {
+		if err := json.Unmarshal(instance.Params, v); nil != err {
+			return &NioRpcError{Code: RpcCodeInvalidParams, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	s e r v e r
+//----------------------------------------------------------------------------------------------------------------------
+
+// Register adds a method called by clients with NioClient.Call.
+// Middleware is applied in order, the first is the outermost (after middleware added with Use).
+func (instance *NioServer) Register(method string, handler NioRpcHandler, middleware ...NioRpcMiddleware) {
+	if nil != instance && nil != handler {
+		instance.rpc.register(method, handler, middleware)
+	}
+}
+
+func (instance *NioServer) Unregister(method string) {
+	if nil != instance {
+		instance.rpc.mux.Lock()
+		defer instance.rpc.mux.Unlock()
+		delete(instance.rpc.methods, method)
+	}
+}
+
+// Use adds middleware applied to all methods, also to methods already registered
+func (instance *NioServer) Use(middleware ...NioRpcMiddleware) {
+	if nil != instance {
+		instance.rpc.mux.Lock()
+		defer instance.rpc.mux.Unlock()
+		instance.rpc.middleware = append(instance.rpc.middleware, middleware...)
+	}
+}
+
+// Methods returns the names of registered methods, sorted
+func (instance *NioServer) Methods() []string {
+	if nil != instance {
+		return instance.rpc.names()
+	}
+	return []string{}
+}
+
+// handleRpc runs a call and returns the response
+func (instance *NioServer) handleRpc(c *client, r *rpcMessage) *rpcMessage {
+	response := &rpcMessage{Protocol: rpcProtocol}
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+	result, err := instance.rpc.call(ctx, &NioRpcRequest{Method: r.Method, ClientId: c.Id, Params: r.Params})
+	if nil == err {
+		response.Result, err = json.Marshal(result)
+	}
+	if nil != err {
+		response.Result = nil
+		response.Error = toRpcError(err)
+	}
+	return response
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c l i e n t
+//----------------------------------------------------------------------------------------------------------------------
+
+// Call runs a method on server. The response is decoded into resp (if not nil).
+// Errors returned by the method are *NioRpcError.
+func (instance *NioClient) Call(method string, req interface{}, resp interface{}) error {
+	return instance.CallContext(context.Background(), method, req, resp)
+}
+
+// CallContext is like Call, the deadline of ctx is passed to the method
+func (instance *NioClient) CallContext(ctx context.Context, method string, req interface{}, resp interface{}) error {
+	if nil != instance {
+		r := &rpcMessage{Protocol: rpcProtocol, Method: method}
+		if nil != req {
+			params, err := json.Marshal(req)
+			if nil != err {
+				return err
+			}
+			r.Params = params
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			r.Timeout = time.Until(deadline).Milliseconds()
+		}
+		body, err := json.Marshal(r)
+		if nil != err {
+			return err
+		}
+		response, err := instance.SendContext(ctx, body)
+		if nil != err {
+			return err
+		}
+		result := parseRpc(response)
+		if nil == result {
+			return errors.New("Client failed to read rpc response")
+		}
+		if nil != result.Error {
+			return result.Error
+		}
+		if nil != resp && len(result.Result) > 0 {
+			return json.Unmarshal(result.Result, resp)
+		}
+	}
+	return nil
+}
+
+// Methods returns the methods registered on server
+func (instance *NioClient) Methods() ([]string, error) {
+	var methods []string
+	err := instance.Call(RpcMethods, nil, &methods)
+	return methods, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func parseRpc(message *NioMessage) *rpcMessage {
+	if v, b := message.Body.([]byte); b && bytes.Contains(v, []byte(rpcProtocol)) {
+		var r rpcMessage
+		if nil == json.Unmarshal(v, &r) && r.Protocol == rpcProtocol {
+			return &r
+		}
+	}
+	return nil
+}
+
+func toRpcError(err error) *NioRpcError {
+	var rpcErr *NioRpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorRpcTimeout
+	}
+	return &NioRpcError{Code: RpcCodeInternal, Message: err.Error()}
+}
+
+func newRpcRegistry() *rpcRegistry {
+	instance := new(rpcRegistry)
+	instance.methods = make(map[string]*rpcMethod)
+	return instance
+}
+
+func (instance *rpcRegistry) register(name string, handler NioRpcHandler, middleware []NioRpcMiddleware) {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	instance.methods[name] = &rpcMethod{name: name, handler: handler}
+}
+
+func (instance *rpcRegistry) names() []string {
+	instance.mux.RLock()
+	defer instance.mux.RUnlock()
+	names := make([]string, 0, len(instance.methods))
+	for name := range instance.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (instance *rpcRegistry) call(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+	instance.mux.RLock()
+	method, ok := instance.methods[req.Method]
+	middleware := instance.middleware
+	instance.mux.RUnlock()
+
+	var handler NioRpcHandler
+	if ok {
+		handler = method.handler
+	} else if req.Method == RpcMethods {
+		handler = func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+			return instance.names(), nil
+		}
+	} else {
+		return nil, ErrorRpcMethodNotFound
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,118 @@
+package qb_nio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestNioClient_call(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		server, client := openTestPair(t, secure, "")
+
+		var log []string
+		var logMux sync.Mutex
+		server.Use(func(next NioRpcHandler) NioRpcHandler {
+			return func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+				logMux.Lock()
+				log = append(log, req.Method)
+				logMux.Unlock()
+				return next(ctx, req)
+			}
+		})
+		authorized := func(next NioRpcHandler) NioRpcHandler {
+			return func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+				var user testUser
+				if err := req.Bind(&user); nil != err || user.Name != "admin" {
+					return nil, ErrorRpcUnauthorized
+				}
+				return next(ctx, req)
+			}
+		}
+		server.Register("Users.Get", func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+			var user testUser
+			if err := req.Bind(&user); nil != err {
+				return nil, err
+			}
+			if user.Id == 0 {
+				return nil, &NioRpcError{Code: "not_found", Message: "user not found", Data: map[string]int{"id": user.Id}}
+			}
+			user.Name = fmt.Sprintf("user %d", user.Id)
+			return user, nil
+		})
+		server.Register("Users.Delete", func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+			return true, nil
+		}, authorized)
+		server.Register("Slow", func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+				return "late", nil
+			}
+		})
+		server.Register("Fail", func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+			return nil, errors.New("disk full")
+		})
+
+		var user testUser
+		if err := client.Call("Users.Get", testUser{Id: 7}, &user); nil != err || user.Name != "user 7" {
+			t.Errorf("secure=%v: bad call %v %v", secure, user, err)
+		}
+
+		err := client.Call("Users.Get", testUser{}, &user)
+		var rpcErr *NioRpcError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != "not_found" || nil == rpcErr.Data {
+			t.Errorf("expected not_found error, got %v", err)
+		}
+		if err = client.Call("Users.Get", "bad params", &user); !errors.Is(err, ErrorRpcInvalidParams) {
+			t.Errorf("expected invalid params, got %v", err)
+		}
+		if err = client.Call("Users.Delete", testUser{Name: "guest"}, nil); !errors.Is(err, ErrorRpcUnauthorized) {
+			t.Errorf("expected unauthorized, got %v", err)
+		}
+		var deleted bool
+		if err = client.Call("Users.Delete", testUser{Name: "admin"}, &deleted); nil != err || !deleted {
+			t.Errorf("bad delete: %v %v", deleted, err)
+		}
+		if err = client.Call("Users.Unknown", nil, nil); !errors.Is(err, ErrorRpcMethodNotFound) {
+			t.Errorf("expected method not found, got %v", err)
+		}
+		if err = client.Call("Fail", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != RpcCodeInternal || !strings.Contains(rpcErr.Message, "disk full") {
+			t.Errorf("expected internal error, got %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		err = client.CallContext(ctx, "Slow", nil, nil)
+		cancel()
+		if !errors.Is(err, ErrorRpcTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected timeout, got %v", err)
+		}
+
+		methods, err := client.Methods()
+		if nil != err || fmt.Sprint(methods) != "[Fail Slow Users.Delete Users.Get]" {
+			t.Errorf("bad methods: %v %v", methods, err)
+		}
+		logMux.Lock()
+		if len(log) < 7 || log[0] != "Users.Get" {
+			t.Errorf("global middleware not called: %v", log)
+		}
+		logMux.Unlock()
+
+		// plain messages are still handled by OnMessage
+		if response, err := client.Send("echo"); nil != err || string(response.Body.([]byte)) != "echo" {
+			t.Errorf("bad response: %v %v", response, err)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
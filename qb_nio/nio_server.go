@@ -3,10 +3,22 @@ package qb_nio
 import (
 	"bufio"
 	"crypto/rsa"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+var (
+	ErrorClientNotFound = errors.New("client_not_found")
+	ErrorClientNotReady = errors.New("client_not_ready")
 )
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -14,10 +26,26 @@ import (
 //----------------------------------------------------------------------------------------------------------------------
 
 type NioServer struct {
+	MaxConcurrency      int      // max messages of a single client processed in parallel
+	Auth                *NioAuth // (optional) enable the authenticated handshake
+	SubscriberQueueSize int      // published messages waiting to be pushed to a subscriber
+	// limits (read by Open)
+	MaxClients     int           // max connected clients, new connections are rejected. Zero is unlimited
+	ReadTimeout    time.Duration // max time to receive a message, once started
+	WriteTimeout   time.Duration // max time to send a message
+	IdleTimeout    time.Duration // clients not sending messages for this time are disconnected
+	HelloTimeout   time.Duration // max time to receive the codec negotiation of a new connection (default 10 seconds)
+	MaxMessageSize int           // max size of a received message (default 4Mb), larger messages close the connection
+	// unix socket (read by Open)
+	SocketMode    os.FileMode // permissions of socket file (default 0600)
+	PeerUids      []uint32    // (optional) user ids of processes allowed to connect (SO_PEERCRED, linux only)
+	PeerGids      []uint32    // (optional) group ids of processes allowed to connect (SO_PEERCRED, linux only)
+	TrustedSocket bool        // accept clients without authenticated handshake, also if Auth is set
 
 	//-- private --//
 	uuid       string
 	port       int
+	address    string // unix socket address
 	listener   net.Listener
 	clients    int
 	clientsMap map[string]*client
@@ -25,6 +53,11 @@ type NioServer struct {
 	handler    NioMessageHandler
 	stopChan   chan bool
 	active     bool
+	topics     *topicRegistry
+	rpc        *rpcRegistry
+	events     *qb_events.Emitter
+	stats      serverCounters
+	limits     serverLimits // limits of the open server
 	// RSA
 	publicKey  *rsa.PublicKey
 	privateKey *rsa.PrivateKey
@@ -32,8 +65,20 @@ type NioServer struct {
 
 type client struct {
 	Id         string
+	conn       net.Conn
 	publicKey  *rsa.PublicKey // public key of the client
 	sessionKey []byte         // session key for the client
+	rw         *bufio.ReadWriter
+	codec      NioCodec
+	writeMux   sync.Mutex  // responses and pushes are written from different goroutines
+	ready      bool        // handshake completed
+	auth       *authState  // authenticated handshake in progress
+	session    *nioSession // authenticated session
+	inFlight   int32       // messages being handled (atomic): the client is waiting for responses, not idle
+	// stats
+	counters     *counters
+	connectedAt  time.Time
+	writeTimeout time.Duration
 }
 
 type NioMessageHandler func(message *NioMessage) interface{}
@@ -56,6 +101,17 @@ func (instance *NioServer) IsOpen() bool {
 	return false
 }
 
+// Address returns the unix socket address (unix:///path/to.sock) or the TCP port
+func (instance *NioServer) Address() string {
+	if nil != instance {
+		if instance.isUnix() {
+			return instance.address
+		}
+		return qb_utils.Strings.Format(":%s", instance.port)
+	}
+	return ""
+}
+
 func (instance *NioServer) Port() int {
 	if nil != instance {
 		return instance.port
@@ -68,17 +124,35 @@ func (instance *NioServer) Open() error {
 		if !instance.active {
 			instance.active = true
 			instance.stopChan = make(chan bool, 1)
+			if instance.stats.startedAt.IsZero() {
+				instance.stats.startedAt = time.Now()
+			}
 
 			err := instance.initRSA()
 			if nil != err {
 				return err
 			}
 
-			listener, err := net.Listen("tcp", fmt.Sprintf(":%v", instance.port))
+			var listener net.Listener
+			if instance.isUnix() {
+				listener, err = listenUnix(strings.TrimPrefix(instance.address, UnixScheme), instance.SocketMode)
+			} else {
+				listener, err = net.Listen("tcp", fmt.Sprintf(":%v", instance.port))
+			}
 			if nil != err {
 				return err
 			}
 			instance.listener = listener
+			instance.limits = serverLimits{
+				maxClients:     instance.MaxClients,
+				readTimeout:    instance.ReadTimeout,
+				writeTimeout:   instance.WriteTimeout,
+				idleTimeout:    instance.IdleTimeout,
+				helloTimeout:   instance.HelloTimeout,
+				maxMessageSize: instance.MaxMessageSize,
+				peerUids:       append([]uint32{}, instance.PeerUids...),
+				peerGids:       append([]uint32{}, instance.PeerGids...),
+			}
 
 			// main listener loop
 			go instance.open()
@@ -95,6 +169,12 @@ func (instance *NioServer) Close() error {
 			if nil != instance.listener {
 				err = instance.listener.Close()
 			}
+			// disconnect clients
+			instance.mux.Lock()
+			for _, c := range instance.clientsMap {
+				_ = c.conn.Close()
+			}
+			instance.mux.Unlock()
 			instance.stopChan <- true
 			return err
 		}
@@ -130,6 +210,55 @@ func (instance *NioServer) ClientsId() []string {
 	return []string{}
 }
 
+// SendTo sends a message to a connected client without waiting for a request.
+// The client receives the message with NioClient.OnPush.
+func (instance *NioServer) SendTo(clientId string, body interface{}) error {
+	if nil != instance {
+		instance.mux.Lock()
+		c, ok := instance.clientsMap[clientId]
+		instance.mux.Unlock()
+		if !ok {
+			return ErrorClientNotFound
+		}
+		return c.push(body, instance.publicKey)
+	}
+	return nil
+}
+
+// Broadcast sends a message to all connected clients.
+// Returns an error for each client that could not be reached.
+func (instance *NioServer) Broadcast(body interface{}) error {
+	if nil != instance {
+		instance.mux.Lock()
+		clients := make([]*client, 0, len(instance.clientsMap))
+		for _, c := range instance.clientsMap {
+			clients = append(clients, c)
+		}
+		instance.mux.Unlock()
+
+		var errs error
+		for _, c := range clients {
+			if err := c.push(body, instance.publicKey); nil != err {
+				errs = qb_utils.Errors.Append(errs, qb_utils.Errors.Prefix(err, c.Id+": "))
+			}
+		}
+		return errs
+	}
+	return nil
+}
+
+// Publish sends a message to all clients subscribed to a matching topic (see NioClient.Subscribe).
+// Returns the number of subscribers receiving the message.
+func (instance *NioServer) Publish(topic string, body interface{}) (int, error) {
+	if nil != instance {
+		if !validTopic(topic, false) {
+			return 0, ErrorInvalidTopic
+		}
+		return instance.topics.publish(topic, serialize(body)), nil
+	}
+	return 0, nil
+}
+
 func (instance *NioServer) OnMessage(callback NioMessageHandler) {
 	if nil != instance {
 		instance.handler = callback
@@ -160,14 +289,20 @@ func (instance *NioServer) open() {
 		// accept connections
 		conn, err := instance.listener.Accept()
 		if err != nil {
+			if !instance.active {
+				return // listener closed
+			}
 			// error accepting connection
 			continue
 		}
+		if !instance.accept(conn) {
+			continue // too many clients
+		}
 		go instance.handleConnection(conn)
 	}
 }
 
-func (instance *NioServer) incClients(conn net.Conn) *client {
+func (instance *NioServer) incClients(conn net.Conn, rw *bufio.ReadWriter, codec NioCodec, cnt *counters) *client {
 	if nil != instance {
 		instance.mux.Lock()
 		defer instance.mux.Unlock()
@@ -176,7 +311,16 @@ func (instance *NioServer) incClients(conn net.Conn) *client {
 
 		c := new(client)
 		c.Id = conn.RemoteAddr().String()
+		if instance.isUnix() {
+			c.Id = newUnixClientId()
+		}
+		c.conn = conn
 		c.sessionKey = session[:]
+		c.rw = rw
+		c.codec = codec
+		c.counters = cnt
+		c.connectedAt = time.Now()
+		c.writeTimeout = instance.limits.writeTimeout
 		instance.clients++
 		instance.clientsMap[c.Id] = c
 		return c
@@ -189,65 +333,101 @@ func (instance *NioServer) decClients(id string) {
 		instance.mux.Lock()
 		defer instance.mux.Unlock()
 
-		_, ok := instance.clientsMap[id]
+		c, ok := instance.clientsMap[id]
 		if ok {
 			instance.clients--
 			delete(instance.clientsMap, id)
+			instance.release(c)
+			// unsubscribe
+			instance.topics.remove(id)
 		}
 	}
 }
 
 func (instance *NioServer) handleConnection(conn net.Conn) {
+	cnt := new(counters)
+	conn = &statsConn{Conn: conn, counters: cnt}
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	defer conn.Close()
+	defer atomic.AddInt64(&instance.stats.connections, -1)
+
+	if instance.limits.helloTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(instance.limits.helloTimeout))
+	}
+	codec, err := negotiateCodec(rw)
+	if nil != err {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
 
 	// new client connection
-	c := instance.incClients(conn)
+	c := instance.incClients(conn, rw, codec, cnt)
+	max := instance.MaxConcurrency
+	if max < 1 {
+		max = 1
+	}
+	sem := make(chan bool, max)
 
 	// connection loop
 	for {
+		if err := instance.waitMessage(c); nil != err {
+			break
+		}
 		var message NioMessage
-		dec := gob.NewDecoder(rw)
-		err := dec.Decode(&message)
+		err := decode(c.codec, rw.Reader, &message, instance.limits.maxMessageSize)
 		if nil != err {
 			if err.Error() == "EOF" {
 				// client disconnected
+			} else if instance.limits.readTimeout > 0 && isTimeout(err) {
+				instance.evict(c, ReasonReadTimeout)
 			}
 			// exit
 			break
 		}
+		atomic.AddInt64(&cnt.messagesIn, 1)
+		atomic.StoreInt64(&cnt.lastSeen, time.Now().UnixNano())
+
+		if nil != c.session {
+			// authenticated session: messages are decrypted in the same order they are sent
+			if v, b := message.Body.([]byte); b {
+				data, err := c.session.open(message.Id, message.Push, v)
+				if nil != err {
+					break
+				}
+				message.Body = data
+			}
+		} else if h := parseAuthHandshake(&message); nil != h {
+			if err := instance.handleAuth(c, &message, h); nil != err {
+				break
+			}
+			continue
+		} else if nil != instance.Auth && !instance.Auth.AllowLegacy && !(instance.isUnix() && instance.TrustedSocket) {
+			// authentication required
+			break
+		}
 
 		isHandshake := instance.isHandshake(&message)
 		if isHandshake {
 			// set public key for client
+			c.writeMux.Lock()
 			c.publicKey = message.PublicKey
+			c.writeMux.Unlock()
 		}
 
-		if !isHandshake && nil != instance.handler {
-			if nil != c.publicKey && nil != c.sessionKey {
-				// decode client message body
-				if v, b := message.Body.([]byte); b {
-					data, err := decrypt(v, c.sessionKey)
-					if nil == err {
-						message.Body = data
-					} else {
-						// encryption error
-						fmt.Println("Http error decrypting data:", err)
-					}
+		if !isHandshake {
+			// messages are processed concurrently, client matches responses using the message id
+			sem <- true
+			atomic.AddInt32(&c.inFlight, 1)
+			go func(message *NioMessage) {
+				defer func() { <-sem }()
+				defer atomic.AddInt32(&c.inFlight, -1)
+				if err := instance.handleMessage(c, message); nil != err {
+					_ = conn.Close()
 				}
-			}
-			customResponse := instance.handler(&message)
-			if nil == customResponse {
-				customResponse = true
-			}
-
-			err := sendResponse(customResponse, rw, c.sessionKey, c.publicKey, instance.publicKey, isHandshake)
-			if err != nil {
-				break
-			}
+			}(&message)
 		} else {
 			// response OK (default)
-			err := sendResponse(true, rw, c.sessionKey, c.publicKey, instance.publicKey, isHandshake)
+			err := c.send(message.Id, true, instance.publicKey, isHandshake, false)
 			if err != nil {
 				break
 			}
@@ -258,6 +438,94 @@ func (instance *NioServer) handleConnection(conn net.Conn) {
 	instance.decClients(c.Id)
 }
 
+func (instance *NioServer) handleMessage(c *client, message *NioMessage) error {
+	if nil != c.publicKey && nil != c.sessionKey {
+		// decode client message body
+		if v, b := message.Body.([]byte); b {
+			data, err := decrypt(v, c.sessionKey)
+			if nil == err {
+				message.Body = data
+			} else {
+				// encryption error
+				fmt.Println("Http error decrypting data:", err)
+			}
+		}
+	}
+	if r := parsePubSub(message); nil != r {
+		return c.send(message.Id, qb_utils.JSON.Bytes(instance.handlePubSub(c, r)), instance.publicKey, false, false)
+	}
+	if r := parseRpc(message); nil != r {
+		return c.send(message.Id, qb_utils.JSON.Bytes(instance.handleRpc(c, r)), instance.publicKey, false, false)
+	}
+	var customResponse interface{}
+	if handler := instance.handler; nil != handler {
+		customResponse = handler(message)
+	}
+	if nil == customResponse {
+		customResponse = true
+	}
+	return c.send(message.Id, customResponse, instance.publicKey, false, false)
+}
+
+// handleAuth runs a step of the authenticated handshake. Returns an error if the client must be disconnected.
+func (instance *NioServer) handleAuth(c *client, message *NioMessage, h *authHandshake) error {
+	if nil == instance.Auth {
+		return ErrorAuthentication
+	}
+	switch h.Step {
+	case authClientHello:
+		hello, state, err := instance.Auth.serverHello(h)
+		if nil != err {
+			return err
+		}
+		c.auth = state
+		return c.send(message.Id, qb_utils.JSON.Bytes(hello), nil, false, false)
+	case authClientFinish:
+		if err := instance.Auth.verifyFinish(c.auth, h); nil != err {
+			return err
+		}
+		c.writeMux.Lock()
+		c.session = c.auth.session
+		c.auth = nil
+		c.writeMux.Unlock()
+		if err := c.send(message.Id, HANDSHAKE.Body, nil, false, false); nil != err {
+			return err
+		}
+		c.writeMux.Lock()
+		c.ready = true
+		c.writeMux.Unlock()
+		return nil
+	}
+	return ErrorAuthentication
+}
+
+// handlePubSub runs a pub/sub request and returns the response
+func (instance *NioServer) handlePubSub(c *client, r *pubsubRequest) *pubsubRequest {
+	response := newPubSub(pubsubAck, r.Topic, nil)
+	switch r.Action {
+	case pubsubSubscribe:
+		if validTopic(r.Topic, true) {
+			instance.topics.subscribe(c, r.Topic, instance.SubscriberQueueSize, instance.deliver)
+		} else {
+			response.Error = ErrorInvalidTopic.Error()
+		}
+	case pubsubUnsubscribe:
+		instance.topics.unsubscribe(c.Id, r.Topic)
+	case pubsubPublish:
+		if _, err := instance.Publish(r.Topic, r.Body); nil != err {
+			response.Error = err.Error()
+		}
+	default:
+		response.Error = "unsupported_action"
+	}
+	return response
+}
+
+// deliver pushes a published message to a subscriber
+func (instance *NioServer) deliver(c *client, message *pubsubRequest) {
+	_ = c.push(qb_utils.JSON.Bytes(message), instance.publicKey)
+}
+
 func (instance *NioServer) isHandshake(message *NioMessage) bool {
 	if v, b := message.Body.([]byte); b {
 		return string(v) == string(HANDSHAKE.Body.([]byte))
@@ -265,22 +533,39 @@ func (instance *NioServer) isHandshake(message *NioMessage) bool {
 	return false
 }
 
-func sendResponse(body interface{}, rw *bufio.ReadWriter, sessionKey []byte, clientKey, serverKey *rsa.PublicKey, isHandshake bool) error {
+// push sends a server initiated message
+func (instance *client) push(body interface{}, serverKey *rsa.PublicKey) error {
+	return instance.send(0, body, serverKey, false, true)
+}
+
+func (instance *client) send(id uint64, body interface{}, serverKey *rsa.PublicKey, isHandshake, isPush bool) error {
+	instance.writeMux.Lock()
+	defer instance.writeMux.Unlock()
+
+	if isPush && !instance.ready {
+		// client did not complete the handshake
+		return ErrorClientNotReady
+	}
+
 	response := new(NioMessage)
+	response.Id = id
+	response.Push = isPush
 
 	// public key is passed only with handshake
 	if isHandshake {
 		response.PublicKey = serverKey
-		if nil != clientKey {
-			response.SessionKey, _ = encryptKey(sessionKey, clientKey)
+		if nil != instance.publicKey {
+			response.SessionKey, _ = encryptKey(instance.sessionKey, instance.publicKey)
 		}
 	}
 
 	s := serialize(body)
 
 	// encode server message body
-	if nil != clientKey && !isHandshake {
-		data, err := encrypt(s, sessionKey)
+	if nil != instance.session {
+		s = instance.session.seal(id, isPush, s)
+	} else if nil != instance.publicKey && !isHandshake {
+		data, err := encrypt(s, instance.sessionKey)
 		if nil == err {
 			s = data
 		} else {
@@ -289,11 +574,39 @@ func sendResponse(body interface{}, rw *bufio.ReadWriter, sessionKey []byte, cli
 	}
 	response.Body = s
 
-	enc := gob.NewEncoder(rw)
-	err := enc.Encode(response)
+	if instance.writeTimeout > 0 {
+		_ = instance.conn.SetWriteDeadline(time.Now().Add(instance.writeTimeout))
+	}
+	err := instance.codec.Encode(instance.rw, response)
 	if err != nil {
 		return err
 	}
-	err = rw.Flush()
+	err = instance.rw.Flush()
+	if nil == err {
+		atomic.AddInt64(&instance.counters.messagesOut, 1)
+	}
+	if nil == err && isHandshake {
+		instance.ready = true
+	}
 	return err
 }
+
+// negotiateCodec reads the codec requested by client. Clients not requesting a codec use gob.
+func negotiateCodec(rw *bufio.ReadWriter) (NioCodec, error) {
+	if _, err := rw.Reader.Peek(1); nil != err {
+		return nil, err // closed or silent peer
+	}
+	if !isHello(rw.Reader) {
+		return GetCodec(CodecGob), nil
+	}
+	name, err := readHello(rw.Reader)
+	if nil != err {
+		return nil, err
+	}
+	codec := GetCodec(name)
+	if nil == codec {
+		_ = writeHello(rw.Writer, "") // rejected
+		return nil, ErrorUnsupportedCodec
+	}
+	return codec, writeHello(rw.Writer, codec.Name())
+}
@@ -0,0 +1,262 @@
+package qb_nio
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	EventClientRejected = "client_rejected"
+	EventClientEvicted  = "client_evicted"
+
+	ReasonMaxClients  = "max_clients"
+	ReasonIdle        = "idle"
+	ReasonReadTimeout = "read_timeout"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// NioClientStats is a snapshot of the counters of a connected client
+type NioClientStats struct {
+	Id            string    `json:"id"`
+	RemoteAddress string    `json:"remote_address"`
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	MessagesIn    int64     `json:"messages_in"`
+	MessagesOut   int64     `json:"messages_out"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	LastSeen      time.Time `json:"last_seen"` // last message received
+}
+
+// NioServerStats is a snapshot of server counters. Totals include disconnected clients.
+type NioServerStats struct {
+	StartedAt   time.Time         `json:"started_at"`
+	Clients     int               `json:"clients"`
+	Accepted    int64             `json:"accepted"`
+	Rejected    int64             `json:"rejected"`
+	Evicted     int64             `json:"evicted"`
+	BytesIn     int64             `json:"bytes_in"`
+	BytesOut    int64             `json:"bytes_out"`
+	MessagesIn  int64             `json:"messages_in"`
+	MessagesOut int64             `json:"messages_out"`
+	ClientStats []*NioClientStats `json:"client_stats"`
+}
+
+// NioClientEvent is the argument of client_rejected and client_evicted events
+type NioClientEvent struct {
+	RemoteAddress string
+	Reason        string
+	Stats         *NioClientStats // nil for rejected clients
+}
+
+// counters are updated atomically
+type counters struct {
+	bytesIn     int64
+	bytesOut    int64
+	messagesIn  int64
+	messagesOut int64
+	lastSeen    int64 // unix nano
+}
+
+// serverLimits are the limits of the server copied by Open. Changes of NioServer fields apply on next Open.
+type serverLimits struct {
+	maxClients     int
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	helloTimeout   time.Duration
+	maxMessageSize int
+	peerUids       []uint32
+	peerGids       []uint32
+}
+
+// serverCounters are totals of the server
+type serverCounters struct {
+	counters
+	connections int64 // open connections (also before handshake)
+	accepted    int64
+	rejected    int64
+	evicted     int64
+	startedAt   time.Time
+}
+
+// statsConn counts bytes read and written
+type statsConn struct {
+	net.Conn
+	counters *counters
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+// Stats returns a snapshot of server and clients counters
+func (instance *NioServer) Stats() *NioServerStats {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+
+		stats := &NioServerStats{
+			StartedAt:   instance.stats.startedAt,
+			Clients:     instance.clients,
+			Accepted:    atomic.LoadInt64(&instance.stats.accepted),
+			Rejected:    atomic.LoadInt64(&instance.stats.rejected),
+			Evicted:     atomic.LoadInt64(&instance.stats.evicted),
+			BytesIn:     atomic.LoadInt64(&instance.stats.bytesIn),
+			BytesOut:    atomic.LoadInt64(&instance.stats.bytesOut),
+			MessagesIn:  atomic.LoadInt64(&instance.stats.messagesIn),
+			MessagesOut: atomic.LoadInt64(&instance.stats.messagesOut),
+			ClientStats: make([]*NioClientStats, 0, len(instance.clientsMap)),
+		}
+		for _, c := range instance.clientsMap {
+			s := c.snapshot()
+			stats.BytesIn += s.BytesIn
+			stats.BytesOut += s.BytesOut
+			stats.MessagesIn += s.MessagesIn
+			stats.MessagesOut += s.MessagesOut
+			stats.ClientStats = append(stats.ClientStats, s)
+		}
+		return stats
+	}
+	return nil
+}
+
+// ClientStats returns a snapshot of the counters of a connected client
+func (instance *NioServer) ClientStats(clientId string) (*NioClientStats, error) {
+	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
+		if c, ok := instance.clientsMap[clientId]; ok {
+			return c.snapshot(), nil
+		}
+		return nil, ErrorClientNotFound
+	}
+	return nil, nil
+}
+
+// OnClientRejected is notified when a connection is refused because of MaxClients. Argument is *NioClientEvent
+func (instance *NioServer) OnClientRejected(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventClientRejected, callback)
+	}
+}
+
+// OnClientEvicted is notified when a client is disconnected by IdleTimeout or ReadTimeout. Argument is *NioClientEvent
+func (instance *NioServer) OnClientEvicted(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventClientEvicted, callback)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+// accept checks the limit of connections and peer credentials. Returns false if the connection was rejected.
+func (instance *NioServer) accept(conn net.Conn) bool {
+	if instance.isUnix() && !instance.checkPeer(conn) {
+		atomic.AddInt64(&instance.stats.rejected, 1)
+		_ = conn.Close()
+		instance.events.Emit(EventClientRejected, &NioClientEvent{RemoteAddress: conn.RemoteAddr().String(), Reason: ReasonPeerCredentials})
+		return false
+	}
+	connections := atomic.AddInt64(&instance.stats.connections, 1)
+	if instance.limits.maxClients > 0 && connections > int64(instance.limits.maxClients) {
+		atomic.AddInt64(&instance.stats.connections, -1)
+		atomic.AddInt64(&instance.stats.rejected, 1)
+		_ = conn.Close()
+		instance.events.Emit(EventClientRejected, &NioClientEvent{RemoteAddress: conn.RemoteAddr().String(), Reason: ReasonMaxClients})
+		return false
+	}
+	atomic.AddInt64(&instance.stats.accepted, 1)
+	return true
+}
+
+// release adds the counters of a disconnected client to totals
+func (instance *NioServer) release(c *client) {
+	atomic.AddInt64(&instance.stats.bytesIn, atomic.LoadInt64(&c.counters.bytesIn))
+	atomic.AddInt64(&instance.stats.bytesOut, atomic.LoadInt64(&c.counters.bytesOut))
+	atomic.AddInt64(&instance.stats.messagesIn, atomic.LoadInt64(&c.counters.messagesIn))
+	atomic.AddInt64(&instance.stats.messagesOut, atomic.LoadInt64(&c.counters.messagesOut))
+}
+
+// evict notifies a client disconnected by server
+func (instance *NioServer) evict(c *client, reason string) {
+	atomic.AddInt64(&instance.stats.evicted, 1)
+	stats := c.snapshot()
+	instance.events.Emit(EventClientEvicted, &NioClientEvent{RemoteAddress: stats.RemoteAddress, Reason: reason, Stats: stats})
+}
+
+// waitMessage waits the first byte of next message (IdleTimeout), then sets the deadline to read the message (ReadTimeout).
+// A client waiting for responses of messages still handled by the server is not idle.
+func (instance *NioServer) waitMessage(c *client) error {
+	if instance.limits.idleTimeout <= 0 && instance.limits.readTimeout <= 0 {
+		return nil
+	}
+	for {
+		if instance.limits.idleTimeout > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(instance.limits.idleTimeout))
+		} else {
+			_ = c.conn.SetReadDeadline(time.Time{})
+		}
+		_, err := c.rw.Reader.Peek(1)
+		if nil == err {
+			break
+		}
+		if !isTimeout(err) {
+			return err
+		}
+		if atomic.LoadInt32(&c.inFlight) == 0 {
+			instance.evict(c, ReasonIdle)
+			return err
+		}
+	}
+	if instance.limits.readTimeout > 0 {
+		return c.conn.SetReadDeadline(time.Now().Add(instance.limits.readTimeout))
+	}
+	return c.conn.SetReadDeadline(time.Time{})
+}
+
+func (instance *client) snapshot() *NioClientStats {
+	stats := &NioClientStats{
+		Id:            instance.Id,
+		RemoteAddress: instance.conn.RemoteAddr().String(),
+		BytesIn:       atomic.LoadInt64(&instance.counters.bytesIn),
+		BytesOut:      atomic.LoadInt64(&instance.counters.bytesOut),
+		MessagesIn:    atomic.LoadInt64(&instance.counters.messagesIn),
+		MessagesOut:   atomic.LoadInt64(&instance.counters.messagesOut),
+		ConnectedAt:   instance.connectedAt,
+	}
+	if lastSeen := atomic.LoadInt64(&instance.counters.lastSeen); lastSeen > 0 {
+		stats.LastSeen = time.Unix(0, lastSeen)
+	}
+	return stats
+}
+
+func (instance *statsConn) Read(b []byte) (int, error) {
+	n, err := instance.Conn.Read(b)
+	atomic.AddInt64(&instance.counters.bytesIn, int64(n))
+	return n, err
+}
+
+func (instance *statsConn) Write(b []byte) (int, error) {
+	n, err := instance.Conn.Write(b)
+	atomic.AddInt64(&instance.counters.bytesOut, int64(n))
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	if e, b := err.(net.Error); b {
+		return e.Timeout()
+	}
+	return false
+}
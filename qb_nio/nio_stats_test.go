@@ -0,0 +1,107 @@
+package qb_nio
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+)
+
+func TestNioServer_limits(t *testing.T) {
+	server := openConfiguredServer(t, func(server *NioServer) {
+		server.MaxClients = 1
+		server.IdleTimeout = 300 * time.Millisecond
+	})
+	defer server.Close()
+	client := NIO.NewClient("127.0.0.1", server.Port())
+	if err := client.Open(); nil != err {
+		t.Fatalf("open client: %v", err)
+	}
+	defer client.Close()
+
+	rejected := make(chan *NioClientEvent, 1)
+	evicted := make(chan *NioClientEvent, 1)
+	server.OnClientRejected(func(e *qb_events.Event) {
+		rejected <- e.Argument(0).(*NioClientEvent)
+	})
+	server.OnClientEvicted(func(e *qb_events.Event) {
+		evicted <- e.Argument(0).(*NioClientEvent)
+	})
+
+	other := NIO.NewClient("127.0.0.1", server.Port())
+	other.Timeout = time.Second
+	if _, err := other.Send("hello"); nil == err {
+		t.Errorf("expected rejected client")
+	}
+	select {
+	case e := <-rejected:
+		if e.Reason != ReasonMaxClients {
+			t.Errorf("bad reason: %v", e.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("missing rejected event")
+	}
+
+	if _, err := client.Send("hello"); nil != err {
+		t.Fatalf("send: %v", err)
+	}
+	stats, err := server.ClientStats(server.ClientsId()[0])
+	if nil != err || stats.MessagesIn != 2 || stats.MessagesOut != 2 || stats.BytesIn == 0 || stats.BytesOut == 0 || stats.LastSeen.IsZero() {
+		t.Errorf("bad client stats: %+v %v", stats, err)
+	}
+	select {
+	case e := <-evicted:
+		if e.Reason != ReasonIdle || e.Stats.MessagesIn != 2 {
+			t.Errorf("bad evicted event: %+v %+v", e, e.Stats)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("missing evicted event")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	s := server.Stats()
+	if s.Clients != 0 || s.Accepted != 1 || s.Rejected != 1 || s.Evicted != 1 || s.MessagesIn != 2 || s.BytesIn == 0 || s.StartedAt.IsZero() {
+		t.Errorf("bad server stats: %+v", s)
+	}
+}
+
+func TestNioServer_idleWhileHandling(t *testing.T) {
+	server := openConfiguredServer(t, func(server *NioServer) {
+		server.IdleTimeout = 200 * time.Millisecond
+		server.Register("slow", func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+			time.Sleep(600 * time.Millisecond)
+			return "done", nil
+		})
+	})
+	defer server.Close()
+	evicted := make(chan *NioClientEvent, 1)
+	server.OnClientEvicted(func(e *qb_events.Event) {
+		evicted <- e.Argument(0).(*NioClientEvent)
+	})
+	client := NIO.NewClient("127.0.0.1", server.Port())
+	if err := client.Open(); nil != err {
+		t.Fatalf("open client: %v", err)
+	}
+	defer client.Close()
+
+	// the client waits for a response longer than IdleTimeout
+	var response string
+	if err := client.Call("slow", nil, &response); nil != err || response != "done" {
+		t.Fatalf("call: %v %v", response, err)
+	}
+	select {
+	case e := <-evicted:
+		t.Fatalf("client evicted while waiting a response: %+v", e)
+	default:
+	}
+	// idle after the response
+	select {
+	case e := <-evicted:
+		if e.Reason != ReasonIdle {
+			t.Errorf("bad reason: %v", e.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("missing evicted event")
+	}
+}
@@ -0,0 +1,510 @@
+package qb_nio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+)
+
+func TestNioServer_push(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		server, client := openTestPair(t, secure, "")
+
+		pushes := make(chan string, 10)
+		client.OnPush(func(message *NioMessage) {
+			pushes <- string(message.Body.([]byte))
+		})
+		if _, err := client.Send("hello"); nil != err {
+			t.Fatalf("send: %v", err)
+		}
+
+		ids := server.ClientsId()
+		if len(ids) != 1 {
+			t.Fatalf("expected 1 client, got %v", ids)
+		}
+		if err := server.SendTo(ids[0], "config changed"); nil != err {
+			t.Fatalf("send to: %v", err)
+		}
+		if err := server.Broadcast("reload"); nil != err {
+			t.Fatalf("broadcast: %v", err)
+		}
+		if err := server.SendTo("unknown", "lost"); err != ErrorClientNotFound {
+			t.Errorf("expected client not found, got %v", err)
+		}
+
+		// requests still work while pushes are delivered
+		response, err := client.Send("after push")
+		if nil != err || string(response.Body.([]byte)) != "after push" {
+			t.Errorf("bad response after push: %v %v", response, err)
+		}
+
+		for _, expected := range []string{"config changed", "reload"} {
+			select {
+			case got := <-pushes:
+				if got != expected {
+					t.Errorf("secure=%v: expected push %q, got %q", secure, expected, got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("secure=%v: push %q not received", secure, expected)
+			}
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestNioClient_concurrentSend(t *testing.T) {
+	server, client := openTestPair(t, true, "")
+	defer server.Close()
+	defer client.Close()
+	server.OnMessage(func(message *NioMessage) interface{} {
+		var delay int
+		_, _ = fmt.Sscanf(string(message.Body.([]byte)), "%d", &delay)
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		return message.Body
+	})
+
+	// slower requests are sent first: responses arrive out of order
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 10; i > 0; i-- {
+		wg.Add(1)
+		go func(delay int) {
+			defer wg.Done()
+			body := fmt.Sprintf("%d", delay*20)
+			response, err := client.Send(body)
+			if nil != err {
+				t.Errorf("send: %v", err)
+			} else if string(response.Body.([]byte)) != body {
+				t.Errorf("expected %s, got %s", body, response.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("requests are not processed concurrently: %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.SendContext(ctx, "500"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if response, err := client.Send("1"); nil != err || string(response.Body.([]byte)) != "1" {
+		t.Errorf("bad response after timeout: %v %v", response, err)
+	}
+}
+
+func TestNioClient_onPushWhileDispatching(t *testing.T) {
+	server, client := openTestPair(t, false, "")
+	defer server.Close()
+	defer client.Close()
+	pushes := make(chan bool, 100)
+	handler := func(message *NioMessage) {
+		pushes <- true
+	}
+	client.OnPush(handler)
+	for i := 0; i < 50; i++ {
+		_ = server.Broadcast("push")
+		client.OffPush()
+		client.OnPush(handler)
+	}
+	select {
+	case <-pushes:
+	case <-time.After(2 * time.Second):
+		t.Errorf("push not received")
+	}
+}
+
+func TestNioCodec(t *testing.T) {
+	for _, codec := range []string{CodecGob, CodecJson, CodecBinary} {
+		for _, secure := range []bool{false, true} {
+			server, client := openTestPair(t, secure, codec)
+			pushes := make(chan string, 1)
+			client.OnPush(func(message *NioMessage) {
+				pushes <- string(message.Body.([]byte))
+			})
+			response, err := client.Send(map[string]interface{}{"name": "nio"})
+			if nil != err || string(response.Body.([]byte)) != `{"name":"nio"}` {
+				t.Errorf("%s secure=%v: bad response %v %v", codec, secure, response, err)
+			}
+			_ = server.Broadcast("push")
+			select {
+			case got := <-pushes:
+				if got != "push" {
+					t.Errorf("%s secure=%v: bad push %q", codec, secure, got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Errorf("%s secure=%v: push not received", codec, secure)
+			}
+			_ = client.Close()
+			_ = server.Close()
+		}
+	}
+
+	server, client := openTestPair(t, false, "")
+	defer server.Close()
+	defer client.Close()
+	client.Codec = "unknown"
+	_ = client.Close()
+	if _, err := client.Send("hello"); err != ErrorUnsupportedCodec {
+		t.Errorf("expected unsupported codec, got %v", err)
+	}
+}
+
+// TestNioCodec_binaryWire talks to server as a client written in another language
+func TestNioCodec_binaryWire(t *testing.T) {
+	server, client := openTestPair(t, false, "")
+	defer server.Close()
+	_ = client.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.Port()))
+	if nil != err {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// hello
+	_, _ = conn.Write(append([]byte("QBNIO\x01\x06"), "binary"...))
+	hello := make([]byte, 13)
+	if _, err = io.ReadFull(conn, hello); nil != err || string(hello) != "QBNIO\x01\x06binary" {
+		t.Fatalf("bad hello: %q %v", hello, err)
+	}
+
+	// handshake and request: flags, id, no public key, no session key, body
+	for id, body := range []string{"ACK", "ping"} {
+		frame := []byte{0, 0, 0, byte(17 + len(body)), 0, 0, 0, 0, 0, 0, 0, 0, byte(id + 1), 0, 0, 0, 0, 0, 0, 0, 0}
+		_, _ = conn.Write(append(frame, body...))
+
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(conn, header); nil != err {
+			t.Fatalf("read: %v", err)
+		}
+		response := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err = io.ReadFull(conn, response); nil != err {
+			t.Fatalf("read: %v", err)
+		}
+		if response[0] != 0 || binary.BigEndian.Uint64(response[1:9]) != uint64(id+1) {
+			t.Errorf("bad response header: %v", response[:9])
+		}
+		if id == 1 && string(response[17:]) != "ping" {
+			t.Errorf("bad response body: %q", response[17:])
+		}
+	}
+}
+
+func TestNioCodec_maxMessageSize(t *testing.T) {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(DefaultMaxMessageSize)+1)
+	var message NioMessage
+	if err := GetCodec(CodecBinary).Decode(bufio.NewReader(bytes.NewReader(frame)), &message); err != ErrorMessageTooLarge {
+		t.Errorf("expected too large frame, got %v", err)
+	}
+	line := bytes.Repeat([]byte("a"), DefaultMaxMessageSize+1)
+	if err := GetCodec(CodecJson).Decode(bufio.NewReader(bytes.NewReader(line)), &message); err != ErrorMessageTooLarge {
+		t.Errorf("expected too large line, got %v", err)
+	}
+
+	// gob: consecutive messages are read by new decoders, a large message is refused before it is read
+	var stream bytes.Buffer
+	codec := GetCodec(CodecGob)
+	for _, body := range []string{"first", "second", strings.Repeat("x", 2048)} {
+		_ = codec.Encode(&stream, &NioMessage{Id: 1, Body: []byte(body)})
+	}
+	reader := bufio.NewReader(&stream)
+	for _, body := range []string{"first", "second"} {
+		if err := decode(codec, reader, &message, 1024); nil != err || string(message.Body.([]byte)) != body {
+			t.Errorf("bad gob message: %v %v", message.Body, err)
+		}
+	}
+	if err := decode(codec, reader, &message, 1024); err != ErrorMessageTooLarge {
+		t.Errorf("expected too large gob message, got %v", err)
+	}
+	// declared size is checked before gob allocates it
+	huge := []byte{0xfc, 0x3f, 0xff, 0xff, 0xff} // 1Gb
+	if err := decode(codec, bufio.NewReader(bytes.NewReader(huge)), &message, 1024); err != ErrorMessageTooLarge {
+		t.Errorf("expected too large gob length, got %v", err)
+	}
+
+	// each server has its own limit
+	for _, limit := range []int{1024, DefaultMaxMessageSize} {
+		server := openConfiguredServer(t, func(server *NioServer) {
+			server.MaxMessageSize = limit
+		})
+		client := NIO.NewClient("127.0.0.1", server.Port())
+		client.Timeout = time.Second
+		if err := client.Open(); nil != err {
+			t.Fatal(err)
+		}
+		_, err := client.Send(strings.Repeat("x", 2048))
+		if (limit == 1024) != (nil != err) {
+			t.Errorf("limit %v: unexpected response error %v", limit, err)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+
+	// silent peer is disconnected
+	server := openConfiguredServer(t, func(server *NioServer) {
+		server.HelloTimeout = 100 * time.Millisecond
+	})
+	defer server.Close()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.Port()))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection closed by server, got %v", err)
+	}
+}
+
+// openTestPair opens an echo server and a connected client
+func openTestPair(t *testing.T, secure bool, codec string) (*NioServer, *NioClient) {
+	server := openTestServer(t, nil)
+	client := NIO.NewClient("127.0.0.1", server.Port())
+	client.Secure = secure
+	client.Codec = codec
+	if err := client.Open(); nil != err {
+		t.Fatalf("open client: %v", err)
+	}
+	return server, client
+}
+
+func openTestServer(t *testing.T, auth *NioAuth) *NioServer {
+	return openConfiguredServer(t, func(server *NioServer) {
+		server.Auth = auth
+	})
+}
+
+// openConfiguredServer opens an echo server. Settings are changed by configure before Open.
+func openConfiguredServer(t *testing.T, configure func(server *NioServer)) *NioServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("listen: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	server := NIO.NewServer(port)
+	configure(server)
+	server.OnMessage(func(message *NioMessage) interface{} {
+		return message.Body
+	})
+	if err = server.Open(); nil != err {
+		t.Fatalf("open server: %v", err)
+	}
+	return server
+}
+
+func TestNioClient_reconnect(t *testing.T) {
+	server := openTestServer(t, nil)
+	port := server.Port()
+	client := NIO.NewClient("127.0.0.1", port)
+	client.Secure = true
+	client.AutoReconnect = true
+	client.ReconnectDelay = 50 * time.Millisecond
+	client.ReconnectMax = 200 * time.Millisecond
+	client.QueueSize = 10
+	events := make(chan string, 10)
+	client.OnConnect(func(e *qb_events.Event) { events <- "connect" })
+	client.OnDisconnect(func(e *qb_events.Event) { events <- "disconnect" })
+	if err := client.Open(); nil != err {
+		t.Fatalf("open client: %v", err)
+	}
+	defer client.Close()
+
+	_ = server.Close()
+	time.Sleep(100 * time.Millisecond)
+	if client.IsConnected() {
+		t.Errorf("expected disconnected client")
+	}
+
+	// requests sent while disconnected wait for reconnection
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("queued %d", i)
+			response, err := client.Send(body)
+			if nil != err || string(response.Body.([]byte)) != body {
+				t.Errorf("bad response after reconnect: %v %v", response, err)
+			}
+		}(i)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	server = NIO.NewServer(port)
+	server.OnMessage(func(message *NioMessage) interface{} {
+		return message.Body
+	})
+	if err := server.Open(); nil != err {
+		t.Fatalf("reopen server: %v", err)
+	}
+	defer server.Close()
+	wg.Wait()
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("missing events: %v", got)
+		}
+	}
+	if fmt.Sprint(got) != "[connect disconnect connect]" {
+		t.Errorf("bad events: %v", got)
+	}
+}
+
+func TestNioClient_sendWhileReconnecting(t *testing.T) {
+	server := openTestServer(t, nil)
+	defer server.Close()
+	client := NIO.NewClient("127.0.0.1", server.Port())
+	client.Secure = true
+	client.AutoReconnect = true
+	client.ReconnectDelay = 10 * time.Millisecond
+	client.ReconnectMax = 20 * time.Millisecond
+	client.QueueSize = 10
+	if err := client.Open(); nil != err {
+		t.Fatalf("open client: %v", err)
+	}
+	defer client.Close()
+
+	// server drops connections while requests are sent: each reconnection has a new session key
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(30 * time.Millisecond)
+			server.mux.Lock()
+			for _, c := range server.clientsMap {
+				_ = c.conn.Close()
+			}
+			server.mux.Unlock()
+		}
+		close(done)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				body := fmt.Sprintf("message %d", i)
+				// requests in flight when the connection is dropped fail
+				if response, err := client.Send(body); nil == err && string(response.Body.([]byte)) != body {
+					t.Errorf("bad response: %v", response.Body)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := client.SendContext(ctx, "last"); nil != err {
+		t.Errorf("send after reconnection: %v", err)
+	}
+}
+
+func TestNioClient_queueFull(t *testing.T) {
+	server := openTestServer(t, nil)
+	port := server.Port()
+	_ = server.Close()
+
+	client := NIO.NewClient("127.0.0.1", port)
+	client.AutoReconnect = true
+	client.ReconnectDelay = time.Second
+	if err := client.Open(); nil != err {
+		t.Fatalf("open client: %v", err)
+	}
+	if _, err := client.Send("no queue"); nil == err {
+		t.Errorf("expected error without queue")
+	}
+
+	client.QueueSize = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go func() { _, _ = client.SendContext(ctx, "waiting") }()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := client.Send("full"); err != ErrorQueueFull {
+		t.Errorf("expected queue full, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = client.Close()
+	}()
+	client.QueueSize = 2
+	if _, err := client.Send("closing"); err != ErrorClientClosed {
+		t.Errorf("expected client closed, got %v", err)
+	}
+}
+
+func TestNioClient_legacyServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// legacy server: gob messages, responses in request order without id
+		conn, err := listener.Accept()
+		if nil != err {
+			return
+		}
+		defer conn.Close()
+		codec, reader, writer := GetCodec(CodecGob), bufio.NewReader(conn), bufio.NewWriter(conn)
+		for {
+			var message NioMessage
+			if err := codec.Decode(reader, &message); nil != err {
+				return
+			}
+			if body, ok := message.Body.([]byte); ok && string(body) == "slow" {
+				time.Sleep(400 * time.Millisecond)
+			}
+			_ = codec.Encode(writer, &NioMessage{Body: message.Body})
+			_ = writer.Flush()
+		}
+	}()
+
+	client := NIO.NewClient("127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	client.Timeout = 200 * time.Millisecond
+	if err = client.Open(); nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, body := range []string{"first", "second"} {
+		response, err := client.Send(body)
+		if nil != err || string(response.Body.([]byte)) != body {
+			t.Fatalf("expected %s, got %v %v", body, response, err)
+		}
+	}
+	if _, err = client.Send("slow"); err != ErrorResponseTimeout {
+		t.Fatalf("expected response timeout, got %v", err)
+	}
+	// late response of the slow request is discarded
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if response, err := client.SendContext(ctx, "third"); nil != err || string(response.Body.([]byte)) != "third" {
+		t.Fatalf("bad response after timeout: %v %v", response, err)
+	}
+}
@@ -0,0 +1,412 @@
+package qb_nio
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rskvp/qb-core/qb_events"
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	RpcTransferBegin  = "transfer.begin"
+	RpcTransferChunk  = "transfer.chunk"
+	RpcTransferCommit = "transfer.commit"
+
+	RpcCodeChecksumMismatch = "checksum_mismatch"
+	RpcCodeUnexpectedChunk  = "unexpected_chunk"
+	RpcCodeUnknownTransfer  = "unknown_transfer"
+
+	EventTransferProgress = "transfer_progress"
+	EventTransferComplete = "transfer_complete"
+)
+
+var (
+	ErrorRpcChecksumMismatch = NewRpcError(RpcCodeChecksumMismatch, "checksum mismatch")
+	ErrorRpcUnexpectedChunk  = NewRpcError(RpcCodeUnexpectedChunk, "unexpected chunk")
+	ErrorRpcUnknownTransfer  = NewRpcError(RpcCodeUnknownTransfer, "unknown transfer")
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// NioFileManifest describes a file sent with NioClient.SendFile
+type NioFileManifest struct {
+	Id        string `json:"id"` // same file has same id: used to resume transfers
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Chunks    uint64 `json:"chunks"`
+	SHA256    string `json:"sha256"` // hash of the file
+}
+
+// NioTransferProgress is the argument of transfer events
+type NioTransferProgress struct {
+	Manifest *NioFileManifest
+	Chunks   uint64 // acknowledged chunks
+	Bytes    int64  // acknowledged bytes
+	Filename string // (receiver) file path, set when complete
+}
+
+type transferChunk struct {
+	Id     string `json:"id"`
+	Index  uint64 `json:"index"`
+	SHA256 string `json:"sha256"`
+	Data   []byte `json:"data"`
+}
+
+type transferAck struct {
+	Next uint64 `json:"next"` // next chunk expected by receiver
+}
+
+// transferState is saved next to the partial file, so transfers can be resumed also after a restart
+type transferState struct {
+	Manifest *NioFileManifest `json:"manifest"`
+	Next     uint64           `json:"next"`
+}
+
+// transferReceiver stores files sent by clients in a directory
+type transferReceiver struct {
+	dir    string
+	events *qb_events.Emitter
+	mux    sync.Mutex // chunks of a transfer arrive in sequence, a lock for all transfers is enough
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	s e r v e r
+//----------------------------------------------------------------------------------------------------------------------
+
+// ReceiveFiles accepts files sent with NioClient.SendFile and stores them in dir.
+// Partial transfers are kept in dir and resumed when the client sends the same file again.
+func (instance *NioServer) ReceiveFiles(dir string, middleware ...NioRpcMiddleware) error {
+	if nil != instance {
+		if err := os.MkdirAll(dir, os.ModePerm); nil != err {
+			return err
+		}
+		receiver := &transferReceiver{dir: dir, events: instance.events}
+		instance.Register(RpcTransferBegin, receiver.begin, middleware...)
+		instance.Register(RpcTransferChunk, receiver.chunk, middleware...)
+		instance.Register(RpcTransferCommit, receiver.commit, middleware...)
+	}
+	return nil
+}
+
+// OnTransferProgress is notified for each received chunk. Argument is *NioTransferProgress
+func (instance *NioServer) OnTransferProgress(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventTransferProgress, callback)
+	}
+}
+
+// OnTransferComplete is notified when a file is received. Argument is *NioTransferProgress
+func (instance *NioServer) OnTransferComplete(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventTransferComplete, callback)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c l i e n t
+//----------------------------------------------------------------------------------------------------------------------
+
+// SendFile sends a file in chunks to a server accepting files (see NioServer.ReceiveFiles).
+// If a previous transfer of the same file was interrupted, it is resumed from the last acknowledged chunk.
+func (instance *NioClient) SendFile(filename string) (*NioFileManifest, error) {
+	return instance.SendFileContext(context.Background(), filename)
+}
+
+func (instance *NioClient) SendFileContext(ctx context.Context, filename string) (*NioFileManifest, error) {
+	if nil != instance {
+		manifest, err := instance.newManifest(filename)
+		if nil != err {
+			return nil, err
+		}
+
+		var ack transferAck
+		if err = instance.CallContext(ctx, RpcTransferBegin, manifest, &ack); nil != err {
+			return nil, err
+		}
+		chunker := qb_utils.NewFileChunker(manifest.ChunkSize)
+		err = chunker.SplitWalkFrom(filename, ack.Next, func(index uint64, data []byte) error {
+			chunk := &transferChunk{Id: manifest.Id, Index: index, SHA256: qb_utils.Coding.SHA256(data), Data: data}
+			if err := instance.CallContext(ctx, RpcTransferChunk, chunk, &ack); nil != err {
+				return err
+			}
+			instance.events.Emit(EventTransferProgress, newTransferProgress(manifest, ack.Next, ""))
+			return nil
+		})
+		if nil != err {
+			return nil, err
+		}
+		if err = instance.CallContext(ctx, RpcTransferCommit, manifest, nil); nil != err {
+			return nil, err
+		}
+		instance.events.Emit(EventTransferComplete, newTransferProgress(manifest, manifest.Chunks, ""))
+		return manifest, nil
+	}
+	return nil, nil
+}
+
+// OnTransferProgress is notified for each chunk acknowledged by server. Argument is *NioTransferProgress
+func (instance *NioClient) OnTransferProgress(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventTransferProgress, callback)
+	}
+}
+
+// OnTransferComplete is notified when a file is sent. Argument is *NioTransferProgress
+func (instance *NioClient) OnTransferComplete(callback func(e *qb_events.Event)) {
+	if nil != instance {
+		instance.events.On(EventTransferComplete, callback)
+	}
+}
+
+func (instance *NioClient) newManifest(filename string) (*NioFileManifest, error) {
+	chunkSize := instance.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = qb_utils.ChunkSizeLarge
+	}
+	size, chunks, err := qb_utils.NewFileChunker(chunkSize).CalculateChunks(filename)
+	if nil != err {
+		return nil, err
+	}
+	hash, err := qb_utils.Coding.SHA256FromFile(filename)
+	if nil != err {
+		return nil, err
+	}
+	manifest := &NioFileManifest{
+		Name:      filepath.Base(filename),
+		Size:      size,
+		ChunkSize: chunkSize,
+		Chunks:    chunks,
+		SHA256:    hash,
+	}
+	manifest.Id = qb_utils.Coding.SHA256FromText(qb_utils.Strings.Format("%s|%s|%s|%s",
+		manifest.Name, manifest.Size, manifest.ChunkSize, manifest.SHA256))
+	return manifest, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	r e c e i v e r
+//----------------------------------------------------------------------------------------------------------------------
+
+// begin starts a transfer or resumes a partial transfer. Responds the next expected chunk.
+func (instance *transferReceiver) begin(_ context.Context, req *NioRpcRequest) (interface{}, error) {
+	var manifest NioFileManifest
+	if err := req.Bind(&manifest); nil != err {
+		return nil, err
+	}
+	if len(manifest.Id) == 0 || manifest.ChunkSize <= 0 || !isTransferId(manifest.Id) || !isTransferName(manifest.Name) {
+		return nil, ErrorRpcInvalidParams
+	}
+
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	state, err := instance.load(manifest.Id)
+	if nil == err && nil != state && *state.Manifest == manifest {
+		return &transferAck{Next: state.Next}, nil // resume
+	}
+	state = &transferState{Manifest: &manifest}
+	if err = os.WriteFile(instance.partName(manifest.Id), []byte{}, 0600); nil != err {
+		return nil, err
+	}
+	return &transferAck{Next: 0}, instance.save(state)
+}
+
+// chunk writes a chunk. Chunks must be sent in order, chunks already received are acknowledged again.
+func (instance *transferReceiver) chunk(_ context.Context, req *NioRpcRequest) (interface{}, error) {
+	var chunk transferChunk
+	if err := req.Bind(&chunk); nil != err {
+		return nil, err
+	}
+
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	state, err := instance.load(chunk.Id)
+	if nil != err {
+		return nil, ErrorRpcUnknownTransfer
+	}
+	if chunk.Index < state.Next {
+		return &transferAck{Next: state.Next}, nil // already received
+	}
+	if chunk.Index > state.Next || chunk.Index >= state.Manifest.Chunks {
+		return nil, &NioRpcError{Code: RpcCodeUnexpectedChunk, Message: "unexpected chunk", Data: &transferAck{Next: state.Next}}
+	}
+	if qb_utils.Coding.SHA256(chunk.Data) != chunk.SHA256 {
+		return nil, ErrorRpcChecksumMismatch
+	}
+
+	file, err := os.OpenFile(instance.partName(chunk.Id), os.O_WRONLY, 0600)
+	if nil != err {
+		return nil, err
+	}
+	_, err = file.WriteAt(chunk.Data, int64(chunk.Index)*state.Manifest.ChunkSize)
+	if nil == err {
+		err = file.Sync()
+	}
+	_ = file.Close()
+	if nil != err {
+		return nil, err
+	}
+
+	state.Next++
+	if err = instance.save(state); nil != err {
+		return nil, err
+	}
+	instance.events.Emit(EventTransferProgress, newTransferProgress(state.Manifest, state.Next, ""))
+	return &transferAck{Next: state.Next}, nil
+}
+
+// commit verifies the file and moves it to the directory of received files
+func (instance *transferReceiver) commit(_ context.Context, req *NioRpcRequest) (interface{}, error) {
+	var manifest NioFileManifest
+	if err := req.Bind(&manifest); nil != err {
+		return nil, err
+	}
+
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	state, err := instance.load(manifest.Id)
+	if nil != err {
+		return nil, ErrorRpcUnknownTransfer
+	}
+	if state.Next != state.Manifest.Chunks {
+		return nil, &NioRpcError{Code: RpcCodeUnexpectedChunk, Message: "transfer not complete", Data: &transferAck{Next: state.Next}}
+	}
+	part := instance.partName(manifest.Id)
+	hash, err := qb_utils.Coding.SHA256FromFile(part)
+	if nil != err {
+		return nil, err
+	}
+	if hash != state.Manifest.SHA256 {
+		// start again
+		_ = os.Remove(part)
+		_ = os.Remove(instance.stateName(manifest.Id))
+		return nil, ErrorRpcChecksumMismatch
+	}
+	filename, err := instance.move(part, filepath.Base(state.Manifest.Name))
+	if nil != err {
+		return nil, err
+	}
+	_ = os.Remove(instance.stateName(manifest.Id))
+	instance.events.Emit(EventTransferComplete, newTransferProgress(state.Manifest, state.Next, filename))
+	return true, nil
+}
+
+func (instance *transferReceiver) load(id string) (*transferState, error) {
+	if !isTransferId(id) {
+		return nil, ErrorRpcUnknownTransfer
+	}
+	data, err := os.ReadFile(instance.stateName(id))
+	if nil != err {
+		return nil, err
+	}
+	var state transferState
+	if err = qb_utils.JSON.Read(data, &state); nil != err {
+		return nil, err
+	}
+	if nil == state.Manifest {
+		return nil, ErrorRpcUnknownTransfer
+	}
+	return &state, nil
+}
+
+// save writes the state into a temporary file and renames it, so that a crash never leaves a partial state
+func (instance *transferReceiver) save(state *transferState) error {
+	filename := instance.stateName(state.Manifest.Id)
+	f, err := os.CreateTemp(instance.dir, filepath.Base(filename)+".*.tmp")
+	if nil != err {
+		return err
+	}
+	_, err = f.Write(qb_utils.JSON.Bytes(state))
+	if nil == err {
+		err = f.Sync()
+	}
+	if e := f.Close(); nil == err {
+		err = e
+	}
+	if nil != err {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// move moves a completed file into the directory without overwriting existing files.
+// If name is already used, a number is added to the name: "app (1).log".
+func (instance *transferReceiver) move(part, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		filename := filepath.Join(instance.dir, name)
+		if i > 0 {
+			filename = filepath.Join(instance.dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		// a hard link fails if the file exists (rename would replace it)
+		err := os.Link(part, filename)
+		if nil == err {
+			_ = os.Remove(part)
+			return filename, nil
+		}
+		if os.IsExist(err) {
+			continue
+		}
+		// file system without hard links
+		if _, e := os.Lstat(filename); os.IsNotExist(e) {
+			return filename, os.Rename(part, filename)
+		} else if nil != e {
+			return "", e
+		}
+	}
+}
+
+func (instance *transferReceiver) partName(id string) string {
+	return filepath.Join(instance.dir, "."+id+".part")
+}
+
+func (instance *transferReceiver) stateName(id string) string {
+	return filepath.Join(instance.dir, "."+id+".json")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func newTransferProgress(manifest *NioFileManifest, chunks uint64, filename string) *NioTransferProgress {
+	bytes := int64(chunks) * manifest.ChunkSize
+	if bytes > manifest.Size {
+		bytes = manifest.Size
+	}
+	return &NioTransferProgress{Manifest: manifest, Chunks: chunks, Bytes: bytes, Filename: filename}
+}
+
+// isTransferName checks the name of a received file is a plain file name, not hidden (partial files and states are hidden)
+func isTransferName(name string) bool {
+	name = filepath.Base(name)
+	return len(name) > 0 && name != string(filepath.Separator) && !strings.HasPrefix(name, ".")
+}
+
+// isTransferId checks id is a SHA-256 hex string (id is used in file names)
+func isTransferId(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
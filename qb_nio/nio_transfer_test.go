@@ -0,0 +1,143 @@
+package qb_nio
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+)
+
+func TestNioClient_sendFile(t *testing.T) {
+	server, client := openTestPair(t, true, CodecBinary)
+	defer server.Close()
+	defer client.Close()
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source", "app.log")
+	data := make([]byte, 300*1024+17)
+	_, _ = rand.Read(data)
+	_ = os.MkdirAll(filepath.Dir(source), os.ModePerm)
+	if err := os.WriteFile(source, data, 0600); nil != err {
+		t.Fatalf("write: %v", err)
+	}
+
+	// first transfer is interrupted at chunk 3
+	var received []uint64
+	var mux sync.Mutex
+	interrupted := false
+	interrupt := func(next NioRpcHandler) NioRpcHandler {
+		return func(ctx context.Context, req *NioRpcRequest) (interface{}, error) {
+			if req.Method == RpcTransferChunk {
+				var chunk transferChunk
+				_ = req.Bind(&chunk)
+				mux.Lock()
+				defer mux.Unlock()
+				if chunk.Index == 3 && !interrupted {
+					interrupted = true
+					return nil, NewRpcError("interrupted", "connection lost")
+				}
+				received = append(received, chunk.Index)
+			}
+			return next(ctx, req)
+		}
+	}
+	target := filepath.Join(dir, "target")
+	if err := server.ReceiveFiles(target, interrupt); nil != err {
+		t.Fatalf("receive files: %v", err)
+	}
+	completed := make(chan *NioTransferProgress, 1)
+	server.OnTransferComplete(func(e *qb_events.Event) {
+		completed <- e.Argument(0).(*NioTransferProgress)
+	})
+	var progress []int64
+	client.OnTransferProgress(func(e *qb_events.Event) {
+		mux.Lock()
+		defer mux.Unlock()
+		progress = append(progress, e.Argument(0).(*NioTransferProgress).Bytes)
+	})
+
+	client.ChunkSize = 64 * 1024
+	if _, err := client.SendFile(source); nil == err {
+		t.Fatalf("expected interrupted transfer")
+	}
+	manifest, err := client.SendFile(source)
+	if nil != err {
+		t.Fatalf("send file: %v", err)
+	}
+	if manifest.Chunks != 5 || manifest.Size != int64(len(data)) {
+		t.Errorf("bad manifest: %+v", manifest)
+	}
+
+	mux.Lock()
+	if len(received) != 5 || received[3] != 3 || received[4] != 4 {
+		t.Errorf("transfer not resumed from last chunk: %v", received)
+	}
+	mux.Unlock()
+
+	select {
+	case p := <-completed:
+		got, err := os.ReadFile(p.Filename)
+		if nil != err || !bytes.Equal(got, data) {
+			t.Errorf("bad received file %s: %v", p.Filename, err)
+		}
+		if p.Bytes != manifest.Size {
+			t.Errorf("bad progress: %+v", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("transfer not completed")
+	}
+	entries, _ := os.ReadDir(target)
+	if len(entries) != 1 {
+		t.Errorf("partial files not removed: %v", entries)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mux.Lock()
+	if len(progress) != 5 {
+		t.Errorf("expected 5 progress events, got %v", progress)
+	}
+	mux.Unlock()
+}
+
+func TestNioClient_sendFileExisting(t *testing.T) {
+	server, client := openTestPair(t, true, CodecJson)
+	defer server.Close()
+	defer client.Close()
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "app.log")
+	target := filepath.Join(dir, "target")
+	if err := server.ReceiveFiles(target); nil != err {
+		t.Fatalf("receive files: %v", err)
+	}
+	existing := []byte("do not overwrite")
+	_ = os.WriteFile(filepath.Join(target, "app.log"), existing, 0600)
+	_ = os.WriteFile(source, []byte("received"), 0600)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.SendFile(source); nil != err {
+			t.Fatalf("send file: %v", err)
+		}
+	}
+	expected := map[string]string{"app.log": "do not overwrite", "app (1).log": "received", "app (2).log": "received"}
+	for name, text := range expected {
+		if got, _ := os.ReadFile(filepath.Join(target, name)); string(got) != text {
+			t.Errorf("%s: expected %q, got %q", name, text, got)
+		}
+	}
+
+	// hidden names would overwrite partial files and states
+	for _, name := range []string{".app.json", "..", "/"} {
+		manifest := &NioFileManifest{Id: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			Name: name, Size: 1, ChunkSize: 1, Chunks: 1}
+		if err := client.Call(RpcTransferBegin, manifest, nil); nil == err {
+			t.Errorf("%q: expected invalid params", name)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package qb_nio
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	UnixScheme = "unix://" // unix:///path/to.sock
+
+	DefaultSocketMode = os.FileMode(0600)
+
+	ReasonPeerCredentials = "peer_credentials"
+)
+
+var (
+	ErrorPeerCredentialsUnsupported = errors.New("peer_credentials_unsupported")
+	ErrorNotASocket                 = errors.New("not_a_socket")
+)
+
+// unix clients have no address, ids are generated
+var lastUnixClientId uint64
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// NioPeerCredentials identifies the process connected to a unix socket (SO_PEERCRED)
+type NioPeerCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+// IsUnixAddress checks if address is a unix socket address (unix:///path/to.sock)
+func IsUnixAddress(address string) bool {
+	return strings.HasPrefix(address, UnixScheme)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+// networkAddress returns network and address to dial or listen
+func networkAddress(host string, port int) (network string, address string) {
+	if IsUnixAddress(host) {
+		return "unix", strings.TrimPrefix(host, UnixScheme)
+	}
+	return "tcp", qb_utils.Strings.Format("%s:%s", host, port)
+}
+
+// listenUnix creates the socket file (removing a stale socket) with mode permissions
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); nil == err {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, qb_utils.Errors.Prefix(ErrorNotASocket, path+": ")
+		}
+		if conn, err := net.Dial("unix", path); nil == err {
+			_ = conn.Close()
+			return nil, qb_utils.Errors.Prefix(errors.New("address_in_use"), path+": ")
+		}
+		_ = os.Remove(path) // stale
+	}
+	listener, err := net.Listen("unix", path)
+	if nil != err {
+		return nil, err
+	}
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	if err = os.Chmod(path, mode); nil != err {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// checkPeer verifies the credentials of the process connected to a unix socket
+func (instance *NioServer) checkPeer(conn net.Conn) bool {
+	if len(instance.limits.peerUids) == 0 && len(instance.limits.peerGids) == 0 {
+		return true
+	}
+	cred, err := peerCredentials(conn)
+	if nil != err {
+		return false
+	}
+	for _, uid := range instance.limits.peerUids {
+		if uid == cred.Uid {
+			return true
+		}
+	}
+	for _, gid := range instance.limits.peerGids {
+		if gid == cred.Gid {
+			return true
+		}
+	}
+	return false
+}
+
+func (instance *NioServer) isUnix() bool {
+	return IsUnixAddress(instance.address)
+}
+
+func newUnixClientId() string {
+	return qb_utils.Strings.Format("unix:%s", atomic.AddUint64(&lastUnixClientId, 1))
+}
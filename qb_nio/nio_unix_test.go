@@ -0,0 +1,93 @@
+package qb_nio
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_events"
+)
+
+func TestNioServer_unixSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is supported only on linux")
+	}
+	dir, err := os.MkdirTemp("", "nio") // socket paths are limited to ~100 chars
+	if nil != err {
+		t.Fatalf("temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nio.sock")
+
+	var settings NioSettings
+	_ = settings.Parse(`{"address":"unix://` + path + `"}`)
+	if !settings.IsUnix() || settings.Host() != "unix://"+path || settings.Port() != 0 {
+		t.Errorf("bad settings: %v %v", settings.Host(), settings.Port())
+	}
+
+	_, serverKey, _ := GenerateAuthKey()
+	server := NIO.NewServer(settings.Address)
+	server.SocketMode = 0660
+	server.Auth = &NioAuth{PrivateKey: serverKey} // not required on trusted socket
+	server.TrustedSocket = true
+	server.PeerUids = []uint32{uint32(os.Getuid())}
+	server.OnMessage(func(message *NioMessage) interface{} {
+		return message.Body
+	})
+	if err = server.Open(); nil != err {
+		t.Fatalf("open server: %v", err)
+	}
+	defer server.Close()
+	if info, err := os.Stat(path); nil != err || info.Mode().Perm() != 0660 {
+		t.Errorf("bad socket mode: %v %v", info, err)
+	}
+
+	clients := make([]*NioClient, 2)
+	for i := range clients {
+		clients[i] = NIO.NewClient(settings.Host(), settings.Port())
+		clients[i].TrustedSocket = true
+		clients[i].Secure = true
+		if _, err = clients[i].Send("hello"); nil != err {
+			t.Fatalf("send: %v", err)
+		}
+		defer clients[i].Close()
+	}
+	if server.ClientsCount() != 2 {
+		t.Errorf("expected 2 clients, got %v", server.ClientsId())
+	}
+	if c, _ := clients[0].connect(); nil != clients[0].publicKey || len(c.getSessionKey()) > 0 {
+		t.Errorf("trusted socket must not be encrypted")
+	}
+
+	// peer credentials
+	other := NIO.NewServer(UnixScheme + filepath.Join(dir, "other.sock"))
+	other.PeerUids = []uint32{uint32(os.Getuid()) + 1}
+	rejected := make(chan string, 1)
+	other.OnClientRejected(func(e *qb_events.Event) {
+		rejected <- e.Argument(0).(*NioClientEvent).Reason
+	})
+	if err = other.Open(); nil != err {
+		t.Fatalf("open server: %v", err)
+	}
+	defer other.Close()
+	client := NIO.NewClient(other.Address(), 0)
+	client.Timeout = time.Second
+	if _, err = client.Send("hello"); nil == err {
+		t.Errorf("expected rejected client")
+	}
+	select {
+	case reason := <-rejected:
+		if reason != ReasonPeerCredentials {
+			t.Errorf("bad reason %v", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("missing rejected event")
+	}
+
+	_ = server.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed: %v", err)
+	}
+}
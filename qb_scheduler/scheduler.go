@@ -1,12 +1,16 @@
 package qb_scheduler
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rskvp/qb-core/qb_events"
 	"github.com/rskvp/qb-core/qb_utils"
+	"github.com/rskvp/qb-core/qb_vcal"
 )
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -18,23 +22,46 @@ const (
 	onError    = "on_error"
 )
 
+var (
+	ErrorTaskTimeout     = errors.New("task_timeout_error")
+	ErrorTaskSkipped     = errors.New("task_skipped_error")
+	ErrorInvalidTimeline = errors.New("invalid_timeline_error")
+)
+
 //----------------------------------------------------------------------------------------------------------------------
 //	t y p e s
 //----------------------------------------------------------------------------------------------------------------------
 
 type SchedulerTaskHandler func(schedule *SchedulerTask)
+type SchedulerTaskContextHandler func(ctx context.Context, schedule *SchedulerTask)
 type SchedulerErrorHandler func(err string)
 
 type Scheduler struct {
 	settings       *SchedulerSettings
 	internalEvents *qb_events.Emitter
 	taskHandlers   []SchedulerTaskHandler
+	ctxHandlers    []SchedulerTaskContextHandler
 	errorHandlers  []SchedulerErrorHandler
-	timer          *time.Ticker
-	stopChan       chan bool
+	stopChan       chan bool // closed on Stop
 	closed         bool
 	paused         bool
+	stateMux       sync.RWMutex // guards stopChan, closed, paused and ctx
 	tasks          []*SchedulerTask
+	tasksMux       sync.RWMutex
+	configFile     string
+	state          *schedulerStateStore // guarded by tasksMux
+	saveMux        sync.Mutex           // serializes saves of the run loop and Stop
+	ctx            context.Context      // cancelled on Stop
+	ctxCancel      context.CancelFunc
+	calendars      map[string]*ExclusionCalendar // exclusion calendars by name or file
+	calendarsMux   sync.Mutex
+	leaderHandlers []SchedulerLeaderHandler
+	leaderLock     LeaderLock
+	leaderOwner    string
+	leaderTtl      time.Duration
+	leader         bool
+	leaderMux      sync.RWMutex
+	leaderStop     chan bool
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -46,11 +73,14 @@ func NewScheduler() *Scheduler {
 	instance.settings = new(SchedulerSettings)
 	instance.internalEvents = qb_events.Events.NewEmitter()
 	instance.taskHandlers = make([]SchedulerTaskHandler, 0)
+	instance.ctxHandlers = make([]SchedulerTaskContextHandler, 0)
 	instance.errorHandlers = make([]SchedulerErrorHandler, 0)
-	instance.stopChan = make(chan bool, 1)
+	instance.leaderHandlers = make([]SchedulerLeaderHandler, 0)
+	instance.stopChan = make(chan bool)
 	instance.closed = true
 	instance.paused = false
 	instance.tasks = make([]*SchedulerTask, 0)
+	instance.calendars = make(map[string]*ExclusionCalendar)
 	instance.initEvents()
 
 	return instance
@@ -65,6 +95,7 @@ func NewSchedulerWithSettings(settings *SchedulerSettings) *Scheduler {
 
 func NewSchedulerFromFile(configFile string) *Scheduler {
 	instance := NewScheduler()
+	instance.configFile = configFile
 	instance.load(configFile)
 
 	return instance
@@ -104,14 +135,14 @@ func (instance *Scheduler) IsAsync() bool {
 
 func (instance *Scheduler) IsStarted() bool {
 	if nil != instance && nil != instance.settings {
-		return nil != instance.timer
+		return !instance.isClosed()
 	}
 	return false
 }
 
 func (instance *Scheduler) CountHandlers() int {
 	if nil != instance && nil != instance.settings && nil != instance.taskHandlers {
-		return len(instance.taskHandlers)
+		return len(instance.taskHandlers) + len(instance.ctxHandlers)
 	}
 	return 0
 }
@@ -124,9 +155,9 @@ func (instance *Scheduler) SetAsync(value bool) {
 
 func (instance *Scheduler) HasErrors() bool {
 	if nil != instance {
-		if len(instance.tasks) > 0 {
-			for _, t := range instance.tasks {
-				if nil != t.err {
+		if tasks := instance.getTasks(); len(tasks) > 0 {
+			for _, t := range tasks {
+				if len(t.Error()) > 0 {
 					return true
 				}
 			}
@@ -138,10 +169,10 @@ func (instance *Scheduler) HasErrors() bool {
 func (instance *Scheduler) GetErrors() string {
 	if nil != instance {
 		builder := new(strings.Builder)
-		if len(instance.tasks) > 0 {
-			for _, t := range instance.tasks {
-				if nil != t.err {
-					builder.WriteString(t.err.Error() + "\n")
+		if tasks := instance.getTasks(); len(tasks) > 0 {
+			for _, t := range tasks {
+				if e := t.Error(); len(e) > 0 {
+					builder.WriteString(e + "\n")
 				}
 			}
 		}
@@ -157,15 +188,184 @@ func (instance *Scheduler) GetTimeout() time.Duration {
 	return 0 * time.Second
 }
 
+// SetStateFile enable persistence of tasks state (last and next run).
+// Runs missed while the scheduler was not running are handled using Schedule.Misfire policy.
+func (instance *Scheduler) SetStateFile(filename string) {
+	if nil != instance && nil != instance.settings {
+		instance.settings.StateFile = filename
+	}
+}
+
+func (instance *Scheduler) GetStateFile() string {
+	if nil != instance && nil != instance.settings && len(instance.settings.StateFile) > 0 {
+		filename := instance.settings.StateFile
+		if len(instance.configFile) > 0 && !qb_utils.Paths.IsAbs(filename) {
+			filename = qb_utils.Paths.Concat(qb_utils.Paths.Dir(instance.configFile), filename)
+		}
+		return qb_utils.Paths.Absolute(filename)
+	}
+	return ""
+}
+
+// AddExclusionCalendar registers a named exclusion calendar (holidays, maintenance windows).
+// Schedules refer to it by name into Schedule.Exclusions. Tasks already active are not changed.
+func (instance *Scheduler) AddExclusionCalendar(name string, calendars ...*qb_vcal.Calendar) *ExclusionCalendar {
+	if nil != instance && len(name) > 0 {
+		exclusions := NewExclusionCalendar(calendars...)
+		instance.calendarsMux.Lock()
+		instance.calendars[name] = exclusions
+		instance.calendarsMux.Unlock()
+		return exclusions
+	}
+	return nil
+}
+
+// AddSchedule adds a schedule. If the scheduler is already started, the task is immediately active.
 func (instance *Scheduler) AddSchedule(item *Schedule, args ...interface{}) {
-	if nil != instance {
+	if nil != instance && nil != item {
 		if len(args) > 0 {
 			item.Arguments = append(item.Arguments, args...)
 		}
+		instance.tasksMux.Lock()
 		instance.settings.Schedules = append(instance.settings.Schedules, item)
+		instance.tasksMux.Unlock()
+		if !instance.isClosed() {
+			instance.addTask(item)
+		}
 	}
 }
 
+// RemoveSchedule removes a schedule and its task. Returns false if uid was not found.
+func (instance *Scheduler) RemoveSchedule(uid string) bool {
+	if nil != instance && len(uid) > 0 {
+		instance.tasksMux.Lock()
+		defer instance.tasksMux.Unlock()
+
+		found := false
+		for i, schedule := range instance.settings.Schedules {
+			if schedule.Uid == uid {
+				instance.settings.Schedules = append(instance.settings.Schedules[:i], instance.settings.Schedules[i+1:]...)
+				found = true
+				break
+			}
+		}
+		for i, task := range instance.tasks {
+			if task.Uid == uid {
+				instance.tasks = append(instance.tasks[:i], instance.tasks[i+1:]...)
+				if nil != instance.state {
+					instance.state.Remove(uid) // uid is the key of tasks with uid
+				}
+				break
+			}
+		}
+		return found
+	}
+	return false
+}
+
+// ReplaceSchedule replaces the schedule with same uid. Returns false if uid was not found.
+// A running task is not interrupted, new settings are used from next run.
+// Runs in progress and queued runs are kept by the concurrency policy.
+func (instance *Scheduler) ReplaceSchedule(item *Schedule, args ...interface{}) bool {
+	if nil != instance && nil != item && len(item.Uid) > 0 {
+		if len(args) > 0 {
+			item.Arguments = append(item.Arguments, args...)
+		}
+		instance.tasksMux.Lock()
+		found := false
+		for i, schedule := range instance.settings.Schedules {
+			if schedule.Uid == item.Uid {
+				instance.settings.Schedules[i] = item
+				found = true
+				break
+			}
+		}
+		var task *SchedulerTask
+		for _, t := range instance.tasks {
+			if t.Uid == item.Uid {
+				task = t
+				break
+			}
+		}
+		instance.tasksMux.Unlock()
+
+		if found && !instance.isClosed() {
+			if nil == task {
+				instance.addTask(item)
+			} else {
+				replaced := newSchedulerTask(instance.settings.Uid, instance.settings.Timezone, instance.getExclusions, item)
+				if e := replaced.Error(); len(e) > 0 {
+					instance.internalEmit(onError, e)
+				}
+				task.update(replaced)
+			}
+		}
+		return found
+	}
+	return false
+}
+
+func (instance *Scheduler) GetSchedule(uid string) *Schedule {
+	if nil != instance && len(uid) > 0 {
+		instance.tasksMux.RLock()
+		defer instance.tasksMux.RUnlock()
+		for _, schedule := range instance.settings.Schedules {
+			if schedule.Uid == uid {
+				return schedule
+			}
+		}
+	}
+	return nil
+}
+
+// GetTask returns the active task with passed uid. Returns nil if the scheduler is not started.
+func (instance *Scheduler) GetTask(uid string) *SchedulerTask {
+	if nil != instance && len(uid) > 0 {
+		for _, task := range instance.getTasks() {
+			if task.Uid == uid {
+				return task
+			}
+		}
+	}
+	return nil
+}
+
+// PauseTask pause a single schedule. Paused schedules do not fire until resumed (missed runs are lost).
+func (instance *Scheduler) PauseTask(uid string) bool {
+	return instance.setTaskPaused(uid, true)
+}
+
+func (instance *Scheduler) ResumeTask(uid string) bool {
+	return instance.setTaskPaused(uid, false)
+}
+
+func (instance *Scheduler) IsTaskPaused(uid string) bool {
+	if schedule := instance.GetSchedule(uid); nil != schedule {
+		return schedule.Paused
+	}
+	return false
+}
+
+// ListTasks returns info about all the tasks including next "count" fire times.
+// If the scheduler is not started, info are calculated from schedules as if it was started now.
+func (instance *Scheduler) ListTasks(count int) []*SchedulerTaskInfo {
+	response := make([]*SchedulerTaskInfo, 0)
+	if nil != instance {
+		tasks := instance.getTasks()
+		if instance.isClosed() {
+			instance.tasksMux.RLock()
+			for _, schedule := range instance.settings.Schedules {
+				tasks = append(tasks, newSchedulerTask(instance.settings.Uid, instance.settings.Timezone, instance.getExclusions, schedule))
+			}
+			instance.tasksMux.RUnlock()
+		}
+		for _, task := range tasks {
+			response = append(response, task.Info(count))
+		}
+	}
+	return response
+}
+
 func (instance *Scheduler) AddScheduleByJson(json string, args ...interface{}) {
 	if nil != instance {
 		if qb_utils.Regex.IsValidJsonObject(json) {
@@ -184,6 +384,52 @@ func (instance *Scheduler) OnSchedule(handler SchedulerTaskHandler) {
 	}
 }
 
+// OnScheduleContext adds a handler receiving the context of the run.
+// The context is cancelled when the scheduler stops or the run exceeds Schedule.MaxDuration.
+func (instance *Scheduler) OnScheduleContext(handler SchedulerTaskContextHandler) {
+	if nil != instance && nil != handler {
+		instance.ctxHandlers = append(instance.ctxHandlers, handler)
+	}
+}
+
+// OnLeaderChange adds a handler notified when this scheduler acquires or loses leadership
+func (instance *Scheduler) OnLeaderChange(handler SchedulerLeaderHandler) {
+	if nil != instance && nil != handler {
+		instance.leaderHandlers = append(instance.leaderHandlers, handler)
+	}
+}
+
+// SetLeaderLock enable single-leader execution: only the scheduler holding the lock fires tasks.
+// The lock is acquired on Start, renewed every ttl/3 and released on Stop. Must be called before Start.
+func (instance *Scheduler) SetLeaderLock(lock LeaderLock, ttl time.Duration) {
+	if nil != instance {
+		instance.leaderLock = lock
+		instance.leaderTtl = ttl
+	}
+}
+
+// IsLeader returns true if this scheduler can fire tasks.
+// A scheduler without a leader lock is always leader.
+func (instance *Scheduler) IsLeader() bool {
+	if nil != instance {
+		if nil == instance.leaderLock {
+			return true
+		}
+		instance.leaderMux.RLock()
+		defer instance.leaderMux.RUnlock()
+		return instance.leader
+	}
+	return false
+}
+
+// LeaderOwner returns the name used by this scheduler to hold the leader lock
+func (instance *Scheduler) LeaderOwner() string {
+	if nil != instance {
+		return instance.leaderOwner
+	}
+	return ""
+}
+
 func (instance *Scheduler) OnError(handler SchedulerErrorHandler) {
 	if nil != instance && nil != handler {
 		instance.errorHandlers = append(instance.errorHandlers, handler)
@@ -191,45 +437,68 @@ func (instance *Scheduler) OnError(handler SchedulerErrorHandler) {
 }
 
 func (instance *Scheduler) Start() {
-	if nil != instance && instance.closed {
-		instance.closed = false
-		if nil != instance.timer {
-			instance.timer.Stop()
-			instance.timer = nil
+	if nil != instance {
+		instance.stateMux.Lock()
+		if !instance.closed {
+			instance.stateMux.Unlock()
+			return
 		}
+		instance.closed = false
+		instance.stopChan = make(chan bool)
+		instance.ctx, instance.ctxCancel = context.WithCancel(context.Background())
+		stop := instance.stopChan
+		instance.stateMux.Unlock()
+
 		instance.initTasks()
-		go instance.run()
+		instance.initLeader()
+		go instance.run(stop)
 	}
 }
 
 func (instance *Scheduler) Stop() {
 	if nil != instance {
-		if nil != instance.timer {
-			instance.timer.Stop()
-		} else {
-			instance.timer = nil
+		instance.stateMux.Lock()
+		if instance.closed {
+			instance.stateMux.Unlock()
+			return
 		}
 		instance.closed = true
-		instance.stopChan <- true
-		instance.stopChan = make(chan bool, 1) // reset channel
+		instance.ctxCancel() // cancel running tasks
+		close(instance.stopChan)
+		instance.stateMux.Unlock()
+
+		// waits a save of the run loop in progress, the run loop does not save when closed
+		instance.saveMux.Lock()
+		instance.saveState()
+		instance.stopLeader()
+		instance.tasksMux.Lock()
 		instance.tasks = make([]*SchedulerTask, 0)
+		instance.state = nil
+		instance.tasksMux.Unlock()
+		instance.saveMux.Unlock()
 	}
 }
 
 func (instance *Scheduler) Pause() {
 	if nil != instance {
+		instance.stateMux.Lock()
 		instance.paused = true
+		instance.stateMux.Unlock()
 	}
 }
 
 func (instance *Scheduler) Resume() {
 	if nil != instance {
+		instance.stateMux.Lock()
 		instance.paused = false
+		instance.stateMux.Unlock()
 	}
 }
 
 func (instance *Scheduler) IsPaused() bool {
 	if nil != instance {
+		instance.stateMux.RLock()
+		defer instance.stateMux.RUnlock()
 		return instance.paused
 	}
 	return false
@@ -237,7 +506,9 @@ func (instance *Scheduler) IsPaused() bool {
 
 func (instance *Scheduler) TogglePause() {
 	if nil != instance {
+		instance.stateMux.Lock()
 		instance.paused = !instance.paused
+		instance.stateMux.Unlock()
 	}
 }
 
@@ -249,8 +520,13 @@ func (instance *Scheduler) Reload() {
 }
 
 func (instance *Scheduler) Join() {
-	if nil != instance && nil != instance.stopChan && !instance.closed {
-		<-instance.stopChan
+	if nil != instance {
+		instance.stateMux.RLock()
+		stop, closed := instance.stopChan, instance.closed
+		instance.stateMux.RUnlock()
+		if !closed {
+			<-stop
+		}
 	}
 }
 
@@ -258,6 +534,29 @@ func (instance *Scheduler) Join() {
 //	p r i v a t e
 //----------------------------------------------------------------------------------------------------------------------
 
+func (instance *Scheduler) isClosed() bool {
+	instance.stateMux.RLock()
+	defer instance.stateMux.RUnlock()
+	return instance.closed
+}
+
+// isActive returns true if the scheduler is started and not paused
+func (instance *Scheduler) isActive() bool {
+	instance.stateMux.RLock()
+	defer instance.stateMux.RUnlock()
+	return !instance.closed && !instance.paused
+}
+
+// context returns the context of the running scheduler, cancelled on Stop
+func (instance *Scheduler) context() context.Context {
+	instance.stateMux.RLock()
+	defer instance.stateMux.RUnlock()
+	if nil != instance.ctx {
+		return instance.ctx
+	}
+	return context.Background()
+}
+
 func (instance *Scheduler) load(filename string) {
 	if len(filename) > 0 {
 		txt, err := qb_utils.IO.ReadTextFromFile(filename)
@@ -269,16 +568,22 @@ func (instance *Scheduler) load(filename string) {
 
 func (instance *Scheduler) initEvents() {
 	instance.internalEvents.On(onSchedule, func(event *qb_events.Event) {
-		if nil != instance && len(instance.taskHandlers) > 0 && !instance.closed && !instance.paused {
+		if nil != instance && instance.CountHandlers() > 0 && instance.isActive() {
 			item := event.Argument(0)
 			if v, b := item.(*SchedulerTask); b {
-				for _, handler := range instance.taskHandlers {
-					if nil != handler && !instance.closed && !instance.paused {
-						// external handler
+				instance.runTask(v)
+			}
+		}
+	})
+	instance.internalEvents.On(onLeaderChange, func(event *qb_events.Event) {
+		if nil != instance && len(instance.leaderHandlers) > 0 {
+			if isLeader, b := event.Argument(0).(bool); b {
+				for _, handler := range instance.leaderHandlers {
+					if nil != handler {
 						if instance.IsAsync() {
-							go handler(v)
+							go handler(isLeader)
 						} else {
-							handler(v)
+							handler(isLeader)
 						}
 					}
 				}
@@ -286,7 +591,7 @@ func (instance *Scheduler) initEvents() {
 		}
 	})
 	instance.internalEvents.On(onError, func(event *qb_events.Event) {
-		if nil != instance && len(instance.errorHandlers) > 0 && !instance.closed {
+		if nil != instance && len(instance.errorHandlers) > 0 && !instance.isClosed() {
 			var err string
 			item := event.Argument(0)
 			if v, b := item.(string); b {
@@ -296,7 +601,7 @@ func (instance *Scheduler) initEvents() {
 			}
 			if len(err) > 0 {
 				for _, handler := range instance.errorHandlers {
-					if nil != handler && !instance.closed {
+					if nil != handler && !instance.isClosed() {
 						// handler(err)
 						// external handler
 						if instance.IsAsync() {
@@ -312,13 +617,75 @@ func (instance *Scheduler) initEvents() {
 }
 
 func (instance *Scheduler) initTasks() {
+	// optional persistence
+	if filename := instance.GetStateFile(); len(filename) > 0 {
+		state, err := newSchedulerStateStore(filename, instance.Uid())
+		instance.tasksMux.Lock()
+		instance.state = state
+		instance.tasksMux.Unlock()
+		if nil != err {
+			instance.internalEmit(onError, qb_utils.Strings.Format("Scheduler '%s' unable to load state: %s", instance.Uid(), err))
+		}
+	}
+
 	// read configuration and creates task array
-	schedules := instance.settings.Schedules
+	instance.tasksMux.RLock()
+	schedules := append([]*Schedule{}, instance.settings.Schedules...)
+	instance.tasksMux.RUnlock()
 	for _, schedule := range schedules {
-		task := NewSchedulerTask(instance.settings.Uid, schedule)
-		instance.tasks = append(instance.tasks, task)
-		if e := task.Error(); len(e) > 0 {
-			instance.internalEmit(onError, e)
+		instance.addTask(schedule)
+	}
+	instance.saveState()
+}
+
+func (instance *Scheduler) addTask(schedule *Schedule) {
+	task := newSchedulerTask(instance.settings.Uid, instance.settings.Timezone, instance.getExclusions, schedule)
+	if e := task.Error(); len(e) > 0 {
+		instance.internalEmit(onError, e)
+	} else if state := instance.getState(); nil != state {
+		task.restore(state.Get(task.key()), time.Now())
+	}
+	instance.tasksMux.Lock()
+	instance.tasks = append(instance.tasks, task)
+	instance.tasksMux.Unlock()
+}
+
+func (instance *Scheduler) getState() *schedulerStateStore {
+	instance.tasksMux.RLock()
+	defer instance.tasksMux.RUnlock()
+	return instance.state
+}
+
+func (instance *Scheduler) getTasks() []*SchedulerTask {
+	instance.tasksMux.RLock()
+	defer instance.tasksMux.RUnlock()
+	return append([]*SchedulerTask{}, instance.tasks...)
+}
+
+func (instance *Scheduler) setTaskPaused(uid string, value bool) bool {
+	if nil != instance {
+		if schedule := instance.GetSchedule(uid); nil != schedule {
+			instance.tasksMux.Lock()
+			schedule.Paused = value
+			instance.tasksMux.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+func (instance *Scheduler) saveState() {
+	if !instance.IsLeader() {
+		return // state file is shared with the leader
+	}
+	if state := instance.getState(); nil != state {
+		for _, task := range instance.getTasks() {
+			if len(task.Error()) == 0 {
+				state.Update(task)
+			}
+		}
+		if err := state.Save(); nil != err {
+			instance.internalEmit(onError, qb_utils.Strings.Format("Scheduler '%s' unable to save state: %s", instance.Uid(), err))
 		}
 	}
 }
@@ -336,9 +703,10 @@ func (instance *Scheduler) newTicker(fixed bool) *time.Ticker {
 func (instance *Scheduler) calculateTimeout() time.Duration {
 	if nil != instance {
 		min := 1 * time.Minute
-		for _, t := range instance.tasks {
-			if t.timeline < min {
-				min = t.timeline
+		for _, t := range instance.getTasks() {
+			timeline := t.wakeUp()
+			if timeline > 0 && timeline < min {
+				min = timeline
 			}
 		}
 
@@ -347,32 +715,27 @@ func (instance *Scheduler) calculateTimeout() time.Duration {
 	return 1 * time.Second
 }
 
-func (instance *Scheduler) run() {
-	instance.timer = instance.newTicker(true)
-	if nil == instance.timer {
+func (instance *Scheduler) run(stop chan bool) {
+	timer := instance.newTicker(true)
+	if nil == timer {
 		return
 	}
+	defer func() { timer.Stop() }()
 	for {
 		select {
-		case <-instance.stopChan:
+		case <-stop:
 			return // exit
-		case <-instance.timer.C:
+		case <-timer.C:
 			// timer tick
-			if nil != instance.timer {
-				instance.timer.Stop()
-				instance.timer = nil
-				instance.checkSchedule()
-				instance.timer = instance.newTicker(false)
-				if nil == instance.timer {
-					return
-				}
-			}
+			timer.Stop()
+			instance.checkSchedule()
+			timer = instance.newTicker(false)
 		}
 	}
 }
 
 func (instance *Scheduler) checkSchedule() {
-	if nil != instance && !instance.closed {
+	if nil != instance && !instance.isClosed() {
 		// PANIC RECOVERY
 		defer func() {
 			if r := recover(); r != nil {
@@ -386,17 +749,235 @@ func (instance *Scheduler) checkSchedule() {
 			}
 		}()
 
-		for _, task := range instance.tasks {
-			if nil != task && task.IsReady() {
+		// followers keep tasks updated, but only the leader fires them
+		leader := instance.IsLeader()
+		fired := false
+		for _, task := range instance.getTasks() {
+			if nil != task && task.IsReady() && !instance.isTaskPaused(task) && leader {
+				fired = true
 				// trigger: is sync because of internal use only
 				instance.internalEmit(onSchedule, task)
 			}
 		}
+		if fired {
+			instance.saveMux.Lock()
+			if !instance.isClosed() {
+				instance.saveState()
+			}
+			instance.saveMux.Unlock()
+		}
 	}
 }
 
+// runTask applies the task concurrency policy and runs the task
+func (instance *Scheduler) runTask(task *SchedulerTask) {
+	if ok, policy := task.acquire(); !ok {
+		if policy == ConcurrencySkip {
+			instance.internalEmit(onError, qb_utils.Errors.Prefix(ErrorTaskSkipped,
+				qb_utils.Strings.Format("Scheduler '%s' task '%s' skipped because previous run is still in progress: ", instance.Uid(), task.Uid)))
+		}
+		return
+	}
+	if instance.IsAsync() {
+		go instance.execute(task)
+	} else {
+		instance.execute(task)
+	}
+}
+
+// execute invokes all handlers for a run and then all the queued runs
+func (instance *Scheduler) execute(task *SchedulerTask) {
+	for {
+		instance.invoke(task)
+		if !task.release(!instance.isClosed()) {
+			return
+		}
+	}
+}
+
+func (instance *Scheduler) invoke(task *SchedulerTask) {
+	parent := instance.context()
+	var ctx context.Context
+	var cancel context.CancelFunc
+	maxDuration := task.getMaxDuration()
+	if maxDuration > 0 {
+		ctx, cancel = context.WithTimeout(parent, maxDuration)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+	task.setContext(ctx)
+
+	// timeout watcher
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				instance.internalEmit(onError, qb_utils.Errors.Prefix(ErrorTaskTimeout,
+					qb_utils.Strings.Format("Scheduler '%s' task '%s' exceeded max duration of %s: ", instance.Uid(), task.Uid, maxDuration)))
+			}
+		}
+	}()
+
+	async := instance.IsAsync()
+	var wg sync.WaitGroup
+	call := func(f func()) {
+		if async {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				instance.safeCall(f)
+			}()
+		} else {
+			instance.safeCall(f)
+		}
+	}
+	for _, handler := range instance.taskHandlers {
+		if nil != handler && instance.isActive() {
+			h := handler
+			call(func() { h(task) })
+		}
+	}
+	for _, handler := range instance.ctxHandlers {
+		if nil != handler && instance.isActive() {
+			h := handler
+			call(func() { h(ctx, task) })
+		}
+	}
+	wg.Wait()
+}
+
+// safeCall invokes an external handler recovering from panic, so that the task is always released
+func (instance *Scheduler) safeCall(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			instance.internalEmit(onError, qb_utils.Strings.Format("[panic] Scheduler '%s' ERROR: %s", instance.Uid(), r))
+		}
+	}()
+	f()
+}
+
+func (instance *Scheduler) isTaskPaused(task *SchedulerTask) bool {
+	settings := task.Settings()
+	instance.tasksMux.RLock()
+	defer instance.tasksMux.RUnlock()
+	return settings.Paused
+}
+
 func (instance *Scheduler) internalEmit(event string, args ...interface{}) {
 	if nil != instance && nil != instance.internalEvents {
 		instance.internalEvents.Emit(event, args...)
 	}
 }
+
+func (instance *Scheduler) initLeader() {
+	if nil == instance.leaderLock && nil != instance.settings.Leader && len(instance.settings.Leader.LockFile) > 0 {
+		filename := instance.settings.Leader.LockFile
+		if len(instance.configFile) > 0 && !qb_utils.Paths.IsAbs(filename) {
+			filename = qb_utils.Paths.Concat(qb_utils.Paths.Dir(instance.configFile), filename)
+		}
+		ttl, _ := parseTimeline(instance.settings.Leader.Ttl)
+		instance.SetLeaderLock(NewFileLeaderLock(filename), ttl)
+	}
+	if nil == instance.leaderLock {
+		return
+	}
+	if instance.leaderTtl <= 0 {
+		instance.leaderTtl = defaultLeaderTtl
+	}
+	if len(instance.leaderOwner) == 0 {
+		if nil != instance.settings.Leader && len(instance.settings.Leader.Owner) > 0 {
+			instance.leaderOwner = instance.settings.Leader.Owner
+		} else {
+			instance.leaderOwner = newLeaderOwner()
+		}
+	}
+	instance.renewLeader()
+	instance.leaderStop = make(chan bool)
+	go instance.runLeader(instance.leaderStop)
+}
+
+// runLeader renews the lease (or tries to acquire it) every ttl/3 and releases it on stop
+func (instance *Scheduler) runLeader(stop chan bool) {
+	ticker := time.NewTicker(instance.leaderTtl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			if instance.IsLeader() {
+				if err := instance.leaderLock.Unlock(instance.leaderOwner); nil != err {
+					instance.internalEmit(onError, qb_utils.Errors.Prefix(err,
+						qb_utils.Strings.Format("Scheduler '%s' unable to release leader lock: ", instance.Uid())))
+				}
+			}
+			instance.setLeader(false)
+			stop <- true // released
+			return
+		case <-ticker.C:
+			instance.renewLeader()
+		}
+	}
+}
+
+func (instance *Scheduler) renewLeader() {
+	isLeader, err := instance.leaderLock.TryLock(instance.leaderOwner, instance.leaderTtl)
+	if nil != err {
+		// leadership cannot be confirmed
+		isLeader = false
+		instance.internalEmit(onError, qb_utils.Errors.Prefix(err,
+			qb_utils.Strings.Format("Scheduler '%s' unable to acquire leader lock: ", instance.Uid())))
+	}
+	instance.setLeader(isLeader)
+}
+
+func (instance *Scheduler) stopLeader() {
+	if nil != instance.leaderStop {
+		instance.leaderStop <- true
+		<-instance.leaderStop
+		instance.leaderStop = nil
+	}
+}
+
+func (instance *Scheduler) setLeader(value bool) {
+	instance.leaderMux.Lock()
+	changed := instance.leader != value
+	instance.leader = value
+	instance.leaderMux.Unlock()
+	if changed {
+		instance.internalEmit(onLeaderChange, value)
+	}
+}
+
+// getExclusions resolves names of exclusion calendars.
+// A name not registered with AddExclusionCalendar is an iCalendar file (relative path is relative to config file)
+func (instance *Scheduler) getExclusions(names ...string) (*ExclusionCalendar, error) {
+	instance.calendarsMux.Lock()
+	defer instance.calendarsMux.Unlock()
+
+	response := NewExclusionCalendar()
+	for _, name := range names {
+		if calendar, ok := instance.calendars[name]; ok {
+			response.Merge(calendar)
+			continue
+		}
+		filename := name
+		if len(instance.configFile) > 0 && !qb_utils.Paths.IsAbs(filename) {
+			filename = qb_utils.Paths.Concat(qb_utils.Paths.Dir(instance.configFile), filename)
+		}
+		filename = qb_utils.Paths.Absolute(filename)
+		calendar, ok := instance.calendars[filename]
+		if !ok {
+			var err error
+			calendar, err = LoadExclusionCalendar(filename)
+			if nil != err {
+				return nil, err
+			}
+			instance.calendars[filename] = calendar
+		}
+		response.Merge(calendar)
+	}
+	return response, nil
+}
@@ -0,0 +1,436 @@
+package qb_scheduler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+var (
+	ErrorInvalidCronExpression = errors.New("invalid_cron_expression_error")
+	ErrorInvalidTimezone       = errors.New("invalid_timezone_error")
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+var cronDayNames = map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+}
+
+// cronMaxYears is the look-ahead limit used to detect expressions that never match (i.e. "0 0 30 2 *")
+const cronMaxYears = 5
+
+const cronAllHours = 1<<24 - 1
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+type cronBounds struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronSecondBounds = cronBounds{0, 59, nil}
+	cronMinuteBounds = cronBounds{0, 59, nil}
+	cronHourBounds   = cronBounds{0, 23, nil}
+	cronDomBounds    = cronBounds{1, 31, nil}
+	cronMonthBounds  = cronBounds{1, 12, cronMonthNames}
+	cronDowBounds    = cronBounds{0, 7, cronDayNames}
+)
+
+// CronExpression is a parsed cron expression.
+// Supported syntax is the classic 5 fields "minute hour day-of-month month day-of-week" or
+// 6 fields with leading seconds. Each field accepts "*", "?", lists "1,2", ranges "1-5" and steps "*/15", "10-40/5".
+// Day of month accepts "L" (last day of month), day of week accepts "5L" (last friday of month)
+// and "1#2" (second monday of month). Macros: @yearly, @annually, @monthly, @weekly, @daily, @midnight, @hourly.
+type CronExpression struct {
+	expression string
+	second     uint64
+	minute     uint64
+	hour       uint64
+	dom        uint64
+	month      uint64
+	dow        uint64
+	domLast    bool    // "L" in day of month
+	dowLast    uint64  // "5L" in day of week
+	dowNth     [7]uint // "1#2" in day of week: bit n is set for nth occurrence
+	domAny     bool
+	dowAny     bool
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t r u c t o r
+//----------------------------------------------------------------------------------------------------------------------
+
+func ParseCron(expression string) (*CronExpression, error) {
+	instance := new(CronExpression)
+	instance.expression = strings.TrimSpace(expression)
+	err := instance.parse()
+	if nil != err {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// IsCronExpression returns true if the text looks like a cron expression rather than a "unit:count" timeline
+func IsCronExpression(text string) bool {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "@") {
+		return true
+	}
+	n := len(strings.Fields(text))
+	return n == 5 || n == 6
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *CronExpression) String() string {
+	if nil != instance {
+		return instance.expression
+	}
+	return ""
+}
+
+// Next returns the first time strictly after "from" matching the expression.
+// Returned time is in the same location of "from". Zero time is returned if there's no match.
+// Daylight saving transitions of the location are handled like most cron daemons do: a time skipped when clock
+// springs forward fires at the first valid time after the gap, a time repeated when clock falls back fires only once.
+// Expressions with every hour ("*" in hour field) are not affected and fire on absolute time.
+func (instance *CronExpression) Next(from time.Time) time.Time {
+	if nil == instance {
+		return time.Time{}
+	}
+	loc := from.Location()
+	t := from.Truncate(time.Second).Add(time.Second)
+	yearLimit := t.Year() + cronMaxYears
+
+WRAP:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for !has(instance.month, int(t.Month())) {
+		t = dateIn(loc, t.Year(), t.Month()+1, 1, 0, 0, 0)
+		if t.Month() == time.January {
+			goto WRAP
+		}
+	}
+
+	for !instance.matchDay(t) {
+		t = dateIn(loc, t.Year(), t.Month(), t.Day()+1, 0, 0, 0)
+		if t.Day() == 1 {
+			goto WRAP
+		}
+	}
+
+	for !instance.matchHour(t) {
+		prev := t
+		t = dateIn(loc, t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0)
+		if !t.After(prev) {
+			// ambiguous or missing wall clock (DST): move forward on absolute time
+			t = prev.Add(time.Hour)
+			t = t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+		}
+		if t.Hour() == 0 || t.Day() != prev.Day() {
+			goto WRAP
+		}
+	}
+
+	for !has(instance.minute, t.Minute()) {
+		prev := t
+		t = t.Truncate(time.Minute).Add(time.Minute)
+		if t.Minute() == 0 || t.Hour() != prev.Hour() {
+			goto WRAP
+		}
+	}
+
+	for !has(instance.second, t.Second()) {
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto WRAP
+		}
+	}
+
+	return t
+}
+
+// NextN returns next "count" fire times after "from"
+func (instance *CronExpression) NextN(from time.Time, count int) []time.Time {
+	response := make([]time.Time, 0)
+	t := from
+	for i := 0; i < count; i++ {
+		t = instance.Next(t)
+		if t.IsZero() {
+			break
+		}
+		response = append(response, t)
+	}
+	return response
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *CronExpression) parse() (err error) {
+	expression := instance.expression
+	if strings.HasPrefix(expression, "@") {
+		if v, b := cronMacros[strings.ToLower(expression)]; b {
+			expression = v
+		} else {
+			return qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Unknown macro '"+expression+"': ")
+		}
+	}
+
+	fields := strings.Fields(expression)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+		// with seconds
+	default:
+		return qb_utils.Errors.Prefix(ErrorInvalidCronExpression,
+			qb_utils.Strings.Format("Expected 5 or 6 fields, found %s in '%s': ", len(fields), instance.expression))
+	}
+
+	if instance.second, err = parseCronField(fields[0], cronSecondBounds); nil != err {
+		return
+	}
+	if instance.minute, err = parseCronField(fields[1], cronMinuteBounds); nil != err {
+		return
+	}
+	if instance.hour, err = parseCronField(fields[2], cronHourBounds); nil != err {
+		return
+	}
+	if err = instance.parseDom(fields[3]); nil != err {
+		return
+	}
+	if instance.month, err = parseCronField(fields[4], cronMonthBounds); nil != err {
+		return
+	}
+	if err = instance.parseDow(fields[5]); nil != err {
+		return
+	}
+	return
+}
+
+func (instance *CronExpression) parseDom(field string) (err error) {
+	instance.domAny = field == "*" || field == "?"
+	parts := make([]string, 0)
+	for _, part := range strings.Split(field, ",") {
+		if strings.ToUpper(part) == "L" {
+			instance.domLast = true
+		} else {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) > 0 {
+		instance.dom, err = parseCronField(strings.Join(parts, ","), cronDomBounds)
+	}
+	return
+}
+
+func (instance *CronExpression) parseDow(field string) (err error) {
+	instance.dowAny = field == "*" || field == "?"
+	parts := make([]string, 0)
+	for _, part := range strings.Split(strings.ToUpper(field), ",") {
+		if strings.HasSuffix(part, "L") && len(part) > 1 {
+			day, e := parseCronValue(strings.TrimSuffix(part, "L"), cronDowBounds)
+			if nil != e {
+				return e
+			}
+			instance.dowLast |= 1 << uint(day%7)
+		} else if i := strings.Index(part, "#"); i > -1 {
+			day, e := parseCronValue(part[:i], cronDowBounds)
+			if nil != e {
+				return e
+			}
+			nth, e := strconv.Atoi(part[i+1:])
+			if nil != e || nth < 1 || nth > 5 {
+				return qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Invalid occurrence in '"+part+"': ")
+			}
+			instance.dowNth[day%7] |= 1 << uint(nth)
+		} else {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) > 0 {
+		instance.dow, err = parseCronField(strings.Join(parts, ","), cronDowBounds)
+		if has(instance.dow, 7) {
+			instance.dow |= 1 // 7 is sunday too
+		}
+	}
+	return
+}
+
+func (instance *CronExpression) matchHour(t time.Time) bool {
+	if instance.hour == cronAllHours {
+		return true
+	}
+	hour := t.Hour()
+	if has(instance.hour, hour) {
+		// clock falls back: fire only on first pass of repeated hour
+		return t.Add(-time.Hour).Hour() != hour
+	}
+	if hour > 0 && has(instance.hour, hour-1) {
+		// clock springs forward: previous hour was skipped
+		return time.Date(t.Year(), t.Month(), t.Day(), hour-1, 0, 0, 0, t.Location()).Hour() != hour-1
+	}
+	return false
+}
+
+func (instance *CronExpression) matchDay(t time.Time) bool {
+	day := t.Day()
+	weekday := int(t.Weekday())
+	lastDay := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+
+	domMatch := has(instance.dom, day) || (instance.domLast && day == lastDay)
+	dowMatch := has(instance.dow, weekday) ||
+		(has(instance.dowLast, weekday) && day+7 > lastDay) ||
+		(instance.dowNth[weekday]&(1<<uint((day-1)/7+1)) > 0)
+
+	if instance.domAny && instance.dowAny {
+		return true
+	}
+	if instance.domAny {
+		return dowMatch
+	}
+	if instance.dowAny {
+		return domMatch
+	}
+	// both restricted: standard cron matches any of them
+	return domMatch || dowMatch
+}
+
+// dateIn works like time.Date, but with a defined behaviour on daylight saving transitions:
+// a wall clock skipped by the transition is moved forward by the gap, a repeated wall clock returns the first occurrence.
+func dateIn(loc *time.Location, year int, month time.Month, day, hour, min, sec int) time.Time {
+	t := time.Date(year, month, day, hour, min, sec, 0, loc)
+	wanted := time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	if got.Before(wanted) {
+		// skipped
+		return t.Add(wanted.Sub(got))
+	}
+	if got.Equal(wanted) {
+		// repeated
+		for _, d := range []time.Duration{time.Hour, 30 * time.Minute} {
+			prev := t.Add(-d)
+			if prev.Hour() == t.Hour() && prev.Minute() == t.Minute() && prev.Day() == t.Day() {
+				return prev
+			}
+		}
+	}
+	return t
+}
+
+func has(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) > 0
+}
+
+func parseCronField(field string, bounds cronBounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		b, err := parseCronRange(part, bounds)
+		if nil != err {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+// parseCronRange parses "*", "?", "n", "n-m" with optional "/step"
+func parseCronRange(expr string, bounds cronBounds) (uint64, error) {
+	step := 1
+	rangeAndStep := strings.Split(expr, "/")
+	if len(rangeAndStep) > 2 {
+		return 0, qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Too many slashes in '"+expr+"': ")
+	}
+	if len(rangeAndStep) == 2 {
+		s, err := strconv.Atoi(rangeAndStep[1])
+		if nil != err || s <= 0 {
+			return 0, qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Invalid step in '"+expr+"': ")
+		}
+		step = s
+	}
+
+	var start, end int
+	lowAndHigh := strings.Split(rangeAndStep[0], "-")
+	if lowAndHigh[0] == "*" || lowAndHigh[0] == "?" {
+		if len(lowAndHigh) > 1 {
+			return 0, qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Invalid range in '"+expr+"': ")
+		}
+		start, end = bounds.min, bounds.max
+	} else {
+		var err error
+		if start, err = parseCronValue(lowAndHigh[0], bounds); nil != err {
+			return 0, err
+		}
+		switch len(lowAndHigh) {
+		case 1:
+			end = start
+			if len(rangeAndStep) == 2 {
+				end = bounds.max // "n/step" means from n to max
+			}
+		case 2:
+			if end, err = parseCronValue(lowAndHigh[1], bounds); nil != err {
+				return 0, err
+			}
+		default:
+			return 0, qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Invalid range in '"+expr+"': ")
+		}
+	}
+	if start > end {
+		return 0, qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Range start is beyond end in '"+expr+"': ")
+	}
+
+	var bits uint64
+	for i := start; i <= end; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, bounds cronBounds) (int, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if nil != bounds.names {
+		if v, b := bounds.names[value]; b {
+			return v, nil
+		}
+	}
+	v, err := strconv.Atoi(value)
+	if nil != err {
+		return 0, qb_utils.Errors.Prefix(ErrorInvalidCronExpression, "Invalid value '"+value+"': ")
+	}
+	if v < bounds.min || v > bounds.max {
+		return 0, qb_utils.Errors.Prefix(ErrorInvalidCronExpression,
+			qb_utils.Strings.Format("Value %s out of range [%s-%s]: ", v, bounds.min, bounds.max))
+	}
+	return v, nil
+}
@@ -0,0 +1,100 @@
+package qb_scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron_invalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * * MON#6",
+		"@every_day",
+	}
+	for _, expr := range tests {
+		if _, err := ParseCron(expr); nil == err {
+			t.Errorf("expected error for '%s'", expr)
+		}
+	}
+}
+
+func TestCronExpression_Next(t *testing.T) {
+	from := time.Date(2023, time.August, 12, 10, 15, 30, 0, time.UTC) // saturday
+	tests := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2023, time.August, 12, 10, 16, 0, 0, time.UTC)},
+		{"*/10 * * * * *", time.Date(2023, time.August, 12, 10, 15, 40, 0, time.UTC)},
+		{"30 8 * * MON-FRI", time.Date(2023, time.August, 14, 8, 30, 0, 0, time.UTC)},
+		{"0 12 1,15 * *", time.Date(2023, time.August, 15, 12, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1#1", time.Date(2023, time.September, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 18 * * 5L", time.Date(2023, time.August, 25, 18, 0, 0, 0, time.UTC)},
+		{"0 0 L * *", time.Date(2023, time.August, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 L 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * JAN,JUL SUN", time.Date(2024, time.January, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2023, time.August, 13, 0, 0, 0, 0, time.UTC)},
+		{"15 10-14/2 * * *", time.Date(2023, time.August, 12, 12, 15, 0, 0, time.UTC)},
+		{"@daily", time.Date(2023, time.August, 13, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2023, time.August, 12, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2023, time.August, 13, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.expr)
+		if nil != err {
+			t.Fatalf("'%s': %v", test.expr, err)
+		}
+		if next := cron.Next(from); !next.Equal(test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.expr, test.expected, next)
+		}
+	}
+}
+
+func TestCronExpression_NextN(t *testing.T) {
+	cron, err := ParseCron("0 0 8 * * MON-FRI")
+	if nil != err {
+		t.Fatalf("err: %v", err)
+	}
+	from := time.Date(2023, time.August, 11, 9, 0, 0, 0, time.UTC) // friday
+	next := cron.NextN(from, 3)
+	expected := []time.Time{
+		time.Date(2023, time.August, 14, 8, 0, 0, 0, time.UTC),
+		time.Date(2023, time.August, 15, 8, 0, 0, 0, time.UTC),
+		time.Date(2023, time.August, 16, 8, 0, 0, 0, time.UTC),
+	}
+	if len(next) != len(expected) {
+		t.Fatalf("bad: %v", next)
+	}
+	for i := range expected {
+		if !next[i].Equal(expected[i]) {
+			t.Errorf("expected %v, got %v", expected[i], next[i])
+		}
+	}
+}
+
+func TestSchedulerTask_cron(t *testing.T) {
+	task := NewSchedulerTask("test", &Schedule{Uid: "cron", Timeline: "*/5 * * * * *"})
+	if !task.IsCron() || len(task.Error()) > 0 {
+		t.Fatalf("expected cron task: %v", task.Error())
+	}
+	if task.NextStartAt().Second()%5 != 0 {
+		t.Errorf("bad next start: %v", task.NextStartAt())
+	}
+
+	task = NewSchedulerTask("test", &Schedule{Uid: "invalid", Cron: "* * *"})
+	if len(task.Error()) == 0 || task.IsReady() {
+		t.Errorf("expected invalid task")
+	}
+}
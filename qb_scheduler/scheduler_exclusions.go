@@ -0,0 +1,220 @@
+package qb_scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_utils"
+	"github.com/rskvp/qb-core/qb_vcal"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+// ExclusionPolicy is what a task does with a run falling into an exclusion calendar event
+type ExclusionPolicy string
+
+const (
+	ExclusionSkip  ExclusionPolicy = "skip"  // do not run (default)
+	ExclusionShift ExclusionPolicy = "shift" // run at same time of next business day
+)
+
+// exclusionMaxLoops limits the search of a valid run (i.e. a calendar excluding everything)
+const exclusionMaxLoops = 100000
+
+// exclusionSlotsWindow is how far slots of repeated events are calculated ahead of the checked time
+const exclusionSlotsWindow = 366 * 24 * time.Hour
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// exclusionResolver returns a calendar from the names (or .ics files) declared into a schedule
+type exclusionResolver func(names ...string) (*ExclusionCalendar, error)
+
+// ExclusionCalendar is a set of iCalendar events (holidays, maintenance windows) when tasks must not run
+type ExclusionCalendar struct {
+	events []*exclusionEvent
+	err    error // first event rejected because its repeat rule cannot be evaluated
+}
+
+type exclusionEvent struct {
+	start  time.Time
+	end    time.Time
+	allDay bool
+	rrule  *qb_vcal.RRule
+	// slots of rrule calculated until slotsUntil (sorted by start)
+	slots       []*qb_vcal.RRuleSlot
+	slotsUntil  time.Time
+	maxDuration time.Duration
+	mux         sync.Mutex
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t r u c t o r
+//----------------------------------------------------------------------------------------------------------------------
+
+func NewExclusionCalendar(calendars ...*qb_vcal.Calendar) *ExclusionCalendar {
+	instance := new(ExclusionCalendar)
+	instance.events = make([]*exclusionEvent, 0)
+	for _, calendar := range calendars {
+		instance.Add(calendar)
+	}
+	return instance
+}
+
+// LoadExclusionCalendar loads one or more iCalendar (.ics) files.
+// Events with a repeat rule that cannot be evaluated are rejected and reported by Error.
+func LoadExclusionCalendar(filenames ...string) (*ExclusionCalendar, error) {
+	instance := NewExclusionCalendar()
+	for _, filename := range filenames {
+		calendar, err := qb_vcal.VCal.Parse(filename)
+		if nil != err {
+			return nil, err
+		}
+		instance.Add(calendar)
+	}
+	return instance, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+// Add adds events of a calendar. An event with a repeat rule that cannot be evaluated is rejected
+// and recorded into Error, other events of the calendar are still used.
+func (instance *ExclusionCalendar) Add(calendar *qb_vcal.Calendar) {
+	if nil != instance && nil != calendar {
+		for _, event := range calendar.Events() {
+			if event.IsStatusCancelled() {
+				continue
+			}
+			start, end, err := event.GetRange()
+			if nil != err {
+				continue
+			}
+			rrule := event.RRule()
+			if err = rrule.Validate(); nil != err {
+				if nil == instance.err {
+					instance.err = qb_utils.Errors.Prefix(err, qb_utils.Strings.Format("Event '%s': ", event.Id()))
+				}
+				continue
+			}
+			instance.events = append(instance.events, &exclusionEvent{
+				start:  start,
+				end:    end,
+				allDay: event.IsAllDay(),
+				rrule:  rrule,
+			})
+		}
+	}
+}
+
+// Merge adds events of other calendars
+func (instance *ExclusionCalendar) Merge(others ...*ExclusionCalendar) {
+	if nil != instance {
+		for _, other := range others {
+			if nil != other {
+				instance.events = append(instance.events, other.events...)
+				if nil == instance.err {
+					instance.err = other.err
+				}
+			}
+		}
+	}
+}
+
+// Error returns the error of the first event rejected because its repeat rule cannot be evaluated
+func (instance *ExclusionCalendar) Error() error {
+	if nil != instance {
+		return instance.err
+	}
+	return nil
+}
+
+func (instance *ExclusionCalendar) Count() int {
+	if nil != instance {
+		return len(instance.events)
+	}
+	return 0
+}
+
+// IsExcluded returns true if t falls inside an event or inside a slot of a repeated event.
+// All day events are compared with the date of t in its own location.
+func (instance *ExclusionCalendar) IsExcluded(t time.Time) bool {
+	if nil != instance {
+		for _, event := range instance.events {
+			if event.contains(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *exclusionEvent) contains(t time.Time) bool {
+	if instance.allDay {
+		// all day events are floating dates
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	if t.Before(instance.start) {
+		return false
+	}
+	if inRange(t, instance.start, instance.end) {
+		return true
+	}
+	if nil != instance.rrule {
+		slots, maxDuration := instance.getSlots(t)
+		// last slot starting before t, and previous ones still in progress
+		i := sort.Search(len(slots), func(i int) bool { return slots[i].StartAt.After(t) })
+		for i--; i >= 0 && t.Sub(slots[i].StartAt) <= maxDuration; i-- {
+			if inRange(t, slots[i].StartAt, slots[i].EndAt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getSlots returns slots of the repeat rule including t.
+// Slots are calculated for a window ahead of t and reused until t is beyond the window.
+func (instance *exclusionEvent) getSlots(t time.Time) ([]*qb_vcal.RRuleSlot, time.Duration) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	// slots are calculated only if they end before "until"
+	needed := t.Add(instance.end.Sub(instance.start)).AddDate(0, 0, 1)
+	if !instance.rrule.Until.IsZero() && instance.rrule.Until.Before(needed) {
+		needed = instance.rrule.Until
+	}
+	if nil == instance.slots || instance.slotsUntil.Before(needed) {
+		until := needed.Add(exclusionSlotsWindow)
+		if !instance.rrule.Until.IsZero() && instance.rrule.Until.Before(until) {
+			until = instance.rrule.Until
+		}
+		slots := instance.rrule.GetSlots(instance.start, instance.end, until)
+		sort.SliceStable(slots, func(i, j int) bool { return slots[i].StartAt.Before(slots[j].StartAt) })
+		instance.maxDuration = 0
+		for _, slot := range slots {
+			if d := slot.EndAt.Sub(slot.StartAt); d > instance.maxDuration {
+				instance.maxDuration = d
+			}
+		}
+		instance.slots, instance.slotsUntil = slots, until
+	}
+	return instance.slots, instance.maxDuration
+}
+
+func inRange(t, start, end time.Time) bool {
+	return !t.Before(start) && (t.Before(end) || (end.Equal(start) && t.Equal(start)))
+}
+
+func isWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
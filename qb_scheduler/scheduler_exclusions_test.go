@@ -0,0 +1,208 @@
+package qb_scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_vcal"
+)
+
+const holidaysIcs = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//test//holidays//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:christmas\r\n" +
+	"DTSTART;VALUE=DATE:20241225\r\n" +
+	"DTEND;VALUE=DATE:20241227\r\n" +
+	"RRULE:FREQ=YEARLY\r\n" +
+	"SUMMARY:Christmas\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:maintenance\r\n" +
+	"DTSTART:20241203T080000Z\r\n" +
+	"DTEND:20241203T120000Z\r\n" +
+	"SUMMARY:Maintenance\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestExclusionCalendar_IsExcluded(t *testing.T) {
+	calendar, err := qb_vcal.ParseCalendar(strings.NewReader(holidaysIcs))
+	if nil != err {
+		t.Fatalf("err: %v", err)
+	}
+	exclusions := NewExclusionCalendar(calendar)
+	if exclusions.Count() != 2 {
+		t.Fatalf("expected 2 events, got %v", exclusions.Count())
+	}
+	rome, _ := time.LoadLocation("Europe/Rome")
+	tests := []struct {
+		at       time.Time
+		expected bool
+	}{
+		{time.Date(2024, 12, 25, 9, 0, 0, 0, rome), true},
+		{time.Date(2024, 12, 26, 23, 59, 0, 0, rome), true},
+		{time.Date(2024, 12, 27, 0, 0, 0, 0, rome), false},
+		{time.Date(2025, 12, 25, 9, 0, 0, 0, rome), true},
+		{time.Date(2023, 12, 25, 9, 0, 0, 0, rome), false},
+		{time.Date(2024, 12, 3, 10, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 12, 3, 12, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if exclusions.IsExcluded(test.at) != test.expected {
+			t.Errorf("%v: expected excluded=%v", test.at, test.expected)
+		}
+	}
+}
+
+func TestExclusionCalendar_yearlyRules(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:thanksgiving\r\n" +
+		"DTSTART;VALUE=DATE:20231123\r\n" +
+		"RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=4TH\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:memorial\r\n" +
+		"DTSTART;VALUE=DATE:20230529\r\n" +
+		"RRULE:FREQ=YEARLY;BYMONTH=5;BYDAY=-1MO\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	calendar, err := qb_vcal.ParseCalendar(strings.NewReader(ics))
+	if nil != err {
+		t.Fatalf("err: %v", err)
+	}
+	exclusions := NewExclusionCalendar(calendar)
+	if nil != exclusions.Error() {
+		t.Fatalf("err: %v", exclusions.Error())
+	}
+	tests := []struct {
+		at       string
+		expected bool
+	}{
+		{"2024-11-28T10:00:00Z", true},
+		{"2024-11-21T10:00:00Z", false},
+		{"2025-11-27T10:00:00Z", true},
+		{"2030-11-28T10:00:00Z", true},
+		{"2024-05-27T10:00:00Z", true},
+		{"2024-05-20T10:00:00Z", false},
+		{"2026-05-25T10:00:00Z", true},
+		{"2022-11-24T10:00:00Z", false},
+	}
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.at)
+		if exclusions.IsExcluded(at) != test.expected {
+			t.Errorf("%v: expected excluded=%v", test.at, test.expected)
+		}
+	}
+
+	// a rule that cannot be evaluated rejects only its event
+	unsupported := strings.Replace(ics, "BYMONTH=5;BYDAY=-1MO", "BYMONTHDAY=25;BYDAY=MO", 1)
+	calendar, _ = qb_vcal.ParseCalendar(strings.NewReader(unsupported))
+	sched := NewScheduler()
+	exclusions = sched.AddExclusionCalendar("holidays", calendar)
+	if err = exclusions.Error(); nil == err || !strings.Contains(err.Error(), qb_vcal.ErrorUnsupportedRRule.Error()) {
+		t.Fatalf("expected unsupported rule, got %v", err)
+	}
+	if exclusions.Count() != 1 {
+		t.Fatalf("expected 1 event, got %v", exclusions.Count())
+	}
+	if at, _ := time.Parse(time.RFC3339, "2024-11-28T10:00:00Z"); !exclusions.IsExcluded(at) {
+		t.Errorf("%v: expected excluded", at)
+	}
+	task := newSchedulerTask("test", "", sched.getExclusions, &Schedule{Uid: "job", Timeline: "hour:1", Exclusions: []string{"holidays"}})
+	if len(task.Error()) == 0 || task.NextStartAt().IsZero() {
+		t.Errorf("expected exclusion warning and a next run: %v %v", task.Error(), task.NextStartAt())
+	}
+}
+
+func TestExclusionCalendar_monthDays(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:christmas\r\n" +
+		"DTSTART;VALUE=DATE:20231225\r\n" +
+		"RRULE:FREQ=YEARLY;BYMONTH=12;BYMONTHDAY=25\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:closing\r\n" +
+		"DTSTART:20240131T180000Z\r\n" +
+		"DTEND:20240131T200000Z\r\n" +
+		"RRULE:FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	calendar, err := qb_vcal.ParseCalendar(strings.NewReader(ics))
+	if nil != err {
+		t.Fatalf("err: %v", err)
+	}
+	exclusions := NewExclusionCalendar(calendar)
+	if nil != exclusions.Error() || exclusions.Count() != 2 {
+		t.Fatalf("err: %v %v", exclusions.Error(), exclusions.Count())
+	}
+	tests := []struct {
+		at       string
+		expected bool
+	}{
+		{"2024-12-25T10:00:00Z", true},
+		{"2027-12-25T10:00:00Z", true},
+		{"2024-12-26T10:00:00Z", false},
+		{"2024-02-29T19:00:00Z", true},
+		{"2024-03-31T19:00:00Z", true},
+		{"2024-04-30T19:00:00Z", false}, // COUNT=3
+		{"2024-02-28T19:00:00Z", false},
+	}
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.at)
+		if exclusions.IsExcluded(at) != test.expected {
+			t.Errorf("%v: expected excluded=%v", test.at, test.expected)
+		}
+	}
+}
+
+func TestSchedulerTask_exclusions(t *testing.T) {
+	calendar, err := qb_vcal.ParseCalendar(strings.NewReader(holidaysIcs))
+	if nil != err {
+		t.Fatalf("err: %v", err)
+	}
+	tests := []struct {
+		policy   ExclusionPolicy
+		expected []string
+	}{
+		// christmas 2024 is on wednesday, st. stephen on thursday
+		{ExclusionSkip, []string{"2024-12-24T09:00:00+01:00", "2024-12-31T09:00:00+01:00", "2025-01-01T09:00:00+01:00"}},
+		{ExclusionShift, []string{"2024-12-24T09:00:00+01:00", "2024-12-27T09:00:00+01:00", "2024-12-31T09:00:00+01:00"}},
+	}
+	for _, test := range tests {
+		sched := NewScheduler()
+		sched.AddExclusionCalendar("holidays", calendar)
+		sched.AddSchedule(&Schedule{Uid: "job", Cron: "0 9 * * TUE-THU", Timezone: "Europe/Rome",
+			Exclusions: []string{"holidays"}, ExclusionPolicy: test.policy})
+		task := newSchedulerTask("test", "", sched.getExclusions, sched.GetSchedule("job"))
+		if nil != task.err {
+			t.Fatalf("err: %v", task.err)
+		}
+		from, _ := time.Parse(time.RFC3339, "2024-12-23T12:00:00+01:00")
+		next := make([]time.Time, 0)
+		for at := from; len(next) < len(test.expected); {
+			at = task.next(at)
+			next = append(next, at)
+		}
+		assertTimes(t, test.expected, next)
+	}
+
+	// shifted run comes before next regular one
+	sched := NewScheduler()
+	sched.AddExclusionCalendar("holidays", calendar)
+	task := newSchedulerTask("test", "", sched.getExclusions, &Schedule{Uid: "weekly", Cron: "0 9 * * WED",
+		Timezone: "Europe/Rome", Exclusions: []string{"holidays"}, ExclusionPolicy: ExclusionShift})
+	from, _ := time.Parse(time.RFC3339, "2024-12-20T12:00:00+01:00")
+	assertTimes(t, []string{"2024-12-27T09:00:00+01:00", "2025-01-01T09:00:00+01:00"},
+		[]time.Time{task.next(from), task.next(task.next(from))})
+
+	// missing calendar file: task never runs
+	task = NewSchedulerTask("test", &Schedule{Uid: "missing", Timeline: "hour:1", Exclusions: []string{"./missing.ics"}})
+	if len(task.Error()) == 0 || !task.NextStartAt().IsZero() {
+		t.Errorf("expected exclusion error")
+	}
+}
@@ -0,0 +1,171 @@
+package qb_scheduler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_rnd"
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	onLeaderChange = "on_leader_change"
+
+	defaultLeaderTtl = 30 * time.Second
+	leaderMutexTtl   = 10 * time.Second // a mutex file older than this was left by a dead process
+)
+
+var (
+	ErrorLeaderLockBusy = errors.New("leader_lock_busy_error")
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// LeaderLock is a lease shared by schedulers running in different processes.
+// Only the owner of the lease fires tasks. The lease expires if not renewed within ttl.
+type LeaderLock interface {
+	// TryLock acquires the lease or renews it if owner is already the holder.
+	// Returns false if the lease is held by another owner and is not expired.
+	TryLock(owner string, ttl time.Duration) (bool, error)
+	// Unlock releases the lease if owner is the holder
+	Unlock(owner string) error
+}
+
+type SchedulerLeaderHandler func(isLeader bool)
+
+// FileLeaderLock is a LeaderLock using a file on a filesystem shared by all the processes.
+// Holders must have synchronized clocks (the lease expiration time is written into the file).
+type FileLeaderLock struct {
+	filename string
+	mux      sync.Mutex
+}
+
+type leaderLease struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t r u c t o r
+//----------------------------------------------------------------------------------------------------------------------
+
+func NewFileLeaderLock(filename string) *FileLeaderLock {
+	instance := new(FileLeaderLock)
+	instance.filename = qb_utils.Paths.Absolute(filename)
+	return instance
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *FileLeaderLock) Filename() string {
+	return instance.filename
+}
+
+func (instance *FileLeaderLock) TryLock(owner string, ttl time.Duration) (bool, error) {
+	if len(owner) == 0 {
+		return false, errors.New("missing_owner")
+	}
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	if err := instance.lockMutex(); nil != err {
+		return false, err
+	}
+	defer instance.unlockMutex()
+
+	now := time.Now()
+	lease := instance.read()
+	if nil != lease && lease.Owner != owner && now.Before(lease.ExpiresAt) {
+		return false, nil
+	}
+	err := instance.write(&leaderLease{Owner: owner, ExpiresAt: now.Add(ttl)})
+	if nil != err {
+		return false, err
+	}
+	return true, nil
+}
+
+func (instance *FileLeaderLock) Unlock(owner string) error {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	if err := instance.lockMutex(); nil != err {
+		return err
+	}
+	defer instance.unlockMutex()
+
+	if lease := instance.read(); nil != lease && lease.Owner == owner {
+		return instance.write(&leaderLease{Owner: "", ExpiresAt: time.Now()})
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *FileLeaderLock) read() *leaderLease {
+	text, err := qb_utils.IO.ReadTextFromFile(instance.filename)
+	if nil != err || len(text) == 0 {
+		return nil
+	}
+	var lease leaderLease
+	if err = qb_utils.JSON.Read(text, &lease); nil != err {
+		return nil
+	}
+	return &lease
+}
+
+func (instance *FileLeaderLock) write(lease *leaderLease) error {
+	return writeFileAtomic(instance.filename, qb_utils.JSON.Stringify(lease))
+}
+
+// lockMutex creates the mutex file guarding read and write of the lease.
+// File creation with O_EXCL is atomic also between processes.
+func (instance *FileLeaderLock) lockMutex() error {
+	if err := os.MkdirAll(filepath.Dir(instance.filename), os.ModePerm); nil != err {
+		return err
+	}
+	mutex := instance.filename + ".mutex"
+	for i := 0; i < 50; i++ {
+		f, err := os.OpenFile(mutex, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if nil == err {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, e := os.Stat(mutex); nil == e && time.Since(info.ModTime()) > leaderMutexTtl {
+			_ = os.Remove(mutex)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ErrorLeaderLockBusy
+}
+
+func (instance *FileLeaderLock) unlockMutex() {
+	_ = os.Remove(instance.filename + ".mutex")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	s c h e d u l e r
+//----------------------------------------------------------------------------------------------------------------------
+
+// newLeaderOwner returns a unique name for this process
+func newLeaderOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), qb_rnd.Rnd.RndId()[:8])
+}
@@ -0,0 +1,88 @@
+package qb_scheduler
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLeaderLock(t *testing.T) {
+	lock := NewFileLeaderLock(filepath.Join(t.TempDir(), "leader.lock"))
+	ttl := 200 * time.Millisecond
+
+	if ok, err := lock.TryLock("a", ttl); !ok || nil != err {
+		t.Fatalf("'a' expected to acquire the lock: %v", err)
+	}
+	if ok, _ := lock.TryLock("b", ttl); ok {
+		t.Fatalf("'b' must not acquire a lock held by 'a'")
+	}
+	if ok, _ := lock.TryLock("a", ttl); !ok {
+		t.Fatalf("'a' expected to renew the lock")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if ok, _ := lock.TryLock("b", ttl); !ok {
+		t.Fatalf("'b' expected to acquire an expired lock")
+	}
+	_ = lock.Unlock("a") // not the holder
+	if ok, _ := lock.TryLock("a", ttl); ok {
+		t.Fatalf("unlock by a non holder must be ignored")
+	}
+	_ = lock.Unlock("b")
+	if ok, _ := lock.TryLock("a", ttl); !ok {
+		t.Fatalf("'a' expected to acquire a released lock")
+	}
+}
+
+func TestScheduler_leader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leader.lock")
+	ttl := 300 * time.Millisecond
+
+	var mux sync.Mutex
+	runs := map[string]int{}
+	changes := map[string][]bool{}
+	newSched := func(name string) *Scheduler {
+		sched := NewSchedulerWithSettings(&SchedulerSettings{Uid: name, Sync: true})
+		sched.SetLeaderLock(NewFileLeaderLock(filename), ttl)
+		sched.AddSchedule(&Schedule{Uid: "job", Timeline: "millisecond:50"})
+		sched.OnSchedule(func(task *SchedulerTask) {
+			mux.Lock()
+			runs[name]++
+			mux.Unlock()
+		})
+		sched.OnLeaderChange(func(isLeader bool) {
+			mux.Lock()
+			changes[name] = append(changes[name], isLeader)
+			mux.Unlock()
+		})
+		return sched
+	}
+
+	first, second := newSched("first"), newSched("second")
+	first.Start()
+	second.Start()
+	time.Sleep(1300 * time.Millisecond) // first tick is after one second
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("expected 'first' as leader")
+	}
+
+	first.Stop() // lock released: second takes over at next renewal
+	time.Sleep(500 * time.Millisecond)
+	if !second.IsLeader() {
+		t.Fatalf("expected 'second' as leader")
+	}
+	second.Stop()
+	time.Sleep(100 * time.Millisecond) // events are dispatched asynchronously
+
+	mux.Lock()
+	defer mux.Unlock()
+	if runs["first"] == 0 || runs["second"] == 0 {
+		t.Errorf("expected runs from both leaders, got %v", runs)
+	}
+	if len(changes["first"]) != 2 || !changes["first"][0] || changes["first"][1] {
+		t.Errorf("bad leader changes for 'first': %v", changes["first"])
+	}
+	if len(changes["second"]) != 2 || !changes["second"][0] || changes["second"][1] {
+		t.Errorf("bad leader changes for 'second': %v", changes["second"])
+	}
+}
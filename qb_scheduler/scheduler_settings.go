@@ -2,6 +2,28 @@ package qb_scheduler
 
 import "github.com/rskvp/qb-core/qb_utils"
 
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t
+//----------------------------------------------------------------------------------------------------------------------
+
+// MisfirePolicy is what a persistent scheduler does with runs missed while it was not running
+type MisfirePolicy string
+
+const (
+	MisfireOnce MisfirePolicy = "once" // fire only once for all missed runs (default)
+	MisfireAll  MisfirePolicy = "all"  // fire every missed run
+	MisfireSkip MisfirePolicy = "skip" // ignore missed runs and wait for next one
+)
+
+// ConcurrencyPolicy is what the scheduler does when a task is fired while its previous run is still in progress
+type ConcurrencyPolicy string
+
+const (
+	ConcurrencyAllow ConcurrencyPolicy = "allow" // run in parallel (default)
+	ConcurrencySkip  ConcurrencyPolicy = "skip"  // do not run and notify an error
+	ConcurrencyQueue ConcurrencyPolicy = "queue" // run when previous run is completed
+)
+
 //----------------------------------------------------------------------------------------------------------------------
 //	t y p e s
 //----------------------------------------------------------------------------------------------------------------------
@@ -9,6 +31,9 @@ import "github.com/rskvp/qb-core/qb_utils"
 type SchedulerSettings struct {
 	Uid       string      `json:"uid"`
 	Sync      bool        `json:"sync"`
+	Timezone  string      `json:"timezone,omitempty"`   // (optional) IANA name, i.e. "Europe/Rome". Default is local time
+	StateFile string      `json:"state_file,omitempty"` // (optional) enable persistence. Relative path is relative to config file
+	Leader    *Leader     `json:"leader,omitempty"`     // (optional) only one scheduler with same lock file fires tasks
 	Schedules []*Schedule `json:"schedules"`
 }
 
@@ -16,12 +41,27 @@ func (instance *SchedulerSettings) String() string {
 	return qb_utils.JSON.Stringify(instance)
 }
 
+// Leader configures single-leader execution of schedulers running in different processes
+type Leader struct {
+	LockFile string `json:"lock_file"`       // lease file on a shared filesystem. Relative path is relative to config file
+	Ttl      string `json:"ttl,omitempty"`   // second:30 (default) lease is lost if not renewed within this time
+	Owner    string `json:"owner,omitempty"` // (optional) unique name of this process. Default is "host:pid:random"
+}
+
 type Schedule struct {
-	Uid       string                 `json:"uid,omitempty"`
-	StartAt   string                 `json:"start_at"` // hh:mm ss (optional)
-	Timeline  string                 `json:"timeline"` // minutes:1, hour:24, second:10
-	Payload   map[string]interface{} `json:"payload,omitempty"`
-	Arguments []interface{}          `json:"-"` // custom attachments
+	Uid             string                 `json:"uid,omitempty"`
+	StartAt         string                 `json:"start_at"`                   // hh:mm ss (optional)
+	Timeline        string                 `json:"timeline"`                   // minute:1 (or minutes:1), hour:24, second:10
+	Cron            string                 `json:"cron,omitempty"`             // "30 8 * * MON-FRI", "0 0 9 * * 1#1", "@daily" (optional, overrides start_at and timeline)
+	Timezone        string                 `json:"timezone,omitempty"`         // (optional) IANA name, overrides scheduler timezone
+	Misfire         MisfirePolicy          `json:"misfire,omitempty"`          // once, all, skip (used only with persistence)
+	Concurrency     ConcurrencyPolicy      `json:"concurrency,omitempty"`      // allow, skip, queue
+	MaxDuration     string                 `json:"max_duration,omitempty"`     // minute:5 (optional) run context is cancelled after this time
+	Paused          bool                   `json:"paused,omitempty"`           // paused schedules do not fire
+	Exclusions      []string               `json:"exclusions,omitempty"`       // (optional) names of exclusion calendars or iCalendar files (holidays, maintenance windows)
+	ExclusionPolicy ExclusionPolicy        `json:"exclusion_policy,omitempty"` // skip, shift
+	Payload         map[string]interface{} `json:"payload,omitempty"`
+	Arguments       []interface{}          `json:"-"` // custom attachments
 }
 
 func (instance *Schedule) String() string {
@@ -0,0 +1,133 @@
+package qb_scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rskvp/qb-core/qb_utils"
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+//	t y p e s
+//----------------------------------------------------------------------------------------------------------------------
+
+// SchedulerState is the content of the state file.
+// Each task is stored with its key (task uid or schedule signature).
+type SchedulerState struct {
+	Uid   string                         `json:"uid"`
+	Tasks map[string]*SchedulerTaskState `json:"tasks"`
+}
+
+type SchedulerTaskState struct {
+	Signature string    `json:"signature"` // changing the schedule definition invalidates the state
+	LastRun   time.Time `json:"last_run"`
+	NextRun   time.Time `json:"next_run"`
+}
+
+// schedulerStateStore persists SchedulerState into a JSON file
+type schedulerStateStore struct {
+	filename string
+	state    *SchedulerState
+	mux      sync.Mutex
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	c o n s t r u c t o r
+//----------------------------------------------------------------------------------------------------------------------
+
+// newSchedulerStateStore returns a store and the error reading an existing state file.
+// A corrupt state file is moved to "<filename>.corrupt" and the store starts empty.
+func newSchedulerStateStore(filename, schedulerUid string) (*schedulerStateStore, error) {
+	instance := new(schedulerStateStore)
+	instance.filename = filename
+	instance.state = &SchedulerState{
+		Uid:   schedulerUid,
+		Tasks: make(map[string]*SchedulerTaskState),
+	}
+	err := instance.load()
+
+	return instance, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p u b l i c
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *schedulerStateStore) Get(key string) *SchedulerTaskState {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	if v, b := instance.state.Tasks[key]; b {
+		clone := *v
+		return &clone
+	}
+	return nil
+}
+
+func (instance *schedulerStateStore) Update(task *SchedulerTask) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	key, state := task.snapshot()
+	instance.state.Tasks[key] = state
+}
+
+func (instance *schedulerStateStore) Remove(key string) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	delete(instance.state.Tasks, key)
+}
+
+func (instance *schedulerStateStore) Save() error {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	if len(instance.filename) > 0 {
+		_ = qb_utils.Paths.Mkdir(instance.filename)
+		return writeFileAtomic(instance.filename, qb_utils.JSON.Stringify(instance.state))
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+//	p r i v a t e
+//----------------------------------------------------------------------------------------------------------------------
+
+func (instance *schedulerStateStore) load() error {
+	if b, _ := qb_utils.Paths.Exists(instance.filename); b {
+		var state SchedulerState
+		err := qb_utils.JSON.ReadFromFile(instance.filename, &state)
+		if nil != err {
+			// keep the corrupt file for inspection, next Save writes a new one
+			corrupt := instance.filename + ".corrupt"
+			if e := os.Rename(instance.filename, corrupt); nil != e {
+				return qb_utils.Errors.Prefix(err, qb_utils.Strings.Format("Corrupt state file '%s': ", instance.filename))
+			}
+			return qb_utils.Errors.Prefix(err, qb_utils.Strings.Format("Corrupt state file '%s' moved to '%s': ", instance.filename, corrupt))
+		}
+		if nil != state.Tasks {
+			instance.state.Tasks = state.Tasks
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes a temporary file and renames it, so that readers (and restarts) never get a partial file
+func writeFileAtomic(filename, text string) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if nil != err {
+		return err
+	}
+	_, err = f.WriteString(text)
+	if e := f.Close(); nil == err {
+		err = e
+	}
+	if nil != err {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
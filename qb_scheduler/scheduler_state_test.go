@@ -0,0 +1,55 @@
+package qb_scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSchedulerState_corrupt(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(filename, []byte(`{"uid":"test","tasks":{`), 0644); nil != err {
+		t.Fatal(err)
+	}
+	store, err := newSchedulerStateStore(filename, "test")
+	if nil == err {
+		t.Fatal("expected corrupt state error")
+	}
+	if _, err = os.Stat(filename + ".corrupt"); nil != err {
+		t.Fatal("corrupt file not kept", err)
+	}
+
+	task := NewSchedulerTask("test", &Schedule{Uid: "task", Timeline: "hour:1"})
+	task.lastRunAt = time.Now()
+	store.Update(task)
+	if err = store.Save(); nil != err {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filename + ".*.tmp")
+	if len(files) > 0 {
+		t.Fatal("temporary files not removed", files)
+	}
+	store, err = newSchedulerStateStore(filename, "test")
+	if nil != err || nil == store.Get("task") {
+		t.Fatal("state not saved", err)
+	}
+}
+
+func TestSchedulerState_stopWhileRunning(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	scheduler := NewScheduler()
+	scheduler.SetAsync(false)
+	scheduler.SetStateFile(filename)
+	scheduler.AddSchedule(&Schedule{Uid: "task", Timeline: "millisecond:1"})
+	scheduler.OnSchedule(func(task *SchedulerTask) {})
+	for i := 0; i < 10; i++ {
+		scheduler.Start()
+		time.Sleep(20 * time.Millisecond)
+		scheduler.Stop()
+	}
+	store, err := newSchedulerStateStore(filename, scheduler.Uid())
+	if nil != err || nil == store.Get("task") {
+		t.Fatal("state not saved", err)
+	}
+}
@@ -1,8 +1,9 @@
 package qb_scheduler
 
 import (
-	"fmt"
+	"context"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rskvp/qb-core/qb_utils"
@@ -10,6 +11,9 @@ import (
 
 const (
 	defaultTimeline = "hour:12"
+
+	// misfireMaxRuns limits the number of missed runs fired with MisfireAll policy
+	misfireMaxRuns = 1000
 )
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -24,9 +28,41 @@ type SchedulerTask struct {
 	schedulerUid string
 	startAt      time.Time // fixed setting start value
 	nextStartAt  time.Time // next tick
+	lastRunAt    time.Time // last fired tick
+	runAt        time.Time // tick currently fired (may be in the past for missed runs)
 	timeline     time.Duration
+	wallClock    bool // timeline is anchored to start_at wall clock in location
+	location     *time.Location
+	exclusions   *ExclusionCalendar
+	maxDuration  time.Duration
+	cron         *CronExpression
 	err          error
 	settings     *Schedule
+	misfire      bool // restored a missed run: fire once and move after now
+	catchUp      bool // restored missed runs: fire each of them
+
+	// execution
+	mux     sync.Mutex      // guards execution and settings replaced by Scheduler.ReplaceSchedule
+	running int             // runs in progress
+	queued  int             // runs waiting for the running one (ConcurrencyQueue)
+	ctx     context.Context // context of last run
+}
+
+// SchedulerTaskInfo is a snapshot of a task state
+type SchedulerTaskInfo struct {
+	Uid       string      `json:"uid"`
+	StartAt   string      `json:"start_at,omitempty"`
+	Timeline  string      `json:"timeline,omitempty"`
+	Cron      string      `json:"cron,omitempty"`
+	Paused    bool        `json:"paused"`
+	Running   bool        `json:"running"`
+	Error     string      `json:"error,omitempty"`
+	LastRunAt time.Time   `json:"last_run_at"`
+	NextRuns  []time.Time `json:"next_runs"`
+}
+
+func (instance *SchedulerTaskInfo) String() string {
+	return qb_utils.JSON.Stringify(instance)
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -34,10 +70,16 @@ type SchedulerTask struct {
 //----------------------------------------------------------------------------------------------------------------------
 
 func NewSchedulerTask(schedulerUid string, settings *Schedule) *SchedulerTask {
+	return newSchedulerTask(schedulerUid, "", LoadExclusionCalendar, settings)
+}
+
+// newSchedulerTask creates a task using the scheduler timezone if the schedule does not declare one.
+// Exclusion calendars declared into the schedule are resolved by the scheduler.
+func newSchedulerTask(schedulerUid, timezone string, calendars exclusionResolver, settings *Schedule) *SchedulerTask {
 	instance := new(SchedulerTask)
 	instance.schedulerUid = schedulerUid
 	instance.settings = settings
-	instance.init()
+	instance.init(timezone, calendars)
 
 	return instance
 }
@@ -55,12 +97,16 @@ func (instance *SchedulerTask) String() string {
 
 func (instance *SchedulerTask) GoString() string {
 	if nil != instance {
+		instance.mux.Lock()
+		defer instance.mux.Unlock()
 		data := map[string]interface{}{
 			"scheduler": instance.schedulerUid,
 			"uid":       instance.settings.Uid,
-			"error":     instance.Error(),
+			"error":     instance.errorText(),
 			"start_at":  instance.startAt,
 			"timeline":  instance.settings.Timeline,
+			"cron":      instance.settings.Cron,
+			"next":      instance.nextStartAt,
 		}
 		return qb_utils.JSON.Stringify(data)
 	}
@@ -68,22 +114,109 @@ func (instance *SchedulerTask) GoString() string {
 }
 
 func (instance *SchedulerTask) Settings() *Schedule {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
 	return instance.settings
 }
 
 func (instance *SchedulerTask) Error() string {
-	if nil != instance.err {
-		return instance.err.Error()
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.errorText()
+}
+
+func (instance *SchedulerTask) IsCron() bool {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return nil != instance.cron
+}
+
+func (instance *SchedulerTask) NextStartAt() time.Time {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.nextStartAt
+}
+
+func (instance *SchedulerTask) LastRunAt() time.Time {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.lastRunAt
+}
+
+// ScheduledAt returns the time the current run was scheduled for.
+// It differs from current time when a missed run is fired after a restart.
+func (instance *SchedulerTask) ScheduledAt() time.Time {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.runAt
+}
+
+// Context returns the context of the last run.
+// The context is cancelled when the scheduler stops or the run exceeds Schedule.MaxDuration.
+// Use OnScheduleContext handlers to get the context of each single run.
+func (instance *SchedulerTask) Context() context.Context {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	if nil != instance.ctx {
+		return instance.ctx
+	}
+	return context.Background()
+}
+
+func (instance *SchedulerTask) IsRunning() bool {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.running > 0
+}
+
+// NextRuns returns next "count" fire times
+func (instance *SchedulerTask) NextRuns(count int) []time.Time {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.nextRuns(count)
+}
+
+func (instance *SchedulerTask) Info(count int) *SchedulerTaskInfo {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return &SchedulerTaskInfo{
+		Uid:       instance.Uid,
+		StartAt:   instance.settings.StartAt,
+		Timeline:  instance.settings.Timeline,
+		Cron:      instance.settings.Cron,
+		Paused:    instance.settings.Paused,
+		Running:   instance.running > 0,
+		Error:     instance.errorText(),
+		LastRunAt: instance.lastRunAt,
+		NextRuns:  instance.nextRuns(count),
 	}
-	return ""
 }
 
 func (instance *SchedulerTask) IsReady() bool {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	if instance.nextStartAt.IsZero() {
+		// invalid or expired schedule
+		return false
+	}
 	now := time.Now()
 	diff := instance.nextStartAt.Sub(now)
 	if diff <= 0 {
+		instance.runAt = instance.nextStartAt
+		instance.lastRunAt = now
+
 		// move to next tick
-		instance.nextStartAt = instance.nextStartAt.Add(instance.timeline)
+		if instance.catchUp {
+			instance.nextStartAt = instance.next(instance.nextStartAt)
+			instance.catchUp = !instance.nextStartAt.After(now)
+		} else if instance.misfire {
+			instance.misfire = false
+			instance.nextStartAt = instance.nextAfter(now)
+		} else if nil != instance.cron {
+			instance.nextStartAt = instance.nextAfter(now)
+		} else {
+			instance.nextStartAt = instance.next(instance.nextStartAt)
+		}
 
 		return true
 	}
@@ -94,37 +227,321 @@ func (instance *SchedulerTask) IsReady() bool {
 //	p r i v a t e
 //----------------------------------------------------------------------------------------------------------------------
 
-func (instance *SchedulerTask) init() {
-	now := time.Now()
+func (instance *SchedulerTask) errorText() string {
+	if nil != instance.err {
+		return instance.err.Error()
+	}
+	return ""
+}
+
+func (instance *SchedulerTask) nextRuns(count int) []time.Time {
+	response := make([]time.Time, 0)
+	t := instance.nextStartAt
+	for i := 0; i < count && !t.IsZero(); i++ {
+		response = append(response, t)
+		t = instance.next(t)
+	}
+	return response
+}
+
+// wakeUp returns the time to wait for next check of the task
+func (instance *SchedulerTask) wakeUp() time.Duration {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	timeline := instance.timeline
+	if (nil != instance.cron || instance.wallClock) && !instance.nextStartAt.IsZero() {
+		// wake up exactly at next fire time
+		timeline = time.Until(instance.nextStartAt)
+		if timeline < 10*time.Millisecond {
+			timeline = 10 * time.Millisecond
+		}
+	}
+	if instance.catchUp || instance.misfire {
+		// missed runs are pending
+		timeline = 10 * time.Millisecond
+	}
+	return timeline
+}
+
+// update applies the settings of a task created from a replaced schedule.
+// Runs in progress, queued runs and last run are kept.
+func (instance *SchedulerTask) update(task *SchedulerTask) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	instance.Arguments = task.Arguments
+	instance.Payload = task.Payload
+	instance.settings = task.settings
+	instance.startAt = task.startAt
+	instance.nextStartAt = task.nextStartAt
+	instance.timeline = task.timeline
+	instance.wallClock = task.wallClock
+	instance.location = task.location
+	instance.exclusions = task.exclusions
+	instance.maxDuration = task.maxDuration
+	instance.cron = task.cron
+	instance.err = task.err
+	instance.misfire = false
+	instance.catchUp = false
+}
+
+// acquire reserves a run slot applying the concurrency policy.
+// Returns false if the run must not start now (skipped or queued).
+func (instance *SchedulerTask) acquire() (bool, ConcurrencyPolicy) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	policy := instance.settings.Concurrency
+	if instance.running > 0 {
+		switch policy {
+		case ConcurrencySkip:
+			return false, policy
+		case ConcurrencyQueue:
+			instance.queued++
+			return false, policy
+		}
+	}
+	instance.running++
+	return true, policy
+}
+
+// release frees a run slot. Returns true if a queued run takes the slot and must start.
+// Queued runs are discarded if dequeue is false (the scheduler is stopping).
+func (instance *SchedulerTask) release(dequeue bool) bool {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+
+	instance.running--
+	if !dequeue {
+		instance.queued = 0
+	} else if instance.queued > 0 {
+		instance.queued--
+		instance.running++
+		return true
+	}
+	return false
+}
+
+func (instance *SchedulerTask) getMaxDuration() time.Duration {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.maxDuration
+}
+
+func (instance *SchedulerTask) setContext(ctx context.Context) {
+	instance.mux.Lock()
+	instance.ctx = ctx
+	instance.mux.Unlock()
+}
+
+// snapshot returns key and state of the task to persist
+func (instance *SchedulerTask) snapshot() (string, *SchedulerTaskState) {
+	instance.mux.Lock()
+	defer instance.mux.Unlock()
+	return instance.key(), &SchedulerTaskState{
+		Signature: instance.signature(),
+		LastRun:   instance.lastRunAt,
+		NextRun:   instance.nextStartAt,
+	}
+}
+
+// key identifies the task into the state file
+func (instance *SchedulerTask) key() string {
+	if len(instance.settings.Uid) > 0 {
+		return instance.settings.Uid
+	}
+	return instance.signature()
+}
+
+// signature changes when the schedule definition changes
+func (instance *SchedulerTask) signature() string {
 	settings := instance.settings
+	return qb_utils.Coding.MD5(settings.StartAt + "|" + settings.Timeline + "|" + settings.Cron + "|" + instance.location.String())
+}
+
+// restore applies a persisted state and the misfire policy for runs missed while the scheduler was not running
+func (instance *SchedulerTask) restore(state *SchedulerTaskState, now time.Time) {
+	if nil == state || nil != instance.err || state.Signature != instance.signature() {
+		return
+	}
+	instance.lastRunAt = state.LastRun
+	if state.NextRun.IsZero() {
+		return
+	}
+	if state.NextRun.After(now) {
+		// keep the phase of the schedule
+		instance.nextStartAt = state.NextRun
+		return
+	}
+
+	// missed runs
+	instance.nextStartAt = state.NextRun
+	switch instance.settings.Misfire {
+	case MisfireSkip:
+		instance.nextStartAt = instance.nextAfter(now)
+	case MisfireAll:
+		instance.catchUp = true
+		count := 0
+		for t := state.NextRun; !t.IsZero() && !t.After(now); t = instance.next(t) {
+			count++
+		}
+		for ; count > misfireMaxRuns; count-- {
+			instance.nextStartAt = instance.next(instance.nextStartAt)
+		}
+	default:
+		instance.misfire = true
+	}
+}
+
+// next returns the run following t
+func (instance *SchedulerTask) next(t time.Time) time.Time {
+	return instance.exclude(instance.nextRaw(t))
+}
+
+// nextAfter returns the first run after t
+func (instance *SchedulerTask) nextAfter(t time.Time) time.Time {
+	return instance.exclude(instance.nextAfterRaw(t))
+}
+
+// exclude applies exclusion calendars to a run
+func (instance *SchedulerTask) exclude(run time.Time) time.Time {
+	if nil == instance.exclusions || run.IsZero() || !instance.exclusions.IsExcluded(run) {
+		return run
+	}
+
+	// first regular run not excluded
+	regular := run
+	for i := 0; i < exclusionMaxLoops && !regular.IsZero() && instance.exclusions.IsExcluded(regular); i++ {
+		regular = instance.nextRaw(regular)
+	}
+
+	if instance.settings.ExclusionPolicy == ExclusionShift {
+		// same time of next business day, unless a regular run comes first
+		local := run.In(instance.location)
+		shifted := local
+		for i := 1; i < exclusionMaxLoops; i++ {
+			shifted = dateIn(instance.location, local.Year(), local.Month(), local.Day()+i, local.Hour(), local.Minute(), local.Second())
+			if !isWeekend(shifted) && !instance.exclusions.IsExcluded(shifted) {
+				break
+			}
+		}
+		if regular.IsZero() || shifted.Before(regular) {
+			return shifted
+		}
+	}
+	return regular
+}
+
+// nextRaw returns the run following t without exclusions
+func (instance *SchedulerTask) nextRaw(t time.Time) time.Time {
+	if nil != instance.cron {
+		return instance.cron.Next(t.In(instance.location))
+	}
+	if instance.wallClock {
+		return instance.nextWallClock(t)
+	}
+	return t.Add(instance.timeline)
+}
+
+// nextAfterRaw returns the first run after t without exclusions
+func (instance *SchedulerTask) nextAfterRaw(t time.Time) time.Time {
+	if nil != instance.cron {
+		return instance.cron.Next(t.In(instance.location))
+	}
+	if instance.wallClock {
+		return instance.nextWallClock(t)
+	}
+	next := instance.nextStartAt
+	if !next.After(t) && instance.timeline > 0 {
+		count := t.Sub(next)/instance.timeline + 1
+		next = next.Add(count * instance.timeline)
+	}
+	return next
+}
+
+// nextWallClock returns the first run after t adding the timeline to the start_at wall clock.
+// This keeps "start_at": "09:00" with "timeline": "hour:24" at 09:00 across daylight saving transitions.
+func (instance *SchedulerTask) nextWallClock(t time.Time) time.Time {
+	anchor := instance.startAt
+	step := int(instance.timeline / time.Second)
+	count := int(t.Sub(anchor)/instance.timeline) - 1
+	if count < 0 {
+		count = 0
+	}
+	for ; ; count++ {
+		next := dateIn(instance.location, anchor.Year(), anchor.Month(), anchor.Day(),
+			anchor.Hour(), anchor.Minute(), anchor.Second()+count*step)
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+func (instance *SchedulerTask) init(timezone string, calendars exclusionResolver) {
+	settings := instance.settings
+
+	// TIMEZONE
+	instance.location = time.Local
+	if len(settings.Timezone) > 0 {
+		timezone = settings.Timezone
+	}
+	if len(timezone) > 0 {
+		instance.location = qb_utils.Dates.GetLocation(timezone)
+		if instance.location.String() != timezone {
+			instance.err = qb_utils.Errors.Prefix(ErrorInvalidTimezone,
+				qb_utils.Strings.Format("Unknown timezone '%s', using '%s': ", timezone, instance.location))
+		}
+	}
+	now := time.Now().In(instance.location)
 
 	instance.Uid = settings.Uid
 	instance.Arguments = append(instance.Arguments, settings.Arguments...)
 	instance.Payload = settings.Payload
 
+	// MAX-DURATION
+	instance.maxDuration, _ = parseTimeline(settings.MaxDuration)
+	if len(settings.MaxDuration) > 0 && !isTimelineUnit(settings.MaxDuration) {
+		instance.err = qb_utils.Errors.Prefix(ErrorInvalidTimeline,
+			qb_utils.Strings.Format("Unknown unit in max duration '%s', using '%s': ", settings.MaxDuration, defaultTimeline))
+	}
+
+	// EXCLUSIONS
+	if len(settings.Exclusions) > 0 && nil != calendars {
+		exclusions, err := calendars(settings.Exclusions...)
+		if nil != err {
+			// a task must never run when it should not
+			instance.err = qb_utils.Errors.Prefix(err, "Unable to load exclusion calendars: ")
+			return
+		}
+		instance.exclusions = exclusions
+		if err = exclusions.Error(); nil != err {
+			// other events of the calendars are still used
+			instance.err = qb_utils.Errors.Prefix(err, "Event rejected from exclusion calendars: ")
+		}
+	}
+
+	// CRON
+	if len(settings.Cron) > 0 || IsCronExpression(settings.Timeline) {
+		expression := settings.Cron
+		if len(expression) == 0 {
+			expression = settings.Timeline
+		}
+		cron, err := ParseCron(expression)
+		if nil != err {
+			instance.err = err
+			return
+		}
+		instance.cron = cron
+		instance.startAt = now
+		instance.nextStartAt = instance.nextAfter(now)
+		return
+	}
+
 	// START-AT
 	if len(settings.StartAt) > 0 {
 		t, err := qb_utils.Formatter.ParseDate(settings.StartAt, "HH:mm:ss")
 		if nil == err {
-			year := now.Year()
-			month := qb_utils.Strings.FillLeft(qb_utils.Convert.ToString(int(now.Month())), 2, '0')
-			day := qb_utils.Strings.FillLeft(qb_utils.Convert.ToString(now.Day()), 2, '0')
-			hour := qb_utils.Strings.FillLeft(qb_utils.Convert.ToString(t.Hour()), 2, '0')
-			min := qb_utils.Strings.FillLeft(qb_utils.Convert.ToString(t.Minute()), 2, '0')
-			sec := qb_utils.Strings.FillLeft(qb_utils.Convert.ToString(t.Second()), 2, '0')
-			_, zOffset := now.Zone()
-			z := qb_utils.Strings.FillLeft(qb_utils.Convert.ToString(zOffset/36), 4, '0')
-			if zOffset > 0 {
-				z = "+" + z
-			}
-			sdate := fmt.Sprintf("%v-%v-%v %v:%v:%v %v", year, month, day, hour, min, sec, z)
-			d, err := qb_utils.Formatter.ParseDate(sdate, "yyyy-MM-dd HH:mm:ss Z")
-			if nil == err {
-				instance.startAt = d
-			} else {
-				instance.err = err
-				instance.startAt = now
-			}
+			instance.startAt = dateIn(instance.location, now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second())
+			instance.wallClock = true
 		} else {
 			instance.err = err
 			instance.startAt = now
@@ -134,30 +551,58 @@ func (instance *SchedulerTask) init() {
 	}
 
 	// TIMELINE
-	tl := strings.Split(settings.Timeline, ":") // hour:12
+	if timeline, b := parseTimeline(settings.Timeline); b {
+		instance.timeline = timeline
+		if !isTimelineUnit(settings.Timeline) {
+			instance.err = qb_utils.Errors.Prefix(ErrorInvalidTimeline,
+				qb_utils.Strings.Format("Unknown unit in timeline '%s', using '%s': ", settings.Timeline, defaultTimeline))
+		}
+	} else {
+		// invalid timeline add defaults
+		settings.Timeline = defaultTimeline
+		instance.timeline = 12 * time.Hour
+	}
+	// short timelines run on absolute time
+	instance.wallClock = instance.wallClock && instance.timeline >= time.Hour
+
+	// NEXT
+	instance.nextStartAt = instance.exclude(instance.startAt)
+}
+
+// parseTimeline parses "unit:count" values like "hour:12", "minutes:5", "second:30", "millisecond:500".
+// Units may be plural. Unknown units are 12 hours.
+func parseTimeline(text string) (time.Duration, bool) {
+	tl := strings.Split(text, ":") // hour:12
 	if len(tl) == 2 {
 		value := qb_utils.Convert.ToInt(tl[1])
 		if value == 0 {
 			value = 1
 		}
-		switch tl[0] {
+		switch timelineUnit(tl[0]) {
 		case "millisecond":
-			instance.timeline = time.Duration(value) * time.Millisecond
+			return time.Duration(value) * time.Millisecond, true
 		case "second":
-			instance.timeline = time.Duration(value) * time.Second
+			return time.Duration(value) * time.Second, true
 		case "minute":
-			instance.timeline = time.Duration(value) * time.Minute
+			return time.Duration(value) * time.Minute, true
 		case "hour":
-			instance.timeline = time.Duration(value) * time.Hour
+			return time.Duration(value) * time.Hour, true
 		default:
-			instance.timeline = 12 * time.Hour
+			return 12 * time.Hour, true
 		}
-	} else {
-		// invalid timeline add defaults
-		settings.Timeline = defaultTimeline
-		instance.timeline = 12 * time.Hour
 	}
+	return 0, false
+}
 
-	// NEXT
-	instance.nextStartAt = instance.startAt
+// isTimelineUnit returns false if the unit of a "unit:count" value is unknown
+func isTimelineUnit(text string) bool {
+	switch timelineUnit(strings.Split(text, ":")[0]) {
+	case "millisecond", "second", "minute", "hour":
+		return true
+	}
+	return false
+}
+
+func timelineUnit(unit string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(unit)), "s")
 }
@@ -0,0 +1,96 @@
+package qb_scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulerTask_restore(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		misfire  MisfirePolicy
+		expected int // fired runs
+	}{
+		{MisfireOnce, 1},
+		{"", 1},
+		{MisfireAll, 3},
+		{MisfireSkip, 0},
+	}
+	for _, test := range tests {
+		task := NewSchedulerTask("test", &Schedule{Uid: "task", Timeline: "hour:1", Misfire: test.misfire})
+		state := &SchedulerTaskState{
+			Signature: task.signature(),
+			LastRun:   now.Add(-210 * time.Minute),
+			NextRun:   now.Add(-150 * time.Minute), // missed: -150, -90, -30
+		}
+		task.restore(state, now)
+
+		count := 0
+		for task.IsReady() {
+			count++
+			if count > 10 {
+				break
+			}
+		}
+		if count != test.expected {
+			t.Errorf("'%s': expected %v runs, got %v", test.misfire, test.expected, count)
+		}
+		if expected := now.Add(30 * time.Minute); task.NextStartAt().Sub(expected).Abs() > time.Second {
+			t.Errorf("'%s': expected next at %v, got %v", test.misfire, expected, task.NextStartAt())
+		}
+	}
+}
+
+func TestSchedulerTask_restoreChanged(t *testing.T) {
+	now := time.Now()
+	task := NewSchedulerTask("test", &Schedule{Uid: "task", Timeline: "hour:1"})
+	next := task.NextStartAt()
+	task.restore(&SchedulerTaskState{Signature: "changed", NextRun: now.Add(-time.Hour)}, now)
+	if !task.NextStartAt().Equal(next) {
+		t.Errorf("state of a changed schedule must be ignored")
+	}
+}
+
+func TestSchedulerTask_release(t *testing.T) {
+	task := NewSchedulerTask("test", &Schedule{Uid: "task", Timeline: "hour:1", Concurrency: ConcurrencyQueue})
+	if ok, _ := task.acquire(); !ok {
+		t.Fatal("expected slot")
+	}
+	if ok, _ := task.acquire(); ok {
+		t.Fatal("expected queued run")
+	}
+	if !task.release(true) || !task.IsRunning() {
+		t.Fatal("expected queued run to take the slot")
+	}
+	_, _ = task.acquire()
+	if task.release(false) || task.IsRunning() {
+		t.Fatal("expected slot released and queue discarded on stop")
+	}
+	if ok, _ := task.acquire(); !ok {
+		t.Fatal("expected free slot")
+	}
+}
+
+func TestSchedulerTask_timelineUnits(t *testing.T) {
+	for text, expected := range map[string]time.Duration{"minutes:1": time.Minute, "hours:2": 2 * time.Hour,
+		"second:30": 30 * time.Second, "Milliseconds:500": 500 * time.Millisecond} {
+		task := NewSchedulerTask("test", &Schedule{Timeline: text})
+		if len(task.Error()) > 0 || task.timeline != expected {
+			t.Errorf("%s: expected %v, got %v '%s'", text, expected, task.timeline, task.Error())
+		}
+	}
+	// unknown units fall back to 12 hours with a warning
+	for _, schedule := range []*Schedule{{Timeline: "days:2"}, {Timeline: "hour:1", MaxDuration: "weeks:1"}} {
+		task := NewSchedulerTask("test", schedule)
+		if !strings.Contains(task.Error(), ErrorInvalidTimeline.Error()) || task.NextStartAt().IsZero() {
+			t.Errorf("expected invalid timeline warning for %v, got '%s'", schedule, task.Error())
+		}
+	}
+	if task := NewSchedulerTask("test", &Schedule{Timeline: "days:2"}); task.timeline != 12*time.Hour {
+		t.Errorf("expected default timeline, got %v", task.timeline)
+	}
+	if task := NewSchedulerTask("test", &Schedule{}); len(task.Error()) > 0 || task.Settings().Timeline != defaultTimeline {
+		t.Errorf("expected default timeline, got '%s'", task.Error())
+	}
+}
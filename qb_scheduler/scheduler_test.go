@@ -0,0 +1,159 @@
+package qb_scheduler
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler_concurrencySkip(t *testing.T) {
+	sched := NewScheduler()
+	sched.AddSchedule(&Schedule{Uid: "slow", Timeline: "millisecond:100", Concurrency: ConcurrencySkip})
+
+	var mux sync.Mutex
+	runs, skipped := 0, 0
+	sched.OnSchedule(func(task *SchedulerTask) {
+		mux.Lock()
+		runs++
+		mux.Unlock()
+		time.Sleep(450 * time.Millisecond)
+	})
+	sched.OnError(func(err string) {
+		if strings.Contains(err, ErrorTaskSkipped.Error()) {
+			mux.Lock()
+			skipped++
+			mux.Unlock()
+		}
+	})
+	sched.Start()
+	time.Sleep(1500 * time.Millisecond)
+	sched.Stop()
+
+	mux.Lock()
+	defer mux.Unlock()
+	if runs != 1 || skipped == 0 {
+		t.Errorf("expected 1 run and some skipped, got %v runs and %v skipped", runs, skipped)
+	}
+}
+
+func TestScheduler_timeout(t *testing.T) {
+	sched := NewScheduler()
+	sched.AddSchedule(&Schedule{Uid: "timeout", Timeline: "hour:1", MaxDuration: "millisecond:100"})
+
+	cancelled := make(chan error, 1)
+	timeout := make(chan string, 1)
+	sched.OnScheduleContext(func(ctx context.Context, task *SchedulerTask) {
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	})
+	sched.OnError(func(err string) {
+		timeout <- err
+	})
+	sched.Start()
+	defer sched.Stop()
+
+	if err := <-cancelled; err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if err := <-timeout; !strings.Contains(err, ErrorTaskTimeout.Error()) {
+		t.Errorf("expected timeout error, got '%s'", err)
+	}
+}
+
+func TestScheduler_cancelOnStop(t *testing.T) {
+	sched := NewScheduler()
+	sched.AddSchedule(&Schedule{Uid: "cancel", Timeline: "hour:1"})
+
+	started := make(chan bool, 1)
+	cancelled := make(chan error, 1)
+	sched.OnScheduleContext(func(ctx context.Context, task *SchedulerTask) {
+		started <- true
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+	})
+	sched.Start()
+	<-started
+	sched.Stop()
+
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("expected canceled, got %v", err)
+	}
+}
+
+func TestScheduler_manageTasks(t *testing.T) {
+	sched := NewScheduler()
+	sched.AddSchedule(&Schedule{Uid: "a", Cron: "0 0 8 * * MON-FRI"})
+	sched.AddSchedule(&Schedule{Uid: "b", Timeline: "minute:5"})
+
+	list := sched.ListTasks(3)
+	if len(list) != 2 || len(list[0].NextRuns) != 3 || list[0].NextRuns[0].Hour() != 8 {
+		t.Fatalf("bad: %v", list)
+	}
+	if d := list[1].NextRuns[1].Sub(list[1].NextRuns[0]); d != 5*time.Minute {
+		t.Errorf("bad timeline: %v", d)
+	}
+
+	sched.Start()
+	defer sched.Stop()
+
+	sched.AddSchedule(&Schedule{Uid: "c", Timeline: "hour:1"})
+	if nil == sched.GetTask("c") {
+		t.Errorf("expected task added at runtime")
+	}
+	if !sched.ReplaceSchedule(&Schedule{Uid: "b", Timeline: "minute:10"}) || sched.ReplaceSchedule(&Schedule{Uid: "x"}) {
+		t.Errorf("bad replace")
+	}
+	if task := sched.GetTask("b"); nil == task || task.Settings().Timeline != "minute:10" {
+		t.Errorf("expected replaced task")
+	}
+	if !sched.RemoveSchedule("a") || sched.RemoveSchedule("a") || nil != sched.GetTask("a") {
+		t.Errorf("bad remove")
+	}
+	if !sched.PauseTask("c") || !sched.IsTaskPaused("c") || sched.IsPaused() {
+		t.Errorf("bad pause")
+	}
+	if !sched.ResumeTask("c") || sched.IsTaskPaused("c") {
+		t.Errorf("bad resume")
+	}
+	if n := len(sched.ListTasks(1)); n != 2 {
+		t.Errorf("expected 2 tasks, got %v", n)
+	}
+}
+
+func TestScheduler_replaceRunning(t *testing.T) {
+	sched := NewScheduler()
+	sched.AddSchedule(&Schedule{Uid: "slow", Timeline: "hour:1", Concurrency: ConcurrencyQueue})
+
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	sched.OnSchedule(func(task *SchedulerTask) {
+		started <- true
+		<-release
+	})
+	sched.Start()
+	defer sched.Stop()
+	<-started
+
+	task := sched.GetTask("slow")
+	if !sched.ReplaceSchedule(&Schedule{Uid: "slow", Timeline: "minute:10", Concurrency: ConcurrencyQueue}) {
+		t.Fatal("bad replace")
+	}
+	if sched.GetTask("slow") != task || !task.IsRunning() || task.Settings().Timeline != "minute:10" {
+		t.Errorf("expected running task updated in place")
+	}
+	if ok, _ := task.acquire(); ok {
+		t.Errorf("expected run queued behind the running one")
+	}
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Errorf("queued run not started")
+	}
+}
@@ -0,0 +1,163 @@
+package qb_scheduler
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestCronExpression_NextDST(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		timezone string
+		from     string // RFC3339
+		expected []string
+	}{
+		{
+			name: "rome spring forward skipped time", expr: "30 2 * * *", timezone: "Europe/Rome",
+			from:     "2024-03-30T12:00:00+01:00",
+			expected: []string{"2024-03-31T03:30:00+02:00", "2024-04-01T02:30:00+02:00"},
+		},
+		{
+			name: "rome spring forward hourly", expr: "0 * * * *", timezone: "Europe/Rome",
+			from:     "2024-03-31T01:30:00+01:00",
+			expected: []string{"2024-03-31T03:00:00+02:00", "2024-03-31T04:00:00+02:00"},
+		},
+		{
+			name: "rome fall back repeated time", expr: "30 2 * * *", timezone: "Europe/Rome",
+			from:     "2024-10-27T00:00:00+02:00",
+			expected: []string{"2024-10-27T02:30:00+02:00", "2024-10-28T02:30:00+01:00"},
+		},
+		{
+			name: "rome fall back hourly", expr: "0 * * * *", timezone: "Europe/Rome",
+			from:     "2024-10-27T01:30:00+02:00",
+			expected: []string{"2024-10-27T02:00:00+02:00", "2024-10-27T02:00:00+01:00", "2024-10-27T03:00:00+01:00"},
+		},
+		{
+			name: "new york spring forward skipped time", expr: "30 2 * * *", timezone: "America/New_York",
+			from:     "2024-03-09T12:00:00-05:00",
+			expected: []string{"2024-03-10T03:30:00-04:00", "2024-03-11T02:30:00-04:00"},
+		},
+		{
+			name: "new york fall back repeated time", expr: "30 1 * * *", timezone: "America/New_York",
+			from:     "2024-11-03T00:00:00-04:00",
+			expected: []string{"2024-11-03T01:30:00-04:00", "2024-11-04T01:30:00-05:00"},
+		},
+		{
+			name: "new york fall back every 30 minutes", expr: "*/30 1 * * *", timezone: "America/New_York",
+			from:     "2024-11-03T00:45:00-04:00",
+			expected: []string{"2024-11-03T01:00:00-04:00", "2024-11-03T01:30:00-04:00", "2024-11-04T01:00:00-05:00"},
+		},
+		{
+			name: "utc server with rome schedule", expr: "0 9 * * MON-FRI", timezone: "Europe/Rome",
+			from:     "2024-03-29T10:00:00Z",
+			expected: []string{"2024-04-01T09:00:00+02:00", "2024-04-02T09:00:00+02:00"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(test.timezone)
+			if nil != err {
+				t.Fatalf("err: %v", err)
+			}
+			cron, err := ParseCron(test.expr)
+			if nil != err {
+				t.Fatalf("err: %v", err)
+			}
+			from, _ := time.Parse(time.RFC3339, test.from)
+			next := cron.NextN(from.In(loc), len(test.expected))
+			assertTimes(t, test.expected, next)
+		})
+	}
+}
+
+func TestSchedulerTask_nextWallClockDST(t *testing.T) {
+	tests := []struct {
+		name     string
+		anchor   string // RFC3339
+		timeline string
+		expected []string
+	}{
+		{
+			name: "daily across spring forward", anchor: "2024-03-30T02:30:00+01:00", timeline: "hour:24",
+			expected: []string{"2024-03-31T03:30:00+02:00", "2024-04-01T02:30:00+02:00"},
+		},
+		{
+			name: "daily across fall back", anchor: "2024-10-26T02:30:00+02:00", timeline: "hour:24",
+			expected: []string{"2024-10-27T02:30:00+02:00", "2024-10-28T02:30:00+01:00"},
+		},
+		{
+			name: "daily at nine across fall back", anchor: "2024-10-26T09:00:00+02:00", timeline: "hour:24",
+			expected: []string{"2024-10-27T09:00:00+01:00", "2024-10-28T09:00:00+01:00"},
+		},
+		{
+			name: "hourly across fall back", anchor: "2024-10-27T00:30:00+02:00", timeline: "hour:1",
+			expected: []string{"2024-10-27T01:30:00+02:00", "2024-10-27T02:30:00+02:00", "2024-10-27T03:30:00+01:00"},
+		},
+		{
+			name: "hourly across spring forward", anchor: "2024-03-31T00:30:00+01:00", timeline: "hour:1",
+			expected: []string{"2024-03-31T01:30:00+01:00", "2024-03-31T03:30:00+02:00", "2024-03-31T04:30:00+02:00"},
+		},
+	}
+	loc, err := time.LoadLocation("Europe/Rome")
+	if nil != err {
+		t.Fatalf("err: %v", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := NewSchedulerTask("test", &Schedule{StartAt: "00:00:00", Timeline: test.timeline, Timezone: "Europe/Rome"})
+			anchor, _ := time.Parse(time.RFC3339, test.anchor)
+			task.startAt = anchor.In(loc)
+
+			next := make([]time.Time, 0)
+			for t := task.startAt; len(next) < len(test.expected); {
+				t = task.next(t)
+				next = append(next, t)
+			}
+			assertTimes(t, test.expected, next)
+		})
+	}
+}
+
+func TestSchedulerTask_timezone(t *testing.T) {
+	sched := NewSchedulerWithSettings(&SchedulerSettings{Uid: "test", Timezone: "Asia/Tokyo"})
+	sched.AddSchedule(&Schedule{Uid: "rome", Cron: "0 9 * * *", Timezone: "Europe/Rome"})
+	sched.AddSchedule(&Schedule{Uid: "tokyo", Cron: "0 9 * * *"})
+	sched.AddSchedule(&Schedule{Uid: "anchor", StartAt: "09:00:00", Timeline: "hour:24"})
+
+	for _, info := range sched.ListTasks(1) {
+		if len(info.Error) > 0 {
+			t.Fatalf("unexpected error: %s", info.Error)
+		}
+		next := info.NextRuns[0]
+		zone, _ := next.Zone()
+		switch info.Uid {
+		case "rome":
+			if next.Hour() != 9 || (zone != "CET" && zone != "CEST") {
+				t.Errorf("bad rome time: %v", next)
+			}
+		default:
+			if next.Hour() != 9 || zone != "JST" {
+				t.Errorf("bad tokyo time: %v", next)
+			}
+		}
+	}
+
+	task := NewSchedulerTask("test", &Schedule{Uid: "invalid", Timeline: "hour:1", Timezone: "Mars/Olympus"})
+	if len(task.Error()) == 0 {
+		t.Errorf("expected timezone error")
+	}
+}
+
+func assertTimes(t *testing.T, expected []string, actual []time.Time) {
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v times, got %v", len(expected), actual)
+	}
+	for i, s := range expected {
+		e, _ := time.Parse(time.RFC3339, s)
+		if !actual[i].Equal(e) {
+			t.Errorf("#%v: expected %v, got %v", i, e, actual[i])
+		}
+	}
+}
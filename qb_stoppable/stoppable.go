@@ -8,8 +8,10 @@ import (
 	"syscall"
 	"time"
 
-	qbCore "github.com/rskvp/qb-core"
 	"github.com/rskvp/qb-core/qb_"
+	"github.com/rskvp/qb-core/qb_rnd"
+	"github.com/rskvp/qb-core/qb_sys"
+	"github.com/rskvp/qb-core/qb_utils"
 )
 
 type ShutdownCallback func() error
@@ -32,9 +34,9 @@ type Stoppable struct {
 
 func NewStoppable() *Stoppable {
 	instance := new(Stoppable)
-	instance.name = qbCore.Rnd.Uuid()
+	instance.name = qb_rnd.Rnd.Uuid()
 	instance.shutdownOperations = make(map[string]ShutdownCallback)
-	    qbCore.Sys.OnSignal(instance.onSignal,
+	    qb_sys.Sys.OnSignal(instance.onSignal,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGHUP,
@@ -58,7 +60,7 @@ func NewStoppable() *Stoppable {
 
 func (instance *Stoppable) String() string {
 	if nil != instance {
-		return qbCore.JSON.Stringify(map[string]interface{}{
+		return qb_utils.JSON.Stringify(map[string]interface{}{
 			"id":      instance.ItemId(),
 			"name":    instance.name,
 			"actions": instance.OperationsName(),
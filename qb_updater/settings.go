@@ -16,6 +16,7 @@ type Settings struct {
 	ScheduledUpdates    []*qb_scheduler.Schedule `json:"scheduled_updates"`
 	ScheduledRestart    []*qb_scheduler.Schedule `json:"scheduled_restart"`
 	ScheduledTasks      []*qb_scheduler.Schedule `json:"scheduled_tasks"`
+	PersistentSchedules bool                     `json:"persistent_schedules"` // store schedulers state to run missed tasks after a restart
 }
 
 type PackageFile struct {
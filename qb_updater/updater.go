@@ -60,6 +60,7 @@ type Updater struct {
 	dirWork               string
 	uid                   string
 	settings              *Settings
+	settingsFile          string
 	variables             map[string]string
 	launcher              *Launcher
 	schedulerUpdate       *qb_scheduler.Scheduler
@@ -445,6 +446,7 @@ func (instance *Updater) init(settings interface{}) {
 				// load from file
 				text, err := qb_utils.IO.ReadTextFromFile(v)
 				if nil == err {
+					instance.settingsFile = qb_utils.Paths.Absolute(v)
 					instance.init(text)
 				}
 			}
@@ -600,6 +602,7 @@ func (instance *Updater) initSchedulerUpdate() {
 		// schedulerUpdate not already initialized
 		if len(instance.settings.ScheduledUpdates) > 0 {
 			instance.schedulerUpdate = qb_scheduler.NewScheduler()
+			instance.schedulerUpdate.SetStateFile(instance.getSchedulerStateFile("update"))
 			for _, schedule := range instance.settings.ScheduledUpdates {
 				instance.schedulerUpdate.AddSchedule(schedule)
 			}
@@ -620,6 +623,7 @@ func (instance *Updater) initSchedulerRestart() {
 		// schedulerUpdate not already initialized
 		if len(instance.settings.ScheduledRestart) > 0 {
 			instance.schedulerRestart = qb_scheduler.NewScheduler()
+			instance.schedulerRestart.SetStateFile(instance.getSchedulerStateFile("restart"))
 			for _, schedule := range instance.settings.ScheduledRestart {
 				instance.schedulerRestart.AddSchedule(schedule)
 			}
@@ -639,6 +643,7 @@ func (instance *Updater) initSchedulerTasks() {
 		// schedulerUpdate not already initialized
 		if len(instance.settings.ScheduledTasks) > 0 {
 			instance.schedulerTask = qb_scheduler.NewScheduler()
+			instance.schedulerTask.SetStateFile(instance.getSchedulerStateFile("task"))
 			for _, schedule := range instance.settings.ScheduledTasks {
 				instance.schedulerTask.AddSchedule(schedule)
 			}
@@ -653,6 +658,19 @@ func (instance *Updater) initSchedulerTasks() {
 	}
 }
 
+// getSchedulerStateFile returns the state file of a scheduler (empty if persistence is disabled).
+// State files are stored next to the settings file.
+func (instance *Updater) getSchedulerStateFile(name string) string {
+	if nil != instance.settings && instance.settings.PersistentSchedules {
+		dir := instance.root
+		if len(instance.settingsFile) > 0 {
+			dir = qb_utils.Paths.Dir(instance.settingsFile)
+		}
+		return qb_utils.Paths.Concat(dir, "updater_"+name+".state.json")
+	}
+	return ""
+}
+
 func (instance *Updater) refreshVariables() {
 	if nil != instance {
 		instance.variables[VariableDirHome] = instance.root
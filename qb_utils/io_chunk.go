@@ -1,6 +1,7 @@
 package qb_utils
 
 import (
+	"io"
 	"math"
 	"os"
 )
@@ -87,6 +88,46 @@ func (instance *FileChunker) SplitWalk(filename string, callback func(data []byt
 	return
 }
 
+func (instance *FileChunker) ChunkSize() int64 {
+	if nil != instance {
+		return instance.chunkSize
+	}
+	return 0
+}
+
+// SplitWalkFrom reads chunks starting from chunk with index "from" (zero based).
+// Stops at first error returned by callback.
+func (instance *FileChunker) SplitWalkFrom(filename string, from uint64, callback func(index uint64, data []byte) error) (err error) {
+	if nil != instance && nil != callback {
+		file, e := os.Open(filename)
+		if e != nil {
+			err = e
+			return
+		}
+		defer file.Close()
+
+		fileSize, totalPartsNum := instance.calculateChunks(file)
+		if from > 0 {
+			if _, err = file.Seek(int64(from)*instance.chunkSize, io.SeekStart); nil != err {
+				return
+			}
+		}
+
+		for i := from; i < totalPartsNum; i++ {
+			partSize := int(math.Min(float64(instance.chunkSize), float64(fileSize-int64(i*uint64(instance.chunkSize)))))
+			partBuffer := make([]byte, partSize)
+			_, err = io.ReadFull(file, partBuffer)
+			if nil != err {
+				return
+			}
+			if err = callback(i, partBuffer); nil != err {
+				return
+			}
+		}
+	}
+	return
+}
+
 //----------------------------------------------------------------------------------------------------------------------
 //	p r i v a t e
 //----------------------------------------------------------------------------------------------------------------------
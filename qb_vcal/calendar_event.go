@@ -284,6 +284,37 @@ func (instance *VEvent) GetAllDayEndAt() (t time.Time, err error) {
 	return
 }
 
+// IsAllDay returns true if the event start is a DATE value (i.e. "DTSTART;VALUE=DATE:20241225")
+func (instance *VEvent) IsAllDay() bool {
+	prop := GetProperty(ComponentPropertyDtStart, instance.Properties)
+	if nil != prop {
+		if v, b := prop.ICalParameters[string(ParameterValue)]; b && len(v) > 0 {
+			return v[0] == string(ValueDataTypeDate)
+		}
+		return len(prop.Value) == len(icalAllDayTimeFormat)
+	}
+	return false
+}
+
+// GetRange returns start and end of the event.
+// All day events start at midnight (UTC) of the start date. Local date-times with TZID parameter are in that location.
+// If DTEND is missing, end is one day after start for all day events and equals start for the others.
+func (instance *VEvent) GetRange() (start, end time.Time, err error) {
+	start, err = getPropertyAsLocalTime(ComponentPropertyDtStart, instance.Properties)
+	if nil != err {
+		return
+	}
+	end, err = getPropertyAsLocalTime(ComponentPropertyDtEnd, instance.Properties)
+	if nil != err {
+		err = nil
+		end = start
+		if instance.IsAllDay() {
+			end = start.AddDate(0, 0, 1)
+		}
+	}
+	return
+}
+
 func (instance *VEvent) Location() string {
 	value, _ := GetPropertyAsString(ComponentPropertyLocation, instance.Properties)
 	return value
@@ -1,7 +1,10 @@
 package qb_vcal
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +15,8 @@ import (
 //	constants
 //----------------------------------------------------------------------------------------------------------------------
 
+var ErrorUnsupportedRRule = errors.New("unsupported_rrule")
+
 type PropFrequency string
 
 const (
@@ -106,6 +111,19 @@ func (instance PropByDayValue) String() string {
 	return instance.RawValue
 }
 
+// Ordinal returns the occurrence of the weekday in the month or year (i.e. 4 for "4TH", -1 for "-1SU").
+// Returns 0 if there is no formula.
+func (instance PropByDayValue) Ordinal() (int, error) {
+	if len(instance.Formula) == 0 {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(strings.TrimPrefix(instance.Formula, "+"))
+	if nil != err || value == 0 || value > 53 || value < -53 {
+		return 0, ErrorUnsupportedRRule
+	}
+	return value, nil
+}
+
 func (instance *PropByDayValue) MarshalJSON() ([]byte, error) {
 	if len(instance.Formula) == 0 {
 		return []byte(qb_utils.JSON.Stringify(instance.ByDay)), nil
@@ -147,15 +165,20 @@ func NewRRuleSlot(eventId string, start, end time.Time) *RRuleSlot {
 // FREQ=WEEKLY;BYDAY=FR,MO,TH,TU,WE
 // FREQ=WEEKLY;UNTIL=20220329T170000Z;INTERVAL=1;BYDAY=TU,WE,FR;WKST=SU
 // FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU
+// FREQ=YEARLY;BYMONTH=12;BYMONTHDAY=25
+// FREQ=MONTHLY;BYMONTHDAY=1,-1;COUNT=12
 type RRule struct {
 	EventId       string          `json:"event_id"`
-	Frequency     PropFrequency   `json:"freq"`     // "SECONDLY" / "MINUTELY" / "HOURLY" / "DAILY" / "WEEKLY" / "MONTHLY" / "YEARLY"
-	ByDay         *PropByDayValue `json:"byday"`    // "SU" / "MO" / "TU" / "WE" / "TH" / "FR" / "SA". Each BYDAY value can also be preceded by a positive (+n) or negative (-n) integer. If present, this indicates the nth occurrence of a specific day within the MONTHLY or YEARLY "RRULE". For example, within a MONTHLY rule, +1MO (or simply 1MO) represents the first Monday within the month, whereas -1MO represents the last Monday of the month.
-	ByMonth       int             `json:"bymonth"`  // The BYMONTH rule part specifies a COMMA-separated list of months of the year. Valid values are 1 to 12.
-	Until         time.Time       `json:"until"`    // The UNTIL rule part defines a DATE or DATE-TIME value that bounds the recurrence rule in an inclusive manner.
-	Interval      int             `json:"interval"` // default is 1. The INTERVAL rule part contains a positive integer representing at which intervals the recurrence rule repeats. The default value is "1", meaning every second for a SECONDLY rule, every minute for a MINUTELY rule
-	Count         int             `json:"count"`    // number or repeat. The COUNT rule part defines the number of occurrences at which to range-bound the recurrence. The "DTSTART" property value always counts as the first occurrence.
-	WorkWeekStart PropByDay       `json:"wkst"`     // The WKST rule part specifies the day on which the workweek starts. Valid values are MO, TU, WE, TH, FR, SA, and SU. This is significant when a WEEKLY "RRULE" has an interval greater than 1, and a BYDAY rule part is specified.
+	Frequency     PropFrequency   `json:"freq"`       // "SECONDLY" / "MINUTELY" / "HOURLY" / "DAILY" / "WEEKLY" / "MONTHLY" / "YEARLY"
+	ByDay         *PropByDayValue `json:"byday"`      // "SU" / "MO" / "TU" / "WE" / "TH" / "FR" / "SA". Each BYDAY value can also be preceded by a positive (+n) or negative (-n) integer. If present, this indicates the nth occurrence of a specific day within the MONTHLY or YEARLY "RRULE". For example, within a MONTHLY rule, +1MO (or simply 1MO) represents the first Monday within the month, whereas -1MO represents the last Monday of the month.
+	ByMonth       int             `json:"bymonth"`    // The BYMONTH rule part specifies a COMMA-separated list of months of the year. Valid values are 1 to 12.
+	ByMonthDay    []int           `json:"bymonthday"` // The BYMONTHDAY rule part specifies a COMMA-separated list of days of the month. Valid values are 1 to 31 or -31 to -1. For example, -10 represents the tenth to the last day of the month.
+	Until         time.Time       `json:"until"`      // The UNTIL rule part defines a DATE or DATE-TIME value that bounds the recurrence rule in an inclusive manner.
+	Interval      int             `json:"interval"`   // default is 1. The INTERVAL rule part contains a positive integer representing at which intervals the recurrence rule repeats. The default value is "1", meaning every second for a SECONDLY rule, every minute for a MINUTELY rule
+	Count         int             `json:"count"`      // number or repeat. The COUNT rule part defines the number of occurrences at which to range-bound the recurrence. The "DTSTART" property value always counts as the first occurrence.
+	WorkWeekStart PropByDay       `json:"wkst"`       // The WKST rule part specifies the day on which the workweek starts. Valid values are MO, TU, WE, TH, FR, SA, and SU. This is significant when a WEEKLY "RRULE" has an interval greater than 1, and a BYDAY rule part is specified.
+
+	unsupported []string // rule parts ignored by GetSlots
 }
 
 func ParseRRule(text string) (*RRule, error) {
@@ -187,18 +210,44 @@ func ParseRRule(text string) (*RRule, error) {
 					if len(propValues[0]) > 0 {
 						instance.ByMonth = qb_utils.Convert.ToInt(propValues[0])
 					}
+					if len(propValues) > 1 {
+						instance.unsupported = append(instance.unsupported, prop)
+					}
+				case "BYMONTHDAY":
+					for _, value := range propValues {
+						day, err := strconv.Atoi(strings.TrimPrefix(value, "+"))
+						if nil != err || day == 0 || day > 31 || day < -31 {
+							instance.unsupported = append(instance.unsupported, prop)
+							break
+						}
+						instance.ByMonthDay = append(instance.ByMonthDay, day)
+					}
+				case "COUNT":
+					if value := qb_utils.Convert.ToInt(propValues[0]); value > 0 {
+						instance.Count = value
+					} else {
+						instance.unsupported = append(instance.unsupported, prop)
+					}
+				case "INTERVAL":
+					if value := qb_utils.Convert.ToInt(propValues[0]); value > 0 {
+						instance.Interval = value
+					}
 				case "BYDAY":
 					if len(propValues) > 0 {
 						instance.ByDay = new(PropByDayValue)
 						instance.ByDay.RawValue = tokens[1]
 						for i, value := range propValues {
 							day := ParsePropByDay(value)
-							if i == 0 && len(day.String()) == 0 {
-								instance.ByDay.Formula = value[:2]
-								instance.ByDay.ByDay = append(instance.ByDay.ByDay, ParsePropByDay(value[2:]))
-							} else {
-								instance.ByDay.ByDay = append(instance.ByDay.ByDay, day)
+							if len(day.String()) == 0 && len(value) > 2 {
+								// ordinal: "-1SU", "+1MO", "4TH"
+								if i > 0 {
+									instance.unsupported = append(instance.unsupported, prop)
+									continue
+								}
+								instance.ByDay.Formula = value[:len(value)-2]
+								day = ParsePropByDay(value[len(value)-2:])
 							}
+							instance.ByDay.ByDay = append(instance.ByDay.ByDay, day)
 						}
 					}
 				case "WKST":
@@ -207,6 +256,7 @@ func ParseRRule(text string) (*RRule, error) {
 					}
 				default:
 					// not supported
+					instance.unsupported = append(instance.unsupported, prop)
 				}
 			}
 		}
@@ -242,6 +292,20 @@ func (instance *RRule) Serialize() string {
 			sb.WriteString("BYMONTH=")
 			sb.WriteString(fmt.Sprintf("%v", instance.ByMonth))
 		}
+		if len(instance.ByMonthDay) > 0 {
+			if sb.Len() > 0 {
+				sb.WriteString(";")
+			}
+			sb.WriteString("BYMONTHDAY=")
+			sb.WriteString(qb_utils.Strings.ConcatSep(",", instance.ByMonthDay))
+		}
+		if instance.Count > 0 {
+			if sb.Len() > 0 {
+				sb.WriteString(";")
+			}
+			sb.WriteString("COUNT=")
+			sb.WriteString(fmt.Sprintf("%v", instance.Count))
+		}
 		if nil != instance.ByDay {
 			if sb.Len() > 0 {
 				sb.WriteString(";")
@@ -275,6 +339,53 @@ func (instance *RRule) String() string {
 	return ""
 }
 
+// Validate returns ErrorUnsupportedRRule if GetSlots cannot calculate all the occurrences of the rule
+// (i.e. many BYMONTH values, BYMONTHDAY with BYDAY or a BYDAY ordinal with FREQ=WEEKLY)
+func (instance *RRule) Validate() error {
+	if nil == instance {
+		return nil
+	}
+	unsupported := append([]string{}, instance.unsupported...)
+	formula := ""
+	if nil != instance.ByDay {
+		formula = instance.ByDay.Formula
+		if _, err := instance.ByDay.Ordinal(); nil != err {
+			unsupported = append(unsupported, "BYDAY="+instance.ByDay.RawValue)
+		}
+	}
+	byMonthDay := ""
+	if len(instance.ByMonthDay) > 0 {
+		byMonthDay = "BYMONTHDAY=" + qb_utils.Strings.ConcatSep(",", instance.ByMonthDay)
+		if nil != instance.ByDay {
+			unsupported = append(unsupported, byMonthDay) // days of the month filtered by weekday
+		}
+	}
+	switch instance.Frequency {
+	case PropFreqDaily:
+		if len(byMonthDay) > 0 {
+			unsupported = append(unsupported, byMonthDay)
+		}
+	case PropFreqYearly:
+		if len(formula) > 0 && instance.ByMonth == 0 {
+			unsupported = append(unsupported, "BYDAY="+instance.ByDay.RawValue) // nth weekday of the year
+		}
+		if len(byMonthDay) > 0 && instance.ByMonth == 0 {
+			unsupported = append(unsupported, byMonthDay) // days of every month
+		}
+	case PropFreqWeekly:
+		if nil == instance.ByDay || len(formula) > 0 || instance.Interval > 1 || len(byMonthDay) > 0 {
+			unsupported = append(unsupported, "FREQ=WEEKLY")
+		}
+	case PropFreqMonthly:
+	default:
+		unsupported = append(unsupported, "FREQ="+instance.Frequency.String())
+	}
+	if len(unsupported) > 0 {
+		return qb_utils.Errors.Prefix(ErrorUnsupportedRRule, strings.Join(unsupported, ";")+": ")
+	}
+	return nil
+}
+
 func (instance *RRule) GetSlots(eventStart, eventEnd, until time.Time) []*RRuleSlot {
 	if nil != instance {
 		if qb_utils.Dates.IsZero(until) {
@@ -332,37 +443,130 @@ func (instance *RRule) calculateSlots(eventStart, eventEnd, until time.Time) []*
 				}
 			}
 		case PropFreqMonthly:
-			if len(instance.ByDay.Formula) > 0 {
-				// FREQ=MONTHLY;BYDAY=-1WE last we of month
-				// FREQ=MONTHLY;BYDAY=+1WE first we of month
-				day := instance.ByDay.ByDay[0]
-				if strings.Index(instance.ByDay.Formula, "-") == 0 {
-					// last day of month
-					start = qb_utils.Dates.LastDayOfMonth(start, day.Weekday(), true, true)
-					end = qb_utils.Dates.LastDayOfMonth(end, day.Weekday(), true, true)
-					done = start.Equal(until) || start.After(until) || end.Equal(until) || end.After(until)
-					if !done {
-						response = append(response, NewRRuleSlot(instance.EventId, start, end))
-						start = qb_utils.Dates.AddMonths(start, instance.Interval)
-						end = qb_utils.Dates.AddMonths(end, instance.Interval)
-					}
-				} else {
-					// first day of month
-					start = qb_utils.Dates.FirstDayOfMonth(start, day.Weekday(), true, true)
-					end = qb_utils.Dates.FirstDayOfMonth(end, day.Weekday(), true, true)
-					done = start.Equal(until) || start.After(until) || end.Equal(until) || end.After(until)
-					if !done {
-						response = append(response, NewRRuleSlot(instance.EventId, start, end))
-						start = qb_utils.Dates.AddMonths(start, instance.Interval)
-						end = qb_utils.Dates.AddMonths(end, instance.Interval)
-					}
-				}
+			// FREQ=MONTHLY;BYDAY=-1WE last wednesday of month, FREQ=MONTHLY;BYMONTHDAY=1,15
+			month := time.Date(eventStart.Year(), eventStart.Month()+time.Month(i*instance.Interval), 1, 0, 0, 0, 0, time.UTC)
+			done = month.Year()*12+int(month.Month()) > until.Year()*12+int(until.Month())
+			if !done && (instance.ByMonth == 0 || time.Month(instance.ByMonth) == month.Month()) {
+				var last bool
+				response, last = instance.appendSlots(response, instance.monthStarts(eventStart, month.Year(), month.Month()), eventStart, eventEnd, until)
+				done = done || last
+			}
+		case PropFreqYearly:
+			// every year FREQ=YEARLY (i.e. holidays)
+			if nil != instance.ByDay || instance.ByMonth > 0 {
+				// FREQ=YEARLY;BYMONTH=11;BYDAY=4TH fourth thursday of november
+				year := eventStart.Year() + i*instance.Interval
+				var last bool
+				response, last = instance.appendSlots(response, instance.yearlyStarts(eventStart, year), eventStart, eventEnd, until)
+				done = year > until.Year() || last
 			} else {
-				done = true
+				if i > 0 {
+					start = qb_utils.Dates.AddYears(eventStart, i*instance.Interval)
+					end = qb_utils.Dates.AddYears(eventEnd, i*instance.Interval)
+				}
+				done = start.Equal(until) || start.After(until) || end.Equal(until) || end.After(until)
+				if !done || i == 0 {
+					response = append(response, NewRRuleSlot(instance.EventId, start, end))
+				}
 			}
 		default:
 			done = true
 		}
+		// COUNT: "DTSTART" is the first occurrence
+		if instance.Count > 0 && len(response) >= instance.Count {
+			response = response[:instance.Count]
+			done = true
+		}
+	}
+	return response
+}
+
+// appendSlots adds slots of starts not before eventStart. Returns true if a slot reached until.
+func (instance *RRule) appendSlots(response []*RRuleSlot, starts []time.Time, eventStart, eventEnd, until time.Time) ([]*RRuleSlot, bool) {
+	for _, start := range starts {
+		end := start.Add(eventEnd.Sub(eventStart))
+		if start.Before(eventStart) {
+			continue
+		}
+		if !start.Before(until) || !end.Before(until) {
+			return response, true
+		}
+		response = append(response, NewRRuleSlot(instance.EventId, start, end))
+	}
+	return response, false
+}
+
+// yearlyStarts returns the occurrences of a year for a rule with BYMONTH, BYMONTHDAY and/or BYDAY.
+// The time of the day is the time of eventStart.
+func (instance *RRule) yearlyStarts(eventStart time.Time, year int) []time.Time {
+	month := eventStart.Month()
+	if instance.ByMonth >= 1 && instance.ByMonth <= 12 {
+		month = time.Month(instance.ByMonth)
+	}
+	return instance.monthStarts(eventStart, year, month)
+}
+
+// monthStarts returns the occurrences of a month for a rule with BYMONTHDAY and/or BYDAY.
+// The time of the day is the time of eventStart.
+func (instance *RRule) monthStarts(eventStart time.Time, year int, month time.Month) []time.Time {
+	response := make([]time.Time, 0)
+	date := func(day int) time.Time {
+		return time.Date(year, month, day, eventStart.Hour(), eventStart.Minute(), eventStart.Second(),
+			eventStart.Nanosecond(), eventStart.Location())
+	}
+	days := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if len(instance.ByMonthDay) > 0 {
+		// listed days of the month, counting from the end if negative (missing days have no occurrence)
+		list := make([]int, 0, len(instance.ByMonthDay))
+		for _, day := range instance.ByMonthDay {
+			if day < 0 {
+				day = days + day + 1
+			}
+			if day >= 1 && day <= days {
+				list = append(list, day)
+			}
+		}
+		sort.Ints(list)
+		for i, day := range list {
+			if i == 0 || day != list[i-1] {
+				response = append(response, date(day))
+			}
+		}
+		return response
+	}
+	if nil == instance.ByDay || len(instance.ByDay.ByDay) == 0 {
+		// same day of the month (a missing day, i.e. february 29th, has no occurrence)
+		if eventStart.Day() <= days {
+			response = append(response, date(eventStart.Day()))
+		}
+		return response
+	}
+	if ordinal, err := instance.ByDay.Ordinal(); nil == err && ordinal != 0 {
+		// nth weekday of the month, counting from the end if negative
+		weekday := instance.ByDay.ByDay[0].Weekday()
+		matches := make([]int, 0, 5)
+		for day := 1; day <= days; day++ {
+			if date(day).Weekday() == weekday {
+				matches = append(matches, day)
+			}
+		}
+		if ordinal < 0 {
+			ordinal = len(matches) + ordinal + 1
+		}
+		if ordinal >= 1 && ordinal <= len(matches) {
+			response = append(response, date(matches[ordinal-1]))
+		}
+		return response
+	}
+	// every listed weekday of the month
+	for day := 1; day <= days; day++ {
+		t := date(day)
+		for _, d := range instance.ByDay.ByDay {
+			if t.Weekday() == d.Weekday() {
+				response = append(response, t)
+				break
+			}
+		}
 	}
 	return response
 }
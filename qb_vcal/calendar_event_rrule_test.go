@@ -0,0 +1,172 @@
+package qb_vcal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const rruleIcs = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:christmas\r\n" +
+	"DTSTART;VALUE=DATE:20241225\r\n" +
+	"RRULE:FREQ=YEARLY;BYMONTH=12;BYMONTHDAY=25\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup\r\n" +
+	"DTSTART;TZID=Europe/Rome:20240702T093000\r\n" +
+	"DTEND;TZID=Europe/Rome:20240702T094500\r\n" +
+	"RRULE:FREQ=DAILY;INTERVAL=2\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:release\r\n" +
+	"DTSTART:20240105T170000Z\r\n" +
+	"DTEND:20240105T180000Z\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestRRule_interval(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	tests := []struct {
+		rule     string
+		until    time.Time
+		expected []string
+	}{
+		{"FREQ=DAILY;INTERVAL=3", time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC),
+			[]string{"2024-01-01", "2024-01-04", "2024-01-07"}},
+		{"FREQ=YEARLY;INTERVAL=2", time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC),
+			[]string{"2024-01-01", "2026-01-01", "2028-01-01"}},
+		{"FREQ=MONTHLY;INTERVAL=2;BYMONTHDAY=1", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+			[]string{"2024-01-01", "2024-03-01", "2024-05-01"}},
+		{"FREQ=MONTHLY;BYDAY=-1FR;COUNT=2", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			[]string{"2024-01-26", "2024-02-23"}},
+		{"FREQ=DAILY;COUNT=2", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			[]string{"2024-01-01", "2024-01-02"}},
+	}
+	for _, test := range tests {
+		rule, _ := ParseRRule(test.rule)
+		if err := rule.Validate(); nil != err {
+			t.Errorf("%s: %v", test.rule, err)
+			continue
+		}
+		slots := rule.GetSlots(start, end, test.until)
+		dates := make([]string, 0, len(slots))
+		for _, slot := range slots {
+			dates = append(dates, slot.StartAt.Format("2006-01-02"))
+			if slot.Duration != time.Hour {
+				t.Errorf("%s: bad duration %v", test.rule, slot.Duration)
+			}
+		}
+		if strings.Join(dates, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.rule, test.expected, dates)
+		}
+	}
+}
+
+func TestRRule_yearlyStarts(t *testing.T) {
+	eventStart := time.Date(2023, 5, 29, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		rule     string
+		year     int
+		expected []string
+	}{
+		{"FREQ=YEARLY;BYMONTH=11;BYDAY=4TH", 2024, []string{"2024-11-28T10:30"}},
+		{"FREQ=YEARLY;BYMONTH=5;BYDAY=-1MO", 2026, []string{"2026-05-25T10:30"}},
+		{"FREQ=YEARLY;BYMONTH=12;BYMONTHDAY=25", 2024, []string{"2024-12-25T10:30"}},
+		{"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1,1", 2024, []string{"2024-02-01T10:30", "2024-02-29T10:30"}},
+		{"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30", 2024, []string{}},
+		{"FREQ=YEARLY;BYMONTH=6;BYDAY=SA,SU", 2024, []string{"2024-06-01T10:30", "2024-06-02T10:30",
+			"2024-06-08T10:30", "2024-06-09T10:30", "2024-06-15T10:30", "2024-06-16T10:30",
+			"2024-06-22T10:30", "2024-06-23T10:30", "2024-06-29T10:30", "2024-06-30T10:30"}},
+		{"FREQ=YEARLY", 2025, []string{"2025-05-29T10:30"}},
+	}
+	for _, test := range tests {
+		rule, _ := ParseRRule(test.rule)
+		starts := make([]string, 0)
+		for _, start := range rule.yearlyStarts(eventStart, test.year) {
+			starts = append(starts, start.Format("2006-01-02T15:04"))
+		}
+		if strings.Join(starts, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.rule, test.expected, starts)
+		}
+	}
+}
+
+func TestRRule_Validate(t *testing.T) {
+	tests := []struct {
+		rule  string
+		valid bool
+	}{
+		{"FREQ=YEARLY", true},
+		{"FREQ=YEARLY;BYMONTH=12;BYMONTHDAY=25", true},
+		{"FREQ=YEARLY;BYMONTH=11;BYDAY=4TH", true},
+		{"FREQ=YEARLY;BYDAY=20MO", false},
+		{"FREQ=YEARLY;BYMONTHDAY=1", false},
+		{"FREQ=YEARLY;BYMONTH=1,2", false},
+		{"FREQ=MONTHLY;BYMONTHDAY=1,15,-1", true},
+		{"FREQ=MONTHLY;BYDAY=2TU", true},
+		{"FREQ=MONTHLY;BYMONTHDAY=13;BYDAY=FR", false},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", false},
+		{"FREQ=WEEKLY;BYDAY=MO,FR", true},
+		{"FREQ=WEEKLY;BYDAY=MO;INTERVAL=2", false},
+		{"FREQ=DAILY;COUNT=10", true},
+		{"FREQ=DAILY;COUNT=0", false},
+		{"FREQ=DAILY;BYSETPOS=1", false},
+		{"FREQ=HOURLY", false},
+	}
+	for _, test := range tests {
+		rule, _ := ParseRRule(test.rule)
+		err := rule.Validate()
+		if (nil == err) != test.valid {
+			t.Errorf("%s: expected valid=%v, got %v", test.rule, test.valid, err)
+		}
+		if nil != err && !strings.Contains(err.Error(), ErrorUnsupportedRRule.Error()) {
+			t.Errorf("%s: unexpected error %v", test.rule, err)
+		}
+	}
+	if rule, _ := ParseRRule("FREQ=MONTHLY;BYMONTHDAY=1,-1;COUNT=12"); rule.Serialize() != "FREQ=MONTHLY;BYMONTHDAY=1,-1;COUNT=12;WKST=MO" {
+		t.Errorf("bad serialization: %v", rule.Serialize())
+	}
+}
+
+func TestVEvent_GetRange(t *testing.T) {
+	calendar, err := ParseCalendar(strings.NewReader(rruleIcs))
+	if nil != err {
+		t.Fatalf("err: %v", err)
+	}
+	events := make(map[string]*VEvent)
+	for _, event := range calendar.Events() {
+		events[event.Id()] = event
+	}
+	rome, _ := time.LoadLocation("Europe/Rome")
+	tests := []struct {
+		id     string
+		allDay bool
+		start  time.Time
+		end    time.Time
+	}{
+		// missing DTEND of all day events is one day after start
+		{"christmas", true, time.Date(2024, 12, 25, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 26, 0, 0, 0, 0, time.UTC)},
+		// TZID
+		{"standup", false, time.Date(2024, 7, 2, 9, 30, 0, 0, rome), time.Date(2024, 7, 2, 9, 45, 0, 0, rome)},
+		{"release", false, time.Date(2024, 1, 5, 17, 0, 0, 0, time.UTC), time.Date(2024, 1, 5, 18, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		event := events[test.id]
+		if nil == event {
+			t.Fatalf("missing event %s", test.id)
+		}
+		if event.IsAllDay() != test.allDay {
+			t.Errorf("%s: expected all day=%v", test.id, test.allDay)
+		}
+		start, end, err := event.GetRange()
+		if nil != err || !start.Equal(test.start) || !end.Equal(test.end) {
+			t.Errorf("%s: expected %v - %v, got %v - %v %v", test.id, test.start, test.end, start, end, err)
+		}
+	}
+	if start, _, _ := events["standup"].GetRange(); start.Location().String() != "Europe/Rome" {
+		t.Errorf("expected location of TZID, got %v", start.Location())
+	}
+}
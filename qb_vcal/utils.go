@@ -73,6 +73,31 @@ func GetPropertyAsTime(componentProperty ComponentProperty, tFormat string, prop
 	return
 }
 
+// getPropertyAsLocalTime parses DATE and DATE-TIME values using the TZID parameter if any
+func getPropertyAsLocalTime(componentProperty ComponentProperty, properties []IANAProperty) (t time.Time, err error) {
+	timeProp := GetProperty(componentProperty, properties)
+	if timeProp == nil {
+		return time.Time{}, errors.New("property not found")
+	}
+	value := timeProp.BaseProperty.Value
+	switch {
+	case len(value) == len(icalAllDayTimeFormat):
+		return time.Parse(icalAllDayTimeFormat, value)
+	case strings.HasSuffix(value, "Z"):
+		return ToTime(icalTimeFormat, value)
+	default:
+		loc := time.UTC
+		if v, b := timeProp.ICalParameters[string(ParameterTzid)]; b && len(v) > 0 {
+			loc = qb_utils.Dates.GetLocation(v[0])
+		}
+		t, err = time.ParseInLocation("20060102T150405", value, loc)
+		if nil != err {
+			t, err = ToTime(icalTimeFormat, value)
+		}
+		return
+	}
+}
+
 func GetPropertyAsString(componentProperty ComponentProperty, properties []IANAProperty) (string, error) {
 	timeProp := GetProperty(componentProperty, properties)
 	if timeProp == nil {